@@ -2,13 +2,19 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// globalNamespace is the namespace of the shared user pool
+const globalNamespace int64 = 0
+
 func genToken(n int) (string, error) {
 	b := make([]byte, n)
 	if _, err := rand.Read(b); err != nil {
@@ -23,11 +29,238 @@ func hashPassword(p string) (string, error) {
 }
 
 func comparePassword(hash, p string) bool {
+	if !isBcryptHash(hash) {
+		return compareImportedHash(hash, p)
+	}
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(p)) == nil
 }
 
-func createAccessToken(userId int64) (string, error) {
-	claims := jwt.MapClaims{"userId": userId, "exp": time.Now().Add(time.Hour).Unix()}
+// userNamespace returns the user namespace an application operates in.
+// Requests without an application, or from applications sharing the
+// global pool, resolve to globalNamespace.
+func userNamespace(app *Application) int64 {
+	if app != nil && app.IsolatedUsers {
+		return app.ID
+	}
+	return globalNamespace
+}
+
+// hashToken returns the hex SHA-256 of a high-entropy random token for storage lookups
+func hashToken(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
+// createAccessToken signs an access token for a user; extra claims are merged in as-is
+func createAccessToken(user *User, appID *int64, extra jwt.MapClaims) (string, error) {
+	claims := jwt.MapClaims{"userId": user.ID, "ns": user.NamespaceID, "exp": time.Now().Add(time.Hour).Unix()}
+	if appID != nil {
+		claims["appId"] = *appID
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(jwtSecret)
 }
+
+// refreshTokenTTL is how long a refresh token stays valid
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// errUserDisabled is returned when tokens are requested for a disabled user
+var errUserDisabled = errors.New("user is disabled")
+
+// Authentication methods recorded in the amr claim (RFC 8176, plus fed for logins at an
+// external identity provider)
+const (
+	amrPassword  = "pwd"
+	amrOTP       = "otp"
+	amrWebAuthn  = "webauthn"
+	amrFederated = "fed"
+)
+
+// Authentication context classes recorded in the acr claim
+const (
+	acrSingleFactor = "aal1"
+	acrMultiFactor  = "aal2"
+)
+
+// acrLevels ranks the acr values, so a requirement is met by its own class or a stronger one
+var acrLevels = map[string]int{acrSingleFactor: 1, acrMultiFactor: 2}
+
+// authentication records when and how a user proved who they are. Refreshed sessions
+// keep the authentication of their original login.
+type authentication struct {
+	Time int64 // unix seconds; 0 when unknown
+	AMR  []string
+}
+
+func newAuthentication(methods ...string) authentication {
+	return authentication{Time: time.Now().Unix(), AMR: methods}
+}
+
+// acr derives the authentication context class from the methods used
+func (l authentication) acr() string {
+	for _, m := range l.AMR {
+		if m == amrOTP || m == amrWebAuthn {
+			return acrMultiFactor
+		}
+	}
+	return acrSingleFactor
+}
+
+// tokenGrant describes the session an access/refresh token pair is issued for
+type tokenGrant struct {
+	User           *User
+	ApplicationID  *int64
+	OrganizationID *int64
+	Login          authentication
+}
+
+// issueTokens creates an access token and a persisted refresh token for a grant.
+// The access token embeds the user's effective permissions for the application.
+// Organization claims are only added while the user is still a member; otherwise
+// the session silently drops back to being unscoped.
+func (a *App) issueTokens(g tokenGrant) (access, refresh string, err error) {
+	if g.User.Disabled {
+		return "", "", errUserDisabled
+	}
+	extra := jwt.MapClaims{}
+	if g.ApplicationID != nil {
+		// Claims mapped from the user's directory entry at their last bind
+		acct, err := a.DB.GetDirectoryAccountByUser(*g.ApplicationID, g.User.ID)
+		if err != nil {
+			return "", "", err
+		}
+		if acct != nil {
+			for k, v := range acct.Claims {
+				extra[k] = v
+			}
+		}
+	}
+	orgID := g.OrganizationID
+	if orgID != nil {
+		member, err := a.DB.GetOrganizationMember(*orgID, g.User.ID)
+		if err != nil {
+			return "", "", err
+		}
+		if member == nil {
+			orgID = nil
+		} else {
+			extra["org_id"] = member.OrganizationID
+			extra["org_role"] = member.Role
+		}
+	}
+	perms, err := a.DB.GetUserPermissions(g.User.ID, g.ApplicationID)
+	if err != nil {
+		return "", "", err
+	}
+	if len(perms) > 0 {
+		extra["permissions"] = perms
+	}
+	if g.Login.Time != 0 {
+		extra["auth_time"] = g.Login.Time
+		extra["amr"] = g.Login.AMR
+		extra["acr"] = g.Login.acr()
+	}
+	access, err = createAccessToken(g.User, g.ApplicationID, extra)
+	if err != nil {
+		return "", "", err
+	}
+	refresh, err = genToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	err = a.DB.CreateRefreshToken(&RefreshToken{
+		Token:          refresh,
+		UserID:         g.User.ID,
+		ApplicationID:  g.ApplicationID,
+		OrganizationID: orgID,
+		ExpiresAt:      time.Now().Add(refreshTokenTTL).Unix(),
+		AuthTime:       g.Login.Time,
+		AMR:            g.Login.AMR,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// claimsNamespace extracts the user namespace from access token claims.
+// Tokens issued before namespaces existed belong to the global pool.
+func claimsNamespace(claims jwt.MapClaims) int64 {
+	if ns, ok := claims["ns"].(float64); ok {
+		return int64(ns)
+	}
+	return globalNamespace
+}
+
+// claimsPermissions extracts the permissions claim from access token claims
+func claimsPermissions(claims jwt.MapClaims) []string {
+	raw, _ := claims["permissions"].([]interface{})
+	perms := make([]string, 0, len(raw))
+	for _, p := range raw {
+		if s, ok := p.(string); ok {
+			perms = append(perms, s)
+		}
+	}
+	return perms
+}
+
+// claimsAuthentication extracts the auth_time and amr claims. Tokens issued before they
+// existed, and impersonation tokens, have neither.
+func claimsAuthentication(claims jwt.MapClaims) authentication {
+	var l authentication
+	l.Time, _ = claimInt64(claims, "auth_time")
+	raw, _ := claims["amr"].([]interface{})
+	for _, m := range raw {
+		if s, ok := m.(string); ok {
+			l.AMR = append(l.AMR, s)
+		}
+	}
+	return l
+}
+
+// authRequirement is how recent and how strong the login behind a token must be. The
+// zero value accepts any token.
+type authRequirement struct {
+	MaxAge *int64 // seconds since auth_time
+	ACR    string
+}
+
+func parseAuthRequirement(maxAge *int64, acr string) (authRequirement, error) {
+	if maxAge != nil && *maxAge < 0 {
+		return authRequirement{}, errors.New("max_age must not be negative")
+	}
+	if _, ok := acrLevels[acr]; acr != "" && !ok {
+		return authRequirement{}, errors.New("acr must be aal1 or aal2")
+	}
+	return authRequirement{MaxAge: maxAge, ACR: acr}, nil
+}
+
+// satisfiedBy reports whether the login behind a token meets the requirement
+func (q authRequirement) satisfiedBy(claims jwt.MapClaims, now time.Time) bool {
+	login := claimsAuthentication(claims)
+	if q.MaxAge != nil && (login.Time == 0 || now.Unix()-login.Time > *q.MaxAge) {
+		return false
+	}
+	if q.ACR != "" {
+		acr, _ := claims["acr"].(string)
+		if login.Time == 0 || acrLevels[acr] < acrLevels[q.ACR] {
+			return false
+		}
+	}
+	return true
+}
+
+// challenge describes an unmet requirement in a WWW-Authenticate header (RFC 9470)
+func (q authRequirement) challenge() string {
+	c := `Bearer error="insufficient_user_authentication", error_description="A more recent or stronger login is required"`
+	if q.MaxAge != nil {
+		c += fmt.Sprintf(", max_age=%d", *q.MaxAge)
+	}
+	if q.ACR != "" {
+		c += fmt.Sprintf(`, acr_values="%s"`, q.ACR)
+	}
+	return c
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	cfg "github.com/example/nileauth/internal/config"
+)
+
+// adminScopes are granted to bootstrapped root applications
+var adminScopes = []string{scopeAdminApplications, scopeAdminUsers}
+
+// bootstrapAdminApplication makes sure an application authenticating with apiKey exists
+// and holds every admin scope. It reports whether a new application was created.
+func bootstrapAdminApplication(db DB, name, domain, apiKey string) (*Application, bool, error) {
+	created := false
+	app, _ := (&App{DB: db}).validateAPIKey(apiKey)
+	if app == nil {
+		key, err := newAPIKeyRecord(apiKey, defaultAPIKeyLabel)
+		if err != nil {
+			return nil, false, fmt.Errorf("hashing api key: %w", err)
+		}
+		app, err = db.CreateApplication(name, domain, key, 100, nil, false)
+		if err != nil {
+			return nil, false, fmt.Errorf("creating application: %w", err)
+		}
+		created = true
+	}
+
+	current, err := db.GetScopesByApplicationID(app.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("loading application scopes: %w", err)
+	}
+	granted := map[int64]bool{}
+	var scopeIDs []int64
+	for _, scope := range current {
+		granted[scope.ID] = true
+		scopeIDs = append(scopeIDs, scope.ID)
+	}
+	for _, name := range adminScopes {
+		scope, err := db.GetScopeByName(name)
+		if err != nil {
+			return nil, false, fmt.Errorf("loading scope %s: %w", name, err)
+		}
+		if scope == nil {
+			return nil, false, fmt.Errorf("scope %s is not defined", name)
+		}
+		if !granted[scope.ID] {
+			scopeIDs = append(scopeIDs, scope.ID)
+		}
+	}
+	if err := db.SetApplicationScopes(app.ID, scopeIDs); err != nil {
+		return nil, false, fmt.Errorf("granting admin scopes: %w", err)
+	}
+	return app, created, nil
+}
+
+// runBootstrapAdmin implements the bootstrap-admin command: it creates a root
+// application with every admin scope and prints its API key once.
+func runBootstrapAdmin(c *cfg.Config, args []string) error {
+	fs := flag.NewFlagSet("bootstrap-admin", flag.ContinueOnError)
+	name := fs.String("name", "admin", "Name of the admin application")
+	domain := fs.String("domain", "localhost", "Domain of the admin application")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	if closer, ok := db.(interface{ close() error }); ok {
+		defer closer.close()
+	}
+
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return fmt.Errorf("generating api key: %w", err)
+	}
+	app, _, err := bootstrapAdminApplication(db, *name, *domain, apiKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created admin application %d (%s)\n", app.ID, app.Name)
+	fmt.Printf("API key (shown only once): %s\n", apiKey)
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapAdminApplicationIsIdempotent(t *testing.T) {
+	db := NewMemoryDB()
+	key, err := generateAPIKey()
+	require.NoError(t, err)
+
+	app, created, err := bootstrapAdminApplication(db, "admin", "localhost", key)
+	require.NoError(t, err)
+	require.True(t, created)
+
+	// running again with the same key finds the application instead of adding another
+	again, created, err := bootstrapAdminApplication(db, "admin", "localhost", key)
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, app.ID, again.ID)
+	_, total, err := db.ListApplications(ApplicationFilter{})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	keys, err := db.ListAPIKeys(app.ID)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+
+	scopes, err := db.GetScopesByApplicationID(app.ID)
+	require.NoError(t, err)
+	var names []string
+	for _, s := range scopes {
+		names = append(names, s.Name)
+	}
+	require.ElementsMatch(t, adminScopes, names)
+
+	// a different key makes a separate root application
+	other, err := generateAPIKey()
+	require.NoError(t, err)
+	second, created, err := bootstrapAdminApplication(db, "admin-2", "localhost", other)
+	require.NoError(t, err)
+	require.True(t, created)
+	require.NotEqual(t, app.ID, second.ID)
+}
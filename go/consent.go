@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Client types of an application
+const (
+	// clientTypeConfidential applications exchange authorization codes from a server that
+	// keeps their API key secret
+	clientTypeConfidential = "confidential"
+	// clientTypePublic applications run in browsers or on devices and must use PKCE
+	clientTypePublic = "public"
+)
+
+// normalizeClientType validates a client_type setting; empty means confidential
+func normalizeClientType(clientType string) (string, error) {
+	switch clientType = strings.ToLower(strings.TrimSpace(clientType)); clientType {
+	case "", clientTypeConfidential:
+		return clientTypeConfidential, nil
+	case clientTypePublic:
+		return clientTypePublic, nil
+	}
+	return "", errors.New("client_type must be confidential or public")
+}
+
+// normalizeRedirectURIs validates the redirect URIs registered for an application. They
+// are compared byte for byte with the redirect_uri of each authorize request, so they are
+// stored as given. Web callbacks must use https (http only on loopback); native apps may
+// use a private-use scheme such as com.example.app:/callback.
+func normalizeRedirectURIs(list []string) ([]string, error) {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, raw := range list {
+		u, err := url.Parse(raw)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || u.User != nil {
+			return nil, fmt.Errorf("redirect_uris: %q must be an absolute URL without a fragment", raw)
+		}
+		switch {
+		case u.Scheme == "https" && u.Host != "":
+		case u.Scheme == "http" && isLoopbackHost(u.Hostname()):
+		case u.Scheme != "http" && u.Scheme != "https" && strings.Contains(u.Scheme, "."):
+		default:
+			return nil, fmt.Errorf("redirect_uris: %q must use https, http on localhost, or a private-use scheme", raw)
+		}
+		if !seen[raw] {
+			seen[raw] = true
+			out = append(out, raw)
+		}
+	}
+	return out, nil
+}
+
+// registeredRedirectURI reports whether a redirect URI exactly matches one the application
+// registered
+func registeredRedirectURI(app *Application, redirectURI string) bool {
+	for _, registered := range app.RedirectURIs {
+		if registered == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// consentCovers reports whether a consent already includes every requested scope
+func consentCovers(c *Consent, scopes []*Scope) bool {
+	if c == nil {
+		return false
+	}
+	granted := map[string]bool{}
+	for _, s := range c.Scopes {
+		granted[s] = true
+	}
+	for _, s := range scopes {
+		if !granted[s.Name] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordConsent adds the approved scopes to the user's consent for the application
+func (a *App) recordConsent(r *http.Request, user *User, app *Application, scopes []*Scope) error {
+	existing, err := a.DB.GetConsent(user.ID, app.ID)
+	if err != nil {
+		return err
+	}
+	merged := map[string]bool{}
+	if existing != nil {
+		for _, s := range existing.Scopes {
+			merged[s] = true
+		}
+	}
+	for _, s := range scopes {
+		merged[s.Name] = true
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := a.DB.UpsertConsent(user.ID, app.ID, names); err != nil {
+		return err
+	}
+	a.audit(r, auditConsentGranted, &user.ID, map[string]interface{}{"application_id": app.ID, "scopes": names})
+	return nil
+}
+
+// HandleListConsents lists the applications the calling user approved, with their scopes
+// GET /api/v1/auth/consents
+func (a *App) HandleListConsents(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	consents, err := a.DB.ListConsents(user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list consents")
+		return
+	}
+	out := []map[string]interface{}{}
+	for _, c := range consents {
+		entry := map[string]interface{}{
+			"applicationId": c.ApplicationID,
+			"scopes":        c.Scopes,
+			"grantedAt":     c.CreatedAt,
+			"updatedAt":     c.UpdatedAt,
+		}
+		if app, err := a.DB.GetApplicationByID(c.ApplicationID); err == nil && app != nil {
+			entry["applicationName"] = app.Name
+			entry["applicationDomain"] = app.Domain
+		}
+		out = append(out, entry)
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"consents": out})
+}
+
+// HandleRevokeConsent withdraws the calling user's consent for an application and signs
+// them out of it. The consent page is shown again on the next authorization.
+// DELETE /api/v1/auth/consents/{applicationId}
+func (a *App) HandleRevokeConsent(w http.ResponseWriter, r *http.Request) {
+	appID, ok := pathID(w, r, "applicationId")
+	if !ok {
+		return
+	}
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	if err := a.DB.DeleteConsent(user.ID, appID); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Consent not found")
+		return
+	}
+	if err := a.DB.DeleteApplicationRefreshTokensForUser(user.ID, appID); err != nil {
+		log.Printf("consent revoked for user %d: revoking sessions of application %d: %v", user.ID, appID, err)
+	}
+	a.audit(r, auditConsentRevoked, &user.ID, map[string]interface{}{"application_id": appID})
+	writeSuccess(w, http.StatusOK, map[string]bool{"revoked": true})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// originWildcard in an application's allowed origins accepts requests from any origin,
+// without credentials
+const originWildcard = "*"
+
+// normalizeOriginList validates allowed origins and returns them in canonical form. An
+// entry is "*", an exact origin such as https://app.example.com, or a subdomain pattern
+// such as https://*.example.com, which matches any subdomain but not example.com itself.
+func normalizeOriginList(list []string) ([]string, error) {
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if s == originWildcard {
+			out = append(out, s)
+			continue
+		}
+		origin, err := normalizeOriginPattern(s)
+		if err != nil {
+			return nil, fmt.Errorf("allowed_origins: %q %v", s, err)
+		}
+		out = append(out, origin)
+	}
+	return out, nil
+}
+
+// normalizeOriginPattern checks a single origin or subdomain pattern
+func normalizeOriginPattern(s string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(s, "/"))
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("is not an origin (expected scheme://host[:port])")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("must use http or https")
+	}
+	if u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("must not contain a path, query or credentials")
+	}
+	host := strings.ToLower(u.Host)
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		if strings.Contains(rest, "*") || !strings.Contains(strings.Split(rest, ":")[0], ".") {
+			return "", fmt.Errorf("wildcard must be the leading label of a domain with at least two labels")
+		}
+	} else if strings.Contains(host, "*") {
+		return "", fmt.Errorf("wildcard must be the leading label of a domain with at least two labels")
+	}
+	return u.Scheme + "://" + host, nil
+}
+
+// originMatches reports whether a browser origin matches an allowed origin entry
+func originMatches(pattern, origin string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "/"))
+	origin = strings.ToLower(origin)
+	if pattern == originWildcard || pattern == origin {
+		return true
+	}
+	scheme, suffix, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	host, ok := strings.CutPrefix(origin, scheme+"://")
+	if !ok {
+		return false
+	}
+	label, ok := strings.CutSuffix(host, "."+suffix)
+	return ok && label != "" && !strings.ContainsAny(label, ":/@")
+}
+
+// matchOrigin returns the first of an application's allowed origins that matches a browser
+// origin
+func matchOrigin(app *Application, origin string) (string, bool) {
+	for _, pattern := range app.AllowedOrigins {
+		if originMatches(pattern, origin) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// preflightOriginsTTL bounds how long an application change made through another instance
+// takes to reach this instance's preflight checks. Changes made here apply at once.
+const preflightOriginsTTL = 30 * time.Second
+
+// originCache holds the allowed origins of every active application, so unauthenticated
+// preflight requests do not each read the whole applications table
+type originCache struct {
+	mu       sync.Mutex
+	patterns []string // nil until loaded
+	loadedAt time.Time
+}
+
+// load returns the cached origins, reading them again once they are stale
+func (c *originCache) load(db DB) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.patterns != nil && time.Since(c.loadedAt) < preflightOriginsTTL {
+		return c.patterns, nil
+	}
+	active := true
+	apps, _, err := db.ListApplications(ApplicationFilter{Active: &active})
+	if err != nil {
+		return nil, err
+	}
+	patterns, seen := []string{}, map[string]bool{}
+	for _, app := range apps {
+		for _, pattern := range app.AllowedOrigins {
+			if !seen[pattern] {
+				seen[pattern] = true
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	c.patterns, c.loadedAt = patterns, time.Now()
+	return patterns, nil
+}
+
+// invalidate makes the next preflight read the origins again, after an application was
+// created, changed or deleted
+func (c *originCache) invalidate() {
+	c.mu.Lock()
+	c.patterns = nil
+	c.mu.Unlock()
+}
+
+// anyApplicationAllowsOrigin reports whether some active application accepts a browser
+// origin. Preflight requests carry no API key, so this is all they can be checked against;
+// the request that follows is checked against its own application's origins.
+func (a *App) anyApplicationAllowsOrigin(origin string) bool {
+	patterns, err := a.preflightOrigins.load(a.DB)
+	if err != nil {
+		log.Printf("loading allowed origins: %v", err)
+		return false
+	}
+	for _, pattern := range patterns {
+		if originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errDirectoryUnavailable means a credential check could not be made because the
+// application's directory did not answer
+var errDirectoryUnavailable = errors.New("directory unavailable")
+
+// credentialVerifier checks a login and password. Wrong credentials yield a nil user
+// and a nil error; an error means the check itself failed.
+type credentialVerifier interface {
+	verify(r *http.Request, app *Application, login, password string) (*User, error)
+}
+
+// localVerifier checks the password hash stored with the user
+type localVerifier struct {
+	db DB
+}
+
+func (v localVerifier) verify(r *http.Request, app *Application, login, password string) (*User, error) {
+	user, err := v.db.GetUserByEmail(userNamespace(app), login)
+	if err != nil || user == nil || !comparePassword(user.Password, password) {
+		return nil, nil
+	}
+	if !isBcryptHash(user.Password) {
+		// An imported hash is upgraded now that the password is known; the login goes
+		// ahead even if that fails
+		if hashed, err := hashPassword(password); err != nil {
+			log.Printf("upgrading password hash of user %d: %v", user.ID, err)
+		} else if err := v.db.UpdateUserPassword(user.ID, hashed); err != nil {
+			log.Printf("upgrading password hash of user %d: %v", user.ID, err)
+		} else {
+			user.Password = hashed
+		}
+	}
+	return user, nil
+}
+
+// ldapVerifier binds to the application's directory as the user
+type ldapVerifier struct {
+	a   *App
+	dir *LDAPDirectory
+}
+
+func (v ldapVerifier) verify(r *http.Request, app *Application, login, password string) (*User, error) {
+	// An empty password would be an unauthenticated bind, which servers accept
+	if login == "" || password == "" {
+		return nil, nil
+	}
+	conn, err := dialLDAP(v.dir)
+	if err != nil {
+		log.Printf("ldap directory of application %d: %v", app.ID, err)
+		return nil, errDirectoryUnavailable
+	}
+	defer conn.close()
+	if v.dir.BindDN != "" {
+		if err := conn.bind(v.dir.BindDN, v.dir.BindPassword); err != nil {
+			log.Printf("ldap directory of application %d: service bind: %v", app.ID, err)
+			return nil, errDirectoryUnavailable
+		}
+	}
+	filter, err := parseLDAPFilter(strings.ReplaceAll(v.dir.SearchFilter, "{username}", escapeLDAPFilterValue(login)))
+	if err != nil {
+		log.Printf("ldap directory of application %d: %v", app.ID, err)
+		return nil, errDirectoryUnavailable
+	}
+	// Two entries are enough to tell that a login is ambiguous
+	entries, err := conn.search(v.dir.SearchBase, filter, directoryAttributes(v.dir), 2)
+	if err != nil && !isLDAPResult(err, ldapResultSizeLimit) {
+		log.Printf("ldap directory of application %d: search: %v", app.ID, err)
+		return nil, errDirectoryUnavailable
+	}
+	if len(entries) != 1 || entries[0].DN == "" {
+		if len(entries) > 1 {
+			log.Printf("ldap directory of application %d: login %q matches several entries", app.ID, login)
+		}
+		return nil, nil
+	}
+	if err := conn.bind(entries[0].DN, password); err != nil {
+		if isLDAPResult(err, ldapResultInvalidCreds) {
+			return nil, nil
+		}
+		log.Printf("ldap directory of application %d: bind: %v", app.ID, err)
+		return nil, errDirectoryUnavailable
+	}
+	return v.a.shadowUser(r, app, v.dir, entries[0])
+}
+
+// verifierFor picks how an application checks passwords: against its active LDAP
+// directory when it has one, otherwise against local password hashes
+func (a *App) verifierFor(app *Application) (credentialVerifier, error) {
+	if app != nil {
+		dir, err := a.DB.GetLDAPDirectory(app.ID)
+		if err != nil {
+			return nil, err
+		}
+		if dir != nil && dir.Active {
+			return ldapVerifier{a: a, dir: dir}, nil
+		}
+	}
+	return localVerifier{db: a.DB}, nil
+}
+
+// verifyCredentials checks a login and password with the application's verifier
+func (a *App) verifyCredentials(r *http.Request, app *Application, login, password string) (*User, error) {
+	v, err := a.verifierFor(app)
+	if err != nil {
+		return nil, err
+	}
+	return v.verify(r, app, login, password)
+}
+
+// directoryEmailAttribute is the attribute holding a user's email unless the mapping
+// names another one under "email"
+func directoryEmailAttribute(d *LDAPDirectory) string {
+	if attr := d.AttributeMapping["email"]; attr != "" {
+		return attr
+	}
+	return "mail"
+}
+
+// directoryAttributes lists the attributes a search asks for
+func directoryAttributes(d *LDAPDirectory) []string {
+	attrs := []string{directoryEmailAttribute(d)}
+	for claim, attr := range d.AttributeMapping {
+		if claim != "email" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+// shadowUser creates or updates the local user standing for a directory entry and
+// records the entry's mapped claims, which are added to the user's access tokens
+func (a *App) shadowUser(r *http.Request, app *Application, dir *LDAPDirectory, entry *ldapEntry) (*User, error) {
+	email := strings.TrimSpace(entry.first(directoryEmailAttribute(dir)))
+	if !strings.Contains(email, "@") {
+		log.Printf("ldap directory of application %d: entry %s has no email", app.ID, entry.DN)
+		return nil, nil
+	}
+	claims := map[string]interface{}{}
+	for claim, attr := range dir.AttributeMapping {
+		if claim == "email" {
+			continue
+		}
+		switch values := entry.Attributes[strings.ToLower(attr)]; len(values) {
+		case 0:
+		case 1:
+			claims[claim] = values[0]
+		default:
+			claims[claim] = values
+		}
+	}
+
+	var user *User
+	acct, err := a.DB.GetDirectoryAccount(app.ID, entry.DN)
+	if err != nil {
+		return nil, err
+	}
+	if acct != nil {
+		if user, err = a.DB.GetUserByID(acct.UserID); err != nil {
+			return nil, err
+		}
+	}
+	if user == nil {
+		if user, err = a.DB.GetUserByEmail(userNamespace(app), email); err != nil {
+			return nil, err
+		}
+	}
+	if user == nil {
+		if user, err = a.provisionUser(r, app, email, map[string]interface{}{"ldap_dn": entry.DN}); err != nil {
+			return nil, err
+		}
+	}
+	if user.Email != email {
+		// The directory is authoritative, unless another user already holds the address
+		if err := a.DB.UpdateUserEmail(user.ID, email); err != nil {
+			log.Printf("ldap directory of application %d: updating email of user %d: %v", app.ID, user.ID, err)
+		} else {
+			user.Email = email
+		}
+	}
+	if err := a.DB.UpsertDirectoryAccount(&DirectoryAccount{ApplicationID: app.ID, UserID: user.ID, DN: entry.DN, Claims: claims}); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
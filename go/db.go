@@ -2,273 +2,4169 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// sqliteTimeLayout matches the format produced by SQLite's datetime('now')
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
 // DB interface for database operations
 type DB interface {
 	Init() error
 	// User operations
-	CreateUser(email, password string, applicationID *int64) (*User, error)
-	GetUserByEmail(email string) (*User, error)
+	CreateUser(email, password string, applicationID *int64, namespaceID int64) (*User, error)
+	GetUserByEmail(namespaceID int64, email string) (*User, error)
+	GetUserByID(id int64) (*User, error)
+	UpdateUserPassword(userID int64, passwordHash string) error
+	// UpdateUserEmail changes a user's email; it fails when the email is taken in the namespace
+	UpdateUserEmail(userID int64, email string) error
+	// SetUserTOTPSecret turns on MFA with the given secret, or turns it off when empty
+	SetUserTOTPSecret(userID int64, secret string) error
+	// UseTOTPStep records the time step of a user's accepted TOTP code, reporting false
+	// when it is not later than the last one accepted, so every code is used only once
+	UseTOTPStep(userID int64, step int64) (bool, error)
+	SetUserDisabled(userID int64, disabled bool) error
+	// ListUsers returns one page of users matching the filter, ordered by ID, together with
+	// the total number of matches
+	ListUsers(filter UserFilter) ([]*User, int, error)
+	// DeleteUser removes a user with their tokens, memberships, role assignments and links
+	// to identity providers, directories and SCIM clients. Audit events are kept.
+	DeleteUser(id int64) error
+	// Password reset operations
+	CreatePasswordReset(pr *PasswordReset) error
+	GetPasswordResetByTokenHash(tokenHash string) (*PasswordReset, error)
+	// MarkPasswordResetUsed consumes a reset token; it fails if the token was already used
+	MarkPasswordResetUsed(id int64) error
+	// Authorization code operations
+	CreateAuthorizationCode(c *AuthorizationCode) error
+	// ConsumeAuthorizationCode marks a code used and returns it; it returns nil if the code
+	// is unknown or was already used
+	ConsumeAuthorizationCode(codeHash string) (*AuthorizationCode, error)
+	// Consent operations
+	// UpsertConsent replaces the scopes a user approved for an application
+	UpsertConsent(userID, applicationID int64, scopes []string) error
+	GetConsent(userID, applicationID int64) (*Consent, error)
+	ListConsents(userID int64) ([]*Consent, error)
+	DeleteConsent(userID, applicationID int64) error
+	// Identity provider operations
+	CreateIdentityProvider(p *IdentityProvider) error
+	GetIdentityProviderByID(id int64) (*IdentityProvider, error)
+	GetIdentityProviderByName(name string) (*IdentityProvider, error)
+	// ListIdentityProviders returns every provider, or with applicationID set, the global
+	// providers and those of that application
+	ListIdentityProviders(applicationID *int64) ([]*IdentityProvider, error)
+	UpdateIdentityProvider(p *IdentityProvider) error
+	// DeleteIdentityProvider removes a provider together with the identities linked through it
+	DeleteIdentityProvider(id int64) error
+	// User identity operations
+	CreateUserIdentity(i *UserIdentity) error
+	GetUserIdentity(providerID int64, subject string) (*UserIdentity, error)
+	ListUserIdentities(userID int64) ([]*UserIdentity, error)
+	DeleteUserIdentity(userID, id int64) error
+	// SAML connection operations
+	CreateSAMLConnection(c *SAMLConnection) error
+	GetSAMLConnectionByID(id int64) (*SAMLConnection, error)
+	GetSAMLConnectionByName(name string) (*SAMLConnection, error)
+	// ListSAMLConnections returns every connection, or those of one application
+	ListSAMLConnections(applicationID *int64) ([]*SAMLConnection, error)
+	UpdateSAMLConnection(c *SAMLConnection) error
+	DeleteSAMLConnection(id int64) error
+	// CreateSAMLRequest stores a pending AuthnRequest and prunes expired ones
+	CreateSAMLRequest(r *SAMLRequest) error
+	// ConsumeSAMLRequest deletes and returns a pending AuthnRequest; nil when unknown
+	ConsumeSAMLRequest(id string) (*SAMLRequest, error)
+	// RecordSAMLAssertion remembers an assertion ID until it expires, reporting false when
+	// the connection already accepted it
+	RecordSAMLAssertion(connectionID int64, assertionID string, expiresAt int64) (bool, error)
+	// BindSAMLUser records that a user signs in through a connection
+	BindSAMLUser(connectionID, userID int64) error
+	// SAMLUserBound reports whether a user signs in through a connection
+	SAMLUserBound(connectionID, userID int64) (bool, error)
+	// LDAP directory operations
+	// UpsertLDAPDirectory creates or replaces the directory of an application
+	UpsertLDAPDirectory(d *LDAPDirectory) error
+	GetLDAPDirectory(applicationID int64) (*LDAPDirectory, error)
+	// DeleteLDAPDirectory removes an application's directory and its directory accounts
+	DeleteLDAPDirectory(applicationID int64) error
+	// UpsertDirectoryAccount links a user to a directory entry, replacing any other link of
+	// the user or the entry in the application
+	UpsertDirectoryAccount(acct *DirectoryAccount) error
+	GetDirectoryAccount(applicationID int64, dn string) (*DirectoryAccount, error)
+	GetDirectoryAccountByUser(applicationID, userID int64) (*DirectoryAccount, error)
+	// SCIM resource operations
+	// UpsertSCIMResource creates or updates a resource; it fails when another resource of
+	// the same type and application has the same external ID
+	UpsertSCIMResource(res *SCIMResource) error
+	GetSCIMResource(applicationID int64, resourceType string, resourceID int64) (*SCIMResource, error)
+	// ListSCIMResources returns an application's resources of one type ordered by resource ID
+	ListSCIMResources(applicationID int64, resourceType string) ([]*SCIMResource, error)
+	// GetSCIMResourceByExternalID finds the resource of a type with an external ID
+	GetSCIMResourceByExternalID(applicationID int64, resourceType, externalID string) (*SCIMResource, error)
+	// ListSCIMUsers returns one page of an application's SCIM users with their resources,
+	// ordered by user ID, with the total number of matches
+	ListSCIMUsers(filter SCIMUserFilter) ([]*SCIMUser, int, error)
+	DeleteSCIMResource(applicationID int64, resourceType string, resourceID int64) error
 	// Token operations
-	CreateRefreshToken(token string, userId int64, expiresAt int64, applicationID *int64) error
+	CreateRefreshToken(t *RefreshToken) error
 	GetRefreshToken(token string) (*RefreshToken, error)
 	RevokeRefreshToken(token string) error
 	RevokeAllRefreshTokensForUser(userId int64) error
+	// ListRefreshTokensForUser returns a user's unrevoked, unexpired refresh tokens, newest first
+	ListRefreshTokensForUser(userID int64) ([]*RefreshToken, error)
+	// DeleteApplicationRefreshTokensForUser drops the user's tokens issued to one application.
+	// Unlike revoked tokens, deleted ones do not trigger reuse detection when presented.
+	DeleteApplicationRefreshTokensForUser(userID, applicationID int64) error
 	// Application operations
-	GetApplicationByAPIKeyPrefix(prefix string) ([]*Application, error)
 	GetApplicationByID(id int64) (*Application, error)
-	CreateApplication(name, domain, apiKeyHash, apiKeyPrefix string, rateLimit int, origins []string) (*Application, error)
+	// CreateApplication stores the application together with key as its first API key
+	CreateApplication(name, domain string, key *APIKey, rateLimit int, origins []string, isolatedUsers bool) (*Application, error)
+	// ListApplications returns one page of applications matching the filter, ordered by ID,
+	// together with the total number of matches
+	ListApplications(filter ApplicationFilter) ([]*Application, int, error)
+	// UpdateApplication persists the name, domain, rate limit, allowed origins, IP lists,
+	// session cookie mode, branding, redirect URIs, client type and active flag
+	UpdateApplication(app *Application) error
+	// DeleteApplication removes an application. Users in its isolated namespace and the tokens
+	// it issued are deleted, or moved to reassignTo when set; global users are detached.
+	DeleteApplication(id int64, reassignTo *int64) error
+	// API key operations
+	CreateAPIKey(k *APIKey) error
+	// GetAPIKeysByPrefix returns the unrevoked keys sharing a prefix, expired ones included
+	GetAPIKeysByPrefix(prefix string) ([]*APIKey, error)
+	// GetAPIKeyByLookupHash returns the unrevoked key with the given lookup hash, if any
+	GetAPIKeyByLookupHash(lookupHash string) (*APIKey, error)
+	SetAPIKeyLookupHash(id int64, lookupHash string) error
+	SetAPIKeyOperations(applicationID, keyID int64, operations []string) error
+	ListAPIKeys(applicationID int64) ([]*APIKey, error)
+	// RotateAPIKeys stores newKey and makes the application's other unrevoked keys
+	// expire no later than oldKeysExpireAt
+	RotateAPIKeys(newKey *APIKey, oldKeysExpireAt time.Time) error
+	RevokeAPIKey(applicationID, keyID int64) error
+	TouchAPIKey(id int64, usedAt time.Time) error
 	// Scope operations
 	GetScopesByApplicationID(applicationID int64) ([]*Scope, error)
+	SetApplicationScopes(applicationID int64, scopeIDs []int64) error
 	GetScopeByName(name string) (*Scope, error)
+	ListScopes() ([]*Scope, error)
+	CreateScope(name, description string) (*Scope, error)
+	// Role operations
+	CreateRole(name, description string) (*Role, error)
+	GetRoleByID(id int64) (*Role, error)
+	ListRoles() ([]*Role, error)
+	DeleteRole(id int64) error
+	SetRoleScopes(roleID int64, scopeIDs []int64) error
+	AssignUserRole(userID, roleID int64, applicationID *int64) error
+	RemoveUserRole(userID, roleID int64, applicationID *int64) error
+	ListUserRoles(userID int64) ([]*UserRole, error)
+	// GetUserPermissions returns the scopes granted to a user through roles assigned
+	// globally or for the given application
+	GetUserPermissions(userID int64, applicationID *int64) ([]string, error)
+	// Organization operations
+	CreateOrganization(name string, applicationID *int64) (*Organization, error)
+	GetOrganizationByID(id int64) (*Organization, error)
+	ListOrganizations(applicationID *int64) ([]*Organization, error)
+	UpdateOrganization(id int64, name string) error
+	DeleteOrganization(id int64) error
+	// Membership operations
+	UpsertOrganizationMember(orgID, userID int64, role string) error
+	GetOrganizationMember(orgID, userID int64) (*OrganizationMember, error)
+	ListOrganizationMembers(orgID int64) ([]*OrganizationMember, error)
+	RemoveOrganizationMember(orgID, userID int64) error
+	// Invitation operations
+	CreateOrganizationInvitation(inv *OrganizationInvitation) error
+	GetOrganizationInvitationByTokenHash(tokenHash string) (*OrganizationInvitation, error)
+	ListOrganizationInvitations(orgID int64) ([]*OrganizationInvitation, error)
+	DeleteOrganizationInvitation(id int64) error
+	// MarkOrganizationInvitationAccepted uses up an invitation, reporting false when it
+	// was already accepted
+	MarkOrganizationInvitationAccepted(id int64) (bool, error)
+	// Audit log operations
+	CreateAuditEvent(e *AuditEvent) error
+	// ListAuditEvents returns one page of matching events, newest first, with the total number of matches
+	ListAuditEvents(filter AuditEventFilter) ([]*AuditEvent, int, error)
+	// Login history operations
+	CreateLoginEvent(e *LoginEvent) error
+	// ListLoginEvents returns one page of a user's login attempts, newest first, with the
+	// total number of matches
+	ListLoginEvents(filter LoginEventFilter) ([]*LoginEvent, int, error)
+	// CompleteLoginEvent marks a challenged login successful. It reports false when the
+	// login was not waiting on a challenge, for example because it was already completed.
+	CompleteLoginEvent(id int64) (bool, error)
+	// RecordMFAChallenge remembers an answered challenge ID until it expires, reporting
+	// false when the challenge was already used
+	RecordMFAChallenge(id string, expiresAt int64) (bool, error)
+}
+
+// defaultScopes are seeded into every database (see V2__add_enterprise_features for Postgres)
+var defaultScopes = []Scope{
+	{Name: "read:user", Description: "Read user information"},
+	{Name: "write:user", Description: "Modify user information"},
+	{Name: "admin:users", Description: "Admin access to user management"},
+	{Name: "admin:applications", Description: "Admin access to application management"},
+}
+
+// ApplicationFilter narrows ListApplications. Zero values match everything; a Limit of 0 means no limit.
+type ApplicationFilter struct {
+	Active *bool
+	Domain string
+	Limit  int
+	Offset int
+}
+
+// UserFilter narrows ListUsers. Zero values match everything; a Limit of 0 means no limit.
+type UserFilter struct {
+	EmailPrefix   string // Matched case-insensitively
+	ApplicationID *int64 // Users registered through the application
+	Disabled      *bool
+	Limit         int
+	Offset        int
+}
+
+// SCIMUserFilter narrows ListSCIMUsers to one application. Zero values match everything;
+// a Limit of 0 means no limit.
+type SCIMUserFilter struct {
+	ApplicationID int64
+	UserName      string // The user's email, matched case-insensitively
+	ExternalID    string
+	Limit         int
+	Offset        int
+}
+
+// AuditEventFilter narrows ListAuditEvents. Zero values match everything; a Limit of 0 means no limit.
+type AuditEventFilter struct {
+	ApplicationID *int64
+	UserID        *int64
+	Action        string
+	Limit         int
+	Offset        int
+}
+
+// LoginEventFilter narrows ListLoginEvents to one user. Zero values match everything; a Limit of 0 means no limit.
+type LoginEventFilter struct {
+	UserID int64
+	Since  time.Time
+	Limit  int
+	Offset int
+}
+
+// defaultAPIKeyLabel names the key an application is created with
+const defaultAPIKeyLabel = "default"
+
+// errNamespaceConflict is returned when moving users would duplicate an email in the target namespace
+var errNamespaceConflict = errors.New("email already registered in target namespace")
+
+// userKey identifies a user within its namespace
+type userKey struct {
+	namespaceID int64
+	email       string
 }
 
 // Memory DB
 type MemDB struct {
-	users  map[string]*User
-	tokens map[string]*RefreshToken
-	seq    int64
+	mu          sync.Mutex
+	users       map[userKey]*User
+	tokens      map[string]*RefreshToken
+	orgs        map[int64]*Organization
+	members     map[int64]map[int64]*OrganizationMember
+	invitations map[int64]*OrganizationInvitation
+	apps        map[int64]*Application
+	apiKeys     map[int64]*APIKey
+	appScopes   map[int64][]int64
+	scopes      map[int64]*Scope
+	roles       map[int64]*Role
+	userRoles   []*UserRole
+	resets      map[int64]*PasswordReset
+	codes       map[string]*AuthorizationCode
+	consents    map[int64]map[int64]*Consent
+	idps        map[int64]*IdentityProvider
+	identities  map[int64]*UserIdentity
+	samlConns   map[int64]*SAMLConnection
+	samlReqs    map[string]*SAMLRequest
+	samlSeen    map[int64]map[string]int64
+	samlUsers   map[int64]map[int64]bool // connection ID to the IDs of its users
+	ldapDirs    map[int64]*LDAPDirectory
+	dirAccounts []*DirectoryAccount
+	scim        map[scimKey]*SCIMResource
+	audit       []*AuditEvent
+	logins      []*LoginEvent
+	totpSteps   map[int64]int64
+	challenges  map[string]int64
+	seq         int64
 }
 
 func NewMemoryDB() *MemDB {
-	return &MemDB{users: map[string]*User{}, tokens: map[string]*RefreshToken{}, seq: 1}
+	m := &MemDB{
+		users:       map[userKey]*User{},
+		tokens:      map[string]*RefreshToken{},
+		orgs:        map[int64]*Organization{},
+		members:     map[int64]map[int64]*OrganizationMember{},
+		invitations: map[int64]*OrganizationInvitation{},
+		apps:        map[int64]*Application{},
+		apiKeys:     map[int64]*APIKey{},
+		appScopes:   map[int64][]int64{},
+		scopes:      map[int64]*Scope{},
+		roles:       map[int64]*Role{},
+		resets:      map[int64]*PasswordReset{},
+		codes:       map[string]*AuthorizationCode{},
+		consents:    map[int64]map[int64]*Consent{},
+		idps:        map[int64]*IdentityProvider{},
+		identities:  map[int64]*UserIdentity{},
+		samlConns:   map[int64]*SAMLConnection{},
+		samlReqs:    map[string]*SAMLRequest{},
+		samlSeen:    map[int64]map[string]int64{},
+		samlUsers:   map[int64]map[int64]bool{},
+		ldapDirs:    map[int64]*LDAPDirectory{},
+		scim:        map[scimKey]*SCIMResource{},
+		totpSteps:   map[int64]int64{},
+		challenges:  map[string]int64{},
+		seq:         1,
+	}
+	for _, scope := range defaultScopes {
+		m.createScopeLocked(scope.Name, scope.Description)
+	}
+	return m
+}
+
+func (m *MemDB) nextID() int64 {
+	id := m.seq
+	m.seq++
+	return id
 }
 
 func (m *MemDB) Init() error { return nil }
-func (m *MemDB) CreateUser(email, password string, applicationID *int64) (*User, error) {
-	if _, ok := m.users[email]; ok {
+func (m *MemDB) CreateUser(email, password string, applicationID *int64, namespaceID int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := userKey{namespaceID, email}
+	if _, ok := m.users[key]; ok {
 		return nil, errors.New("exists")
 	}
-	u := &User{ID: m.seq, Email: email, Password: password, ApplicationID: applicationID}
-	m.seq++
-	m.users[email] = u
+	u := &User{ID: m.nextID(), Email: email, Password: password, ApplicationID: applicationID, NamespaceID: namespaceID, CreatedAt: time.Now()}
+	m.users[key] = u
 	return u, nil
 }
-func (m *MemDB) GetUserByEmail(email string) (*User, error) {
-	if u, ok := m.users[email]; ok {
+func (m *MemDB) GetUserByEmail(namespaceID int64, email string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.users[userKey{namespaceID, email}]; ok {
 		return u, nil
 	}
 	return nil, nil
 }
-func (m *MemDB) CreateRefreshToken(token string, userId int64, expiresAt int64, applicationID *int64) error {
-	m.tokens[token] = &RefreshToken{Token: token, UserID: userId, ExpiresAt: expiresAt, ApplicationID: applicationID}
+func (m *MemDB) GetUserByID(id int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return nil, nil
+}
+func (m *MemDB) UpdateUserPassword(userID int64, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.ID == userID {
+			u.Password = passwordHash
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (m *MemDB) UpdateUserEmail(userID int64, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, u := range m.users {
+		if u.ID != userID {
+			continue
+		}
+		if _, taken := m.users[userKey{key.namespaceID, email}]; taken {
+			return errors.New("exists")
+		}
+		delete(m.users, key)
+		u.Email = email
+		m.users[userKey{key.namespaceID, email}] = u
+		return nil
+	}
+	return errors.New("not found")
+}
+
+func (m *MemDB) SetUserTOTPSecret(userID int64, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.ID == userID {
+			u.TOTPSecret = secret
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (m *MemDB) UseTOTPStep(userID int64, step int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if step <= m.totpSteps[userID] {
+		return false, nil
+	}
+	m.totpSteps[userID] = step
+	return true, nil
+}
+
+func (m *MemDB) SetUserDisabled(userID int64, disabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.ID == userID {
+			u.Disabled = disabled
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (m *MemDB) ListUsers(filter UserFilter) ([]*User, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := strings.ToLower(filter.EmailPrefix)
+	users := []*User{}
+	for _, u := range m.users {
+		if !strings.HasPrefix(strings.ToLower(u.Email), prefix) {
+			continue
+		}
+		if filter.ApplicationID != nil && (u.ApplicationID == nil || *u.ApplicationID != *filter.ApplicationID) {
+			continue
+		}
+		if filter.Disabled != nil && u.Disabled != *filter.Disabled {
+			continue
+		}
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	total := len(users)
+	if filter.Offset >= len(users) {
+		return []*User{}, total, nil
+	}
+	users = users[filter.Offset:]
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+	}
+	return users, total, nil
+}
+
+func (m *MemDB) DeleteUser(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, u := range m.users {
+		if u.ID == id {
+			m.deleteUserLocked(key)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (m *MemDB) CreatePasswordReset(pr *PasswordReset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pr.ID = m.nextID()
+	pr.CreatedAt = time.Now()
+	stored := *pr
+	m.resets[pr.ID] = &stored
 	return nil
 }
-func (m *MemDB) GetRefreshToken(token string) (*RefreshToken, error) {
-	if t, ok := m.tokens[token]; ok {
-		return t, nil
+
+func (m *MemDB) GetPasswordResetByTokenHash(tokenHash string) (*PasswordReset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, pr := range m.resets {
+		if pr.TokenHash == tokenHash {
+			copied := *pr
+			return &copied, nil
+		}
 	}
 	return nil, nil
 }
-func (m *MemDB) RevokeRefreshToken(token string) error {
-	if t, ok := m.tokens[token]; ok {
-		t.Revoked = true
+
+func (m *MemDB) MarkPasswordResetUsed(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pr, ok := m.resets[id]
+	if !ok || pr.UsedAt != nil {
+		return errors.New("not found")
+	}
+	now := time.Now()
+	pr.UsedAt = &now
+	return nil
+}
+
+func (m *MemDB) CreateAuthorizationCode(c *AuthorizationCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.codes[c.CodeHash]; ok {
+		return errors.New("exists")
+	}
+	c.ID = m.nextID()
+	c.CreatedAt = time.Now()
+	stored := *c
+	m.codes[c.CodeHash] = &stored
+	return nil
+}
+
+func (m *MemDB) ConsumeAuthorizationCode(codeHash string) (*AuthorizationCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.codes[codeHash]
+	if !ok || c.UsedAt != nil {
+		return nil, nil
+	}
+	now := time.Now()
+	c.UsedAt = &now
+	copied := *c
+	return &copied, nil
+}
+
+func (m *MemDB) UpsertConsent(userID, applicationID int64, scopes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	scopes = append([]string{}, scopes...)
+	now := time.Now()
+	if c, ok := m.consents[userID][applicationID]; ok {
+		c.Scopes = scopes
+		c.UpdatedAt = now
 		return nil
 	}
+	if m.consents[userID] == nil {
+		m.consents[userID] = map[int64]*Consent{}
+	}
+	m.consents[userID][applicationID] = &Consent{UserID: userID, ApplicationID: applicationID, Scopes: scopes, CreatedAt: now, UpdatedAt: now}
 	return nil
 }
-func (m *MemDB) RevokeAllRefreshTokensForUser(userId int64) error {
-	for _, t := range m.tokens {
-		if t.UserID == userId {
-			t.Revoked = true
+
+func (m *MemDB) GetConsent(userID, applicationID int64) (*Consent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.consents[userID][applicationID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (m *MemDB) ListConsents(userID int64) ([]*Consent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	consents := []*Consent{}
+	for _, c := range m.consents[userID] {
+		copied := *c
+		consents = append(consents, &copied)
+	}
+	sort.Slice(consents, func(i, j int) bool { return consents[i].ApplicationID < consents[j].ApplicationID })
+	return consents, nil
+}
+
+func (m *MemDB) DeleteConsent(userID, applicationID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.consents[userID][applicationID]; !ok {
+		return errors.New("not found")
+	}
+	delete(m.consents[userID], applicationID)
+	return nil
+}
+
+// Identity providers are copied in and out so callers never share state with the store
+func (m *MemDB) CreateIdentityProvider(p *IdentityProvider) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.idps {
+		if existing.Name == p.Name {
+			return errors.New("exists")
 		}
 	}
+	p.ID = m.nextID()
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = p.CreatedAt
+	stored := *p
+	m.idps[p.ID] = &stored
 	return nil
 }
 
-// Enterprise features for Memory DB (simplified implementations)
-func (m *MemDB) GetApplicationByAPIKeyPrefix(prefix string) ([]*Application, error) {
-	// Memory DB: return empty for now (can be extended with in-memory storage)
-	return []*Application{}, nil
+func (m *MemDB) GetIdentityProviderByID(id int64) (*IdentityProvider, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.idps[id]
+	if !ok {
+		return nil, nil
+	}
+	copied := *p
+	return &copied, nil
 }
 
-func (m *MemDB) GetApplicationByID(id int64) (*Application, error) {
+func (m *MemDB) GetIdentityProviderByName(name string) (*IdentityProvider, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, p := range m.idps {
+		if p.Name == name {
+			copied := *p
+			return &copied, nil
+		}
+	}
 	return nil, nil
 }
 
-func (m *MemDB) CreateApplication(name, domain, apiKeyHash, apiKeyPrefix string, rateLimit int, origins []string) (*Application, error) {
-	return nil, errors.New("not implemented in memory DB")
+func (m *MemDB) ListIdentityProviders(applicationID *int64) ([]*IdentityProvider, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	providers := []*IdentityProvider{}
+	for _, p := range m.idps {
+		if applicationID != nil && p.ApplicationID != nil && *p.ApplicationID != *applicationID {
+			continue
+		}
+		copied := *p
+		providers = append(providers, &copied)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].ID < providers[j].ID })
+	return providers, nil
 }
 
-func (m *MemDB) GetScopesByApplicationID(applicationID int64) ([]*Scope, error) {
-	return []*Scope{}, nil
+func (m *MemDB) UpdateIdentityProvider(p *IdentityProvider) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.idps[p.ID]
+	if !ok {
+		return errors.New("not found")
+	}
+	for _, other := range m.idps {
+		if other.ID != p.ID && other.Name == p.Name {
+			return errors.New("exists")
+		}
+	}
+	stored := *p
+	stored.CreatedAt = existing.CreatedAt
+	stored.UpdatedAt = time.Now()
+	m.idps[p.ID] = &stored
+	return nil
 }
 
-func (m *MemDB) GetScopeByName(name string) (*Scope, error) {
-	return nil, nil
+func (m *MemDB) DeleteIdentityProvider(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.idps[id]; !ok {
+		return errors.New("not found")
+	}
+	m.deleteIdentityProviderLocked(id)
+	return nil
 }
 
-// SQLite DB
-type SQLiteDB struct {
-	db   *sql.DB
-	path string
+func (m *MemDB) deleteIdentityProviderLocked(id int64) {
+	for identityID, i := range m.identities {
+		if i.ProviderID == id {
+			delete(m.identities, identityID)
+		}
+	}
+	delete(m.idps, id)
 }
 
-func NewSQLiteDB(path string) (*SQLiteDB, error) {
-	d, err := sql.Open("sqlite", path)
-	if err != nil {
-		return nil, err
+func (m *MemDB) CreateUserIdentity(i *UserIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.identities {
+		if existing.ProviderID == i.ProviderID && existing.Subject == i.Subject {
+			return errors.New("exists")
+		}
 	}
-	s := &SQLiteDB{db: d, path: path}
-	if err := s.Init(); err != nil {
-		return nil, err
+	i.ID = m.nextID()
+	i.CreatedAt = time.Now()
+	stored := *i
+	m.identities[i.ID] = &stored
+	return nil
+}
+
+func (m *MemDB) GetUserIdentity(providerID int64, subject string) (*UserIdentity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, i := range m.identities {
+		if i.ProviderID == providerID && i.Subject == subject {
+			copied := *i
+			return &copied, nil
+		}
 	}
-	return s, nil
+	return nil, nil
 }
 
-func (s *SQLiteDB) Init() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT UNIQUE, password TEXT, application_id INTEGER, created_at TEXT);`,
-		`CREATE TABLE IF NOT EXISTS refresh_tokens (token TEXT PRIMARY KEY, user_id INTEGER, application_id INTEGER, expires_at INTEGER, revoked INTEGER DEFAULT 0, created_at TEXT);`,
+func (m *MemDB) ListUserIdentities(userID int64) ([]*UserIdentity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	identities := []*UserIdentity{}
+	for _, i := range m.identities {
+		if i.UserID == userID {
+			copied := *i
+			identities = append(identities, &copied)
+		}
 	}
-	for _, q := range queries {
-		if _, err := s.db.Exec(q); err != nil {
-			return err
+	sort.Slice(identities, func(i, j int) bool { return identities[i].ID < identities[j].ID })
+	return identities, nil
+}
+
+func (m *MemDB) DeleteUserIdentity(userID, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, ok := m.identities[id]
+	if !ok || i.UserID != userID {
+		return errors.New("not found")
+	}
+	delete(m.identities, id)
+	return nil
+}
+
+// SAML connections are copied in and out so callers never share state with the store
+func (m *MemDB) CreateSAMLConnection(c *SAMLConnection) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.samlConns {
+		if existing.Name == c.Name {
+			return errors.New("exists")
 		}
 	}
+	c.ID = m.nextID()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	stored := *c
+	m.samlConns[c.ID] = &stored
 	return nil
 }
 
-// Enterprise features for SQLite DB
-func (s *SQLiteDB) GetApplicationByAPIKeyPrefix(prefix string) ([]*Application, error) {
-	rows, err := s.db.Query(`SELECT id,name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,active,created_at,updated_at FROM applications WHERE api_key_prefix = ? AND active = 1`, prefix)
-	if err != nil {
-		return nil, err
+func (m *MemDB) GetSAMLConnectionByID(id int64) (*SAMLConnection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.samlConns[id]
+	if !ok {
+		return nil, nil
 	}
-	defer rows.Close()
-	var apps []*Application
-	for rows.Next() {
-		var app Application
-		var active int
-		var createdAt, updatedAt string
-		if err := rows.Scan(&app.ID, &app.Name, &app.Domain, &app.APIKeyHash, &app.APIKeyPrefix, &app.RateLimitPerMinute, &active, &createdAt, &updatedAt); err != nil {
-			return nil, err
+	copied := *c
+	return &copied, nil
+}
+
+func (m *MemDB) GetSAMLConnectionByName(name string) (*SAMLConnection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.samlConns {
+		if c.Name == name {
+			copied := *c
+			return &copied, nil
 		}
-		app.Active = active != 0
-		apps = append(apps, &app)
 	}
-	return apps, nil
+	return nil, nil
 }
 
-func (s *SQLiteDB) GetApplicationByID(id int64) (*Application, error) {
-	row := s.db.QueryRow(`SELECT id,name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,active,created_at,updated_at FROM applications WHERE id = ?`, id)
-	var app Application
-	var active int
-	var createdAt, updatedAt string
-	if err := row.Scan(&app.ID, &app.Name, &app.Domain, &app.APIKeyHash, &app.APIKeyPrefix, &app.RateLimitPerMinute, &active, &createdAt, &updatedAt); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+func (m *MemDB) ListSAMLConnections(applicationID *int64) ([]*SAMLConnection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conns := []*SAMLConnection{}
+	for _, c := range m.samlConns {
+		if applicationID != nil && c.ApplicationID != *applicationID {
+			continue
 		}
-		return nil, err
+		copied := *c
+		conns = append(conns, &copied)
 	}
-	app.Active = active != 0
-	return &app, nil
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns, nil
 }
 
-func (s *SQLiteDB) CreateApplication(name, domain, apiKeyHash, apiKeyPrefix string, rateLimit int, origins []string) (*Application, error) {
-	res, err := s.db.Exec(`INSERT INTO applications(name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,created_at,updated_at) VALUES(?,?,?,?,?,datetime('now'),datetime('now'))`, name, domain, apiKeyHash, apiKeyPrefix, rateLimit)
-	if err != nil {
-		return nil, err
+func (m *MemDB) UpdateSAMLConnection(c *SAMLConnection) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.samlConns[c.ID]
+	if !ok {
+		return errors.New("not found")
 	}
-	id, _ := res.LastInsertId()
-	return &Application{ID: id, Name: name, Domain: domain, APIKeyHash: apiKeyHash, APIKeyPrefix: apiKeyPrefix, RateLimitPerMinute: rateLimit, AllowedOrigins: origins, Active: true}, nil
+	for _, other := range m.samlConns {
+		if other.ID != c.ID && other.Name == c.Name {
+			return errors.New("exists")
+		}
+	}
+	stored := *c
+	stored.CreatedAt = existing.CreatedAt
+	stored.UpdatedAt = time.Now()
+	m.samlConns[c.ID] = &stored
+	return nil
 }
 
-func (s *SQLiteDB) GetScopesByApplicationID(applicationID int64) ([]*Scope, error) {
-	rows, err := s.db.Query(`SELECT s.id,s.name,s.description,s.created_at FROM scopes s JOIN application_scopes aps ON s.id = aps.scope_id WHERE aps.application_id = ?`, applicationID)
-	if err != nil {
-		return nil, err
+func (m *MemDB) DeleteSAMLConnection(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.samlConns[id]; !ok {
+		return errors.New("not found")
 	}
-	defer rows.Close()
-	var scopes []*Scope
-	for rows.Next() {
-		var scope Scope
-		var createdAt string
-		if err := rows.Scan(&scope.ID, &scope.Name, &scope.Description, &createdAt); err != nil {
-			return nil, err
+	m.deleteSAMLConnectionLocked(id)
+	return nil
+}
+
+func (m *MemDB) deleteSAMLConnectionLocked(id int64) {
+	for reqID, r := range m.samlReqs {
+		if r.ConnectionID == id {
+			delete(m.samlReqs, reqID)
 		}
-		scopes = append(scopes, &scope)
 	}
-	return scopes, nil
+	delete(m.samlSeen, id)
+	delete(m.samlUsers, id)
+	delete(m.samlConns, id)
 }
 
-func (s *SQLiteDB) GetScopeByName(name string) (*Scope, error) {
-	row := s.db.QueryRow(`SELECT id,name,description,created_at FROM scopes WHERE name = ?`, name)
-	var scope Scope
-	var createdAt string
-	if err := row.Scan(&scope.ID, &scope.Name, &scope.Description, &createdAt); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+func (m *MemDB) CreateSAMLRequest(r *SAMLRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.samlReqs[r.ID]; ok {
+		return errors.New("exists")
+	}
+	now := time.Now()
+	for id, pending := range m.samlReqs {
+		if pending.ExpiresAt < now.Unix() {
+			delete(m.samlReqs, id)
 		}
-		return nil, err
 	}
-	return &scope, nil
+	r.CreatedAt = now
+	stored := *r
+	m.samlReqs[r.ID] = &stored
+	return nil
 }
 
-func (s *SQLiteDB) CreateUser(email, password string, applicationID *int64) (*User, error) {
-	res, err := s.db.Exec(`INSERT INTO users(email,password,application_id,created_at) VALUES(?,?,?,datetime('now'))`, email, password, applicationID)
-	if err != nil {
-		return nil, err
+func (m *MemDB) ConsumeSAMLRequest(id string) (*SAMLRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.samlReqs[id]
+	if !ok {
+		return nil, nil
 	}
-	id, _ := res.LastInsertId()
-	return &User{ID: id, Email: email, Password: password, ApplicationID: applicationID}, nil
+	delete(m.samlReqs, id)
+	return r, nil
 }
 
-func (s *SQLiteDB) GetUserByEmail(email string) (*User, error) {
-	row := s.db.QueryRow(`SELECT id,email,password,application_id,created_at FROM users WHERE email = ?`, email)
-	var u User
-	var created string
-	var appID sql.NullInt64
-	if err := row.Scan(&u.ID, &u.Email, &u.Password, &appID, &created); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+func (m *MemDB) RecordSAMLAssertion(connectionID int64, assertionID string, expiresAt int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	seen := m.samlSeen[connectionID]
+	if seen == nil {
+		seen = map[string]int64{}
+		m.samlSeen[connectionID] = seen
+	}
+	for id, exp := range seen {
+		if exp < now {
+			delete(seen, id)
 		}
-		return nil, err
 	}
-	if appID.Valid {
-		u.ApplicationID = &appID.Int64
+	if _, ok := seen[assertionID]; ok {
+		return false, nil
 	}
-	return &u, nil
+	seen[assertionID] = expiresAt
+	return true, nil
 }
 
-func (s *SQLiteDB) CreateRefreshToken(token string, userId int64, expiresAt int64, applicationID *int64) error {
-	_, err := s.db.Exec(`INSERT INTO refresh_tokens(token,user_id,application_id,expires_at,created_at) VALUES(?,?,?,?,datetime('now'))`, token, userId, applicationID, expiresAt)
-	return err
+func (m *MemDB) BindSAMLUser(connectionID, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.samlConns[connectionID]; !ok {
+		return errors.New("not found")
+	}
+	if m.samlUsers[connectionID] == nil {
+		m.samlUsers[connectionID] = map[int64]bool{}
+	}
+	m.samlUsers[connectionID][userID] = true
+	return nil
 }
 
-func (s *SQLiteDB) GetRefreshToken(token string) (*RefreshToken, error) {
-	row := s.db.QueryRow(`SELECT token,user_id,application_id,expires_at,revoked FROM refresh_tokens WHERE token = ?`, token)
-	var t RefreshToken
-	var revoked int
-	var appID sql.NullInt64
-	if err := row.Scan(&t.Token, &t.UserID, &appID, &t.ExpiresAt, &revoked); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+func (m *MemDB) SAMLUserBound(connectionID, userID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.samlUsers[connectionID][userID], nil
+}
+
+// LDAP directories and directory accounts are copied in and out so callers never share
+// state with the store
+func (m *MemDB) UpsertLDAPDirectory(d *LDAPDirectory) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	d.UpdatedAt = now
+	if existing, ok := m.ldapDirs[d.ApplicationID]; ok {
+		d.CreatedAt = existing.CreatedAt
+	} else {
+		d.CreatedAt = now
+	}
+	stored := *d
+	m.ldapDirs[d.ApplicationID] = &stored
+	return nil
+}
+
+func (m *MemDB) GetLDAPDirectory(applicationID int64) (*LDAPDirectory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.ldapDirs[applicationID]
+	if !ok {
+		return nil, nil
+	}
+	out := *d
+	return &out, nil
+}
+
+func (m *MemDB) DeleteLDAPDirectory(applicationID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.ldapDirs[applicationID]; !ok {
+		return errors.New("not found")
+	}
+	m.deleteLDAPDirectoryLocked(applicationID)
+	return nil
+}
+
+func (m *MemDB) deleteLDAPDirectoryLocked(applicationID int64) {
+	delete(m.ldapDirs, applicationID)
+	m.removeDirectoryAccountsLocked(func(acct *DirectoryAccount) bool { return acct.ApplicationID == applicationID })
+}
+
+func (m *MemDB) removeDirectoryAccountsLocked(match func(*DirectoryAccount) bool) {
+	accounts := m.dirAccounts[:0]
+	for _, acct := range m.dirAccounts {
+		if !match(acct) {
+			accounts = append(accounts, acct)
 		}
-		return nil, err
 	}
-	t.Revoked = revoked != 0
-	if appID.Valid {
-		t.ApplicationID = &appID.Int64
+	m.dirAccounts = accounts
+}
+
+func (m *MemDB) UpsertDirectoryAccount(acct *DirectoryAccount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeDirectoryAccountsLocked(func(other *DirectoryAccount) bool {
+		return other.ApplicationID == acct.ApplicationID && (other.DN == acct.DN || other.UserID == acct.UserID)
+	})
+	acct.UpdatedAt = time.Now()
+	stored := *acct
+	m.dirAccounts = append(m.dirAccounts, &stored)
+	return nil
+}
+
+func (m *MemDB) findDirectoryAccount(match func(*DirectoryAccount) bool) (*DirectoryAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, acct := range m.dirAccounts {
+		if match(acct) {
+			out := *acct
+			return &out, nil
+		}
 	}
-	return &t, nil
+	return nil, nil
 }
 
-func (s *SQLiteDB) RevokeRefreshToken(token string) error {
-	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE token = ?`, token)
-	return err
+func (m *MemDB) GetDirectoryAccount(applicationID int64, dn string) (*DirectoryAccount, error) {
+	return m.findDirectoryAccount(func(acct *DirectoryAccount) bool { return acct.ApplicationID == applicationID && acct.DN == dn })
 }
 
-func (s *SQLiteDB) RevokeAllRefreshTokensForUser(userId int64) error {
-	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userId)
-	return err
+func (m *MemDB) GetDirectoryAccountByUser(applicationID, userID int64) (*DirectoryAccount, error) {
+	return m.findDirectoryAccount(func(acct *DirectoryAccount) bool { return acct.ApplicationID == applicationID && acct.UserID == userID })
 }
 
-// lifecycle helpers
-func (m *MemDB) close() error { return nil }
-func (m *MemDB) ping() bool   { return true }
+// scimKey identifies a SCIM resource in the memory store
+type scimKey struct {
+	applicationID int64
+	resourceType  string
+	resourceID    int64
+}
 
-func (s *SQLiteDB) close() error { return s.db.Close() }
+func (m *MemDB) UpsertSCIMResource(res *SCIMResource) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := scimKey{res.ApplicationID, res.Type, res.ResourceID}
+	if res.ExternalID != "" {
+		for k, other := range m.scim {
+			if k != key && k.applicationID == key.applicationID && k.resourceType == key.resourceType && other.ExternalID == res.ExternalID {
+				return errors.New("exists")
+			}
+		}
+	}
+	now := time.Now()
+	res.UpdatedAt = now
+	if existing, ok := m.scim[key]; ok {
+		res.CreatedAt = existing.CreatedAt
+	} else {
+		res.CreatedAt = now
+	}
+	stored := *res
+	m.scim[key] = &stored
+	return nil
+}
+
+func (m *MemDB) GetSCIMResource(applicationID int64, resourceType string, resourceID int64) (*SCIMResource, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res, ok := m.scim[scimKey{applicationID, resourceType, resourceID}]
+	if !ok {
+		return nil, nil
+	}
+	out := *res
+	return &out, nil
+}
+
+func (m *MemDB) ListSCIMResources(applicationID int64, resourceType string) ([]*SCIMResource, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*SCIMResource{}
+	for k, res := range m.scim {
+		if k.applicationID == applicationID && k.resourceType == resourceType {
+			copied := *res
+			out = append(out, &copied)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ResourceID < out[j].ResourceID })
+	return out, nil
+}
+
+func (m *MemDB) GetSCIMResourceByExternalID(applicationID int64, resourceType, externalID string) (*SCIMResource, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, res := range m.scim {
+		if k.applicationID == applicationID && k.resourceType == resourceType && res.ExternalID == externalID {
+			out := *res
+			return &out, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemDB) ListSCIMUsers(filter SCIMUserFilter) ([]*SCIMUser, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := map[int64]*User{}
+	for _, u := range m.users {
+		users[u.ID] = u
+	}
+	out := []*SCIMUser{}
+	for k, res := range m.scim {
+		if k.applicationID != filter.ApplicationID || k.resourceType != scimTypeUser {
+			continue
+		}
+		if filter.ExternalID != "" && res.ExternalID != filter.ExternalID {
+			continue
+		}
+		u, ok := users[k.resourceID]
+		if !ok || filter.UserName != "" && !strings.EqualFold(u.Email, filter.UserName) {
+			continue
+		}
+		copied := *res
+		out = append(out, &SCIMUser{Resource: &copied, User: u})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].User.ID < out[j].User.ID })
+	total := len(out)
+	if filter.Offset >= len(out) {
+		return []*SCIMUser{}, total, nil
+	}
+	out = out[filter.Offset:]
+	if filter.Limit > 0 && len(out) > filter.Limit {
+		out = out[:filter.Limit]
+	}
+	return out, total, nil
+}
+
+func (m *MemDB) DeleteSCIMResource(applicationID int64, resourceType string, resourceID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := scimKey{applicationID, resourceType, resourceID}
+	if _, ok := m.scim[key]; !ok {
+		return errors.New("not found")
+	}
+	delete(m.scim, key)
+	return nil
+}
+
+// removeSCIMResourcesLocked drops the SCIM resources matching a predicate
+func (m *MemDB) removeSCIMResourcesLocked(match func(scimKey) bool) {
+	for k := range m.scim {
+		if match(k) {
+			delete(m.scim, k)
+		}
+	}
+}
+
+func (m *MemDB) CreateRefreshToken(t *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *t
+	stored.CreatedAt = time.Now()
+	m.tokens[t.Token] = &stored
+	return nil
+}
+func (m *MemDB) GetRefreshToken(token string) (*RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[token]; ok {
+		return t, nil
+	}
+	return nil, nil
+}
+func (m *MemDB) RevokeRefreshToken(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[token]; ok {
+		t.Revoked = true
+		return nil
+	}
+	return nil
+}
+func (m *MemDB) RevokeAllRefreshTokensForUser(userId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.UserID == userId {
+			t.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (m *MemDB) ListRefreshTokensForUser(userID int64) ([]*RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	tokens := []*RefreshToken{}
+	for _, t := range m.tokens {
+		if t.UserID == userID && !t.Revoked && t.ExpiresAt >= now {
+			copied := *t
+			tokens = append(tokens, &copied)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.After(tokens[j].CreatedAt) })
+	return tokens, nil
+}
+
+func (m *MemDB) DeleteApplicationRefreshTokensForUser(userID, applicationID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for token, t := range m.tokens {
+		if t.UserID == userID && t.ApplicationID != nil && *t.ApplicationID == applicationID {
+			delete(m.tokens, token)
+		}
+	}
+	return nil
+}
+
+// Enterprise features for Memory DB
+func (m *MemDB) GetApplicationByID(id int64) (*Application, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apps[id], nil
+}
+
+func (m *MemDB) CreateApplication(name, domain string, key *APIKey, rateLimit int, origins []string, isolatedUsers bool) (*Application, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, app := range m.apps {
+		if app.APIKeyHash == key.KeyHash {
+			return nil, errors.New("exists")
+		}
+	}
+	now := time.Now()
+	app := &Application{ID: m.nextID(), Name: name, Domain: domain, APIKeyHash: key.KeyHash, APIKeyPrefix: key.KeyPrefix, RateLimitPerMinute: rateLimit, AllowedOrigins: origins, IsolatedUsers: isolatedUsers, ClientType: clientTypeConfidential, Active: true, CreatedAt: now, UpdatedAt: now}
+	m.apps[app.ID] = app
+	key.ApplicationID = app.ID
+	if key.Label == "" {
+		key.Label = defaultAPIKeyLabel
+	}
+	if err := m.createAPIKeyLocked(key); err != nil {
+		delete(m.apps, app.ID)
+		return nil, err
+	}
+	return app, nil
+}
+
+func (m *MemDB) ListApplications(filter ApplicationFilter) ([]*Application, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apps := []*Application{}
+	for _, app := range m.apps {
+		if filter.Active != nil && app.Active != *filter.Active {
+			continue
+		}
+		if filter.Domain != "" && !strings.EqualFold(app.Domain, filter.Domain) {
+			continue
+		}
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].ID < apps[j].ID })
+	total := len(apps)
+	if filter.Offset >= len(apps) {
+		return []*Application{}, total, nil
+	}
+	apps = apps[filter.Offset:]
+	if filter.Limit > 0 && len(apps) > filter.Limit {
+		apps = apps[:filter.Limit]
+	}
+	return apps, total, nil
+}
+
+func (m *MemDB) UpdateApplication(app *Application) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.apps[app.ID]
+	if !ok {
+		return errors.New("not found")
+	}
+	existing.Name = app.Name
+	existing.Domain = app.Domain
+	existing.RateLimitPerMinute = app.RateLimitPerMinute
+	existing.AllowedOrigins = app.AllowedOrigins
+	existing.IPAllowlist = app.IPAllowlist
+	existing.IPDenylist = app.IPDenylist
+	existing.SessionCookie = app.SessionCookie
+	existing.Branding = app.Branding
+	existing.RedirectURIs = app.RedirectURIs
+	existing.ClientType = app.ClientType
+	existing.Active = app.Active
+	existing.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *MemDB) DeleteApplication(id int64, reassignTo *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	app, ok := m.apps[id]
+	if !ok {
+		return errors.New("not found")
+	}
+	var target *Application
+	if reassignTo != nil {
+		if target, ok = m.apps[*reassignTo]; !ok || target.ID == id {
+			return errors.New("target application not found")
+		}
+		targetID := target.ID
+		reassignTo = &targetID
+	}
+
+	if app.IsolatedUsers {
+		var keys []userKey
+		for key := range m.users {
+			if key.namespaceID == id {
+				keys = append(keys, key)
+			}
+		}
+		if target != nil {
+			ns := userNamespace(target)
+			for _, key := range keys {
+				if _, exists := m.users[userKey{ns, key.email}]; exists {
+					return errNamespaceConflict
+				}
+			}
+			for _, key := range keys {
+				u := m.users[key]
+				delete(m.users, key)
+				u.NamespaceID = ns
+				m.users[userKey{ns, key.email}] = u
+			}
+		} else {
+			for _, key := range keys {
+				m.deleteUserLocked(key)
+			}
+		}
+	}
+	for _, u := range m.users {
+		if u.ApplicationID != nil && *u.ApplicationID == id {
+			u.ApplicationID = reassignTo
+		}
+	}
+	for token, t := range m.tokens {
+		if t.ApplicationID != nil && *t.ApplicationID == id {
+			if reassignTo != nil {
+				t.ApplicationID = reassignTo
+			} else {
+				delete(m.tokens, token)
+			}
+		}
+	}
+	for orgID, org := range m.orgs {
+		if org.ApplicationID != nil && *org.ApplicationID == id {
+			if reassignTo != nil {
+				org.ApplicationID = reassignTo
+			} else {
+				m.deleteOrganizationLocked(orgID)
+			}
+		}
+	}
+	userRoles := m.userRoles[:0]
+	for _, ur := range m.userRoles {
+		if ur.ApplicationID == nil || *ur.ApplicationID != id {
+			userRoles = append(userRoles, ur)
+		}
+	}
+	m.userRoles = userRoles
+	for keyID, k := range m.apiKeys {
+		if k.ApplicationID == id {
+			delete(m.apiKeys, keyID)
+		}
+	}
+	for hash, c := range m.codes {
+		if c.ApplicationID == id {
+			delete(m.codes, hash)
+		}
+	}
+	for _, consents := range m.consents {
+		delete(consents, id)
+	}
+	for providerID, p := range m.idps {
+		if p.ApplicationID != nil && *p.ApplicationID == id {
+			if reassignTo != nil {
+				p.ApplicationID = reassignTo
+			} else {
+				m.deleteIdentityProviderLocked(providerID)
+			}
+		}
+	}
+	for connID, c := range m.samlConns {
+		if c.ApplicationID == id {
+			if reassignTo != nil {
+				c.ApplicationID = *reassignTo
+			} else {
+				m.deleteSAMLConnectionLocked(connID)
+			}
+		}
+	}
+	m.deleteLDAPDirectoryLocked(id)
+	m.removeSCIMResourcesLocked(func(k scimKey) bool { return k.applicationID == id })
+	delete(m.appScopes, id)
+	delete(m.apps, id)
+	return nil
+}
+
+// API keys are copied in and out so callers never share state with the store
+func (m *MemDB) CreateAPIKey(k *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.createAPIKeyLocked(k)
+}
+
+func (m *MemDB) createAPIKeyLocked(k *APIKey) error {
+	if _, ok := m.apps[k.ApplicationID]; !ok {
+		return errors.New("application not found")
+	}
+	for _, existing := range m.apiKeys {
+		if existing.KeyHash == k.KeyHash || (k.LookupHash != "" && existing.LookupHash == k.LookupHash) {
+			return errors.New("exists")
+		}
+	}
+	k.ID = m.nextID()
+	k.CreatedAt = time.Now()
+	stored := *k
+	m.apiKeys[k.ID] = &stored
+	return nil
+}
+
+func (m *MemDB) GetAPIKeysByPrefix(prefix string) ([]*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []*APIKey{}
+	for _, k := range m.apiKeys {
+		if k.KeyPrefix == prefix && k.RevokedAt == nil {
+			copied := *k
+			keys = append(keys, &copied)
+		}
+	}
+	return keys, nil
+}
+
+func (m *MemDB) GetAPIKeyByLookupHash(lookupHash string) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.apiKeys {
+		if k.LookupHash == lookupHash && k.RevokedAt == nil {
+			copied := *k
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemDB) SetAPIKeyLookupHash(id int64, lookupHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.apiKeys[id]
+	if !ok {
+		return errors.New("not found")
+	}
+	k.LookupHash = lookupHash
+	return nil
+}
+
+func (m *MemDB) SetAPIKeyOperations(applicationID, keyID int64, operations []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.apiKeys[keyID]
+	if !ok || k.ApplicationID != applicationID {
+		return errors.New("not found")
+	}
+	k.Operations = append([]string(nil), operations...)
+	return nil
+}
+
+func (m *MemDB) ListAPIKeys(applicationID int64) ([]*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []*APIKey{}
+	for _, k := range m.apiKeys {
+		if k.ApplicationID == applicationID {
+			copied := *k
+			keys = append(keys, &copied)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (m *MemDB) RotateAPIKeys(newKey *APIKey, oldKeysExpireAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var old []*APIKey
+	for _, k := range m.apiKeys {
+		if k.ApplicationID == newKey.ApplicationID && k.RevokedAt == nil {
+			old = append(old, k)
+		}
+	}
+	if err := m.createAPIKeyLocked(newKey); err != nil {
+		return err
+	}
+	for _, k := range old {
+		if k.ExpiresAt == nil || k.ExpiresAt.After(oldKeysExpireAt) {
+			expiresAt := oldKeysExpireAt
+			k.ExpiresAt = &expiresAt
+		}
+	}
+	return nil
+}
+
+func (m *MemDB) RevokeAPIKey(applicationID, keyID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k, ok := m.apiKeys[keyID]
+	if !ok || k.ApplicationID != applicationID || k.RevokedAt != nil {
+		return errors.New("not found")
+	}
+	now := time.Now()
+	k.RevokedAt = &now
+	return nil
+}
+
+func (m *MemDB) TouchAPIKey(id int64, usedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if k, ok := m.apiKeys[id]; ok {
+		k.LastUsedAt = &usedAt
+	}
+	return nil
+}
+
+// deleteUserLocked removes a user with its tokens, memberships and role assignments
+func (m *MemDB) deleteUserLocked(key userKey) {
+	u, ok := m.users[key]
+	if !ok {
+		return
+	}
+	delete(m.users, key)
+	for token, t := range m.tokens {
+		if t.UserID == u.ID {
+			delete(m.tokens, token)
+		}
+	}
+	for _, members := range m.members {
+		delete(members, u.ID)
+	}
+	for id, pr := range m.resets {
+		if pr.UserID == u.ID {
+			delete(m.resets, id)
+		}
+	}
+	for hash, c := range m.codes {
+		if c.UserID == u.ID {
+			delete(m.codes, hash)
+		}
+	}
+	delete(m.consents, u.ID)
+	for id, i := range m.identities {
+		if i.UserID == u.ID {
+			delete(m.identities, id)
+		}
+	}
+	for _, users := range m.samlUsers {
+		delete(users, u.ID)
+	}
+	userRoles := m.userRoles[:0]
+	for _, ur := range m.userRoles {
+		if ur.UserID != u.ID {
+			userRoles = append(userRoles, ur)
+		}
+	}
+	m.userRoles = userRoles
+	m.removeDirectoryAccountsLocked(func(acct *DirectoryAccount) bool { return acct.UserID == u.ID })
+	m.removeSCIMResourcesLocked(func(k scimKey) bool { return k.resourceType == scimTypeUser && k.resourceID == u.ID })
+	logins := m.logins[:0]
+	for _, e := range m.logins {
+		if e.UserID != u.ID {
+			logins = append(logins, e)
+		}
+	}
+	m.logins = logins
+}
+
+func (m *MemDB) GetScopesByApplicationID(applicationID int64) ([]*Scope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	scopes := []*Scope{}
+	for _, id := range m.appScopes[applicationID] {
+		if scope, ok := m.scopes[id]; ok {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func (m *MemDB) SetApplicationScopes(applicationID int64, scopeIDs []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.apps[applicationID]; !ok {
+		return errors.New("not found")
+	}
+	m.appScopes[applicationID] = append([]int64(nil), scopeIDs...)
+	return nil
+}
+
+func (m *MemDB) GetScopeByName(name string) (*Scope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, scope := range m.scopes {
+		if scope.Name == name {
+			return scope, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemDB) ListScopes() ([]*Scope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	scopes := []*Scope{}
+	for _, scope := range m.scopes {
+		scopes = append(scopes, scope)
+	}
+	sort.Slice(scopes, func(i, j int) bool { return scopes[i].Name < scopes[j].Name })
+	return scopes, nil
+}
+
+func (m *MemDB) CreateScope(name, description string) (*Scope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.createScopeLocked(name, description)
+}
+
+func (m *MemDB) createScopeLocked(name, description string) (*Scope, error) {
+	for _, scope := range m.scopes {
+		if scope.Name == name {
+			return nil, errors.New("exists")
+		}
+	}
+	scope := &Scope{ID: m.nextID(), Name: name, Description: description, CreatedAt: time.Now()}
+	m.scopes[scope.ID] = scope
+	return scope, nil
+}
+
+// Roles for Memory DB
+func (m *MemDB) CreateRole(name, description string) (*Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, role := range m.roles {
+		if role.Name == name {
+			return nil, errors.New("exists")
+		}
+	}
+	role := &Role{ID: m.nextID(), Name: name, Description: description, Scopes: []string{}, CreatedAt: time.Now()}
+	m.roles[role.ID] = role
+	return role, nil
+}
+
+func (m *MemDB) GetRoleByID(id int64) (*Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.roles[id], nil
+}
+
+func (m *MemDB) ListRoles() ([]*Role, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	roles := []*Role{}
+	for _, role := range m.roles {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles, nil
+}
+
+func (m *MemDB) DeleteRole(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.roles[id]; !ok {
+		return errors.New("not found")
+	}
+	delete(m.roles, id)
+	kept := m.userRoles[:0]
+	for _, ur := range m.userRoles {
+		if ur.RoleID != id {
+			kept = append(kept, ur)
+		}
+	}
+	m.userRoles = kept
+	return nil
+}
+
+func (m *MemDB) SetRoleScopes(roleID int64, scopeIDs []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	role, ok := m.roles[roleID]
+	if !ok {
+		return errors.New("not found")
+	}
+	names := []string{}
+	for _, id := range scopeIDs {
+		scope, ok := m.scopes[id]
+		if !ok {
+			return errors.New("scope not found")
+		}
+		names = append(names, scope.Name)
+	}
+	sort.Strings(names)
+	role.Scopes = names
+	return nil
+}
+
+func sameApplication(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func (m *MemDB) AssignUserRole(userID, roleID int64, applicationID *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	role, ok := m.roles[roleID]
+	if !ok {
+		return errors.New("role not found")
+	}
+	for _, ur := range m.userRoles {
+		if ur.UserID == userID && ur.RoleID == roleID && sameApplication(ur.ApplicationID, applicationID) {
+			return nil
+		}
+	}
+	m.userRoles = append(m.userRoles, &UserRole{UserID: userID, RoleID: roleID, RoleName: role.Name, ApplicationID: applicationID, CreatedAt: time.Now()})
+	return nil
+}
+
+func (m *MemDB) RemoveUserRole(userID, roleID int64, applicationID *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, ur := range m.userRoles {
+		if ur.UserID == userID && ur.RoleID == roleID && sameApplication(ur.ApplicationID, applicationID) {
+			m.userRoles = append(m.userRoles[:i], m.userRoles[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not found")
+}
+
+func (m *MemDB) ListUserRoles(userID int64) ([]*UserRole, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	roles := []*UserRole{}
+	for _, ur := range m.userRoles {
+		if ur.UserID == userID {
+			roles = append(roles, ur)
+		}
+	}
+	return roles, nil
+}
+
+func (m *MemDB) GetUserPermissions(userID int64, applicationID *int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[string]bool{}
+	perms := []string{}
+	for _, ur := range m.userRoles {
+		if ur.UserID != userID || (ur.ApplicationID != nil && !sameApplication(ur.ApplicationID, applicationID)) {
+			continue
+		}
+		for _, scope := range m.roles[ur.RoleID].Scopes {
+			if !seen[scope] {
+				seen[scope] = true
+				perms = append(perms, scope)
+			}
+		}
+	}
+	sort.Strings(perms)
+	return perms, nil
+}
+
+// Organizations for Memory DB
+func (m *MemDB) CreateOrganization(name string, applicationID *int64) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	org := &Organization{ID: m.nextID(), Name: name, ApplicationID: applicationID, CreatedAt: now, UpdatedAt: now}
+	m.orgs[org.ID] = org
+	m.members[org.ID] = map[int64]*OrganizationMember{}
+	return org, nil
+}
+
+func (m *MemDB) GetOrganizationByID(id int64) (*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.orgs[id], nil
+}
+
+func (m *MemDB) ListOrganizations(applicationID *int64) ([]*Organization, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	orgs := []*Organization{}
+	for _, org := range m.orgs {
+		if applicationID == nil || (org.ApplicationID != nil && *org.ApplicationID == *applicationID) {
+			orgs = append(orgs, org)
+		}
+	}
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].ID < orgs[j].ID })
+	return orgs, nil
+}
+
+func (m *MemDB) UpdateOrganization(id int64, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	org, ok := m.orgs[id]
+	if !ok {
+		return errors.New("not found")
+	}
+	org.Name = name
+	org.UpdatedAt = time.Now()
+	return nil
+}
+
+func (m *MemDB) DeleteOrganization(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.orgs[id]; !ok {
+		return errors.New("not found")
+	}
+	m.deleteOrganizationLocked(id)
+	return nil
+}
+
+// deleteOrganizationLocked removes an organization with its members and invitations
+func (m *MemDB) deleteOrganizationLocked(id int64) {
+	delete(m.orgs, id)
+	delete(m.members, id)
+	for invID, inv := range m.invitations {
+		if inv.OrganizationID == id {
+			delete(m.invitations, invID)
+		}
+	}
+	for _, t := range m.tokens {
+		if t.OrganizationID != nil && *t.OrganizationID == id {
+			t.OrganizationID = nil
+		}
+	}
+	for connID, c := range m.samlConns {
+		if c.OrganizationID != nil && *c.OrganizationID == id {
+			m.deleteSAMLConnectionLocked(connID)
+		}
+	}
+	m.removeSCIMResourcesLocked(func(k scimKey) bool { return k.resourceType == scimTypeGroup && k.resourceID == id })
+}
+
+func (m *MemDB) UpsertOrganizationMember(orgID, userID int64, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members, ok := m.members[orgID]
+	if !ok {
+		return errors.New("organization not found")
+	}
+	if member, ok := members[userID]; ok {
+		member.Role = role
+		return nil
+	}
+	members[userID] = &OrganizationMember{OrganizationID: orgID, UserID: userID, Role: role, CreatedAt: time.Now()}
+	return nil
+}
+
+func (m *MemDB) GetOrganizationMember(orgID, userID int64) (*OrganizationMember, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.members[orgID][userID], nil
+}
+
+func (m *MemDB) ListOrganizationMembers(orgID int64) ([]*OrganizationMember, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := []*OrganizationMember{}
+	for _, member := range m.members[orgID] {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+	return members, nil
+}
+
+func (m *MemDB) RemoveOrganizationMember(orgID, userID int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.members[orgID][userID]; !ok {
+		return errors.New("not found")
+	}
+	delete(m.members[orgID], userID)
+	return nil
+}
+
+func (m *MemDB) CreateOrganizationInvitation(inv *OrganizationInvitation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inv.ID = m.nextID()
+	inv.CreatedAt = time.Now()
+	stored := *inv
+	m.invitations[inv.ID] = &stored
+	return nil
+}
+
+func (m *MemDB) GetOrganizationInvitationByTokenHash(tokenHash string) (*OrganizationInvitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, inv := range m.invitations {
+		if inv.TokenHash == tokenHash {
+			return inv, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MemDB) ListOrganizationInvitations(orgID int64) ([]*OrganizationInvitation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invitations := []*OrganizationInvitation{}
+	for _, inv := range m.invitations {
+		if inv.OrganizationID == orgID {
+			invitations = append(invitations, inv)
+		}
+	}
+	sort.Slice(invitations, func(i, j int) bool { return invitations[i].ID < invitations[j].ID })
+	return invitations, nil
+}
+
+func (m *MemDB) DeleteOrganizationInvitation(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.invitations[id]; !ok {
+		return errors.New("not found")
+	}
+	delete(m.invitations, id)
+	return nil
+}
+
+func (m *MemDB) MarkOrganizationInvitationAccepted(id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inv, ok := m.invitations[id]
+	if !ok {
+		return false, errors.New("not found")
+	}
+	if inv.AcceptedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	inv.AcceptedAt = &now
+	return true, nil
+}
+
+func (m *MemDB) CreateAuditEvent(e *AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.ID = m.nextID()
+	e.CreatedAt = time.Now()
+	stored := *e
+	m.audit = append(m.audit, &stored)
+	return nil
+}
+
+func (m *MemDB) ListAuditEvents(filter AuditEventFilter) ([]*AuditEvent, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []*AuditEvent{}
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		e := m.audit[i]
+		if filter.ApplicationID != nil && (e.ApplicationID == nil || *e.ApplicationID != *filter.ApplicationID) {
+			continue
+		}
+		if filter.UserID != nil && (e.UserID == nil || *e.UserID != *filter.UserID) {
+			continue
+		}
+		if filter.Action != "" && e.Action != filter.Action {
+			continue
+		}
+		events = append(events, e)
+	}
+	total := len(events)
+	if filter.Offset >= len(events) {
+		return []*AuditEvent{}, total, nil
+	}
+	events = events[filter.Offset:]
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, total, nil
+}
+
+func (m *MemDB) CreateLoginEvent(e *LoginEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.ID = m.nextID()
+	e.CreatedAt = time.Now()
+	stored := *e
+	stored.RiskReasons = append([]string(nil), e.RiskReasons...)
+	m.logins = append(m.logins, &stored)
+	return nil
+}
+
+func (m *MemDB) ListLoginEvents(filter LoginEventFilter) ([]*LoginEvent, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []*LoginEvent{}
+	for i := len(m.logins) - 1; i >= 0; i-- {
+		e := m.logins[i]
+		if (filter.UserID != 0 && e.UserID != filter.UserID) || e.CreatedAt.Before(filter.Since) {
+			continue
+		}
+		copied := *e
+		events = append(events, &copied)
+	}
+	total := len(events)
+	if filter.Offset >= len(events) {
+		return []*LoginEvent{}, total, nil
+	}
+	events = events[filter.Offset:]
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, total, nil
+}
+
+func (m *MemDB) CompleteLoginEvent(id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.logins {
+		if e.ID == id && e.Outcome == loginChallenged {
+			e.Outcome = loginSucceeded
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemDB) RecordMFAChallenge(id string, expiresAt int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	for used, exp := range m.challenges {
+		if exp < now {
+			delete(m.challenges, used)
+		}
+	}
+	if _, ok := m.challenges[id]; ok {
+		return false, nil
+	}
+	m.challenges[id] = expiresAt
+	return true, nil
+}
+
+// SQLite DB
+type SQLiteDB struct {
+	db   *sql.DB
+	path string
+}
+
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	d, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLiteDB{db: d, path: path}
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteDB) Init() error {
+	if err := s.migrateLegacyUsers(); err != nil {
+		return err
+	}
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL, password TEXT, application_id INTEGER, namespace_id INTEGER NOT NULL DEFAULT 0, created_at TEXT, UNIQUE(namespace_id, email));`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (token TEXT PRIMARY KEY, user_id INTEGER, application_id INTEGER, expires_at INTEGER, revoked INTEGER DEFAULT 0, created_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS applications (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, domain TEXT NOT NULL, api_key_hash TEXT UNIQUE NOT NULL, api_key_prefix TEXT NOT NULL, rate_limit_per_minute INTEGER DEFAULT 100, allowed_origins TEXT, isolated_users INTEGER DEFAULT 0, active INTEGER DEFAULT 1, created_at TEXT, updated_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS scopes (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE NOT NULL, description TEXT, created_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS application_scopes (application_id INTEGER NOT NULL, scope_id INTEGER NOT NULL, PRIMARY KEY (application_id, scope_id));`,
+		`CREATE INDEX IF NOT EXISTS idx_applications_api_key_prefix ON applications(api_key_prefix);`,
+		`CREATE TABLE IF NOT EXISTS organizations (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, application_id INTEGER, created_at TEXT, updated_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS organization_members (organization_id INTEGER NOT NULL, user_id INTEGER NOT NULL, role TEXT NOT NULL, created_at TEXT, PRIMARY KEY (organization_id, user_id));`,
+		`CREATE TABLE IF NOT EXISTS organization_invitations (id INTEGER PRIMARY KEY AUTOINCREMENT, organization_id INTEGER NOT NULL, email TEXT NOT NULL, role TEXT NOT NULL, token_hash TEXT UNIQUE NOT NULL, expires_at INTEGER NOT NULL, accepted_at TEXT, created_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS roles (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE NOT NULL, description TEXT, created_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS role_scopes (role_id INTEGER NOT NULL, scope_id INTEGER NOT NULL, PRIMARY KEY (role_id, scope_id));`,
+		`CREATE TABLE IF NOT EXISTS user_roles (user_id INTEGER NOT NULL, role_id INTEGER NOT NULL, application_id INTEGER, created_at TEXT);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_user_roles_unique ON user_roles(user_id, role_id, COALESCE(application_id, 0));`,
+		`CREATE TABLE IF NOT EXISTS api_keys (id INTEGER PRIMARY KEY AUTOINCREMENT, application_id INTEGER NOT NULL, label TEXT NOT NULL DEFAULT '', key_hash TEXT UNIQUE NOT NULL, key_prefix TEXT NOT NULL, created_at TEXT, last_used_at TEXT, expires_at TEXT, revoked_at TEXT);`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_key_prefix ON api_keys(key_prefix);`,
+		`CREATE TABLE IF NOT EXISTS password_resets (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, token_hash TEXT UNIQUE NOT NULL, expires_at INTEGER NOT NULL, used_at TEXT, created_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS audit_events (id INTEGER PRIMARY KEY AUTOINCREMENT, application_id INTEGER, user_id INTEGER, action TEXT NOT NULL, ip TEXT NOT NULL DEFAULT '', details TEXT, created_at TEXT);`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_application_id ON audit_events(application_id);`,
+		`CREATE TABLE IF NOT EXISTS login_events (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, application_id INTEGER, outcome TEXT NOT NULL, ip TEXT NOT NULL DEFAULT '', user_agent TEXT NOT NULL DEFAULT '', device_id TEXT NOT NULL DEFAULT '', country TEXT NOT NULL DEFAULT '', city TEXT NOT NULL DEFAULT '', latitude REAL, longitude REAL, risk_score INTEGER NOT NULL DEFAULT 0, risk_level TEXT NOT NULL DEFAULT '', risk_reasons TEXT, created_at TEXT);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_events_user_id ON login_events(user_id, created_at);`,
+		`CREATE TABLE IF NOT EXISTS mfa_challenges (id TEXT PRIMARY KEY, expires_at INTEGER NOT NULL);`,
+		`CREATE TABLE IF NOT EXISTS consents (user_id INTEGER NOT NULL, application_id INTEGER NOT NULL, scopes TEXT, created_at TEXT, updated_at TEXT, PRIMARY KEY (user_id, application_id));`,
+		`CREATE TABLE IF NOT EXISTS identity_providers (id INTEGER PRIMARY KEY AUTOINCREMENT, application_id INTEGER, name TEXT UNIQUE NOT NULL, display_name TEXT NOT NULL DEFAULT '', issuer TEXT NOT NULL, client_id TEXT NOT NULL, client_secret TEXT NOT NULL DEFAULT '', scopes TEXT, claim_mapping TEXT, active INTEGER NOT NULL DEFAULT 1, created_at TEXT, updated_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS user_identities (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, provider_id INTEGER NOT NULL, subject TEXT NOT NULL, email TEXT NOT NULL DEFAULT '', created_at TEXT, UNIQUE(provider_id, subject));`,
+		`CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);`,
+		`CREATE TABLE IF NOT EXISTS saml_connections (id INTEGER PRIMARY KEY AUTOINCREMENT, application_id INTEGER NOT NULL, organization_id INTEGER, name TEXT UNIQUE NOT NULL, idp_entity_id TEXT NOT NULL, idp_sso_url TEXT NOT NULL, idp_certificate TEXT NOT NULL, email_attribute TEXT NOT NULL DEFAULT '', domains TEXT, sp_private_key TEXT NOT NULL, sp_certificate TEXT NOT NULL, active INTEGER NOT NULL DEFAULT 1, created_at TEXT, updated_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS saml_requests (id TEXT PRIMARY KEY, connection_id INTEGER NOT NULL, request TEXT NOT NULL, expires_at INTEGER NOT NULL, created_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS saml_assertions (connection_id INTEGER NOT NULL, assertion_id TEXT NOT NULL, expires_at INTEGER NOT NULL, PRIMARY KEY (connection_id, assertion_id));`,
+		`CREATE TABLE IF NOT EXISTS saml_users (connection_id INTEGER NOT NULL, user_id INTEGER NOT NULL, PRIMARY KEY (connection_id, user_id));`,
+		`CREATE INDEX IF NOT EXISTS idx_saml_users_user_id ON saml_users(user_id);`,
+		`CREATE TABLE IF NOT EXISTS ldap_directories (application_id INTEGER PRIMARY KEY, url TEXT NOT NULL, start_tls INTEGER NOT NULL DEFAULT 0, ca_certificate TEXT NOT NULL DEFAULT '', bind_dn TEXT NOT NULL DEFAULT '', bind_password TEXT NOT NULL DEFAULT '', search_base TEXT NOT NULL, search_filter TEXT NOT NULL, attribute_mapping TEXT, active INTEGER NOT NULL DEFAULT 1, created_at TEXT, updated_at TEXT);`,
+		`CREATE TABLE IF NOT EXISTS directory_accounts (application_id INTEGER NOT NULL, user_id INTEGER NOT NULL, dn TEXT NOT NULL, claims TEXT, updated_at TEXT, PRIMARY KEY (application_id, dn), UNIQUE (application_id, user_id));`,
+		`CREATE TABLE IF NOT EXISTS scim_resources (application_id INTEGER NOT NULL, resource_type TEXT NOT NULL, resource_id INTEGER NOT NULL, external_id TEXT NOT NULL DEFAULT '', attributes TEXT, created_at TEXT, updated_at TEXT, PRIMARY KEY (application_id, resource_type, resource_id));`,
+		`CREATE TABLE IF NOT EXISTS authorization_codes (id INTEGER PRIMARY KEY AUTOINCREMENT, code_hash TEXT UNIQUE NOT NULL, application_id INTEGER NOT NULL, user_id INTEGER NOT NULL, redirect_uri TEXT NOT NULL, scopes TEXT, code_challenge TEXT NOT NULL DEFAULT '', expires_at INTEGER NOT NULL, used_at TEXT, created_at TEXT);`,
+		// Applications created before api_keys existed keep authenticating with their original key
+		`INSERT INTO api_keys(application_id,label,key_hash,key_prefix,created_at) SELECT id,'default',api_key_hash,api_key_prefix,created_at FROM applications a WHERE NOT EXISTS (SELECT 1 FROM api_keys k WHERE k.application_id = a.id);`,
+	}
+	for _, q := range queries {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	for _, scope := range defaultScopes {
+		if _, err := s.db.Exec(`INSERT OR IGNORE INTO scopes(name,description,created_at) VALUES(?,?,datetime('now'))`, scope.Name, scope.Description); err != nil {
+			return err
+		}
+	}
+	// Columns added after the initial schema; CREATE TABLE IF NOT EXISTS leaves existing tables untouched
+	columns := []struct{ table, column, decl string }{
+		{"refresh_tokens", "organization_id", "INTEGER"},
+		{"api_keys", "lookup_hash", "TEXT"},
+		{"api_keys", "operations", "TEXT"},
+		{"applications", "ip_allowlist", "TEXT"},
+		{"applications", "ip_denylist", "TEXT"},
+		{"applications", "session_cookie", "TEXT DEFAULT ''"},
+		{"applications", "branding", "TEXT"},
+		{"applications", "redirect_uris", "TEXT"},
+		{"applications", "client_type", "TEXT DEFAULT 'confidential'"},
+		{"users", "totp_secret", "TEXT DEFAULT ''"},
+		{"users", "disabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"refresh_tokens", "auth_time", "INTEGER NOT NULL DEFAULT 0"},
+		{"refresh_tokens", "amr", "TEXT"},
+		{"authorization_codes", "auth_time", "INTEGER NOT NULL DEFAULT 0"},
+		{"authorization_codes", "amr", "TEXT"},
+	}
+	for _, c := range columns {
+		if err := s.ensureColumn(c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+	indexes := []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_lookup_hash ON api_keys(lookup_hash)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_scim_resources_external_id ON scim_resources(application_id, resource_type, external_id) WHERE external_id <> ''`,
+	}
+	for _, q := range indexes {
+		if _, err := s.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds a column to an existing table if it is missing
+func (s *SQLiteDB) ensureColumn(table, column, decl string) error {
+	rows, err := s.db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+	return err
+}
+
+// migrateLegacyUsers rebuilds a users table created with a global UNIQUE(email)
+// constraint so that uniqueness is scoped to (namespace_id, email) instead.
+func (s *SQLiteDB) migrateLegacyUsers() error {
+	var ddl string
+	err := s.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'`).Scan(&ddl)
+	if err == sql.ErrNoRows || strings.Contains(ddl, "namespace_id") {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	queries := []string{
+		`ALTER TABLE users RENAME TO users_legacy;`,
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL, password TEXT, application_id INTEGER, namespace_id INTEGER NOT NULL DEFAULT 0, created_at TEXT, UNIQUE(namespace_id, email));`,
+		`INSERT INTO users(id,email,password,application_id,namespace_id,created_at) SELECT id,email,password,application_id,0,created_at FROM users_legacy;`,
+		`DROP TABLE users_legacy;`,
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Enterprise features for SQLite DB
+const sqliteApplicationColumns = `id,name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,allowed_origins,ip_allowlist,ip_denylist,session_cookie,branding,redirect_uris,client_type,isolated_users,active,created_at,updated_at`
+
+// scanSQLiteApplication scans a row selected with sqliteApplicationColumns
+func scanSQLiteApplication(row interface{ Scan(...interface{}) error }) (*Application, error) {
+	var app Application
+	var origins, allowlist, denylist, sessionCookie, branding, redirectURIs, clientType sql.NullString
+	var isolated, active int
+	var createdAt, updatedAt string
+	if err := row.Scan(&app.ID, &app.Name, &app.Domain, &app.APIKeyHash, &app.APIKeyPrefix, &app.RateLimitPerMinute, &origins, &allowlist, &denylist, &sessionCookie, &branding, &redirectURIs, &clientType, &isolated, &active, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	for _, list := range []struct {
+		raw sql.NullString
+		dst *[]string
+	}{{origins, &app.AllowedOrigins}, {allowlist, &app.IPAllowlist}, {denylist, &app.IPDenylist}, {redirectURIs, &app.RedirectURIs}} {
+		if list.raw.Valid && list.raw.String != "" {
+			if err := json.Unmarshal([]byte(list.raw.String), list.dst); err != nil {
+				return nil, err
+			}
+		}
+	}
+	app.SessionCookie = sessionCookie.String
+	app.ClientType = clientType.String
+	if branding.Valid && branding.String != "" {
+		if err := json.Unmarshal([]byte(branding.String), &app.Branding); err != nil {
+			return nil, err
+		}
+	}
+	app.IsolatedUsers = isolated != 0
+	app.Active = active != 0
+	app.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	app.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &app, nil
+}
+
+func (s *SQLiteDB) GetApplicationByID(id int64) (*Application, error) {
+	app, err := scanSQLiteApplication(s.db.QueryRow(`SELECT `+sqliteApplicationColumns+` FROM applications WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return app, err
+}
+
+func (s *SQLiteDB) CreateApplication(name, domain string, key *APIKey, rateLimit int, origins []string, isolatedUsers bool) (*Application, error) {
+	encoded, err := json.Marshal(origins)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO applications(name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,allowed_origins,isolated_users,created_at,updated_at) VALUES(?,?,?,?,?,?,?,datetime('now'),datetime('now'))`, name, domain, key.KeyHash, key.KeyPrefix, rateLimit, string(encoded), isolatedUsers)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	key.ApplicationID = id
+	if key.Label == "" {
+		key.Label = defaultAPIKeyLabel
+	}
+	if err := insertSQLiteAPIKey(tx, key); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &Application{ID: id, Name: name, Domain: domain, APIKeyHash: key.KeyHash, APIKeyPrefix: key.KeyPrefix, RateLimitPerMinute: rateLimit, AllowedOrigins: origins, IsolatedUsers: isolatedUsers, Active: true, CreatedAt: key.CreatedAt, UpdatedAt: key.CreatedAt}, nil
+}
+
+func (s *SQLiteDB) ListApplications(filter ApplicationFilter) ([]*Application, int, error) {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if filter.Active != nil {
+		where += ` AND active = ?`
+		args = append(args, *filter.Active)
+	}
+	if filter.Domain != "" {
+		where += ` AND lower(domain) = lower(?)`
+		args = append(args, filter.Domain)
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM applications`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT `+sqliteApplicationColumns+` FROM applications`+where+` ORDER BY id LIMIT ? OFFSET ?`, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	apps := []*Application{}
+	for rows.Next() {
+		app, err := scanSQLiteApplication(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		apps = append(apps, app)
+	}
+	return apps, total, rows.Err()
+}
+
+func (s *SQLiteDB) UpdateApplication(app *Application) error {
+	var encoded [4][]byte
+	for i, list := range [][]string{app.AllowedOrigins, app.IPAllowlist, app.IPDenylist, app.RedirectURIs} {
+		b, err := json.Marshal(list)
+		if err != nil {
+			return err
+		}
+		encoded[i] = b
+	}
+	branding, err := json.Marshal(app.Branding)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE applications SET name = ?, domain = ?, rate_limit_per_minute = ?, allowed_origins = ?, ip_allowlist = ?, ip_denylist = ?, session_cookie = ?, branding = ?, redirect_uris = ?, client_type = ?, active = ?, updated_at = datetime('now') WHERE id = ?`, app.Name, app.Domain, app.RateLimitPerMinute, string(encoded[0]), string(encoded[1]), string(encoded[2]), app.SessionCookie, string(branding), string(encoded[3]), app.ClientType, app.Active, app.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) DeleteApplication(id int64, reassignTo *int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var isolated bool
+	if err := tx.QueryRow(`SELECT isolated_users FROM applications WHERE id = ?`, id).Scan(&isolated); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("not found")
+		}
+		return err
+	}
+
+	var queries []string
+	if reassignTo != nil {
+		var targetNS int64
+		err := tx.QueryRow(`SELECT CASE WHEN isolated_users THEN id ELSE 0 END FROM applications WHERE id = ? AND id <> ?`, *reassignTo, id).Scan(&targetNS)
+		if err == sql.ErrNoRows {
+			return errors.New("target application not found")
+		}
+		if err != nil {
+			return err
+		}
+		if isolated {
+			var conflicts int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM users u JOIN users t ON t.email = u.email AND t.namespace_id = ? WHERE u.namespace_id = ?`, targetNS, id).Scan(&conflicts); err != nil {
+				return err
+			}
+			if conflicts > 0 {
+				return errNamespaceConflict
+			}
+			if _, err := tx.Exec(`UPDATE users SET namespace_id = ? WHERE namespace_id = ?`, targetNS, id); err != nil {
+				return err
+			}
+		}
+		for _, q := range []string{
+			`UPDATE users SET application_id = ? WHERE application_id = ?`,
+			`UPDATE refresh_tokens SET application_id = ? WHERE application_id = ?`,
+			`UPDATE organizations SET application_id = ? WHERE application_id = ?`,
+			`UPDATE identity_providers SET application_id = ? WHERE application_id = ?`,
+			`UPDATE saml_connections SET application_id = ? WHERE application_id = ?`,
+		} {
+			if _, err := tx.Exec(q, *reassignTo, id); err != nil {
+				return err
+			}
+		}
+	} else {
+		if isolated {
+			queries = append(queries,
+				`DELETE FROM refresh_tokens WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM organization_members WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM user_roles WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM password_resets WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM authorization_codes WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM consents WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM user_identities WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM saml_users WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM directory_accounts WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM login_events WHERE user_id IN (SELECT id FROM users WHERE namespace_id = ?)`,
+				`DELETE FROM users WHERE namespace_id = ?`,
+			)
+		}
+		queries = append(queries,
+			`UPDATE users SET application_id = NULL WHERE application_id = ?`,
+			`DELETE FROM refresh_tokens WHERE application_id = ?`,
+			`DELETE FROM organization_members WHERE organization_id IN (SELECT id FROM organizations WHERE application_id = ?)`,
+			`DELETE FROM organization_invitations WHERE organization_id IN (SELECT id FROM organizations WHERE application_id = ?)`,
+			`UPDATE refresh_tokens SET organization_id = NULL WHERE organization_id IN (SELECT id FROM organizations WHERE application_id = ?)`,
+			`DELETE FROM organizations WHERE application_id = ?`,
+			`DELETE FROM saml_requests WHERE connection_id IN (SELECT id FROM saml_connections WHERE application_id = ?)`,
+			`DELETE FROM saml_assertions WHERE connection_id IN (SELECT id FROM saml_connections WHERE application_id = ?)`,
+			`DELETE FROM saml_users WHERE connection_id IN (SELECT id FROM saml_connections WHERE application_id = ?)`,
+			`DELETE FROM saml_connections WHERE application_id = ?`,
+			`DELETE FROM user_identities WHERE provider_id IN (SELECT id FROM identity_providers WHERE application_id = ?)`,
+			`DELETE FROM identity_providers WHERE application_id = ?`,
+		)
+	}
+	queries = append(queries,
+		`DELETE FROM consents WHERE application_id = ?`,
+		`DELETE FROM authorization_codes WHERE application_id = ?`,
+		`DELETE FROM user_roles WHERE application_id = ?`,
+		`DELETE FROM application_scopes WHERE application_id = ?`,
+		`DELETE FROM directory_accounts WHERE application_id = ?`,
+		`DELETE FROM ldap_directories WHERE application_id = ?`,
+		`DELETE FROM scim_resources WHERE application_id = ?`,
+		`DELETE FROM api_keys WHERE application_id = ?`,
+		`DELETE FROM applications WHERE id = ?`,
+	)
+	for _, q := range queries {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const sqliteAPIKeyColumns = `id,application_id,label,key_hash,COALESCE(lookup_hash,''),key_prefix,operations,created_at,last_used_at,expires_at,revoked_at`
+
+// scanSQLiteAPIKey scans a row selected with sqliteAPIKeyColumns
+func scanSQLiteAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	var createdAt string
+	var operations, lastUsedAt, expiresAt, revokedAt sql.NullString
+	if err := row.Scan(&k.ID, &k.ApplicationID, &k.Label, &k.KeyHash, &k.LookupHash, &k.KeyPrefix, &operations, &createdAt, &lastUsedAt, &expiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	if operations.Valid && operations.String != "" {
+		if err := json.Unmarshal([]byte(operations.String), &k.Operations); err != nil {
+			return nil, err
+		}
+	}
+	k.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	k.LastUsedAt = parseSQLiteTime(lastUsedAt)
+	k.ExpiresAt = parseSQLiteTime(expiresAt)
+	k.RevokedAt = parseSQLiteTime(revokedAt)
+	return &k, nil
+}
+
+// parseSQLiteTime converts a nullable timestamp column
+func parseSQLiteTime(v sql.NullString) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t, err := time.Parse(sqliteTimeLayout, v.String)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// nullString stores empty strings as NULL so they stay out of unique indexes
+func nullString(v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	return v
+}
+
+// formatSQLiteTime formats an optional time for storage
+func formatSQLiteTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func (s *SQLiteDB) queryAPIKeys(query string, args ...interface{}) ([]*APIKey, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteDB) CreateAPIKey(k *APIKey) error {
+	return insertSQLiteAPIKey(s.db, k)
+}
+
+func insertSQLiteAPIKey(exec interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, k *APIKey) error {
+	operations, err := json.Marshal(k.Operations)
+	if err != nil {
+		return err
+	}
+	k.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	res, err := exec.Exec(`INSERT INTO api_keys(application_id,label,key_hash,lookup_hash,key_prefix,operations,created_at,expires_at) VALUES(?,?,?,?,?,?,?,?)`, k.ApplicationID, k.Label, k.KeyHash, nullString(k.LookupHash), k.KeyPrefix, string(operations), k.CreatedAt.Format(sqliteTimeLayout), formatSQLiteTime(k.ExpiresAt))
+	if err != nil {
+		return err
+	}
+	k.ID, _ = res.LastInsertId()
+	return nil
+}
+
+func (s *SQLiteDB) GetAPIKeysByPrefix(prefix string) ([]*APIKey, error) {
+	return s.queryAPIKeys(`SELECT `+sqliteAPIKeyColumns+` FROM api_keys WHERE key_prefix = ? AND revoked_at IS NULL`, prefix)
+}
+
+func (s *SQLiteDB) GetAPIKeyByLookupHash(lookupHash string) (*APIKey, error) {
+	k, err := scanSQLiteAPIKey(s.db.QueryRow(`SELECT `+sqliteAPIKeyColumns+` FROM api_keys WHERE lookup_hash = ? AND revoked_at IS NULL`, lookupHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+func (s *SQLiteDB) SetAPIKeyLookupHash(id int64, lookupHash string) error {
+	_, err := s.db.Exec(`UPDATE api_keys SET lookup_hash = ? WHERE id = ?`, lookupHash, id)
+	return err
+}
+
+func (s *SQLiteDB) SetAPIKeyOperations(applicationID, keyID int64, operations []string) error {
+	encoded, err := json.Marshal(operations)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE api_keys SET operations = ? WHERE id = ? AND application_id = ?`, string(encoded), keyID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) ListAPIKeys(applicationID int64) ([]*APIKey, error) {
+	return s.queryAPIKeys(`SELECT `+sqliteAPIKeyColumns+` FROM api_keys WHERE application_id = ? ORDER BY id`, applicationID)
+}
+
+func (s *SQLiteDB) RotateAPIKeys(newKey *APIKey, oldKeysExpireAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	expiresAt := oldKeysExpireAt.UTC().Format(sqliteTimeLayout)
+	if _, err := tx.Exec(`UPDATE api_keys SET expires_at = ? WHERE application_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)`, expiresAt, newKey.ApplicationID, expiresAt); err != nil {
+		return err
+	}
+	if err := insertSQLiteAPIKey(tx, newKey); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) RevokeAPIKey(applicationID, keyID int64) error {
+	res, err := s.db.Exec(`UPDATE api_keys SET revoked_at = datetime('now') WHERE id = ? AND application_id = ? AND revoked_at IS NULL`, keyID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) TouchAPIKey(id int64, usedAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, usedAt.UTC().Format(sqliteTimeLayout), id)
+	return err
+}
+
+func (s *SQLiteDB) GetScopesByApplicationID(applicationID int64) ([]*Scope, error) {
+	rows, err := s.db.Query(`SELECT s.id,s.name,s.description,s.created_at FROM scopes s JOIN application_scopes aps ON s.id = aps.scope_id WHERE aps.application_id = ?`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var scopes []*Scope
+	for rows.Next() {
+		var scope Scope
+		var createdAt string
+		if err := rows.Scan(&scope.ID, &scope.Name, &scope.Description, &createdAt); err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, &scope)
+	}
+	return scopes, nil
+}
+
+func (s *SQLiteDB) SetApplicationScopes(applicationID int64, scopeIDs []int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM application_scopes WHERE application_id = ?`, applicationID); err != nil {
+		return err
+	}
+	for _, scopeID := range scopeIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO application_scopes(application_id,scope_id) VALUES(?,?)`, applicationID, scopeID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) GetScopeByName(name string) (*Scope, error) {
+	row := s.db.QueryRow(`SELECT id,name,description,created_at FROM scopes WHERE name = ?`, name)
+	var scope Scope
+	var createdAt string
+	if err := row.Scan(&scope.ID, &scope.Name, &scope.Description, &createdAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &scope, nil
+}
+
+func (s *SQLiteDB) ListScopes() ([]*Scope, error) {
+	rows, err := s.db.Query(`SELECT id,name,description,created_at FROM scopes ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scopes := []*Scope{}
+	for rows.Next() {
+		var scope Scope
+		var description sql.NullString
+		var createdAt string
+		if err := rows.Scan(&scope.ID, &scope.Name, &description, &createdAt); err != nil {
+			return nil, err
+		}
+		scope.Description = description.String
+		scope.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+		scopes = append(scopes, &scope)
+	}
+	return scopes, rows.Err()
+}
+
+func (s *SQLiteDB) CreateScope(name, description string) (*Scope, error) {
+	res, err := s.db.Exec(`INSERT INTO scopes(name,description,created_at) VALUES(?,?,datetime('now'))`, name, description)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &Scope{ID: id, Name: name, Description: description, CreatedAt: time.Now()}, nil
+}
+
+// Roles for SQLite DB
+func (s *SQLiteDB) CreateRole(name, description string) (*Role, error) {
+	res, err := s.db.Exec(`INSERT INTO roles(name,description,created_at) VALUES(?,?,datetime('now'))`, name, description)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &Role{ID: id, Name: name, Description: description, Scopes: []string{}, CreatedAt: time.Now()}, nil
+}
+
+// roleScopes returns the scope names bundled in a role
+func (s *SQLiteDB) roleScopes(roleID int64) ([]string, error) {
+	rows, err := s.db.Query(`SELECT sc.name FROM scopes sc JOIN role_scopes rs ON sc.id = rs.scope_id WHERE rs.role_id = ? ORDER BY sc.name`, roleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scopes := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, name)
+	}
+	return scopes, rows.Err()
+}
+
+func (s *SQLiteDB) GetRoleByID(id int64) (*Role, error) {
+	var role Role
+	var description sql.NullString
+	var createdAt string
+	err := s.db.QueryRow(`SELECT id,name,description,created_at FROM roles WHERE id = ?`, id).Scan(&role.ID, &role.Name, &description, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	role.Description = description.String
+	role.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	if role.Scopes, err = s.roleScopes(role.ID); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func (s *SQLiteDB) ListRoles() ([]*Role, error) {
+	rows, err := s.db.Query(`SELECT id FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	roles := []*Role{}
+	for _, id := range ids {
+		role, err := s.GetRoleByID(id)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+func (s *SQLiteDB) DeleteRole(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM roles WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	if _, err := tx.Exec(`DELETE FROM role_scopes WHERE role_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE role_id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) SetRoleScopes(roleID int64, scopeIDs []int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM role_scopes WHERE role_id = ?`, roleID); err != nil {
+		return err
+	}
+	for _, scopeID := range scopeIDs {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO role_scopes(role_id,scope_id) VALUES(?,?)`, roleID, scopeID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) AssignUserRole(userID, roleID int64, applicationID *int64) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO user_roles(user_id,role_id,application_id,created_at) VALUES(?,?,?,datetime('now'))`, userID, roleID, applicationID)
+	return err
+}
+
+func (s *SQLiteDB) RemoveUserRole(userID, roleID int64, applicationID *int64) error {
+	res, err := s.db.Exec(`DELETE FROM user_roles WHERE user_id = ? AND role_id = ? AND COALESCE(application_id, 0) = COALESCE(?, 0)`, userID, roleID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) ListUserRoles(userID int64) ([]*UserRole, error) {
+	rows, err := s.db.Query(`SELECT ur.user_id,ur.role_id,r.name,ur.application_id,ur.created_at FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = ? ORDER BY r.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*UserRole{}
+	for rows.Next() {
+		var ur UserRole
+		var appID sql.NullInt64
+		var createdAt string
+		if err := rows.Scan(&ur.UserID, &ur.RoleID, &ur.RoleName, &appID, &createdAt); err != nil {
+			return nil, err
+		}
+		if appID.Valid {
+			ur.ApplicationID = &appID.Int64
+		}
+		ur.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+		roles = append(roles, &ur)
+	}
+	return roles, rows.Err()
+}
+
+func (s *SQLiteDB) GetUserPermissions(userID int64, applicationID *int64) ([]string, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT sc.name FROM user_roles ur JOIN role_scopes rs ON rs.role_id = ur.role_id JOIN scopes sc ON sc.id = rs.scope_id WHERE ur.user_id = ? AND (ur.application_id IS NULL OR ur.application_id = ?) ORDER BY sc.name`, userID, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	perms := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		perms = append(perms, name)
+	}
+	return perms, rows.Err()
+}
+
+func (s *SQLiteDB) CreateUser(email, password string, applicationID *int64, namespaceID int64) (*User, error) {
+	res, err := s.db.Exec(`INSERT INTO users(email,password,application_id,namespace_id,created_at) VALUES(?,?,?,?,datetime('now'))`, email, password, applicationID, namespaceID)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return &User{ID: id, Email: email, Password: password, ApplicationID: applicationID, NamespaceID: namespaceID}, nil
+}
+
+const sqliteUserColumns = `id,email,password,application_id,namespace_id,totp_secret,disabled,created_at`
+
+// scanSQLiteUser scans a row selected with sqliteUserColumns
+func scanSQLiteUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	var u User
+	var created string
+	var appID sql.NullInt64
+	var totpSecret sql.NullString
+	var disabled int
+	if err := row.Scan(&u.ID, &u.Email, &u.Password, &appID, &u.NamespaceID, &totpSecret, &disabled, &created); err != nil {
+		return nil, err
+	}
+	u.Disabled = disabled != 0
+	if appID.Valid {
+		u.ApplicationID = &appID.Int64
+	}
+	u.TOTPSecret = totpSecret.String
+	u.CreatedAt, _ = time.Parse(sqliteTimeLayout, created)
+	return &u, nil
+}
+
+func (s *SQLiteDB) GetUserByEmail(namespaceID int64, email string) (*User, error) {
+	u, err := scanSQLiteUser(s.db.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE namespace_id = ? AND email = ?`, namespaceID, email))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (s *SQLiteDB) GetUserByID(id int64) (*User, error) {
+	u, err := scanSQLiteUser(s.db.QueryRow(`SELECT `+sqliteUserColumns+` FROM users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (s *SQLiteDB) CreateRefreshToken(t *RefreshToken) error {
+	amr, err := json.Marshal(t.AMR)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO refresh_tokens(token,user_id,application_id,organization_id,expires_at,auth_time,amr,created_at) VALUES(?,?,?,?,?,?,?,datetime('now'))`, t.Token, t.UserID, t.ApplicationID, t.OrganizationID, t.ExpiresAt, t.AuthTime, string(amr))
+	return err
+}
+
+func (s *SQLiteDB) GetRefreshToken(token string) (*RefreshToken, error) {
+	row := s.db.QueryRow(`SELECT token,user_id,application_id,organization_id,expires_at,revoked,auth_time,amr FROM refresh_tokens WHERE token = ?`, token)
+	var t RefreshToken
+	var revoked int
+	var appID, orgID sql.NullInt64
+	var amr sql.NullString
+	if err := row.Scan(&t.Token, &t.UserID, &appID, &orgID, &t.ExpiresAt, &revoked, &t.AuthTime, &amr); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	t.Revoked = revoked != 0
+	if amr.Valid && amr.String != "" {
+		if err := json.Unmarshal([]byte(amr.String), &t.AMR); err != nil {
+			return nil, err
+		}
+	}
+	if appID.Valid {
+		t.ApplicationID = &appID.Int64
+	}
+	if orgID.Valid {
+		t.OrganizationID = &orgID.Int64
+	}
+	return &t, nil
+}
+
+func (s *SQLiteDB) RevokeRefreshToken(token string) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE token = ?`, token)
+	return err
+}
+
+func (s *SQLiteDB) RevokeAllRefreshTokensForUser(userId int64) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userId)
+	return err
+}
+
+func (s *SQLiteDB) ListRefreshTokensForUser(userID int64) ([]*RefreshToken, error) {
+	rows, err := s.db.Query(`SELECT token,user_id,application_id,organization_id,expires_at,created_at FROM refresh_tokens WHERE user_id = ? AND revoked = 0 AND expires_at >= ? ORDER BY created_at DESC, rowid DESC`, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*RefreshToken{}
+	for rows.Next() {
+		var t RefreshToken
+		var appID, orgID sql.NullInt64
+		var createdAt sql.NullString
+		if err := rows.Scan(&t.Token, &t.UserID, &appID, &orgID, &t.ExpiresAt, &createdAt); err != nil {
+			return nil, err
+		}
+		if appID.Valid {
+			t.ApplicationID = &appID.Int64
+		}
+		if orgID.Valid {
+			t.OrganizationID = &orgID.Int64
+		}
+		t.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt.String)
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteApplicationRefreshTokensForUser(userID, applicationID int64) error {
+	_, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE user_id = ? AND application_id = ?`, userID, applicationID)
+	return err
+}
+
+// Organizations for SQLite DB
+func scanSQLiteOrganization(row interface{ Scan(...interface{}) error }) (*Organization, error) {
+	var org Organization
+	var appID sql.NullInt64
+	var createdAt, updatedAt string
+	if err := row.Scan(&org.ID, &org.Name, &appID, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if appID.Valid {
+		org.ApplicationID = &appID.Int64
+	}
+	org.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	org.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &org, nil
+}
+
+func (s *SQLiteDB) CreateOrganization(name string, applicationID *int64) (*Organization, error) {
+	res, err := s.db.Exec(`INSERT INTO organizations(name,application_id,created_at,updated_at) VALUES(?,?,datetime('now'),datetime('now'))`, name, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	return s.GetOrganizationByID(id)
+}
+
+func (s *SQLiteDB) GetOrganizationByID(id int64) (*Organization, error) {
+	org, err := scanSQLiteOrganization(s.db.QueryRow(`SELECT id,name,application_id,created_at,updated_at FROM organizations WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return org, err
+}
+
+func (s *SQLiteDB) ListOrganizations(applicationID *int64) ([]*Organization, error) {
+	rows, err := s.db.Query(`SELECT id,name,application_id,created_at,updated_at FROM organizations WHERE ? IS NULL OR application_id = ? ORDER BY id`, applicationID, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orgs := []*Organization{}
+	for rows.Next() {
+		org, err := scanSQLiteOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+func (s *SQLiteDB) UpdateOrganization(id int64, name string) error {
+	res, err := s.db.Exec(`UPDATE organizations SET name = ?, updated_at = datetime('now') WHERE id = ?`, name, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) DeleteOrganization(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM organizations WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	queries := []string{
+		`DELETE FROM organization_members WHERE organization_id = ?`,
+		`DELETE FROM organization_invitations WHERE organization_id = ?`,
+		`UPDATE refresh_tokens SET organization_id = NULL WHERE organization_id = ?`,
+		`DELETE FROM saml_requests WHERE connection_id IN (SELECT id FROM saml_connections WHERE organization_id = ?)`,
+		`DELETE FROM saml_assertions WHERE connection_id IN (SELECT id FROM saml_connections WHERE organization_id = ?)`,
+		`DELETE FROM saml_users WHERE connection_id IN (SELECT id FROM saml_connections WHERE organization_id = ?)`,
+		`DELETE FROM saml_connections WHERE organization_id = ?`,
+		`DELETE FROM scim_resources WHERE resource_type = 'Group' AND resource_id = ?`,
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) UpsertOrganizationMember(orgID, userID int64, role string) error {
+	_, err := s.db.Exec(`INSERT INTO organization_members(organization_id,user_id,role,created_at) VALUES(?,?,?,datetime('now')) ON CONFLICT(organization_id,user_id) DO UPDATE SET role = excluded.role`, orgID, userID, role)
+	return err
+}
+
+func scanSQLiteOrganizationMember(row interface{ Scan(...interface{}) error }) (*OrganizationMember, error) {
+	var member OrganizationMember
+	var createdAt string
+	if err := row.Scan(&member.OrganizationID, &member.UserID, &member.Role, &createdAt); err != nil {
+		return nil, err
+	}
+	member.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	return &member, nil
+}
+
+func (s *SQLiteDB) GetOrganizationMember(orgID, userID int64) (*OrganizationMember, error) {
+	member, err := scanSQLiteOrganizationMember(s.db.QueryRow(`SELECT organization_id,user_id,role,created_at FROM organization_members WHERE organization_id = ? AND user_id = ?`, orgID, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return member, err
+}
+
+func (s *SQLiteDB) ListOrganizationMembers(orgID int64) ([]*OrganizationMember, error) {
+	rows, err := s.db.Query(`SELECT organization_id,user_id,role,created_at FROM organization_members WHERE organization_id = ? ORDER BY user_id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := []*OrganizationMember{}
+	for rows.Next() {
+		member, err := scanSQLiteOrganizationMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (s *SQLiteDB) RemoveOrganizationMember(orgID, userID int64) error {
+	res, err := s.db.Exec(`DELETE FROM organization_members WHERE organization_id = ? AND user_id = ?`, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) CreateOrganizationInvitation(inv *OrganizationInvitation) error {
+	res, err := s.db.Exec(`INSERT INTO organization_invitations(organization_id,email,role,token_hash,expires_at,created_at) VALUES(?,?,?,?,?,datetime('now'))`, inv.OrganizationID, inv.Email, inv.Role, inv.TokenHash, inv.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	inv.ID, _ = res.LastInsertId()
+	inv.CreatedAt = time.Now()
+	return nil
+}
+
+func scanSQLiteOrganizationInvitation(row interface{ Scan(...interface{}) error }) (*OrganizationInvitation, error) {
+	var inv OrganizationInvitation
+	var acceptedAt sql.NullString
+	var createdAt string
+	if err := row.Scan(&inv.ID, &inv.OrganizationID, &inv.Email, &inv.Role, &inv.TokenHash, &inv.ExpiresAt, &acceptedAt, &createdAt); err != nil {
+		return nil, err
+	}
+	if acceptedAt.Valid {
+		if t, err := time.Parse(sqliteTimeLayout, acceptedAt.String); err == nil {
+			inv.AcceptedAt = &t
+		}
+	}
+	inv.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	return &inv, nil
+}
+
+func (s *SQLiteDB) GetOrganizationInvitationByTokenHash(tokenHash string) (*OrganizationInvitation, error) {
+	inv, err := scanSQLiteOrganizationInvitation(s.db.QueryRow(`SELECT id,organization_id,email,role,token_hash,expires_at,accepted_at,created_at FROM organization_invitations WHERE token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+func (s *SQLiteDB) ListOrganizationInvitations(orgID int64) ([]*OrganizationInvitation, error) {
+	rows, err := s.db.Query(`SELECT id,organization_id,email,role,token_hash,expires_at,accepted_at,created_at FROM organization_invitations WHERE organization_id = ? ORDER BY id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := []*OrganizationInvitation{}
+	for rows.Next() {
+		inv, err := scanSQLiteOrganizationInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteOrganizationInvitation(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM organization_invitations WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) MarkOrganizationInvitationAccepted(id int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE organization_invitations SET accepted_at = datetime('now') WHERE id = ? AND accepted_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLiteDB) UpdateUserPassword(userID int64, passwordHash string) error {
+	res, err := s.db.Exec(`UPDATE users SET password = ? WHERE id = ?`, passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) UpdateUserEmail(userID int64, email string) error {
+	res, err := s.db.Exec(`UPDATE users SET email = ? WHERE id = ?`, email, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) SetUserTOTPSecret(userID int64, secret string) error {
+	res, err := s.db.Exec(`UPDATE users SET totp_secret = ? WHERE id = ?`, secret, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) UseTOTPStep(userID int64, step int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteDB) SetUserDisabled(userID int64, disabled bool) error {
+	res, err := s.db.Exec(`UPDATE users SET disabled = ? WHERE id = ?`, disabled, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// likePrefix turns a prefix into a LIKE pattern matching it literally, with \ as the
+// escape character
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(prefix)) + "%"
+}
+
+// qualifyColumns prefixes every column of a column list with a table alias
+func qualifyColumns(alias, columns string) string {
+	return alias + "." + strings.ReplaceAll(columns, ",", ","+alias+".")
+}
+
+func (s *SQLiteDB) ListUsers(filter UserFilter) ([]*User, int, error) {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if filter.EmailPrefix != "" {
+		where += ` AND lower(email) LIKE ? ESCAPE '\'`
+		args = append(args, likePrefix(filter.EmailPrefix))
+	}
+	if filter.ApplicationID != nil {
+		where += ` AND application_id = ?`
+		args = append(args, *filter.ApplicationID)
+	}
+	if filter.Disabled != nil {
+		where += ` AND disabled = ?`
+		args = append(args, *filter.Disabled)
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := s.db.Query(`SELECT `+sqliteUserColumns+` FROM users`+where+` ORDER BY id LIMIT ? OFFSET ?`, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	users := []*User{}
+	for rows.Next() {
+		u, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteUser(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		`DELETE FROM refresh_tokens WHERE user_id = ?`,
+		`DELETE FROM organization_members WHERE user_id = ?`,
+		`DELETE FROM user_roles WHERE user_id = ?`,
+		`DELETE FROM password_resets WHERE user_id = ?`,
+		`DELETE FROM authorization_codes WHERE user_id = ?`,
+		`DELETE FROM consents WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+		`DELETE FROM saml_users WHERE user_id = ?`,
+		`DELETE FROM directory_accounts WHERE user_id = ?`,
+		`DELETE FROM scim_resources WHERE resource_type = 'User' AND resource_id = ?`,
+		`DELETE FROM login_events WHERE user_id = ?`,
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) CreateAuthorizationCode(c *AuthorizationCode) error {
+	scopes, err := json.Marshal(c.Scopes)
+	if err != nil {
+		return err
+	}
+	amr, err := json.Marshal(c.AMR)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO authorization_codes(code_hash,application_id,user_id,redirect_uri,scopes,code_challenge,auth_time,amr,expires_at,created_at) VALUES(?,?,?,?,?,?,?,?,?,datetime('now'))`, c.CodeHash, c.ApplicationID, c.UserID, c.RedirectURI, string(scopes), c.CodeChallenge, c.AuthTime, string(amr), c.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	c.ID, _ = res.LastInsertId()
+	c.CreatedAt = time.Now()
+	return nil
+}
+
+func (s *SQLiteDB) ConsumeAuthorizationCode(codeHash string) (*AuthorizationCode, error) {
+	res, err := s.db.Exec(`UPDATE authorization_codes SET used_at = datetime('now') WHERE code_hash = ? AND used_at IS NULL`, codeHash)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	var c AuthorizationCode
+	var scopes, amr sql.NullString
+	var usedAt sql.NullString
+	var createdAt string
+	err = s.db.QueryRow(`SELECT id,code_hash,application_id,user_id,redirect_uri,scopes,code_challenge,auth_time,amr,expires_at,used_at,created_at FROM authorization_codes WHERE code_hash = ?`, codeHash).Scan(&c.ID, &c.CodeHash, &c.ApplicationID, &c.UserID, &c.RedirectURI, &scopes, &c.CodeChallenge, &c.AuthTime, &amr, &c.ExpiresAt, &usedAt, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if scopes.Valid && scopes.String != "" {
+		if err := json.Unmarshal([]byte(scopes.String), &c.Scopes); err != nil {
+			return nil, err
+		}
+	}
+	if amr.Valid && amr.String != "" {
+		if err := json.Unmarshal([]byte(amr.String), &c.AMR); err != nil {
+			return nil, err
+		}
+	}
+	c.UsedAt = parseSQLiteTime(usedAt)
+	c.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	return &c, nil
+}
+
+func (s *SQLiteDB) UpsertConsent(userID, applicationID int64, scopes []string) error {
+	encoded, err := json.Marshal(scopes)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO consents(user_id,application_id,scopes,created_at,updated_at) VALUES(?,?,?,datetime('now'),datetime('now')) ON CONFLICT(user_id,application_id) DO UPDATE SET scopes = excluded.scopes, updated_at = excluded.updated_at`, userID, applicationID, string(encoded))
+	return err
+}
+
+func scanSQLiteConsent(row interface{ Scan(...interface{}) error }) (*Consent, error) {
+	var c Consent
+	var scopes sql.NullString
+	var createdAt, updatedAt string
+	if err := row.Scan(&c.UserID, &c.ApplicationID, &scopes, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if scopes.Valid && scopes.String != "" {
+		if err := json.Unmarshal([]byte(scopes.String), &c.Scopes); err != nil {
+			return nil, err
+		}
+	}
+	c.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	c.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &c, nil
+}
+
+func (s *SQLiteDB) GetConsent(userID, applicationID int64) (*Consent, error) {
+	c, err := scanSQLiteConsent(s.db.QueryRow(`SELECT user_id,application_id,scopes,created_at,updated_at FROM consents WHERE user_id = ? AND application_id = ?`, userID, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (s *SQLiteDB) ListConsents(userID int64) ([]*Consent, error) {
+	rows, err := s.db.Query(`SELECT user_id,application_id,scopes,created_at,updated_at FROM consents WHERE user_id = ? ORDER BY application_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	consents := []*Consent{}
+	for rows.Next() {
+		c, err := scanSQLiteConsent(rows)
+		if err != nil {
+			return nil, err
+		}
+		consents = append(consents, c)
+	}
+	return consents, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteConsent(userID, applicationID int64) error {
+	res, err := s.db.Exec(`DELETE FROM consents WHERE user_id = ? AND application_id = ?`, userID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+const sqliteIdentityProviderColumns = `id,application_id,name,display_name,issuer,client_id,client_secret,scopes,claim_mapping,active,created_at,updated_at`
+
+// scanSQLiteIdentityProvider scans a row selected with sqliteIdentityProviderColumns
+func scanSQLiteIdentityProvider(row interface{ Scan(...interface{}) error }) (*IdentityProvider, error) {
+	var p IdentityProvider
+	var appID sql.NullInt64
+	var scopes, mapping sql.NullString
+	var active int
+	var createdAt, updatedAt string
+	if err := row.Scan(&p.ID, &appID, &p.Name, &p.DisplayName, &p.Issuer, &p.ClientID, &p.ClientSecret, &scopes, &mapping, &active, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if appID.Valid {
+		p.ApplicationID = &appID.Int64
+	}
+	if scopes.Valid && scopes.String != "" {
+		if err := json.Unmarshal([]byte(scopes.String), &p.Scopes); err != nil {
+			return nil, err
+		}
+	}
+	if mapping.Valid && mapping.String != "" {
+		if err := json.Unmarshal([]byte(mapping.String), &p.ClaimMapping); err != nil {
+			return nil, err
+		}
+	}
+	p.Active = active != 0
+	p.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	p.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &p, nil
+}
+
+// encodeIdentityProviderLists serializes the JSON columns of a provider
+func encodeIdentityProviderLists(p *IdentityProvider) (scopes, mapping string, err error) {
+	s, err := json.Marshal(p.Scopes)
+	if err != nil {
+		return "", "", err
+	}
+	m, err := json.Marshal(p.ClaimMapping)
+	if err != nil {
+		return "", "", err
+	}
+	return string(s), string(m), nil
+}
+
+func (s *SQLiteDB) CreateIdentityProvider(p *IdentityProvider) error {
+	scopes, mapping, err := encodeIdentityProviderLists(p)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO identity_providers(application_id,name,display_name,issuer,client_id,client_secret,scopes,claim_mapping,active,created_at,updated_at) VALUES(?,?,?,?,?,?,?,?,?,datetime('now'),datetime('now'))`, p.ApplicationID, p.Name, p.DisplayName, p.Issuer, p.ClientID, p.ClientSecret, scopes, mapping, p.Active)
+	if err != nil {
+		return err
+	}
+	p.ID, _ = res.LastInsertId()
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = p.CreatedAt
+	return nil
+}
+
+func (s *SQLiteDB) GetIdentityProviderByID(id int64) (*IdentityProvider, error) {
+	p, err := scanSQLiteIdentityProvider(s.db.QueryRow(`SELECT `+sqliteIdentityProviderColumns+` FROM identity_providers WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+func (s *SQLiteDB) GetIdentityProviderByName(name string) (*IdentityProvider, error) {
+	p, err := scanSQLiteIdentityProvider(s.db.QueryRow(`SELECT `+sqliteIdentityProviderColumns+` FROM identity_providers WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+func (s *SQLiteDB) ListIdentityProviders(applicationID *int64) ([]*IdentityProvider, error) {
+	rows, err := s.db.Query(`SELECT `+sqliteIdentityProviderColumns+` FROM identity_providers WHERE ? IS NULL OR application_id IS NULL OR application_id = ? ORDER BY id`, applicationID, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	providers := []*IdentityProvider{}
+	for rows.Next() {
+		p, err := scanSQLiteIdentityProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, rows.Err()
+}
+
+func (s *SQLiteDB) UpdateIdentityProvider(p *IdentityProvider) error {
+	scopes, mapping, err := encodeIdentityProviderLists(p)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE identity_providers SET application_id = ?, name = ?, display_name = ?, issuer = ?, client_id = ?, client_secret = ?, scopes = ?, claim_mapping = ?, active = ?, updated_at = datetime('now') WHERE id = ?`, p.ApplicationID, p.Name, p.DisplayName, p.Issuer, p.ClientID, p.ClientSecret, scopes, mapping, p.Active, p.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) DeleteIdentityProvider(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM user_identities WHERE provider_id = ?`, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM identity_providers WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) CreateUserIdentity(i *UserIdentity) error {
+	res, err := s.db.Exec(`INSERT INTO user_identities(user_id,provider_id,subject,email,created_at) VALUES(?,?,?,?,datetime('now'))`, i.UserID, i.ProviderID, i.Subject, i.Email)
+	if err != nil {
+		return err
+	}
+	i.ID, _ = res.LastInsertId()
+	i.CreatedAt = time.Now()
+	return nil
+}
+
+func scanSQLiteUserIdentity(row interface{ Scan(...interface{}) error }) (*UserIdentity, error) {
+	var i UserIdentity
+	var createdAt string
+	if err := row.Scan(&i.ID, &i.UserID, &i.ProviderID, &i.Subject, &i.Email, &createdAt); err != nil {
+		return nil, err
+	}
+	i.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	return &i, nil
+}
+
+func (s *SQLiteDB) GetUserIdentity(providerID int64, subject string) (*UserIdentity, error) {
+	i, err := scanSQLiteUserIdentity(s.db.QueryRow(`SELECT id,user_id,provider_id,subject,email,created_at FROM user_identities WHERE provider_id = ? AND subject = ?`, providerID, subject))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return i, err
+}
+
+func (s *SQLiteDB) ListUserIdentities(userID int64) ([]*UserIdentity, error) {
+	rows, err := s.db.Query(`SELECT id,user_id,provider_id,subject,email,created_at FROM user_identities WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	identities := []*UserIdentity{}
+	for rows.Next() {
+		i, err := scanSQLiteUserIdentity(rows)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteUserIdentity(userID, id int64) error {
+	res, err := s.db.Exec(`DELETE FROM user_identities WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+const sqliteSAMLConnectionColumns = `id,application_id,organization_id,name,idp_entity_id,idp_sso_url,idp_certificate,email_attribute,domains,sp_private_key,sp_certificate,active,created_at,updated_at`
+
+// scanSQLiteSAMLConnection scans a row selected with sqliteSAMLConnectionColumns
+func scanSQLiteSAMLConnection(row interface{ Scan(...interface{}) error }) (*SAMLConnection, error) {
+	var c SAMLConnection
+	var orgID sql.NullInt64
+	var domains sql.NullString
+	var active int
+	var createdAt, updatedAt string
+	if err := row.Scan(&c.ID, &c.ApplicationID, &orgID, &c.Name, &c.IdPEntityID, &c.IdPSSOURL, &c.IdPCertificate, &c.EmailAttribute, &domains, &c.SPPrivateKey, &c.SPCertificate, &active, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if orgID.Valid {
+		c.OrganizationID = &orgID.Int64
+	}
+	if domains.Valid && domains.String != "" {
+		if err := json.Unmarshal([]byte(domains.String), &c.Domains); err != nil {
+			return nil, err
+		}
+	}
+	c.Active = active != 0
+	c.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	c.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &c, nil
+}
+
+func (s *SQLiteDB) CreateSAMLConnection(c *SAMLConnection) error {
+	domains, err := json.Marshal(c.Domains)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO saml_connections(application_id,organization_id,name,idp_entity_id,idp_sso_url,idp_certificate,email_attribute,domains,sp_private_key,sp_certificate,active,created_at,updated_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,datetime('now'),datetime('now'))`,
+		c.ApplicationID, c.OrganizationID, c.Name, c.IdPEntityID, c.IdPSSOURL, c.IdPCertificate, c.EmailAttribute, string(domains), c.SPPrivateKey, c.SPCertificate, c.Active)
+	if err != nil {
+		return err
+	}
+	c.ID, _ = res.LastInsertId()
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	return nil
+}
+
+func (s *SQLiteDB) GetSAMLConnectionByID(id int64) (*SAMLConnection, error) {
+	c, err := scanSQLiteSAMLConnection(s.db.QueryRow(`SELECT `+sqliteSAMLConnectionColumns+` FROM saml_connections WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (s *SQLiteDB) GetSAMLConnectionByName(name string) (*SAMLConnection, error) {
+	c, err := scanSQLiteSAMLConnection(s.db.QueryRow(`SELECT `+sqliteSAMLConnectionColumns+` FROM saml_connections WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (s *SQLiteDB) ListSAMLConnections(applicationID *int64) ([]*SAMLConnection, error) {
+	rows, err := s.db.Query(`SELECT `+sqliteSAMLConnectionColumns+` FROM saml_connections WHERE ? IS NULL OR application_id = ? ORDER BY id`, applicationID, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	conns := []*SAMLConnection{}
+	for rows.Next() {
+		c, err := scanSQLiteSAMLConnection(rows)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conns, rows.Err()
+}
+
+func (s *SQLiteDB) UpdateSAMLConnection(c *SAMLConnection) error {
+	domains, err := json.Marshal(c.Domains)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE saml_connections SET organization_id = ?, name = ?, idp_entity_id = ?, idp_sso_url = ?, idp_certificate = ?, email_attribute = ?, domains = ?, active = ?, updated_at = datetime('now') WHERE id = ?`,
+		c.OrganizationID, c.Name, c.IdPEntityID, c.IdPSSOURL, c.IdPCertificate, c.EmailAttribute, string(domains), c.Active, c.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) DeleteSAMLConnection(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		`DELETE FROM saml_requests WHERE connection_id = ?`,
+		`DELETE FROM saml_assertions WHERE connection_id = ?`,
+		`DELETE FROM saml_users WHERE connection_id = ?`,
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			return err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM saml_connections WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) CreateSAMLRequest(r *SAMLRequest) error {
+	if _, err := s.db.Exec(`DELETE FROM saml_requests WHERE expires_at < ?`, time.Now().Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO saml_requests(id,connection_id,request,expires_at,created_at) VALUES(?,?,?,?,datetime('now'))`, r.ID, r.ConnectionID, r.Request, r.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	r.CreatedAt = time.Now()
+	return nil
+}
+
+func (s *SQLiteDB) ConsumeSAMLRequest(id string) (*SAMLRequest, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var r SAMLRequest
+	var createdAt string
+	err = tx.QueryRow(`SELECT id,connection_id,request,expires_at,created_at FROM saml_requests WHERE id = ?`, id).Scan(&r.ID, &r.ConnectionID, &r.Request, &r.ExpiresAt, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM saml_requests WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	r.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	return &r, tx.Commit()
+}
+
+func (s *SQLiteDB) RecordSAMLAssertion(connectionID int64, assertionID string, expiresAt int64) (bool, error) {
+	if _, err := s.db.Exec(`DELETE FROM saml_assertions WHERE expires_at < ?`, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec(`INSERT INTO saml_assertions(connection_id,assertion_id,expires_at) VALUES(?,?,?) ON CONFLICT DO NOTHING`, connectionID, assertionID, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (s *SQLiteDB) BindSAMLUser(connectionID, userID int64) error {
+	_, err := s.db.Exec(`INSERT INTO saml_users(connection_id,user_id) VALUES(?,?) ON CONFLICT DO NOTHING`, connectionID, userID)
+	return err
+}
+
+func (s *SQLiteDB) SAMLUserBound(connectionID, userID int64) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM saml_users WHERE connection_id = ? AND user_id = ?`, connectionID, userID).Scan(&n)
+	return n > 0, err
+}
+
+const sqliteLDAPDirectoryColumns = `application_id,url,start_tls,ca_certificate,bind_dn,bind_password,search_base,search_filter,attribute_mapping,active,created_at,updated_at`
+
+func (s *SQLiteDB) UpsertLDAPDirectory(d *LDAPDirectory) error {
+	mapping, err := json.Marshal(d.AttributeMapping)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO ldap_directories(`+sqliteLDAPDirectoryColumns+`) VALUES(?,?,?,?,?,?,?,?,?,?,datetime('now'),datetime('now'))
+		ON CONFLICT(application_id) DO UPDATE SET url = excluded.url, start_tls = excluded.start_tls, ca_certificate = excluded.ca_certificate, bind_dn = excluded.bind_dn, bind_password = excluded.bind_password, search_base = excluded.search_base, search_filter = excluded.search_filter, attribute_mapping = excluded.attribute_mapping, active = excluded.active, updated_at = excluded.updated_at`,
+		d.ApplicationID, d.URL, d.StartTLS, d.CACertificate, d.BindDN, d.BindPassword, d.SearchBase, d.SearchFilter, string(mapping), d.Active)
+	if err != nil {
+		return err
+	}
+	stored, err := s.GetLDAPDirectory(d.ApplicationID)
+	if err != nil {
+		return err
+	}
+	d.CreatedAt, d.UpdatedAt = stored.CreatedAt, stored.UpdatedAt
+	return nil
+}
+
+func (s *SQLiteDB) GetLDAPDirectory(applicationID int64) (*LDAPDirectory, error) {
+	var d LDAPDirectory
+	var mapping sql.NullString
+	var startTLS, active int
+	var createdAt, updatedAt string
+	err := s.db.QueryRow(`SELECT `+sqliteLDAPDirectoryColumns+` FROM ldap_directories WHERE application_id = ?`, applicationID).
+		Scan(&d.ApplicationID, &d.URL, &startTLS, &d.CACertificate, &d.BindDN, &d.BindPassword, &d.SearchBase, &d.SearchFilter, &mapping, &active, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Valid && mapping.String != "" {
+		if err := json.Unmarshal([]byte(mapping.String), &d.AttributeMapping); err != nil {
+			return nil, err
+		}
+	}
+	d.StartTLS = startTLS != 0
+	d.Active = active != 0
+	d.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	d.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &d, nil
+}
+
+func (s *SQLiteDB) DeleteLDAPDirectory(applicationID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM ldap_directories WHERE application_id = ?`, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	if _, err := tx.Exec(`DELETE FROM directory_accounts WHERE application_id = ?`, applicationID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDB) UpsertDirectoryAccount(acct *DirectoryAccount) error {
+	claims, err := json.Marshal(acct.Claims)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM directory_accounts WHERE application_id = ? AND (dn = ? OR user_id = ?)`, acct.ApplicationID, acct.DN, acct.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO directory_accounts(application_id,user_id,dn,claims,updated_at) VALUES(?,?,?,?,datetime('now'))`, acct.ApplicationID, acct.UserID, acct.DN, string(claims)); err != nil {
+		return err
+	}
+	acct.UpdatedAt = time.Now()
+	return tx.Commit()
+}
+
+// scanSQLiteDirectoryAccount scans application_id,user_id,dn,claims,updated_at
+func scanSQLiteDirectoryAccount(row interface{ Scan(...interface{}) error }) (*DirectoryAccount, error) {
+	var acct DirectoryAccount
+	var claims sql.NullString
+	var updatedAt string
+	err := row.Scan(&acct.ApplicationID, &acct.UserID, &acct.DN, &claims, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if claims.Valid && claims.String != "" {
+		if err := json.Unmarshal([]byte(claims.String), &acct.Claims); err != nil {
+			return nil, err
+		}
+	}
+	acct.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &acct, nil
+}
+
+func (s *SQLiteDB) GetDirectoryAccount(applicationID int64, dn string) (*DirectoryAccount, error) {
+	return scanSQLiteDirectoryAccount(s.db.QueryRow(`SELECT application_id,user_id,dn,claims,updated_at FROM directory_accounts WHERE application_id = ? AND dn = ?`, applicationID, dn))
+}
+
+func (s *SQLiteDB) GetDirectoryAccountByUser(applicationID, userID int64) (*DirectoryAccount, error) {
+	return scanSQLiteDirectoryAccount(s.db.QueryRow(`SELECT application_id,user_id,dn,claims,updated_at FROM directory_accounts WHERE application_id = ? AND user_id = ?`, applicationID, userID))
+}
+
+func (s *SQLiteDB) UpsertSCIMResource(res *SCIMResource) error {
+	attrs, err := json.Marshal(res.Attributes)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO scim_resources(application_id,resource_type,resource_id,external_id,attributes,created_at,updated_at) VALUES(?,?,?,?,?,datetime('now'),datetime('now'))
+		ON CONFLICT(application_id,resource_type,resource_id) DO UPDATE SET external_id = excluded.external_id, attributes = excluded.attributes, updated_at = excluded.updated_at`,
+		res.ApplicationID, res.Type, res.ResourceID, res.ExternalID, string(attrs))
+	if err != nil {
+		return err
+	}
+	stored, err := s.GetSCIMResource(res.ApplicationID, res.Type, res.ResourceID)
+	if err != nil {
+		return err
+	}
+	res.CreatedAt, res.UpdatedAt = stored.CreatedAt, stored.UpdatedAt
+	return nil
+}
+
+const sqliteSCIMColumns = `application_id,resource_type,resource_id,external_id,attributes,created_at,updated_at`
+
+// scanSQLiteSCIMResource scans a row selected with sqliteSCIMColumns
+func scanSQLiteSCIMResource(row interface{ Scan(...interface{}) error }) (*SCIMResource, error) {
+	var res SCIMResource
+	var attrs sql.NullString
+	var createdAt, updatedAt string
+	if err := row.Scan(&res.ApplicationID, &res.Type, &res.ResourceID, &res.ExternalID, &attrs, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if attrs.Valid && attrs.String != "" {
+		if err := json.Unmarshal([]byte(attrs.String), &res.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	res.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	res.UpdatedAt, _ = time.Parse(sqliteTimeLayout, updatedAt)
+	return &res, nil
+}
+
+func (s *SQLiteDB) GetSCIMResource(applicationID int64, resourceType string, resourceID int64) (*SCIMResource, error) {
+	res, err := scanSQLiteSCIMResource(s.db.QueryRow(`SELECT `+sqliteSCIMColumns+` FROM scim_resources WHERE application_id = ? AND resource_type = ? AND resource_id = ?`, applicationID, resourceType, resourceID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (s *SQLiteDB) ListSCIMResources(applicationID int64, resourceType string) ([]*SCIMResource, error) {
+	rows, err := s.db.Query(`SELECT `+sqliteSCIMColumns+` FROM scim_resources WHERE application_id = ? AND resource_type = ? ORDER BY resource_id`, applicationID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*SCIMResource{}
+	for rows.Next() {
+		res, err := scanSQLiteSCIMResource(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, res)
+	}
+	return out, rows.Err()
+}
+
+// GetSCIMResourceByExternalID also requires a non-empty external_id, so the partial unique
+// index on external IDs can answer it
+func (s *SQLiteDB) GetSCIMResourceByExternalID(applicationID int64, resourceType, externalID string) (*SCIMResource, error) {
+	res, err := scanSQLiteSCIMResource(s.db.QueryRow(`SELECT `+sqliteSCIMColumns+` FROM scim_resources WHERE application_id = ? AND resource_type = ? AND external_id = ? AND external_id <> ''`, applicationID, resourceType, externalID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (s *SQLiteDB) ListSCIMUsers(filter SCIMUserFilter) ([]*SCIMUser, int, error) {
+	from := ` FROM scim_resources s JOIN users u ON u.id = s.resource_id WHERE s.application_id = ? AND s.resource_type = ?`
+	args := []interface{}{filter.ApplicationID, scimTypeUser}
+	if filter.UserName != "" {
+		from += ` AND lower(u.email) = lower(?)`
+		args = append(args, filter.UserName)
+	}
+	if filter.ExternalID != "" {
+		from += ` AND s.external_id = ? AND s.external_id <> ''`
+		args = append(args, filter.ExternalID)
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	page := from + ` ORDER BY s.resource_id LIMIT ? OFFSET ?`
+	args = append(args, limit, filter.Offset)
+
+	// The page is read twice, once per table, so each side keeps its own scan helper
+	users := map[int64]*User{}
+	rows, err := s.db.Query(`SELECT `+qualifyColumns("u", sqliteUserColumns)+page, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := scanSQLiteUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users[u.ID] = u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows, err = s.db.Query(`SELECT `+qualifyColumns("s", sqliteSCIMColumns)+page, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []*SCIMUser{}
+	for rows.Next() {
+		res, err := scanSQLiteSCIMResource(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		if u := users[res.ResourceID]; u != nil {
+			out = append(out, &SCIMUser{Resource: res, User: u})
+		}
+	}
+	return out, total, rows.Err()
+}
+
+func (s *SQLiteDB) DeleteSCIMResource(applicationID int64, resourceType string, resourceID int64) error {
+	res, err := s.db.Exec(`DELETE FROM scim_resources WHERE application_id = ? AND resource_type = ? AND resource_id = ?`, applicationID, resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) CreatePasswordReset(pr *PasswordReset) error {
+	res, err := s.db.Exec(`INSERT INTO password_resets(user_id,token_hash,expires_at,created_at) VALUES(?,?,?,datetime('now'))`, pr.UserID, pr.TokenHash, pr.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	pr.ID, _ = res.LastInsertId()
+	pr.CreatedAt = time.Now()
+	return nil
+}
+
+func (s *SQLiteDB) GetPasswordResetByTokenHash(tokenHash string) (*PasswordReset, error) {
+	var pr PasswordReset
+	var usedAt sql.NullString
+	var createdAt string
+	err := s.db.QueryRow(`SELECT id,user_id,token_hash,expires_at,used_at,created_at FROM password_resets WHERE token_hash = ?`, tokenHash).Scan(&pr.ID, &pr.UserID, &pr.TokenHash, &pr.ExpiresAt, &usedAt, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pr.UsedAt = parseSQLiteTime(usedAt)
+	pr.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+	return &pr, nil
+}
+
+func (s *SQLiteDB) MarkPasswordResetUsed(id int64) error {
+	res, err := s.db.Exec(`UPDATE password_resets SET used_at = datetime('now') WHERE id = ? AND used_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) CreateAuditEvent(e *AuditEvent) error {
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+	e.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	res, err := s.db.Exec(`INSERT INTO audit_events(application_id,user_id,action,ip,details,created_at) VALUES(?,?,?,?,?,?)`, e.ApplicationID, e.UserID, e.Action, e.IP, string(details), e.CreatedAt.Format(sqliteTimeLayout))
+	if err != nil {
+		return err
+	}
+	e.ID, _ = res.LastInsertId()
+	return nil
+}
+
+func (s *SQLiteDB) ListAuditEvents(filter AuditEventFilter) ([]*AuditEvent, int, error) {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if filter.ApplicationID != nil {
+		where += ` AND application_id = ?`
+		args = append(args, *filter.ApplicationID)
+	}
+	if filter.UserID != nil {
+		where += ` AND user_id = ?`
+		args = append(args, *filter.UserID)
+	}
+	if filter.Action != "" {
+		where += ` AND action = ?`
+		args = append(args, filter.Action)
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM audit_events`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := -1
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	rows, err := s.db.Query(`SELECT id,application_id,user_id,action,ip,details,created_at FROM audit_events`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var appID, userID sql.NullInt64
+		var details, createdAt string
+		if err := rows.Scan(&e.ID, &appID, &userID, &e.Action, &e.IP, &details, &createdAt); err != nil {
+			return nil, 0, err
+		}
+		if appID.Valid {
+			e.ApplicationID = &appID.Int64
+		}
+		if userID.Valid {
+			e.UserID = &userID.Int64
+		}
+		if details != "" {
+			if err := json.Unmarshal([]byte(details), &e.Details); err != nil {
+				return nil, 0, err
+			}
+		}
+		e.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+		events = append(events, &e)
+	}
+	return events, total, rows.Err()
+}
+
+// lifecycle helpers
+func (m *MemDB) close() error { return nil }
+func (m *MemDB) ping() bool   { return true }
+
+func (s *SQLiteDB) close() error { return s.db.Close() }
 func (s *SQLiteDB) ping() bool   { return s.db.Ping() == nil }
+
+func (s *SQLiteDB) CreateLoginEvent(e *LoginEvent) error {
+	reasons, err := json.Marshal(e.RiskReasons)
+	if err != nil {
+		return err
+	}
+	e.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	res, err := s.db.Exec(`INSERT INTO login_events(user_id,application_id,outcome,ip,user_agent,device_id,country,city,latitude,longitude,risk_score,risk_level,risk_reasons,created_at) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
+		e.UserID, e.ApplicationID, e.Outcome, e.IP, e.UserAgent, e.DeviceID, e.Country, e.City, e.Latitude, e.Longitude, e.RiskScore, e.RiskLevel, string(reasons), e.CreatedAt.Format(sqliteTimeLayout))
+	if err != nil {
+		return err
+	}
+	e.ID, _ = res.LastInsertId()
+	return nil
+}
+
+func (s *SQLiteDB) ListLoginEvents(filter LoginEventFilter) ([]*LoginEvent, int, error) {
+	where := ` WHERE created_at >= ?`
+	args := []interface{}{filter.Since.UTC().Format(sqliteTimeLayout)}
+	if filter.UserID != 0 {
+		where += ` AND user_id = ?`
+		args = append(args, filter.UserID)
+	}
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM login_events`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	limit := -1
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	rows, err := s.db.Query(`SELECT id,user_id,application_id,outcome,ip,user_agent,device_id,country,city,latitude,longitude,risk_score,risk_level,risk_reasons,created_at FROM login_events`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	events := []*LoginEvent{}
+	for rows.Next() {
+		var e LoginEvent
+		var appID sql.NullInt64
+		var lat, lon sql.NullFloat64
+		var reasons sql.NullString
+		var createdAt string
+		if err := rows.Scan(&e.ID, &e.UserID, &appID, &e.Outcome, &e.IP, &e.UserAgent, &e.DeviceID, &e.Country, &e.City, &lat, &lon, &e.RiskScore, &e.RiskLevel, &reasons, &createdAt); err != nil {
+			return nil, 0, err
+		}
+		if appID.Valid {
+			e.ApplicationID = &appID.Int64
+		}
+		if lat.Valid && lon.Valid {
+			e.Latitude, e.Longitude = &lat.Float64, &lon.Float64
+		}
+		if reasons.Valid && reasons.String != "" {
+			if err := json.Unmarshal([]byte(reasons.String), &e.RiskReasons); err != nil {
+				return nil, 0, err
+			}
+		}
+		e.CreatedAt, _ = time.Parse(sqliteTimeLayout, createdAt)
+		events = append(events, &e)
+	}
+	return events, total, rows.Err()
+}
+
+func (s *SQLiteDB) CompleteLoginEvent(id int64) (bool, error) {
+	res, err := s.db.Exec(`UPDATE login_events SET outcome = ? WHERE id = ? AND outcome = ?`, loginSucceeded, id, loginChallenged)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SQLiteDB) RecordMFAChallenge(id string, expiresAt int64) (bool, error) {
+	if _, err := s.db.Exec(`DELETE FROM mfa_challenges WHERE expires_at < ?`, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec(`INSERT INTO mfa_challenges(id,expires_at) VALUES(?,?) ON CONFLICT DO NOTHING`, id, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
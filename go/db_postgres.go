@@ -2,9 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type PostgresDB struct {
@@ -33,25 +36,23 @@ func (p *PostgresDB) Init() error {
 	return nil
 }
 
-func (p *PostgresDB) CreateUser(email, password string, applicationID *int64) (*User, error) {
+func (p *PostgresDB) CreateUser(email, password string, applicationID *int64, namespaceID int64) (*User, error) {
 	var id int64
-	err := p.db.QueryRow(`INSERT INTO users(email,password,application_id,created_at) VALUES($1,$2,$3,now()) RETURNING id`, email, password, applicationID).Scan(&id)
+	err := p.db.QueryRow(`INSERT INTO users(email,password,application_id,namespace_id,created_at) VALUES($1,$2,$3,$4,now()) RETURNING id`, email, password, applicationID, namespaceID).Scan(&id)
 	if err != nil {
 		// unique violation
 		return nil, err
 	}
-	return &User{ID: id, Email: email, Password: password, ApplicationID: applicationID}, nil
+	return &User{ID: id, Email: email, Password: password, ApplicationID: applicationID, NamespaceID: namespaceID}, nil
 }
 
-func (p *PostgresDB) GetUserByEmail(email string) (*User, error) {
-	row := p.db.QueryRow(`SELECT id,email,password,application_id,created_at FROM users WHERE email = $1`, email)
+const postgresUserColumns = `id,email,password,application_id,namespace_id,totp_secret,disabled,created_at`
+
+// scanPostgresUser scans a row selected with postgresUserColumns
+func scanPostgresUser(row interface{ Scan(...interface{}) error }) (*User, error) {
 	var u User
-	var created string
 	var appID sql.NullInt64
-	if err := row.Scan(&u.ID, &u.Email, &u.Password, &appID, &created); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
+	if err := row.Scan(&u.ID, &u.Email, &u.Password, &appID, &u.NamespaceID, &u.TOTPSecret, &u.Disabled, &u.CreatedAt); err != nil {
 		return nil, err
 	}
 	if appID.Valid {
@@ -60,27 +61,72 @@ func (p *PostgresDB) GetUserByEmail(email string) (*User, error) {
 	return &u, nil
 }
 
-func (p *PostgresDB) CreateRefreshToken(token string, userId int64, expiresAt int64, applicationID *int64) error {
-	_, err := p.db.Exec(`INSERT INTO refresh_tokens(token,user_id,application_id,expires_at,created_at) VALUES($1,$2,$3,$4,now())`, token, userId, applicationID, expiresAt)
+func (p *PostgresDB) GetUserByEmail(namespaceID int64, email string) (*User, error) {
+	u, err := scanPostgresUser(p.db.QueryRow(`SELECT `+postgresUserColumns+` FROM users WHERE namespace_id = $1 AND email = $2`, namespaceID, email))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (p *PostgresDB) GetUserByID(id int64) (*User, error) {
+	u, err := scanPostgresUser(p.db.QueryRow(`SELECT `+postgresUserColumns+` FROM users WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (p *PostgresDB) CreateRefreshToken(t *RefreshToken) error {
+	_, err := p.db.Exec(`INSERT INTO refresh_tokens(token,user_id,application_id,organization_id,expires_at,auth_time,amr,created_at) VALUES($1,$2,$3,$4,$5,$6,$7,now())`, t.Token, t.UserID, t.ApplicationID, t.OrganizationID, t.ExpiresAt, t.AuthTime, pq.Array(t.AMR))
 	return err
 }
 
 func (p *PostgresDB) GetRefreshToken(token string) (*RefreshToken, error) {
-	row := p.db.QueryRow(`SELECT token,user_id,application_id,expires_at,revoked FROM refresh_tokens WHERE token = $1`, token)
+	row := p.db.QueryRow(`SELECT token,user_id,application_id,organization_id,expires_at,revoked,auth_time,amr FROM refresh_tokens WHERE token = $1`, token)
 	var t RefreshToken
-	var appID sql.NullInt64
-	if err := row.Scan(&t.Token, &t.UserID, &appID, &t.ExpiresAt, &t.Revoked); err != nil {
+	var appID, orgID sql.NullInt64
+	var amr pq.StringArray
+	if err := row.Scan(&t.Token, &t.UserID, &appID, &orgID, &t.ExpiresAt, &t.Revoked, &t.AuthTime, &amr); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
+	t.AMR = amr
 	if appID.Valid {
 		t.ApplicationID = &appID.Int64
 	}
+	if orgID.Valid {
+		t.OrganizationID = &orgID.Int64
+	}
 	return &t, nil
 }
 
+func (p *PostgresDB) ListRefreshTokensForUser(userID int64) ([]*RefreshToken, error) {
+	rows, err := p.db.Query(`SELECT token,user_id,application_id,organization_id,expires_at,created_at FROM refresh_tokens WHERE user_id = $1 AND NOT revoked AND expires_at >= $2 ORDER BY created_at DESC`, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*RefreshToken{}
+	for rows.Next() {
+		var t RefreshToken
+		var appID, orgID sql.NullInt64
+		if err := rows.Scan(&t.Token, &t.UserID, &appID, &orgID, &t.ExpiresAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if appID.Valid {
+			t.ApplicationID = &appID.Int64
+		}
+		if orgID.Valid {
+			t.OrganizationID = &orgID.Int64
+		}
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
 func (p *PostgresDB) RevokeRefreshToken(token string) error {
 	res, err := p.db.Exec(`UPDATE refresh_tokens SET revoked = true WHERE token = $1`, token)
 	if err != nil {
@@ -97,50 +143,292 @@ func (p *PostgresDB) RevokeAllRefreshTokensForUser(userId int64) error {
 	return err
 }
 
+func (p *PostgresDB) DeleteApplicationRefreshTokensForUser(userID, applicationID int64) error {
+	_, err := p.db.Exec(`DELETE FROM refresh_tokens WHERE user_id = $1 AND application_id = $2`, userID, applicationID)
+	return err
+}
+
 func (p *PostgresDB) close() error { return p.db.Close() }
 func (p *PostgresDB) ping() bool   { return p.db.Ping() == nil }
 
 // Enterprise features for Postgres DB
-func (p *PostgresDB) GetApplicationByAPIKeyPrefix(prefix string) ([]*Application, error) {
-	rows, err := p.db.Query(`SELECT id,name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,allowed_origins,active,created_at,updated_at FROM applications WHERE api_key_prefix = $1 AND active = true`, prefix)
+const postgresApplicationColumns = `id,name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,allowed_origins,ip_allowlist,ip_denylist,session_cookie,branding,redirect_uris,client_type,isolated_users,active,created_at,updated_at`
+
+// scanPostgresApplication scans a row selected with postgresApplicationColumns
+func scanPostgresApplication(row interface{ Scan(...interface{}) error }) (*Application, error) {
+	var app Application
+	var origins, allowlist, denylist, redirectURIs pq.StringArray
+	var branding []byte
+	if err := row.Scan(&app.ID, &app.Name, &app.Domain, &app.APIKeyHash, &app.APIKeyPrefix, &app.RateLimitPerMinute, &origins, &allowlist, &denylist, &app.SessionCookie, &branding, &redirectURIs, &app.ClientType, &app.IsolatedUsers, &app.Active, &app.CreatedAt, &app.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if len(branding) > 0 {
+		if err := json.Unmarshal(branding, &app.Branding); err != nil {
+			return nil, err
+		}
+	}
+	app.AllowedOrigins = origins
+	app.IPAllowlist = allowlist
+	app.IPDenylist = denylist
+	app.RedirectURIs = redirectURIs
+	return &app, nil
+}
+
+func (p *PostgresDB) GetApplicationByID(id int64) (*Application, error) {
+	app, err := scanPostgresApplication(p.db.QueryRow(`SELECT `+postgresApplicationColumns+` FROM applications WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return app, err
+}
+
+func (p *PostgresDB) CreateApplication(name, domain string, key *APIKey, rateLimit int, origins []string, isolatedUsers bool) (*Application, error) {
+	app := &Application{Name: name, Domain: domain, APIKeyHash: key.KeyHash, APIKeyPrefix: key.KeyPrefix, RateLimitPerMinute: rateLimit, AllowedOrigins: origins, IsolatedUsers: isolatedUsers, Active: true}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`INSERT INTO applications(name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,allowed_origins,isolated_users,created_at,updated_at) VALUES($1,$2,$3,$4,$5,$6,$7,now(),now()) RETURNING id,created_at,updated_at`, name, domain, key.KeyHash, key.KeyPrefix, rateLimit, pq.Array(origins), isolatedUsers).Scan(&app.ID, &app.CreatedAt, &app.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
+	key.ApplicationID = app.ID
+	if key.Label == "" {
+		key.Label = defaultAPIKeyLabel
+	}
+	if err := insertPostgresAPIKey(tx, key); err != nil {
+		return nil, err
+	}
+	return app, tx.Commit()
+}
+
+func (p *PostgresDB) ListApplications(filter ApplicationFilter) ([]*Application, int, error) {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if filter.Active != nil {
+		args = append(args, *filter.Active)
+		where += fmt.Sprintf(` AND active = $%d`, len(args))
+	}
+	if filter.Domain != "" {
+		args = append(args, filter.Domain)
+		where += fmt.Sprintf(` AND lower(domain) = lower($%d)`, len(args))
+	}
+	var total int
+	if err := p.db.QueryRow(`SELECT COUNT(*) FROM applications`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	var limit interface{}
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	query := `SELECT ` + postgresApplicationColumns + ` FROM applications` + where + fmt.Sprintf(` ORDER BY id LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	rows, err := p.db.Query(query, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer rows.Close()
-	var apps []*Application
+	apps := []*Application{}
 	for rows.Next() {
-		var app Application
-		var origins []string
-		if err := rows.Scan(&app.ID, &app.Name, &app.Domain, &app.APIKeyHash, &app.APIKeyPrefix, &app.RateLimitPerMinute, &origins, &app.Active, &app.CreatedAt, &app.UpdatedAt); err != nil {
-			return nil, err
+		app, err := scanPostgresApplication(rows)
+		if err != nil {
+			return nil, 0, err
 		}
-		app.AllowedOrigins = origins
-		apps = append(apps, &app)
+		apps = append(apps, app)
 	}
-	return apps, nil
+	return apps, total, rows.Err()
 }
 
-func (p *PostgresDB) GetApplicationByID(id int64) (*Application, error) {
-	row := p.db.QueryRow(`SELECT id,name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,allowed_origins,active,created_at,updated_at FROM applications WHERE id = $1`, id)
-	var app Application
-	var origins []string
-	if err := row.Scan(&app.ID, &app.Name, &app.Domain, &app.APIKeyHash, &app.APIKeyPrefix, &app.RateLimitPerMinute, &origins, &app.Active, &app.CreatedAt, &app.UpdatedAt); err != nil {
+func (p *PostgresDB) UpdateApplication(app *Application) error {
+	branding, err := json.Marshal(app.Branding)
+	if err != nil {
+		return err
+	}
+	res, err := p.db.Exec(`UPDATE applications SET name = $1, domain = $2, rate_limit_per_minute = $3, allowed_origins = $4, ip_allowlist = $5, ip_denylist = $6, session_cookie = $7, branding = $8, redirect_uris = $9, client_type = $10, active = $11, updated_at = now() WHERE id = $12`, app.Name, app.Domain, app.RateLimitPerMinute, pq.Array(app.AllowedOrigins), pq.Array(app.IPAllowlist), pq.Array(app.IPDenylist), app.SessionCookie, string(branding), pq.Array(app.RedirectURIs), app.ClientType, app.Active, app.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+// DeleteApplication relies on the foreign keys to drop scopes, organizations and per-application
+// role assignments, and to detach global users that registered through the application
+func (p *PostgresDB) DeleteApplication(id int64, reassignTo *int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var isolated bool
+	if err := tx.QueryRow(`SELECT isolated_users FROM applications WHERE id = $1 FOR UPDATE`, id).Scan(&isolated); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil
+			return errors.New("not found")
+		}
+		return err
+	}
+
+	if reassignTo != nil {
+		var targetNS int64
+		err := tx.QueryRow(`SELECT CASE WHEN isolated_users THEN id ELSE 0 END FROM applications WHERE id = $1 AND id <> $2`, *reassignTo, id).Scan(&targetNS)
+		if err == sql.ErrNoRows {
+			return errors.New("target application not found")
 		}
+		if err != nil {
+			return err
+		}
+		if isolated {
+			var conflicts int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM users u JOIN users t ON t.email = u.email AND t.namespace_id = $1 WHERE u.namespace_id = $2`, targetNS, id).Scan(&conflicts); err != nil {
+				return err
+			}
+			if conflicts > 0 {
+				return errNamespaceConflict
+			}
+			if _, err := tx.Exec(`UPDATE users SET namespace_id = $1 WHERE namespace_id = $2`, targetNS, id); err != nil {
+				return err
+			}
+		}
+		for _, q := range []string{
+			`UPDATE users SET application_id = $1 WHERE application_id = $2`,
+			`UPDATE refresh_tokens SET application_id = $1 WHERE application_id = $2`,
+			`UPDATE organizations SET application_id = $1 WHERE application_id = $2`,
+			`UPDATE identity_providers SET application_id = $1 WHERE application_id = $2`,
+			`UPDATE saml_connections SET application_id = $1 WHERE application_id = $2`,
+		} {
+			if _, err := tx.Exec(q, *reassignTo, id); err != nil {
+				return err
+			}
+		}
+	} else {
+		if isolated {
+			if _, err := tx.Exec(`DELETE FROM users WHERE namespace_id = $1`, id); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE application_id = $1`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM applications WHERE id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const postgresAPIKeyColumns = `id,application_id,label,key_hash,COALESCE(lookup_hash,''),key_prefix,operations,created_at,last_used_at,expires_at,revoked_at`
+
+// scanPostgresAPIKey scans a row selected with postgresAPIKeyColumns
+func scanPostgresAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	var operations pq.StringArray
+	var lastUsedAt, expiresAt, revokedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.ApplicationID, &k.Label, &k.KeyHash, &k.LookupHash, &k.KeyPrefix, &operations, &k.CreatedAt, &lastUsedAt, &expiresAt, &revokedAt); err != nil {
 		return nil, err
 	}
-	app.AllowedOrigins = origins
-	return &app, nil
+	k.Operations = operations
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return &k, nil
 }
 
-func (p *PostgresDB) CreateApplication(name, domain, apiKeyHash, apiKeyPrefix string, rateLimit int, origins []string) (*Application, error) {
-	var id int64
-	err := p.db.QueryRow(`INSERT INTO applications(name,domain,api_key_hash,api_key_prefix,rate_limit_per_minute,allowed_origins,created_at,updated_at) VALUES($1,$2,$3,$4,$5,$6,now(),now()) RETURNING id`, name, domain, apiKeyHash, apiKeyPrefix, rateLimit, origins).Scan(&id)
+func (p *PostgresDB) queryAPIKeys(query string, args ...interface{}) ([]*APIKey, error) {
+	rows, err := p.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
-	return &Application{ID: id, Name: name, Domain: domain, APIKeyHash: apiKeyHash, APIKeyPrefix: apiKeyPrefix, RateLimitPerMinute: rateLimit, AllowedOrigins: origins, Active: true}, nil
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanPostgresAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func insertPostgresAPIKey(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, k *APIKey) error {
+	return q.QueryRow(`INSERT INTO api_keys(application_id,label,key_hash,lookup_hash,key_prefix,operations,created_at,expires_at) VALUES($1,$2,$3,NULLIF($4,''),$5,$6,now(),$7) RETURNING id,created_at`, k.ApplicationID, k.Label, k.KeyHash, k.LookupHash, k.KeyPrefix, pq.Array(k.Operations), k.ExpiresAt).Scan(&k.ID, &k.CreatedAt)
+}
+
+func (p *PostgresDB) CreateAPIKey(k *APIKey) error {
+	return insertPostgresAPIKey(p.db, k)
+}
+
+func (p *PostgresDB) GetAPIKeysByPrefix(prefix string) ([]*APIKey, error) {
+	return p.queryAPIKeys(`SELECT `+postgresAPIKeyColumns+` FROM api_keys WHERE key_prefix = $1 AND revoked_at IS NULL`, prefix)
+}
+
+func (p *PostgresDB) GetAPIKeyByLookupHash(lookupHash string) (*APIKey, error) {
+	k, err := scanPostgresAPIKey(p.db.QueryRow(`SELECT `+postgresAPIKeyColumns+` FROM api_keys WHERE lookup_hash = $1 AND revoked_at IS NULL`, lookupHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+func (p *PostgresDB) SetAPIKeyLookupHash(id int64, lookupHash string) error {
+	_, err := p.db.Exec(`UPDATE api_keys SET lookup_hash = $1 WHERE id = $2`, lookupHash, id)
+	return err
+}
+
+func (p *PostgresDB) SetAPIKeyOperations(applicationID, keyID int64, operations []string) error {
+	res, err := p.db.Exec(`UPDATE api_keys SET operations = $1 WHERE id = $2 AND application_id = $3`, pq.Array(operations), keyID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) ListAPIKeys(applicationID int64) ([]*APIKey, error) {
+	return p.queryAPIKeys(`SELECT `+postgresAPIKeyColumns+` FROM api_keys WHERE application_id = $1 ORDER BY id`, applicationID)
+}
+
+func (p *PostgresDB) RotateAPIKeys(newKey *APIKey, oldKeysExpireAt time.Time) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE api_keys SET expires_at = $1 WHERE application_id = $2 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > $1)`, oldKeysExpireAt, newKey.ApplicationID); err != nil {
+		return err
+	}
+	if err := insertPostgresAPIKey(tx, newKey); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresDB) RevokeAPIKey(applicationID, keyID int64) error {
+	res, err := p.db.Exec(`UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND application_id = $2 AND revoked_at IS NULL`, keyID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) TouchAPIKey(id int64, usedAt time.Time) error {
+	_, err := p.db.Exec(`UPDATE api_keys SET last_used_at = $1 WHERE id = $2`, usedAt, id)
+	return err
 }
 
 func (p *PostgresDB) GetScopesByApplicationID(applicationID int64) ([]*Scope, error) {
@@ -160,6 +448,21 @@ func (p *PostgresDB) GetScopesByApplicationID(applicationID int64) ([]*Scope, er
 	return scopes, nil
 }
 
+func (p *PostgresDB) SetApplicationScopes(applicationID int64, scopeIDs []int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM application_scopes WHERE application_id = $1`, applicationID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO application_scopes(application_id,scope_id) SELECT $1, unnest($2::integer[]) ON CONFLICT DO NOTHING`, applicationID, pq.Array(scopeIDs)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (p *PostgresDB) GetScopeByName(name string) (*Scope, error) {
 	row := p.db.QueryRow(`SELECT id,name,description,created_at FROM scopes WHERE name = $1`, name)
 	var scope Scope
@@ -171,3 +474,1176 @@ func (p *PostgresDB) GetScopeByName(name string) (*Scope, error) {
 	}
 	return &scope, nil
 }
+
+// Organizations for Postgres DB
+func scanPostgresOrganization(row interface{ Scan(...interface{}) error }) (*Organization, error) {
+	var org Organization
+	var appID sql.NullInt64
+	if err := row.Scan(&org.ID, &org.Name, &appID, &org.CreatedAt, &org.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if appID.Valid {
+		org.ApplicationID = &appID.Int64
+	}
+	return &org, nil
+}
+
+func (p *PostgresDB) CreateOrganization(name string, applicationID *int64) (*Organization, error) {
+	return scanPostgresOrganization(p.db.QueryRow(`INSERT INTO organizations(name,application_id,created_at,updated_at) VALUES($1,$2,now(),now()) RETURNING id,name,application_id,created_at,updated_at`, name, applicationID))
+}
+
+func (p *PostgresDB) GetOrganizationByID(id int64) (*Organization, error) {
+	org, err := scanPostgresOrganization(p.db.QueryRow(`SELECT id,name,application_id,created_at,updated_at FROM organizations WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return org, err
+}
+
+func (p *PostgresDB) ListOrganizations(applicationID *int64) ([]*Organization, error) {
+	rows, err := p.db.Query(`SELECT id,name,application_id,created_at,updated_at FROM organizations WHERE $1::integer IS NULL OR application_id = $1 ORDER BY id`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orgs := []*Organization{}
+	for rows.Next() {
+		org, err := scanPostgresOrganization(rows)
+		if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+func (p *PostgresDB) UpdateOrganization(id int64, name string) error {
+	res, err := p.db.Exec(`UPDATE organizations SET name = $1, updated_at = now() WHERE id = $2`, name, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) DeleteOrganization(id int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// members and invitations cascade; refresh tokens are detached via ON DELETE SET NULL
+	res, err := tx.Exec(`DELETE FROM organizations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	// SCIM resources point at users or organizations and so carry no foreign key to them
+	if _, err := tx.Exec(`DELETE FROM scim_resources WHERE resource_type = 'Group' AND resource_id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresDB) UpsertOrganizationMember(orgID, userID int64, role string) error {
+	_, err := p.db.Exec(`INSERT INTO organization_members(organization_id,user_id,role,created_at) VALUES($1,$2,$3,now()) ON CONFLICT (organization_id,user_id) DO UPDATE SET role = EXCLUDED.role`, orgID, userID, role)
+	return err
+}
+
+func scanPostgresOrganizationMember(row interface{ Scan(...interface{}) error }) (*OrganizationMember, error) {
+	var member OrganizationMember
+	if err := row.Scan(&member.OrganizationID, &member.UserID, &member.Role, &member.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (p *PostgresDB) GetOrganizationMember(orgID, userID int64) (*OrganizationMember, error) {
+	member, err := scanPostgresOrganizationMember(p.db.QueryRow(`SELECT organization_id,user_id,role,created_at FROM organization_members WHERE organization_id = $1 AND user_id = $2`, orgID, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return member, err
+}
+
+func (p *PostgresDB) ListOrganizationMembers(orgID int64) ([]*OrganizationMember, error) {
+	rows, err := p.db.Query(`SELECT organization_id,user_id,role,created_at FROM organization_members WHERE organization_id = $1 ORDER BY user_id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := []*OrganizationMember{}
+	for rows.Next() {
+		member, err := scanPostgresOrganizationMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (p *PostgresDB) RemoveOrganizationMember(orgID, userID int64) error {
+	res, err := p.db.Exec(`DELETE FROM organization_members WHERE organization_id = $1 AND user_id = $2`, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) CreateOrganizationInvitation(inv *OrganizationInvitation) error {
+	return p.db.QueryRow(`INSERT INTO organization_invitations(organization_id,email,role,token_hash,expires_at,created_at) VALUES($1,$2,$3,$4,$5,now()) RETURNING id,created_at`, inv.OrganizationID, inv.Email, inv.Role, inv.TokenHash, inv.ExpiresAt).Scan(&inv.ID, &inv.CreatedAt)
+}
+
+func scanPostgresOrganizationInvitation(row interface{ Scan(...interface{}) error }) (*OrganizationInvitation, error) {
+	var inv OrganizationInvitation
+	var acceptedAt sql.NullTime
+	if err := row.Scan(&inv.ID, &inv.OrganizationID, &inv.Email, &inv.Role, &inv.TokenHash, &inv.ExpiresAt, &acceptedAt, &inv.CreatedAt); err != nil {
+		return nil, err
+	}
+	if acceptedAt.Valid {
+		inv.AcceptedAt = &acceptedAt.Time
+	}
+	return &inv, nil
+}
+
+func (p *PostgresDB) GetOrganizationInvitationByTokenHash(tokenHash string) (*OrganizationInvitation, error) {
+	inv, err := scanPostgresOrganizationInvitation(p.db.QueryRow(`SELECT id,organization_id,email,role,token_hash,expires_at,accepted_at,created_at FROM organization_invitations WHERE token_hash = $1`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return inv, err
+}
+
+func (p *PostgresDB) ListOrganizationInvitations(orgID int64) ([]*OrganizationInvitation, error) {
+	rows, err := p.db.Query(`SELECT id,organization_id,email,role,token_hash,expires_at,accepted_at,created_at FROM organization_invitations WHERE organization_id = $1 ORDER BY id`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invitations := []*OrganizationInvitation{}
+	for rows.Next() {
+		inv, err := scanPostgresOrganizationInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+func (p *PostgresDB) DeleteOrganizationInvitation(id int64) error {
+	res, err := p.db.Exec(`DELETE FROM organization_invitations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) MarkOrganizationInvitationAccepted(id int64) (bool, error) {
+	res, err := p.db.Exec(`UPDATE organization_invitations SET accepted_at = now() WHERE id = $1 AND accepted_at IS NULL`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (p *PostgresDB) UpdateUserPassword(userID int64, passwordHash string) error {
+	res, err := p.db.Exec(`UPDATE users SET password = $1 WHERE id = $2`, passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) UpdateUserEmail(userID int64, email string) error {
+	res, err := p.db.Exec(`UPDATE users SET email = $1 WHERE id = $2`, email, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) SetUserTOTPSecret(userID int64, secret string) error {
+	res, err := p.db.Exec(`UPDATE users SET totp_secret = $1 WHERE id = $2`, secret, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) UseTOTPStep(userID int64, step int64) (bool, error) {
+	res, err := p.db.Exec(`UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (p *PostgresDB) SetUserDisabled(userID int64, disabled bool) error {
+	res, err := p.db.Exec(`UPDATE users SET disabled = $1 WHERE id = $2`, disabled, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) ListUsers(filter UserFilter) ([]*User, int, error) {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if filter.EmailPrefix != "" {
+		args = append(args, likePrefix(filter.EmailPrefix))
+		where += fmt.Sprintf(` AND lower(email) LIKE $%d ESCAPE '\'`, len(args))
+	}
+	if filter.ApplicationID != nil {
+		args = append(args, *filter.ApplicationID)
+		where += fmt.Sprintf(` AND application_id = $%d`, len(args))
+	}
+	if filter.Disabled != nil {
+		args = append(args, *filter.Disabled)
+		where += fmt.Sprintf(` AND disabled = $%d`, len(args))
+	}
+	var total int
+	if err := p.db.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	var limit interface{}
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	query := `SELECT ` + postgresUserColumns + ` FROM users` + where + fmt.Sprintf(` ORDER BY id LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	rows, err := p.db.Query(query, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	users := []*User{}
+	for rows.Next() {
+		u, err := scanPostgresUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// DeleteUser relies on foreign keys to remove the user's rows in other tables; SCIM
+// resources have none since they point at users or organizations
+func (p *PostgresDB) DeleteUser(id int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM scim_resources WHERE resource_type = 'User' AND resource_id = $1`, id); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresDB) CreateAuthorizationCode(c *AuthorizationCode) error {
+	return p.db.QueryRow(`INSERT INTO authorization_codes(code_hash,application_id,user_id,redirect_uri,scopes,code_challenge,auth_time,amr,expires_at,created_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,now()) RETURNING id,created_at`, c.CodeHash, c.ApplicationID, c.UserID, c.RedirectURI, pq.Array(c.Scopes), c.CodeChallenge, c.AuthTime, pq.Array(c.AMR), c.ExpiresAt).Scan(&c.ID, &c.CreatedAt)
+}
+
+func (p *PostgresDB) ConsumeAuthorizationCode(codeHash string) (*AuthorizationCode, error) {
+	var c AuthorizationCode
+	var scopes, amr pq.StringArray
+	var usedAt sql.NullTime
+	err := p.db.QueryRow(`UPDATE authorization_codes SET used_at = now() WHERE code_hash = $1 AND used_at IS NULL RETURNING id,code_hash,application_id,user_id,redirect_uri,scopes,code_challenge,auth_time,amr,expires_at,used_at,created_at`, codeHash).Scan(&c.ID, &c.CodeHash, &c.ApplicationID, &c.UserID, &c.RedirectURI, &scopes, &c.CodeChallenge, &c.AuthTime, &amr, &c.ExpiresAt, &usedAt, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Scopes = scopes
+	c.AMR = amr
+	if usedAt.Valid {
+		c.UsedAt = &usedAt.Time
+	}
+	return &c, nil
+}
+
+func (p *PostgresDB) UpsertConsent(userID, applicationID int64, scopes []string) error {
+	_, err := p.db.Exec(`INSERT INTO consents(user_id,application_id,scopes,created_at,updated_at) VALUES($1,$2,$3,now(),now()) ON CONFLICT (user_id,application_id) DO UPDATE SET scopes = EXCLUDED.scopes, updated_at = now()`, userID, applicationID, pq.Array(scopes))
+	return err
+}
+
+func scanPostgresConsent(row interface{ Scan(...interface{}) error }) (*Consent, error) {
+	var c Consent
+	var scopes pq.StringArray
+	if err := row.Scan(&c.UserID, &c.ApplicationID, &scopes, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	c.Scopes = scopes
+	return &c, nil
+}
+
+func (p *PostgresDB) GetConsent(userID, applicationID int64) (*Consent, error) {
+	c, err := scanPostgresConsent(p.db.QueryRow(`SELECT user_id,application_id,scopes,created_at,updated_at FROM consents WHERE user_id = $1 AND application_id = $2`, userID, applicationID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (p *PostgresDB) ListConsents(userID int64) ([]*Consent, error) {
+	rows, err := p.db.Query(`SELECT user_id,application_id,scopes,created_at,updated_at FROM consents WHERE user_id = $1 ORDER BY application_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	consents := []*Consent{}
+	for rows.Next() {
+		c, err := scanPostgresConsent(rows)
+		if err != nil {
+			return nil, err
+		}
+		consents = append(consents, c)
+	}
+	return consents, rows.Err()
+}
+
+func (p *PostgresDB) DeleteConsent(userID, applicationID int64) error {
+	res, err := p.db.Exec(`DELETE FROM consents WHERE user_id = $1 AND application_id = $2`, userID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+const postgresIdentityProviderColumns = `id,application_id,name,display_name,issuer,client_id,client_secret,scopes,claim_mapping,active,created_at,updated_at`
+
+// scanPostgresIdentityProvider scans a row selected with postgresIdentityProviderColumns
+func scanPostgresIdentityProvider(row interface{ Scan(...interface{}) error }) (*IdentityProvider, error) {
+	var ip IdentityProvider
+	var appID sql.NullInt64
+	var scopes pq.StringArray
+	var mapping []byte
+	if err := row.Scan(&ip.ID, &appID, &ip.Name, &ip.DisplayName, &ip.Issuer, &ip.ClientID, &ip.ClientSecret, &scopes, &mapping, &ip.Active, &ip.CreatedAt, &ip.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if appID.Valid {
+		ip.ApplicationID = &appID.Int64
+	}
+	ip.Scopes = scopes
+	if len(mapping) > 0 {
+		if err := json.Unmarshal(mapping, &ip.ClaimMapping); err != nil {
+			return nil, err
+		}
+	}
+	return &ip, nil
+}
+
+func (p *PostgresDB) CreateIdentityProvider(ip *IdentityProvider) error {
+	mapping, err := json.Marshal(ip.ClaimMapping)
+	if err != nil {
+		return err
+	}
+	return p.db.QueryRow(`INSERT INTO identity_providers(application_id,name,display_name,issuer,client_id,client_secret,scopes,claim_mapping,active,created_at,updated_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,now(),now()) RETURNING id,created_at,updated_at`,
+		ip.ApplicationID, ip.Name, ip.DisplayName, ip.Issuer, ip.ClientID, ip.ClientSecret, pq.Array(ip.Scopes), mapping, ip.Active).Scan(&ip.ID, &ip.CreatedAt, &ip.UpdatedAt)
+}
+
+func (p *PostgresDB) GetIdentityProviderByID(id int64) (*IdentityProvider, error) {
+	ip, err := scanPostgresIdentityProvider(p.db.QueryRow(`SELECT `+postgresIdentityProviderColumns+` FROM identity_providers WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return ip, err
+}
+
+func (p *PostgresDB) GetIdentityProviderByName(name string) (*IdentityProvider, error) {
+	ip, err := scanPostgresIdentityProvider(p.db.QueryRow(`SELECT `+postgresIdentityProviderColumns+` FROM identity_providers WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return ip, err
+}
+
+func (p *PostgresDB) ListIdentityProviders(applicationID *int64) ([]*IdentityProvider, error) {
+	rows, err := p.db.Query(`SELECT `+postgresIdentityProviderColumns+` FROM identity_providers WHERE $1::INTEGER IS NULL OR application_id IS NULL OR application_id = $1 ORDER BY id`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	providers := []*IdentityProvider{}
+	for rows.Next() {
+		ip, err := scanPostgresIdentityProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, ip)
+	}
+	return providers, rows.Err()
+}
+
+func (p *PostgresDB) UpdateIdentityProvider(ip *IdentityProvider) error {
+	mapping, err := json.Marshal(ip.ClaimMapping)
+	if err != nil {
+		return err
+	}
+	res, err := p.db.Exec(`UPDATE identity_providers SET application_id = $1, name = $2, display_name = $3, issuer = $4, client_id = $5, client_secret = $6, scopes = $7, claim_mapping = $8, active = $9, updated_at = now() WHERE id = $10`,
+		ip.ApplicationID, ip.Name, ip.DisplayName, ip.Issuer, ip.ClientID, ip.ClientSecret, pq.Array(ip.Scopes), mapping, ip.Active, ip.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) DeleteIdentityProvider(id int64) error {
+	res, err := p.db.Exec(`DELETE FROM identity_providers WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) CreateUserIdentity(i *UserIdentity) error {
+	return p.db.QueryRow(`INSERT INTO user_identities(user_id,provider_id,subject,email,created_at) VALUES($1,$2,$3,$4,now()) RETURNING id,created_at`, i.UserID, i.ProviderID, i.Subject, i.Email).Scan(&i.ID, &i.CreatedAt)
+}
+
+func (p *PostgresDB) GetUserIdentity(providerID int64, subject string) (*UserIdentity, error) {
+	var i UserIdentity
+	err := p.db.QueryRow(`SELECT id,user_id,provider_id,subject,email,created_at FROM user_identities WHERE provider_id = $1 AND subject = $2`, providerID, subject).Scan(&i.ID, &i.UserID, &i.ProviderID, &i.Subject, &i.Email, &i.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+func (p *PostgresDB) ListUserIdentities(userID int64) ([]*UserIdentity, error) {
+	rows, err := p.db.Query(`SELECT id,user_id,provider_id,subject,email,created_at FROM user_identities WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	identities := []*UserIdentity{}
+	for rows.Next() {
+		var i UserIdentity
+		if err := rows.Scan(&i.ID, &i.UserID, &i.ProviderID, &i.Subject, &i.Email, &i.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, &i)
+	}
+	return identities, rows.Err()
+}
+
+func (p *PostgresDB) DeleteUserIdentity(userID, id int64) error {
+	res, err := p.db.Exec(`DELETE FROM user_identities WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+const postgresSAMLConnectionColumns = `id,application_id,organization_id,name,idp_entity_id,idp_sso_url,idp_certificate,email_attribute,domains,sp_private_key,sp_certificate,active,created_at,updated_at`
+
+// scanPostgresSAMLConnection scans a row selected with postgresSAMLConnectionColumns
+func scanPostgresSAMLConnection(row interface{ Scan(...interface{}) error }) (*SAMLConnection, error) {
+	var c SAMLConnection
+	var orgID sql.NullInt64
+	var domains pq.StringArray
+	if err := row.Scan(&c.ID, &c.ApplicationID, &orgID, &c.Name, &c.IdPEntityID, &c.IdPSSOURL, &c.IdPCertificate, &c.EmailAttribute, &domains, &c.SPPrivateKey, &c.SPCertificate, &c.Active, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if orgID.Valid {
+		c.OrganizationID = &orgID.Int64
+	}
+	c.Domains = domains
+	return &c, nil
+}
+
+func (p *PostgresDB) CreateSAMLConnection(c *SAMLConnection) error {
+	return p.db.QueryRow(`INSERT INTO saml_connections(application_id,organization_id,name,idp_entity_id,idp_sso_url,idp_certificate,email_attribute,domains,sp_private_key,sp_certificate,active,created_at,updated_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,now(),now()) RETURNING id,created_at,updated_at`,
+		c.ApplicationID, c.OrganizationID, c.Name, c.IdPEntityID, c.IdPSSOURL, c.IdPCertificate, c.EmailAttribute, pq.Array(c.Domains), c.SPPrivateKey, c.SPCertificate, c.Active).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt)
+}
+
+func (p *PostgresDB) GetSAMLConnectionByID(id int64) (*SAMLConnection, error) {
+	c, err := scanPostgresSAMLConnection(p.db.QueryRow(`SELECT `+postgresSAMLConnectionColumns+` FROM saml_connections WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (p *PostgresDB) GetSAMLConnectionByName(name string) (*SAMLConnection, error) {
+	c, err := scanPostgresSAMLConnection(p.db.QueryRow(`SELECT `+postgresSAMLConnectionColumns+` FROM saml_connections WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+func (p *PostgresDB) ListSAMLConnections(applicationID *int64) ([]*SAMLConnection, error) {
+	rows, err := p.db.Query(`SELECT `+postgresSAMLConnectionColumns+` FROM saml_connections WHERE $1::INTEGER IS NULL OR application_id = $1 ORDER BY id`, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	conns := []*SAMLConnection{}
+	for rows.Next() {
+		c, err := scanPostgresSAMLConnection(rows)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, c)
+	}
+	return conns, rows.Err()
+}
+
+func (p *PostgresDB) UpdateSAMLConnection(c *SAMLConnection) error {
+	res, err := p.db.Exec(`UPDATE saml_connections SET organization_id = $1, name = $2, idp_entity_id = $3, idp_sso_url = $4, idp_certificate = $5, email_attribute = $6, domains = $7, active = $8, updated_at = now() WHERE id = $9`,
+		c.OrganizationID, c.Name, c.IdPEntityID, c.IdPSSOURL, c.IdPCertificate, c.EmailAttribute, pq.Array(c.Domains), c.Active, c.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) DeleteSAMLConnection(id int64) error {
+	res, err := p.db.Exec(`DELETE FROM saml_connections WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) CreateSAMLRequest(r *SAMLRequest) error {
+	if _, err := p.db.Exec(`DELETE FROM saml_requests WHERE expires_at < $1`, time.Now().Unix()); err != nil {
+		return err
+	}
+	return p.db.QueryRow(`INSERT INTO saml_requests(id,connection_id,request,expires_at,created_at) VALUES($1,$2,$3,$4,now()) RETURNING created_at`, r.ID, r.ConnectionID, r.Request, r.ExpiresAt).Scan(&r.CreatedAt)
+}
+
+func (p *PostgresDB) ConsumeSAMLRequest(id string) (*SAMLRequest, error) {
+	var r SAMLRequest
+	err := p.db.QueryRow(`DELETE FROM saml_requests WHERE id = $1 RETURNING id,connection_id,request,expires_at,created_at`, id).Scan(&r.ID, &r.ConnectionID, &r.Request, &r.ExpiresAt, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (p *PostgresDB) RecordSAMLAssertion(connectionID int64, assertionID string, expiresAt int64) (bool, error) {
+	if _, err := p.db.Exec(`DELETE FROM saml_assertions WHERE expires_at < $1`, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	res, err := p.db.Exec(`INSERT INTO saml_assertions(connection_id,assertion_id,expires_at) VALUES($1,$2,$3) ON CONFLICT DO NOTHING`, connectionID, assertionID, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (p *PostgresDB) BindSAMLUser(connectionID, userID int64) error {
+	_, err := p.db.Exec(`INSERT INTO saml_users(connection_id,user_id) VALUES($1,$2) ON CONFLICT DO NOTHING`, connectionID, userID)
+	return err
+}
+
+func (p *PostgresDB) SAMLUserBound(connectionID, userID int64) (bool, error) {
+	var bound bool
+	err := p.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM saml_users WHERE connection_id = $1 AND user_id = $2)`, connectionID, userID).Scan(&bound)
+	return bound, err
+}
+
+const postgresLDAPDirectoryColumns = `application_id,url,start_tls,ca_certificate,bind_dn,bind_password,search_base,search_filter,attribute_mapping,active,created_at,updated_at`
+
+func (p *PostgresDB) UpsertLDAPDirectory(d *LDAPDirectory) error {
+	mapping, err := json.Marshal(d.AttributeMapping)
+	if err != nil {
+		return err
+	}
+	return p.db.QueryRow(`INSERT INTO ldap_directories(`+postgresLDAPDirectoryColumns+`) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,now(),now())
+		ON CONFLICT(application_id) DO UPDATE SET url = excluded.url, start_tls = excluded.start_tls, ca_certificate = excluded.ca_certificate, bind_dn = excluded.bind_dn, bind_password = excluded.bind_password, search_base = excluded.search_base, search_filter = excluded.search_filter, attribute_mapping = excluded.attribute_mapping, active = excluded.active, updated_at = excluded.updated_at
+		RETURNING created_at,updated_at`,
+		d.ApplicationID, d.URL, d.StartTLS, d.CACertificate, d.BindDN, d.BindPassword, d.SearchBase, d.SearchFilter, mapping, d.Active).Scan(&d.CreatedAt, &d.UpdatedAt)
+}
+
+func (p *PostgresDB) GetLDAPDirectory(applicationID int64) (*LDAPDirectory, error) {
+	var d LDAPDirectory
+	var mapping []byte
+	err := p.db.QueryRow(`SELECT `+postgresLDAPDirectoryColumns+` FROM ldap_directories WHERE application_id = $1`, applicationID).
+		Scan(&d.ApplicationID, &d.URL, &d.StartTLS, &d.CACertificate, &d.BindDN, &d.BindPassword, &d.SearchBase, &d.SearchFilter, &mapping, &d.Active, &d.CreatedAt, &d.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(mapping) > 0 {
+		if err := json.Unmarshal(mapping, &d.AttributeMapping); err != nil {
+			return nil, err
+		}
+	}
+	return &d, nil
+}
+
+const postgresSCIMColumns = `application_id,resource_type,resource_id,external_id,attributes,created_at,updated_at`
+
+func (p *PostgresDB) UpsertSCIMResource(res *SCIMResource) error {
+	attrs, err := json.Marshal(res.Attributes)
+	if err != nil {
+		return err
+	}
+	return p.db.QueryRow(`INSERT INTO scim_resources(`+postgresSCIMColumns+`) VALUES($1,$2,$3,$4,$5,now(),now())
+		ON CONFLICT(application_id,resource_type,resource_id) DO UPDATE SET external_id = excluded.external_id, attributes = excluded.attributes, updated_at = excluded.updated_at
+		RETURNING created_at,updated_at`,
+		res.ApplicationID, res.Type, res.ResourceID, res.ExternalID, attrs).Scan(&res.CreatedAt, &res.UpdatedAt)
+}
+
+// scanPostgresSCIMResource scans a row selected with postgresSCIMColumns
+func scanPostgresSCIMResource(row interface{ Scan(...interface{}) error }) (*SCIMResource, error) {
+	var res SCIMResource
+	var attrs []byte
+	if err := row.Scan(&res.ApplicationID, &res.Type, &res.ResourceID, &res.ExternalID, &attrs, &res.CreatedAt, &res.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if len(attrs) > 0 {
+		if err := json.Unmarshal(attrs, &res.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	return &res, nil
+}
+
+func (p *PostgresDB) GetSCIMResource(applicationID int64, resourceType string, resourceID int64) (*SCIMResource, error) {
+	res, err := scanPostgresSCIMResource(p.db.QueryRow(`SELECT `+postgresSCIMColumns+` FROM scim_resources WHERE application_id = $1 AND resource_type = $2 AND resource_id = $3`, applicationID, resourceType, resourceID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (p *PostgresDB) ListSCIMResources(applicationID int64, resourceType string) ([]*SCIMResource, error) {
+	rows, err := p.db.Query(`SELECT `+postgresSCIMColumns+` FROM scim_resources WHERE application_id = $1 AND resource_type = $2 ORDER BY resource_id`, applicationID, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*SCIMResource{}
+	for rows.Next() {
+		res, err := scanPostgresSCIMResource(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, res)
+	}
+	return out, rows.Err()
+}
+
+// GetSCIMResourceByExternalID also requires a non-empty external_id, so the partial unique
+// index on external IDs can answer it
+func (p *PostgresDB) GetSCIMResourceByExternalID(applicationID int64, resourceType, externalID string) (*SCIMResource, error) {
+	res, err := scanPostgresSCIMResource(p.db.QueryRow(`SELECT `+postgresSCIMColumns+` FROM scim_resources WHERE application_id = $1 AND resource_type = $2 AND external_id = $3 AND external_id <> ''`, applicationID, resourceType, externalID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return res, err
+}
+
+func (p *PostgresDB) ListSCIMUsers(filter SCIMUserFilter) ([]*SCIMUser, int, error) {
+	from := ` FROM scim_resources s JOIN users u ON u.id = s.resource_id WHERE s.application_id = $1 AND s.resource_type = $2`
+	args := []interface{}{filter.ApplicationID, scimTypeUser}
+	if filter.UserName != "" {
+		args = append(args, filter.UserName)
+		from += fmt.Sprintf(` AND lower(u.email) = lower($%d)`, len(args))
+	}
+	if filter.ExternalID != "" {
+		args = append(args, filter.ExternalID)
+		from += fmt.Sprintf(` AND s.external_id = $%d AND s.external_id <> ''`, len(args))
+	}
+	var total int
+	if err := p.db.QueryRow(`SELECT COUNT(*)`+from, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	var limit interface{}
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	page := from + fmt.Sprintf(` ORDER BY s.resource_id LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	args = append(args, limit, filter.Offset)
+
+	// The page is read twice, once per table, so each side keeps its own scan helper
+	users := map[int64]*User{}
+	rows, err := p.db.Query(`SELECT `+qualifyColumns("u", postgresUserColumns)+page, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u, err := scanPostgresUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users[u.ID] = u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows, err = p.db.Query(`SELECT `+qualifyColumns("s", postgresSCIMColumns)+page, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []*SCIMUser{}
+	for rows.Next() {
+		res, err := scanPostgresSCIMResource(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		if u := users[res.ResourceID]; u != nil {
+			out = append(out, &SCIMUser{Resource: res, User: u})
+		}
+	}
+	return out, total, rows.Err()
+}
+
+func (p *PostgresDB) DeleteSCIMResource(applicationID int64, resourceType string, resourceID int64) error {
+	res, err := p.db.Exec(`DELETE FROM scim_resources WHERE application_id = $1 AND resource_type = $2 AND resource_id = $3`, applicationID, resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) DeleteLDAPDirectory(applicationID int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM ldap_directories WHERE application_id = $1`, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	if _, err := tx.Exec(`DELETE FROM directory_accounts WHERE application_id = $1`, applicationID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresDB) UpsertDirectoryAccount(acct *DirectoryAccount) error {
+	claims, err := json.Marshal(acct.Claims)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM directory_accounts WHERE application_id = $1 AND (dn = $2 OR user_id = $3)`, acct.ApplicationID, acct.DN, acct.UserID); err != nil {
+		return err
+	}
+	if err := tx.QueryRow(`INSERT INTO directory_accounts(application_id,user_id,dn,claims,updated_at) VALUES($1,$2,$3,$4,now()) RETURNING updated_at`, acct.ApplicationID, acct.UserID, acct.DN, claims).Scan(&acct.UpdatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanPostgresDirectoryAccount scans application_id,user_id,dn,claims,updated_at
+func scanPostgresDirectoryAccount(row interface{ Scan(...interface{}) error }) (*DirectoryAccount, error) {
+	var acct DirectoryAccount
+	var claims []byte
+	err := row.Scan(&acct.ApplicationID, &acct.UserID, &acct.DN, &claims, &acct.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(claims) > 0 {
+		if err := json.Unmarshal(claims, &acct.Claims); err != nil {
+			return nil, err
+		}
+	}
+	return &acct, nil
+}
+
+func (p *PostgresDB) GetDirectoryAccount(applicationID int64, dn string) (*DirectoryAccount, error) {
+	return scanPostgresDirectoryAccount(p.db.QueryRow(`SELECT application_id,user_id,dn,claims,updated_at FROM directory_accounts WHERE application_id = $1 AND dn = $2`, applicationID, dn))
+}
+
+func (p *PostgresDB) GetDirectoryAccountByUser(applicationID, userID int64) (*DirectoryAccount, error) {
+	return scanPostgresDirectoryAccount(p.db.QueryRow(`SELECT application_id,user_id,dn,claims,updated_at FROM directory_accounts WHERE application_id = $1 AND user_id = $2`, applicationID, userID))
+}
+
+func (p *PostgresDB) CreatePasswordReset(pr *PasswordReset) error {
+	return p.db.QueryRow(`INSERT INTO password_resets(user_id,token_hash,expires_at,created_at) VALUES($1,$2,$3,now()) RETURNING id,created_at`, pr.UserID, pr.TokenHash, pr.ExpiresAt).Scan(&pr.ID, &pr.CreatedAt)
+}
+
+func (p *PostgresDB) GetPasswordResetByTokenHash(tokenHash string) (*PasswordReset, error) {
+	var pr PasswordReset
+	var usedAt sql.NullTime
+	err := p.db.QueryRow(`SELECT id,user_id,token_hash,expires_at,used_at,created_at FROM password_resets WHERE token_hash = $1`, tokenHash).Scan(&pr.ID, &pr.UserID, &pr.TokenHash, &pr.ExpiresAt, &usedAt, &pr.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if usedAt.Valid {
+		pr.UsedAt = &usedAt.Time
+	}
+	return &pr, nil
+}
+
+func (p *PostgresDB) MarkPasswordResetUsed(id int64) error {
+	res, err := p.db.Exec(`UPDATE password_resets SET used_at = now() WHERE id = $1 AND used_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) CreateAuditEvent(e *AuditEvent) error {
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+	return p.db.QueryRow(`INSERT INTO audit_events(application_id,user_id,action,ip,details,created_at) VALUES($1,$2,$3,$4,$5,now()) RETURNING id,created_at`, e.ApplicationID, e.UserID, e.Action, e.IP, string(details)).Scan(&e.ID, &e.CreatedAt)
+}
+
+func (p *PostgresDB) ListAuditEvents(filter AuditEventFilter) ([]*AuditEvent, int, error) {
+	where := ` WHERE 1=1`
+	var args []interface{}
+	if filter.ApplicationID != nil {
+		args = append(args, *filter.ApplicationID)
+		where += fmt.Sprintf(` AND application_id = $%d`, len(args))
+	}
+	if filter.UserID != nil {
+		args = append(args, *filter.UserID)
+		where += fmt.Sprintf(` AND user_id = $%d`, len(args))
+	}
+	if filter.Action != "" {
+		args = append(args, filter.Action)
+		where += fmt.Sprintf(` AND action = $%d`, len(args))
+	}
+	var total int
+	if err := p.db.QueryRow(`SELECT COUNT(*) FROM audit_events`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	var limit interface{}
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	query := `SELECT id,application_id,user_id,action,ip,details,created_at FROM audit_events` + where + fmt.Sprintf(` ORDER BY id DESC LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	rows, err := p.db.Query(query, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	events := []*AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		var appID, userID sql.NullInt64
+		var details []byte
+		if err := rows.Scan(&e.ID, &appID, &userID, &e.Action, &e.IP, &details, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		if appID.Valid {
+			e.ApplicationID = &appID.Int64
+		}
+		if userID.Valid {
+			e.UserID = &userID.Int64
+		}
+		if len(details) > 0 {
+			if err := json.Unmarshal(details, &e.Details); err != nil {
+				return nil, 0, err
+			}
+		}
+		events = append(events, &e)
+	}
+	return events, total, rows.Err()
+}
+
+func (p *PostgresDB) CreateLoginEvent(e *LoginEvent) error {
+	return p.db.QueryRow(`INSERT INTO login_events(user_id,application_id,outcome,ip,user_agent,device_id,country,city,latitude,longitude,risk_score,risk_level,risk_reasons,created_at) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,now()) RETURNING id,created_at`,
+		e.UserID, e.ApplicationID, e.Outcome, e.IP, e.UserAgent, e.DeviceID, e.Country, e.City, e.Latitude, e.Longitude, e.RiskScore, e.RiskLevel, pq.Array(e.RiskReasons)).Scan(&e.ID, &e.CreatedAt)
+}
+
+func (p *PostgresDB) ListLoginEvents(filter LoginEventFilter) ([]*LoginEvent, int, error) {
+	where := ` WHERE created_at >= $1`
+	args := []interface{}{filter.Since}
+	if filter.UserID != 0 {
+		args = append(args, filter.UserID)
+		where += fmt.Sprintf(` AND user_id = $%d`, len(args))
+	}
+	var total int
+	if err := p.db.QueryRow(`SELECT COUNT(*) FROM login_events`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	var limit interface{}
+	if filter.Limit > 0 {
+		limit = filter.Limit
+	}
+	query := `SELECT id,user_id,application_id,outcome,ip,user_agent,device_id,country,city,latitude,longitude,risk_score,risk_level,risk_reasons,created_at FROM login_events` + where + fmt.Sprintf(` ORDER BY id DESC LIMIT $%d OFFSET $%d`, len(args)+1, len(args)+2)
+	rows, err := p.db.Query(query, append(args, limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	events := []*LoginEvent{}
+	for rows.Next() {
+		var e LoginEvent
+		var appID sql.NullInt64
+		var lat, lon sql.NullFloat64
+		var reasons pq.StringArray
+		if err := rows.Scan(&e.ID, &e.UserID, &appID, &e.Outcome, &e.IP, &e.UserAgent, &e.DeviceID, &e.Country, &e.City, &lat, &lon, &e.RiskScore, &e.RiskLevel, &reasons, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		if appID.Valid {
+			e.ApplicationID = &appID.Int64
+		}
+		if lat.Valid && lon.Valid {
+			e.Latitude, e.Longitude = &lat.Float64, &lon.Float64
+		}
+		e.RiskReasons = reasons
+		events = append(events, &e)
+	}
+	return events, total, rows.Err()
+}
+
+func (p *PostgresDB) CompleteLoginEvent(id int64) (bool, error) {
+	res, err := p.db.Exec(`UPDATE login_events SET outcome = $1 WHERE id = $2 AND outcome = $3`, loginSucceeded, id, loginChallenged)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (p *PostgresDB) RecordMFAChallenge(id string, expiresAt int64) (bool, error) {
+	if _, err := p.db.Exec(`DELETE FROM mfa_challenges WHERE expires_at < $1`, time.Now().Unix()); err != nil {
+		return false, err
+	}
+	res, err := p.db.Exec(`INSERT INTO mfa_challenges(id,expires_at) VALUES($1,$2) ON CONFLICT DO NOTHING`, id, expiresAt)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (p *PostgresDB) ListScopes() ([]*Scope, error) {
+	rows, err := p.db.Query(`SELECT id,name,COALESCE(description,''),created_at FROM scopes ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scopes := []*Scope{}
+	for rows.Next() {
+		var scope Scope
+		if err := rows.Scan(&scope.ID, &scope.Name, &scope.Description, &scope.CreatedAt); err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, &scope)
+	}
+	return scopes, rows.Err()
+}
+
+func (p *PostgresDB) CreateScope(name, description string) (*Scope, error) {
+	scope := Scope{Name: name, Description: description}
+	err := p.db.QueryRow(`INSERT INTO scopes(name,description,created_at) VALUES($1,$2,now()) RETURNING id,created_at`, name, description).Scan(&scope.ID, &scope.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &scope, nil
+}
+
+// Roles for Postgres DB
+func (p *PostgresDB) CreateRole(name, description string) (*Role, error) {
+	role := Role{Name: name, Description: description, Scopes: []string{}}
+	err := p.db.QueryRow(`INSERT INTO roles(name,description,created_at) VALUES($1,$2,now()) RETURNING id,created_at`, name, description).Scan(&role.ID, &role.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// scanPostgresRole scans a row selected as id,name,description,created_at,scopes
+func scanPostgresRole(row interface{ Scan(...interface{}) error }) (*Role, error) {
+	var role Role
+	var scopes pq.StringArray
+	if err := row.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &scopes); err != nil {
+		return nil, err
+	}
+	role.Scopes = []string(scopes)
+	return &role, nil
+}
+
+const postgresRoleQuery = `SELECT r.id,r.name,COALESCE(r.description,''),r.created_at,
+	COALESCE(ARRAY(SELECT sc.name FROM role_scopes rs JOIN scopes sc ON sc.id = rs.scope_id WHERE rs.role_id = r.id ORDER BY sc.name), '{}')
+	FROM roles r`
+
+func (p *PostgresDB) GetRoleByID(id int64) (*Role, error) {
+	role, err := scanPostgresRole(p.db.QueryRow(postgresRoleQuery+` WHERE r.id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return role, err
+}
+
+func (p *PostgresDB) ListRoles() ([]*Role, error) {
+	rows, err := p.db.Query(postgresRoleQuery + ` ORDER BY r.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*Role{}
+	for rows.Next() {
+		role, err := scanPostgresRole(rows)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (p *PostgresDB) DeleteRole(id int64) error {
+	// role_scopes and user_roles cascade
+	res, err := p.db.Exec(`DELETE FROM roles WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) SetRoleScopes(roleID int64, scopeIDs []int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM role_scopes WHERE role_id = $1`, roleID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO role_scopes(role_id,scope_id) SELECT $1, unnest($2::integer[]) ON CONFLICT DO NOTHING`, roleID, pq.Array(scopeIDs)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresDB) AssignUserRole(userID, roleID int64, applicationID *int64) error {
+	_, err := p.db.Exec(`INSERT INTO user_roles(user_id,role_id,application_id,created_at) VALUES($1,$2,$3,now()) ON CONFLICT DO NOTHING`, userID, roleID, applicationID)
+	return err
+}
+
+func (p *PostgresDB) RemoveUserRole(userID, roleID int64, applicationID *int64) error {
+	res, err := p.db.Exec(`DELETE FROM user_roles WHERE user_id = $1 AND role_id = $2 AND COALESCE(application_id, 0) = COALESCE($3::integer, 0)`, userID, roleID, applicationID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("not found")
+	}
+	return nil
+}
+
+func (p *PostgresDB) ListUserRoles(userID int64) ([]*UserRole, error) {
+	rows, err := p.db.Query(`SELECT ur.user_id,ur.role_id,r.name,ur.application_id,ur.created_at FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = $1 ORDER BY r.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := []*UserRole{}
+	for rows.Next() {
+		var ur UserRole
+		var appID sql.NullInt64
+		if err := rows.Scan(&ur.UserID, &ur.RoleID, &ur.RoleName, &appID, &ur.CreatedAt); err != nil {
+			return nil, err
+		}
+		if appID.Valid {
+			ur.ApplicationID = &appID.Int64
+		}
+		roles = append(roles, &ur)
+	}
+	return roles, rows.Err()
+}
+
+func (p *PostgresDB) GetUserPermissions(userID int64, applicationID *int64) ([]string, error) {
+	rows, err := p.db.Query(`SELECT DISTINCT sc.name FROM user_roles ur JOIN role_scopes rs ON rs.role_id = ur.role_id JOIN scopes sc ON sc.id = rs.scope_id WHERE ur.user_id = $1 AND (ur.application_id IS NULL OR ur.application_id = $2) ORDER BY sc.name`, userID, applicationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	perms := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		perms = append(perms, name)
+	}
+	return perms, rows.Err()
+}
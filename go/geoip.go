@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// GeoIPDatabase looks up client addresses in a MaxMind DB file, such as GeoLite2 City or
+// a compatible database, held in memory. Lookups never leave the process.
+type GeoIPDatabase struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// dataStart is the offset of the data section, after the search tree
+	dataStart uint
+	// ipv4Start is the node IPv4 lookups start from: IPv6 databases keep IPv4 under ::/96
+	ipv4Start uint
+}
+
+// GeoLocation is what a GeoIP database knows about an address
+type GeoLocation struct {
+	Country   string // ISO 3166-1 alpha-2 code
+	City      string // English name
+	Latitude  *float64
+	Longitude *float64
+}
+
+// mmdbMetadataMarker precedes the metadata map at the end of the file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errCorruptGeoIPDatabase = errors.New("corrupt MaxMind DB file")
+
+// Data section types of the MaxMind DB format
+const (
+	mmdbPointer = 1
+	mmdbString  = 2
+	mmdbDouble  = 3
+	mmdbBytes   = 4
+	mmdbUint16  = 5
+	mmdbUint32  = 6
+	mmdbMap     = 7
+	mmdbInt32   = 8
+	mmdbUint64  = 9
+	mmdbUint128 = 10
+	mmdbArray   = 11
+	mmdbBool    = 14
+	mmdbFloat   = 15
+)
+
+// OpenGeoIPDatabase reads a MaxMind DB file into memory
+func OpenGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseGeoIPDatabase(buf)
+}
+
+func parseGeoIPDatabase(buf []byte) (*GeoIPDatabase, error) {
+	at := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if at < 0 {
+		return nil, errors.New("not a MaxMind DB file: metadata not found")
+	}
+	metaStart := at + len(mmdbMetadataMarker)
+	raw, _, err := mmdbDecoder{buf: buf[metaStart:]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	meta, _ := raw.(map[string]interface{})
+	g := &GeoIPDatabase{
+		buf:        buf,
+		nodeCount:  mmdbUint(meta["node_count"]),
+		recordSize: mmdbUint(meta["record_size"]),
+		ipVersion:  mmdbUint(meta["ip_version"]),
+	}
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", g.recordSize)
+	}
+	if g.ipVersion != 4 && g.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported MaxMind DB IP version %d", g.ipVersion)
+	}
+	treeSize := g.nodeCount * g.recordSize / 4
+	if treeSize+16 > uint(at) {
+		return nil, errCorruptGeoIPDatabase
+	}
+	g.dataStart = treeSize + 16
+	if g.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < g.nodeCount; i++ {
+			node = g.record(node, 0)
+		}
+		g.ipv4Start = node
+	}
+	return g, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a search tree node
+func (g *GeoIPDatabase) record(node, bit uint) uint {
+	b := g.buf
+	switch g.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[node*8+bit*4:]))
+	}
+}
+
+// Lookup returns the location of an address, or nil when the database has no entry for it
+func (g *GeoIPDatabase) Lookup(ip netip.Addr) (*GeoLocation, error) {
+	ip = ip.Unmap()
+	var addr []byte
+	node := uint(0)
+	switch {
+	case ip.Is4():
+		a := ip.As4()
+		addr = a[:]
+		node = g.ipv4Start
+	case g.ipVersion == 6:
+		a := ip.As16()
+		addr = a[:]
+	default:
+		return nil, nil
+	}
+	for i := 0; i < len(addr)*8 && node < g.nodeCount; i++ {
+		node = g.record(node, uint(addr[i/8]>>(7-i%8))&1)
+	}
+	if node == g.nodeCount {
+		return nil, nil
+	}
+	if node < g.nodeCount {
+		return nil, errCorruptGeoIPDatabase
+	}
+	raw, _, err := mmdbDecoder{buf: g.buf[g.dataStart:]}.decode(node-g.nodeCount-16, 0)
+	if err != nil {
+		return nil, err
+	}
+	rec, _ := raw.(map[string]interface{})
+	loc := &GeoLocation{}
+	if country, ok := rec["country"].(map[string]interface{}); ok {
+		loc.Country, _ = country["iso_code"].(string)
+	}
+	if city, ok := rec["city"].(map[string]interface{}); ok {
+		names, _ := city["names"].(map[string]interface{})
+		loc.City, _ = names["en"].(string)
+	}
+	if location, ok := rec["location"].(map[string]interface{}); ok {
+		lat, latOK := location["latitude"].(float64)
+		lon, lonOK := location["longitude"].(float64)
+		if latOK && lonOK {
+			loc.Latitude, loc.Longitude = &lat, &lon
+		}
+	}
+	return loc, nil
+}
+
+// mmdbDecoder decodes values of a MaxMind DB data section. Pointers are offsets from
+// the start of buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// maxMMDBDepth bounds nesting, so a corrupt file cannot recurse forever
+const maxMMDBDepth = 32
+
+// decode returns the value at offset and the offset after it
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, errCorruptGeoIPDatabase
+	}
+	head, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := head[0]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		target, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+	if typ == 0 {
+		ext, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(ext[0])
+		offset++
+	}
+	size, offset, err := d.size(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errCorruptGeoIPDatabase
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[name] = value
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return b, offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errCorruptGeoIPDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errCorruptGeoIPDatabase
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128, mmdbInt32:
+		if size > 16 {
+			return nil, 0, errCorruptGeoIPDatabase
+		}
+		// 128-bit values keep only their low 64 bits; nothing looked up here needs more
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if typ == mmdbInt32 {
+			return int64(int32(uint32(n))), offset, nil
+		}
+		return n, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", typ)
+}
+
+// pointer decodes the target of a pointer whose control byte is ctrl
+func (d mmdbDecoder) pointer(ctrl byte, offset uint) (target, next uint, err error) {
+	n := uint(ctrl>>3)&3 + 1
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	var v uint
+	if n < 4 {
+		v = uint(ctrl & 7)
+	}
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+	return v, offset + n, nil
+}
+
+// size decodes the payload size that follows a control byte
+func (d mmdbDecoder) size(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	var v uint
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	switch n {
+	case 1:
+		v += 29
+	case 2:
+		v += 285
+	case 3:
+		v += 65821
+	}
+	return v, offset + n, nil
+}
+
+func (d mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset > uint(len(d.buf)) || n > uint(len(d.buf))-offset {
+		return nil, errCorruptGeoIPDatabase
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// mmdbUint reads an unsigned metadata field
+func mmdbUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 	"time"
 )
 
-type creds struct{ Email, Password string }
+type creds struct {
+	Email, Password string
+	OrganizationID  *int64 // Optional organization to scope the session to
+	DeviceID        string // Optional stable client identifier, used to score the login's risk
+}
 
 func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	var c creds
@@ -18,10 +23,14 @@ func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Email and password are required")
 		return
 	}
+	if !a.checkRateLimitRules(w, r, "register", rateLimitIdentity{Email: c.Email}) {
+		return
+	}
 
 	// Get application from context if available
 	var appID *int64
-	if app, ok := r.Context().Value("application").(*Application); ok && app != nil {
+	app := applicationFromRequest(r)
+	if app != nil {
 		appID = &app.ID
 	}
 
@@ -30,22 +39,23 @@ func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to process password")
 		return
 	}
-	user, err := a.DB.CreateUser(c.Email, hashed, appID)
+	user, err := a.DB.CreateUser(c.Email, hashed, appID, userNamespace(app))
 	if err != nil {
 		writeError(w, http.StatusConflict, "USER_EXISTS", "User with this email already exists")
 		return
 	}
-	access, _ := createAccessToken(user.ID)
-	ref, _ := genToken(32)
-	a.DB.CreateRefreshToken(ref, user.ID, time.Now().Add(30*24*time.Hour).Unix(), appID)
-	writeJSON(w, http.StatusCreated, map[string]interface{}{
+	access, ref, err := a.issueTokens(tokenGrant{User: user, ApplicationID: appID, Login: newAuthentication(amrPassword)})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue tokens")
+		return
+	}
+	writeSession(w, r, http.StatusCreated, app, map[string]interface{}{
 		"user": map[string]interface{}{
 			"id":    user.ID,
 			"email": user.Email,
 		},
-		"accessToken":  access,
-		"refreshToken": ref,
-	})
+		"accessToken": access,
+	}, ref)
 }
 
 func (a *App) HandleLogin(w http.ResponseWriter, r *http.Request) {
@@ -54,46 +64,102 @@ func (a *App) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
 		return
 	}
-	user, err := a.DB.GetUserByEmail(c.Email)
-	if err != nil || user == nil {
-		writeError(w, http.StatusUnauthorized, "INVALID_CREDENTIALS", "Invalid email or password")
+	if !a.checkRateLimitRules(w, r, "login", rateLimitIdentity{Email: c.Email}) {
 		return
 	}
-	if !comparePassword(user.Password, c.Password) {
+	// Get application from context if available
+	var appID *int64
+	app := applicationFromRequest(r)
+	if app != nil {
+		appID = &app.ID
+	}
+
+	user, err := a.verifyCredentials(r, app, c.Email, c.Password)
+	if err == errDirectoryUnavailable {
+		writeError(w, http.StatusServiceUnavailable, "DIRECTORY_UNAVAILABLE", "The user directory is unavailable")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to verify credentials")
+		return
+	}
+	if user == nil {
+		a.recordFailedLogin(r, app, c.Email, c.DeviceID)
 		writeError(w, http.StatusUnauthorized, "INVALID_CREDENTIALS", "Invalid email or password")
 		return
 	}
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "USER_DISABLED", "User account is disabled")
+		return
+	}
 
-	// Get application from context if available
-	var appID *int64
-	if app, ok := r.Context().Value("application").(*Application); ok && app != nil {
-		appID = &app.ID
+	// Optionally scope the session to one of the user's organizations
+	if c.OrganizationID != nil && !a.requireOrganizationMember(w, *c.OrganizationID, user.ID, app) {
+		return
 	}
 
-	access, _ := createAccessToken(user.ID)
-	ref, _ := genToken(32)
-	a.DB.CreateRefreshToken(ref, user.ID, time.Now().Add(30*24*time.Hour).Unix(), appID)
-	writeJSON(w, http.StatusOK, map[string]interface{}{
+	// Unusual logins are reported to the user; risky ones need a second factor, or a
+	// code sent by email when the user has none
+	login := a.assessLogin(r, user, app, c.DeviceID)
+	if login.RiskLevel == riskMedium {
+		a.notifyUnusualLogin(user, login)
+	}
+	challenge := mfaChallenge{UserID: user.ID, ApplicationID: appID, OrganizationID: c.OrganizationID}
+	if user.TOTPSecret != "" {
+		a.recordLogin(login, loginChallenged)
+		challenge.LoginEventID = login.ID
+		writeMFARequired(w, challenge)
+		return
+	}
+	if login.RiskLevel == riskHigh {
+		a.recordLogin(login, loginChallenged)
+		challenge.LoginEventID = login.ID
+		a.writeLoginConfirmationRequired(w, user, challenge, login)
+		return
+	}
+	a.recordLogin(login, loginSucceeded)
+
+	access, ref, err := a.issueTokens(tokenGrant{User: user, ApplicationID: appID, OrganizationID: c.OrganizationID, Login: newAuthentication(amrPassword)})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue tokens")
+		return
+	}
+	writeSession(w, r, http.StatusOK, app, map[string]interface{}{
 		"user": map[string]interface{}{
 			"id":    user.ID,
 			"email": user.Email,
 		},
-		"accessToken":  access,
-		"refreshToken": ref,
-	})
+		"accessToken": access,
+	}, ref)
 }
 
 func (a *App) HandleRefresh(w http.ResponseWriter, r *http.Request) {
-	var in struct{ RefreshToken string }
-	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+	var in struct {
+		RefreshToken   string
+		OrganizationID *int64 // Optional: switch the session to another organization
+	}
+	// Cookie sessions may post an empty body
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil && err != io.EOF {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
 		return
 	}
-	if in.RefreshToken == "" {
+	app := applicationFromRequest(r)
+	refresh, _, ok := sessionRefreshToken(w, r, app, in.RefreshToken)
+	if !ok {
+		return
+	}
+	if refresh == "" {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Refresh token is required")
 		return
 	}
-	row, _ := a.DB.GetRefreshToken(in.RefreshToken)
+	row, _ := a.DB.GetRefreshToken(refresh)
+	var userID int64
+	if row != nil {
+		userID = row.UserID
+	}
+	if !a.checkRateLimitRules(w, r, "refresh", rateLimitIdentity{UserID: userID}) {
+		return
+	}
 	if row == nil {
 		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid refresh token")
 		return
@@ -110,34 +176,153 @@ func (a *App) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 
 	// Get application from context if available
 	var appID *int64
-	if app, ok := r.Context().Value("application").(*Application); ok && app != nil {
+	if app != nil {
 		appID = &app.ID
 	} else if row.ApplicationID != nil {
 		appID = row.ApplicationID
 	}
 
+	// Tokens can only be refreshed from within the user's namespace
+	user, _ := a.DB.GetUserByID(row.UserID)
+	if user == nil || (app != nil && user.NamespaceID != userNamespace(app)) {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid refresh token")
+		return
+	}
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "USER_DISABLED", "User account is disabled")
+		return
+	}
+
+	orgID := row.OrganizationID
+	if in.OrganizationID != nil {
+		if !a.requireOrganizationMember(w, *in.OrganizationID, user.ID, app) {
+			return
+		}
+		orgID = in.OrganizationID
+	}
+
 	// rotate
-	a.DB.RevokeRefreshToken(in.RefreshToken)
-	newRef, _ := genToken(32)
-	a.DB.CreateRefreshToken(newRef, row.UserID, time.Now().Add(30*24*time.Hour).Unix(), appID)
-	access, _ := createAccessToken(row.UserID)
-	writeJSON(w, http.StatusOK, map[string]string{
-		"accessToken":  access,
-		"refreshToken": newRef,
-	})
+	a.DB.RevokeRefreshToken(refresh)
+	access, newRef, err := a.issueTokens(tokenGrant{User: user, ApplicationID: appID, OrganizationID: orgID, Login: authentication{Time: row.AuthTime, AMR: row.AMR}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue tokens")
+		return
+	}
+	writeSession(w, r, http.StatusOK, app, map[string]interface{}{"accessToken": access}, newRef)
+}
+
+// HandleReauthenticate has a signed-in user confirm their password, and their one-time
+// code when MFA is on, without logging out. The new tokens carry a fresh auth_time;
+// the session's refresh token, if sent, is rotated so later refreshes keep it.
+// POST /api/v1/auth/reauthenticate
+func (a *App) HandleReauthenticate(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if in.Password == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "password is required")
+		return
+	}
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "USER_DISABLED", "User account is disabled")
+		return
+	}
+	if !a.checkRateLimitRules(w, r, "login", rateLimitIdentity{Email: user.Email}) {
+		return
+	}
+	app := applicationFromRequest(r)
+	verified, err := a.verifyCredentials(r, app, user.Email, in.Password)
+	if err == errDirectoryUnavailable {
+		writeError(w, http.StatusServiceUnavailable, "DIRECTORY_UNAVAILABLE", "The user directory is unavailable")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to verify credentials")
+		return
+	}
+	if verified == nil || verified.ID != user.ID {
+		writeError(w, http.StatusUnauthorized, "INVALID_CREDENTIALS", "Invalid password")
+		return
+	}
+
+	// A re-authentication is never weaker than the user's login
+	methods := []string{amrPassword}
+	switch {
+	case user.TOTPSecret != "" && in.Code == "":
+		writeError(w, http.StatusUnauthorized, "MFA_REQUIRED", "A one-time code is required")
+		return
+	case user.TOTPSecret == "" && in.Code != "":
+		writeError(w, http.StatusConflict, "MFA_NOT_ENABLED", "MFA is not enabled")
+		return
+	case in.Code != "":
+		accepted, err := a.acceptTOTP(user.ID, user.TOTPSecret, in.Code)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to verify one-time code")
+			return
+		}
+		if !accepted {
+			writeError(w, http.StatusUnauthorized, "INVALID_MFA_CODE", "Invalid one-time code")
+			return
+		}
+		methods = append(methods, amrOTP)
+	}
+
+	refresh, _, ok := sessionRefreshToken(w, r, app, in.RefreshToken)
+	if !ok {
+		return
+	}
+	var orgID *int64
+	if refresh != "" {
+		row, _ := a.DB.GetRefreshToken(refresh)
+		if row == nil || row.Revoked || row.UserID != user.ID || row.ExpiresAt < time.Now().Unix() {
+			writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Invalid refresh token")
+			return
+		}
+		orgID = row.OrganizationID
+		a.DB.RevokeRefreshToken(refresh)
+	}
+
+	var appID *int64
+	if app != nil {
+		appID = &app.ID
+	}
+	access, ref, err := a.issueTokens(tokenGrant{User: user, ApplicationID: appID, OrganizationID: orgID, Login: newAuthentication(methods...)})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue tokens")
+		return
+	}
+	writeSession(w, r, http.StatusOK, app, map[string]interface{}{"accessToken": access}, ref)
 }
 
 func (a *App) HandleLogout(w http.ResponseWriter, r *http.Request) {
 	var in struct{ RefreshToken string }
-	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil && err != io.EOF {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
 		return
 	}
-	if in.RefreshToken == "" {
+	app := applicationFromRequest(r)
+	refresh, fromCookie, ok := sessionRefreshToken(w, r, app, in.RefreshToken)
+	if !ok {
+		return
+	}
+	if refresh == "" {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Refresh token is required")
 		return
 	}
-	err := a.DB.RevokeRefreshToken(in.RefreshToken)
+	if fromCookie {
+		clearSessionCookies(w, r, app)
+	}
+	err := a.DB.RevokeRefreshToken(refresh)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, "INVALID_TOKEN", "Token not found or already revoked")
 		return
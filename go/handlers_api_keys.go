@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultKeyRotationGrace is how long replaced keys keep working when API_KEY_ROTATION_GRACE is unset
+const defaultKeyRotationGrace = 24 * time.Hour
+
+func apiKeyJSON(k *APIKey) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           k.ID,
+		"label":        k.Label,
+		"key_prefix":   k.KeyPrefix,
+		"operations":   keyOperations(k),
+		"created_at":   k.CreatedAt,
+		"last_used_at": k.LastUsedAt,
+		"expires_at":   k.ExpiresAt,
+		"revoked_at":   k.RevokedAt,
+		"active":       k.RevokedAt == nil && (k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt)),
+	}
+}
+
+// keyOperations returns a key's allowed operations, never nil so JSON shows an empty list
+// for unrestricted keys
+func keyOperations(k *APIKey) []string {
+	if k.Operations == nil {
+		return []string{}
+	}
+	return k.Operations
+}
+
+// newAPIKey generates a key for an application, returning the stored record and the plaintext key
+func newAPIKey(applicationID int64, label string) (*APIKey, string, error) {
+	plain, err := generateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := newAPIKeyRecord(plain, label)
+	if err != nil {
+		return nil, "", err
+	}
+	key.ApplicationID = applicationID
+	return key, plain, nil
+}
+
+// HandleListAPIKeys lists an application's API keys, including expired and revoked ones
+// GET /api/v1/admin/applications/{id}/keys
+func (a *App) HandleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	keys, err := a.DB.ListAPIKeys(target.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list API keys")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, apiKeyJSON(k))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"keys": out})
+}
+
+// HandleCreateAPIKey adds another API key to an application
+// POST /api/v1/admin/applications/{id}/keys
+func (a *App) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label            string   `json:"label"`
+		ExpiresInSeconds int64    `json:"expires_in_seconds"`
+		Operations       []string `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.ExpiresInSeconds < 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "expires_in_seconds cannot be negative")
+		return
+	}
+	operations, err := validateOperations(req.Operations)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+
+	key, plain, err := newAPIKey(target.ID, strings.TrimSpace(req.Label))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate API key")
+		return
+	}
+	key.Operations = operations
+	if req.ExpiresInSeconds > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		key.ExpiresAt = &expiresAt
+	}
+	if err := a.DB.CreateAPIKey(key); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create API key")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{
+		"key":     apiKeyJSON(key),
+		"api_key": plain, // Only returned on creation
+	})
+}
+
+// HandleRotateAPIKey issues a new API key and lets the application's existing keys
+// keep working until the grace period ends
+// POST /api/v1/admin/applications/{id}/keys/rotate
+func (a *App) HandleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Label              string   `json:"label"`
+		GracePeriodSeconds *int64   `json:"grace_period_seconds"`
+		Operations         []string `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	grace := a.KeyRotationGrace
+	if grace <= 0 {
+		grace = defaultKeyRotationGrace
+	}
+	if req.GracePeriodSeconds != nil {
+		if *req.GracePeriodSeconds < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "grace_period_seconds cannot be negative")
+			return
+		}
+		grace = time.Duration(*req.GracePeriodSeconds) * time.Second
+	}
+	operations, err := validateOperations(req.Operations)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	if req.Operations == nil {
+		// Without explicit operations the new key keeps the restrictions of the newest active key
+		operations, err = a.latestAPIKeyOperations(target.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load API keys")
+			return
+		}
+	}
+
+	label := strings.TrimSpace(req.Label)
+	if label == "" {
+		label = "rotated " + time.Now().UTC().Format("2006-01-02")
+	}
+	key, plain, err := newAPIKey(target.ID, label)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate API key")
+		return
+	}
+	key.Operations = operations
+	oldKeysExpireAt := time.Now().Add(grace)
+	if err := a.DB.RotateAPIKeys(key, oldKeysExpireAt); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to rotate API key")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{
+		"key":                     apiKeyJSON(key),
+		"api_key":                 plain, // Only returned on creation
+		"previous_keys_expire_at": oldKeysExpireAt,
+	})
+}
+
+// latestAPIKeyOperations returns the operations of an application's most recently created active key
+func (a *App) latestAPIKeyOperations(applicationID int64) ([]string, error) {
+	keys, err := a.DB.ListAPIKeys(applicationID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var latest *APIKey
+	for _, k := range keys {
+		if k.RevokedAt != nil || (k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)) {
+			continue
+		}
+		if latest == nil || k.CreatedAt.After(latest.CreatedAt) || (k.CreatedAt.Equal(latest.CreatedAt) && k.ID > latest.ID) {
+			latest = k
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	return latest.Operations, nil
+}
+
+// HandleUpdateAPIKey replaces the operations an API key may call. An empty list lifts
+// all restrictions.
+// PUT /api/v1/admin/applications/{id}/keys/{keyId}
+func (a *App) HandleUpdateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Operations []string `json:"operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.Operations == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "operations is required")
+		return
+	}
+	operations, err := validateOperations(req.Operations)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	keyID, ok := pathID(w, r, "keyId")
+	if !ok {
+		return
+	}
+	if err := a.DB.SetAPIKeyOperations(target.ID, keyID, operations); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "API key not found")
+		return
+	}
+	keys, err := a.DB.ListAPIKeys(target.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load API key")
+		return
+	}
+	for _, k := range keys {
+		if k.ID == keyID {
+			writeSuccess(w, http.StatusOK, map[string]interface{}{"key": apiKeyJSON(k)})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "NOT_FOUND", "API key not found")
+}
+
+// HandleRevokeAPIKey revokes an API key immediately
+// DELETE /api/v1/admin/applications/{id}/keys/{keyId}
+func (a *App) HandleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	keyID, ok := pathID(w, r, "keyId")
+	if !ok {
+		return
+	}
+	if err := a.DB.RevokeAPIKey(target.ID, keyID); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "API key not found or already revoked")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"revoked": true})
+}
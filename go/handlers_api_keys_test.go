@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateAPIKeyGracePeriod(t *testing.T) {
+	a, r, rootKey := newAdminTestApp(t)
+	target, original := addTestApplication(t, a, "shop", false)
+	path := "/api/v1/admin/applications/" + strconv.FormatInt(target.ID, 10) + "/keys/rotate"
+	rotate := func(graceSeconds int) string {
+		status, data := adminCall(t, r, rootKey, "POST", path, `{"grace_period_seconds":`+strconv.Itoa(graceSeconds)+`}`)
+		require.Equal(t, http.StatusCreated, status)
+		return data["api_key"].(string)
+	}
+	valid := func(key string) bool {
+		app, _ := a.validateAPIKey(key)
+		return app != nil && app.ID == target.ID
+	}
+
+	status, _ := adminCall(t, r, rootKey, "POST", path, `{"grace_period_seconds":-1}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// replaced keys keep working through the grace period
+	second := rotate(3600)
+	require.True(t, valid(original))
+	require.True(t, valid(second))
+
+	// a shorter grace period cuts the earlier ones short, a longer one never extends them
+	third := rotate(1)
+	fourth := rotate(3600)
+	for _, key := range []string{original, second, third, fourth} {
+		require.True(t, valid(key))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	require.False(t, valid(original))
+	require.False(t, valid(second))
+	require.True(t, valid(third))
+	require.True(t, valid(fourth))
+
+	keys, err := a.DB.ListAPIKeys(target.ID)
+	require.NoError(t, err)
+	require.Len(t, keys, 4)
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +16,9 @@ import (
 func (a *App) HandleTokenIntrospect(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Token string `json:"token"`
+		// MaxAge and ACR optionally require a recent or strong enough login
+		MaxAge *int64 `json:"max_age"`
+		ACR    string `json:"acr"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -25,6 +30,11 @@ func (a *App) HandleTokenIntrospect(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Token is required")
 		return
 	}
+	requirement, err := parseAuthRequirement(req.MaxAge, req.ACR)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
 
 	// Try to parse as JWT access token first
 	token, err := jwt.Parse(req.Token, func(token *jwt.Token) (interface{}, error) {
@@ -33,10 +43,15 @@ func (a *App) HandleTokenIntrospect(w http.ResponseWriter, r *http.Request) {
 
 	info := TokenInfo{Active: false}
 
+	app := applicationFromRequest(r)
 	if err == nil && token.Valid {
 		claims, ok := token.Claims.(jwt.MapClaims)
-		if ok {
-			info.Active = true
+		if ok && (app == nil || claimsNamespace(claims) == userNamespace(app)) {
+			// A token whose login is too old or too weak is inactive for this caller
+			info.StepUpRequired = !requirement.satisfiedBy(claims, time.Now())
+			info.Active = !info.StepUpRequired
+		}
+		if info.Active {
 			if userId, ok := claims["userId"].(float64); ok {
 				uid := int64(userId)
 				info.UserID = &uid
@@ -45,11 +60,19 @@ func (a *App) HandleTokenIntrospect(w http.ResponseWriter, r *http.Request) {
 				expTime := int64(exp)
 				info.ExpiresAt = &expTime
 			}
+			info.Scopes = claimsPermissions(claims)
+			info.Act = impersonationActor(claims)
+			if login := claimsAuthentication(claims); login.Time != 0 {
+				info.AuthTime = &login.Time
+				info.AMR = login.AMR
+				info.ACR, _ = claims["acr"].(string)
+			}
 		}
-	} else {
-		// Try as refresh token
+	} else if requirement == (authRequirement{}) {
+		// Try as refresh token. Refresh tokens say nothing about how recent the login
+		// is, so they never meet a max_age or acr requirement.
 		rt, _ := a.DB.GetRefreshToken(req.Token)
-		if rt != nil && !rt.Revoked && rt.ExpiresAt > time.Now().Unix() {
+		if rt != nil && !rt.Revoked && rt.ExpiresAt > time.Now().Unix() && a.userInNamespace(rt.UserID, app) {
 			info.Active = true
 			info.UserID = &rt.UserID
 			info.ExpiresAt = &rt.ExpiresAt
@@ -59,8 +82,9 @@ func (a *App) HandleTokenIntrospect(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, info)
 }
 
-// HandleTokenValidate validates an access token
-// GET /api/v1/auth/validate?token=...
+// HandleTokenValidate validates an access token, optionally requiring a login no older
+// than max_age seconds or of at least the given acr
+// GET /api/v1/auth/validate?token=...&max_age=300&acr=aal2
 func (a *App) HandleTokenValidate(w http.ResponseWriter, r *http.Request) {
 	tokenStr := r.URL.Query().Get("token")
 	if tokenStr == "" {
@@ -75,6 +99,20 @@ func (a *App) HandleTokenValidate(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Token is required")
 		return
 	}
+	var maxAge *int64
+	if raw := r.URL.Query().Get("max_age"); raw != "" {
+		seconds, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid max_age")
+			return
+		}
+		maxAge = &seconds
+	}
+	requirement, err := parseAuthRequirement(maxAge, r.URL.Query().Get("acr"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
 
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
@@ -91,21 +129,54 @@ func (a *App) HandleTokenValidate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeSuccess(w, http.StatusOK, map[string]interface{}{
-		"valid":  true,
-		"userId": claims["userId"],
-		"exp":    claims["exp"],
-	})
+	// Tokens from another namespace are not valid for this application
+	if app := applicationFromRequest(r); app != nil && claimsNamespace(claims) != userNamespace(app) {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Token is invalid or expired")
+		return
+	}
+
+	if !requirement.satisfiedBy(claims, time.Now()) {
+		w.Header().Set("WWW-Authenticate", requirement.challenge())
+		writeError(w, http.StatusUnauthorized, "INSUFFICIENT_AUTHENTICATION", "A more recent or stronger login is required")
+		return
+	}
+
+	out := map[string]interface{}{
+		"valid":       true,
+		"userId":      claims["userId"],
+		"exp":         claims["exp"],
+		"permissions": claimsPermissions(claims),
+	}
+	if login := claimsAuthentication(claims); login.Time != 0 {
+		out["authTime"] = login.Time
+		out["amr"] = login.AMR
+		out["acr"] = claims["acr"]
+	}
+	writeSuccess(w, http.StatusOK, out)
 }
 
 // HandleCreateApplication creates a new application/client
 // POST /api/v1/admin/applications
 func (a *App) HandleCreateApplication(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Name              string   `json:"name"`
-		Domain            string   `json:"domain"`
-		RateLimitPerMinute int     `json:"rate_limit_per_minute"`
-		AllowedOrigins    []string `json:"allowed_origins"`
+		Name               string   `json:"name"`
+		Domain             string   `json:"domain"`
+		RateLimitPerMinute int      `json:"rate_limit_per_minute"`
+		AllowedOrigins     []string `json:"allowed_origins"`
+		IsolatedUsers      bool     `json:"isolated_users"`
+		Scopes             []string `json:"scopes"`
+		// Operations restricts the application's first API key; empty allows all
+		Operations  []string `json:"operations"`
+		IPAllowlist []string `json:"ip_allowlist"`
+		IPDenylist  []string `json:"ip_denylist"`
+		// SessionCookie opts browser clients into cookie sessions (strict, lax or none)
+		SessionCookie string `json:"session_cookie"`
+		// Branding customizes the hosted login pages
+		Branding Branding `json:"branding"`
+		// RedirectURIs are the exact URLs the hosted pages may redirect back to
+		RedirectURIs []string `json:"redirect_uris"`
+		// ClientType is confidential (default) or public; public clients must use PKCE
+		ClientType string `json:"client_type"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -117,11 +188,56 @@ func (a *App) HandleCreateApplication(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Name and domain are required")
 		return
 	}
+	operations, err := validateOperations(req.Operations)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	allowlist, err := normalizeIPList("ip_allowlist", req.IPAllowlist)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	denylist, err := normalizeIPList("ip_denylist", req.IPDenylist)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	origins, err := normalizeOriginList(req.AllowedOrigins)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	sessionCookie, err := normalizeSessionCookie(req.SessionCookie)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	branding, err := normalizeBranding(req.Branding)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	redirectURIs, err := normalizeRedirectURIs(req.RedirectURIs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	clientType, err := normalizeClientType(req.ClientType)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
 
 	if req.RateLimitPerMinute <= 0 {
 		req.RateLimitPerMinute = 100 // default
 	}
 
+	scopeIDs, ok := a.resolveScopes(w, req.Scopes)
+	if !ok || !a.checkGrantableScopes(w, r, req.Scopes) {
+		return
+	}
+
 	// Generate API key
 	apiKey, err := generateAPIKey()
 	if err != nil {
@@ -129,40 +245,431 @@ func (a *App) HandleCreateApplication(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiKeyHash, err := hashAPIKey(apiKey)
+	key, err := newAPIKeyRecord(apiKey, defaultAPIKeyLabel)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to hash API key")
 		return
 	}
+	key.Operations = operations
 
-	apiKeyPrefix := getAPIKeyPrefix(apiKey)
-
-	app, err := a.DB.CreateApplication(req.Name, req.Domain, apiKeyHash, apiKeyPrefix, req.RateLimitPerMinute, req.AllowedOrigins)
+	app, err := a.DB.CreateApplication(req.Name, req.Domain, key, req.RateLimitPerMinute, origins, req.IsolatedUsers)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create application")
 		return
 	}
+	a.preflightOrigins.invalidate()
+	if len(scopeIDs) > 0 {
+		if err := a.DB.SetApplicationScopes(app.ID, scopeIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to grant application scopes")
+			return
+		}
+	}
+	if len(allowlist) > 0 || len(denylist) > 0 || sessionCookie != "" || !branding.empty() || len(redirectURIs) > 0 || clientType != clientTypeConfidential {
+		app.IPAllowlist, app.IPDenylist, app.SessionCookie, app.Branding = allowlist, denylist, sessionCookie, branding
+		app.RedirectURIs, app.ClientType = redirectURIs, clientType
+		if err := a.DB.UpdateApplication(app); err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to store application settings")
+			return
+		}
+	}
 
 	// Return API key only once (should be stored securely by client)
+	out := applicationJSON(app)
+	out["scopes"] = req.Scopes
 	writeSuccess(w, http.StatusCreated, map[string]interface{}{
-		"application": map[string]interface{}{
-			"id":                  app.ID,
-			"name":                app.Name,
-			"domain":              app.Domain,
-			"api_key_prefix":      app.APIKeyPrefix,
-			"rate_limit_per_minute": app.RateLimitPerMinute,
-			"allowed_origins":     app.AllowedOrigins,
-		},
-		"api_key": apiKey, // Only returned on creation
+		"application": out,
+		"key":         apiKeyJSON(key),
+		"api_key":     apiKey, // Only returned on creation
 	})
 }
 
-// HandleGetApplications lists all applications
-// GET /api/v1/admin/applications
+// HandleGetApplications lists applications, optionally filtered by active state and domain
+// GET /api/v1/admin/applications?active=true&domain=app.example.com&limit=50&offset=0
 func (a *App) HandleGetApplications(w http.ResponseWriter, r *http.Request) {
-	// This would require a ListApplications method in DB interface
-	// For now, return not implemented
-	writeError(w, http.StatusNotImplemented, "NOT_IMPLEMENTED", "List applications not yet implemented")
+	limit, offset, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	filter := ApplicationFilter{Domain: r.URL.Query().Get("domain"), Limit: limit, Offset: offset}
+	if raw := r.URL.Query().Get("active"); raw != "" {
+		active, err := strconv.ParseBool(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid active filter")
+			return
+		}
+		filter.Active = &active
+	}
+
+	apps, total, err := a.DB.ListApplications(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list applications")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(apps))
+	for _, app := range apps {
+		out = append(out, applicationJSON(app))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"applications": out,
+		"total":        total,
+		"limit":        limit,
+		"offset":       offset,
+	})
+}
+
+// HandleGetApplication returns a single application with its scopes
+// GET /api/v1/admin/applications/{id}
+func (a *App) HandleGetApplication(w http.ResponseWriter, r *http.Request) {
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	scopes, err := a.DB.GetScopesByApplicationID(target.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application scopes")
+		return
+	}
+	names := []string{}
+	for _, scope := range scopes {
+		names = append(names, scope.Name)
+	}
+	out := applicationJSON(target)
+	out["scopes"] = names
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"application": out})
+}
+
+// HandleUpdateApplication updates an application's name, domain, rate limit, allowed origins
+// or IP allow and deny lists.
+// Omitted fields are left unchanged.
+// PUT /api/v1/admin/applications/{id}
+func (a *App) HandleUpdateApplication(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name               *string   `json:"name"`
+		Domain             *string   `json:"domain"`
+		RateLimitPerMinute *int      `json:"rate_limit_per_minute"`
+		AllowedOrigins     *[]string `json:"allowed_origins"`
+		IPAllowlist        *[]string `json:"ip_allowlist"`
+		IPDenylist         *[]string `json:"ip_denylist"`
+		SessionCookie      *string   `json:"session_cookie"`
+		Branding           *Branding `json:"branding"`
+		RedirectURIs       *[]string `json:"redirect_uris"`
+		ClientType         *string   `json:"client_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+
+	updated := *target
+	if req.Name != nil {
+		updated.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Domain != nil {
+		updated.Domain = strings.TrimSpace(*req.Domain)
+	}
+	if updated.Name == "" || updated.Domain == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Name and domain cannot be empty")
+		return
+	}
+	if req.RateLimitPerMinute != nil {
+		if *req.RateLimitPerMinute <= 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "rate_limit_per_minute must be positive")
+			return
+		}
+		updated.RateLimitPerMinute = *req.RateLimitPerMinute
+	}
+	if req.AllowedOrigins != nil {
+		origins, err := normalizeOriginList(*req.AllowedOrigins)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		updated.AllowedOrigins = origins
+	}
+	if req.IPAllowlist != nil {
+		list, err := normalizeIPList("ip_allowlist", *req.IPAllowlist)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		updated.IPAllowlist = list
+	}
+	if req.IPDenylist != nil {
+		list, err := normalizeIPList("ip_denylist", *req.IPDenylist)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		updated.IPDenylist = list
+	}
+	if req.SessionCookie != nil {
+		mode, err := normalizeSessionCookie(*req.SessionCookie)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		updated.SessionCookie = mode
+	}
+	if req.Branding != nil {
+		branding, err := normalizeBranding(*req.Branding)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		updated.Branding = branding
+	}
+	if req.RedirectURIs != nil {
+		uris, err := normalizeRedirectURIs(*req.RedirectURIs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		updated.RedirectURIs = uris
+	}
+	if req.ClientType != nil {
+		clientType, err := normalizeClientType(*req.ClientType)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		updated.ClientType = clientType
+	}
+
+	if err := a.DB.UpdateApplication(&updated); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update application")
+		return
+	}
+	a.preflightOrigins.invalidate()
+	if fresh, err := a.DB.GetApplicationByID(updated.ID); err == nil && fresh != nil {
+		updated = *fresh
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"application": applicationJSON(&updated)})
+}
+
+// HandleDeactivateApplication disables an application; its API key is rejected from then on
+// POST /api/v1/admin/applications/{id}/deactivate
+func (a *App) HandleDeactivateApplication(w http.ResponseWriter, r *http.Request) {
+	a.setApplicationActive(w, r, false)
+}
+
+// HandleActivateApplication re-enables a deactivated application
+// POST /api/v1/admin/applications/{id}/activate
+func (a *App) HandleActivateApplication(w http.ResponseWriter, r *http.Request) {
+	a.setApplicationActive(w, r, true)
+}
+
+func (a *App) setApplicationActive(w http.ResponseWriter, r *http.Request, active bool) {
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	if !active && isCallingApplication(r, target.ID) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "An application cannot deactivate itself")
+		return
+	}
+	updated := *target
+	updated.Active = active
+	if err := a.DB.UpdateApplication(&updated); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update application")
+		return
+	}
+	a.preflightOrigins.invalidate()
+	if fresh, err := a.DB.GetApplicationByID(updated.ID); err == nil && fresh != nil {
+		updated = *fresh
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"application": applicationJSON(&updated)})
+}
+
+// HandleDeleteApplication permanently deletes an application. Without reassign_to, users in its
+// isolated namespace and the refresh tokens it issued are deleted; with it, they are moved to
+// the given application.
+// DELETE /api/v1/admin/applications/{id}?reassign_to={id}
+func (a *App) HandleDeleteApplication(w http.ResponseWriter, r *http.Request) {
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	if isCallingApplication(r, target.ID) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "An application cannot delete itself")
+		return
+	}
+	var reassignTo *int64
+	if raw := r.URL.Query().Get("reassign_to"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id == target.ID {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid reassign_to")
+			return
+		}
+		other, err := a.DB.GetApplicationByID(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application")
+			return
+		}
+		if other == nil {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Reassignment target not found")
+			return
+		}
+		reassignTo = &id
+	}
+
+	if err := a.DB.DeleteApplication(target.ID, reassignTo); err != nil {
+		if err == errNamespaceConflict {
+			writeError(w, http.StatusConflict, "USER_EXISTS", "Some users already exist in the target application's namespace")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete application")
+		return
+	}
+	a.preflightOrigins.invalidate()
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"deleted":     true,
+		"reassign_to": reassignTo,
+	})
+}
+
+// loadApplication resolves the {id} route variable, writing an error response and returning nil when it fails
+func (a *App) loadApplication(w http.ResponseWriter, r *http.Request) *Application {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil
+	}
+	target, err := a.DB.GetApplicationByID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application")
+		return nil
+	}
+	if target == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Application not found")
+		return nil
+	}
+	return target
+}
+
+// isCallingApplication reports whether id is the application making the request
+func isCallingApplication(r *http.Request, id int64) bool {
+	app := applicationFromRequest(r)
+	return app != nil && app.ID == id
+}
+
+func applicationJSON(app *Application) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                    app.ID,
+		"name":                  app.Name,
+		"domain":                app.Domain,
+		"api_key_prefix":        app.APIKeyPrefix,
+		"rate_limit_per_minute": app.RateLimitPerMinute,
+		"allowed_origins":       app.AllowedOrigins,
+		"ip_allowlist":          stringListJSON(app.IPAllowlist),
+		"ip_denylist":           stringListJSON(app.IPDenylist),
+		"session_cookie":        app.SessionCookie,
+		"branding":              app.Branding,
+		"redirect_uris":         stringListJSON(app.RedirectURIs),
+		"client_type":           app.ClientType,
+		"isolated_users":        app.IsolatedUsers,
+		"active":                app.Active,
+		"created_at":            app.CreatedAt,
+		"updated_at":            app.UpdatedAt,
+	}
+}
+
+// stringListJSON renders an unset list as an empty array
+func stringListJSON(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// Pagination defaults for list endpoints
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// pagination parses the limit and offset query parameters
+func pagination(r *http.Request) (limit, offset int, err error) {
+	limit, offset = defaultPageSize, 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit <= 0 {
+			return 0, 0, errors.New("Invalid limit")
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+	}
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil || offset < 0 {
+			return 0, 0, errors.New("Invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+// checkGrantableScopes refuses to grant admin scopes the calling application does not
+// hold itself, so one admin scope cannot be used to obtain the other. It reports false
+// after writing an error.
+func (a *App) checkGrantableScopes(w http.ResponseWriter, r *http.Request, names []string) bool {
+	caller := applicationFromRequest(r)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "admin:") {
+			continue
+		}
+		held := false
+		if caller != nil {
+			var err error
+			if held, err = a.applicationHasScope(caller.ID, name); err != nil {
+				writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application scopes")
+				return false
+			}
+		}
+		if !held {
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "Only applications holding the "+name+" scope can grant it")
+			return false
+		}
+	}
+	return true
+}
+
+// HandleSetApplicationScopes replaces the scopes granted to an application
+// PUT /api/v1/admin/applications/{id}/scopes
+func (a *App) HandleSetApplicationScopes(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	target, err := a.DB.GetApplicationByID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application")
+		return
+	}
+	if target == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Application not found")
+		return
+	}
+	scopeIDs, ok := a.resolveScopes(w, req.Scopes)
+	if !ok || !a.checkGrantableScopes(w, r, req.Scopes) {
+		return
+	}
+	if err := a.DB.SetApplicationScopes(id, scopeIDs); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to set application scopes")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"application_id": id,
+		"scopes":         req.Scopes,
+	})
 }
 
 // HandleRevokeToken revokes a specific token
@@ -192,3 +699,11 @@ func (a *App) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
 	writeSuccess(w, http.StatusOK, map[string]bool{"revoked": true})
 }
 
+// userInNamespace reports whether a user belongs to the namespace of the calling application
+func (a *App) userInNamespace(userID int64, app *Application) bool {
+	if app == nil {
+		return true
+	}
+	user, err := a.DB.GetUserByID(userID)
+	return err == nil && user != nil && user.NamespaceID == userNamespace(app)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newAdminTestApp returns an App with its routes and the API key of an application
+// holding every admin scope
+func newAdminTestApp(t *testing.T) (*App, http.Handler, string) {
+	t.Helper()
+	rootKey, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, rootKey)
+	_, _, err = bootstrapAdminApplication(a.DB, "root", "root.example.com", rootKey)
+	require.NoError(t, err)
+	return a, newRouter(a), rootKey
+}
+
+// adminCall sends a request through the router and returns the status and the data of
+// a success response, or the whole body of an error
+func adminCall(t *testing.T, r http.Handler, key, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out), rec.Body.String())
+	if data, ok := out["data"].(map[string]interface{}); ok {
+		return rec.Code, data
+	}
+	return rec.Code, out
+}
+
+func TestApplicationUpdateAndDeactivation(t *testing.T) {
+	a, r, rootKey := newAdminTestApp(t)
+	root, _ := a.validateAPIKey(rootKey)
+	target, targetKey := addTestApplication(t, a, "shop", false)
+	path := "/api/v1/admin/applications/" + strconv.FormatInt(target.ID, 10)
+
+	// only the fields sent are changed
+	status, data := adminCall(t, r, rootKey, "PUT", path, `{"name":" Shop ","rate_limit_per_minute":5}`)
+	require.Equal(t, http.StatusOK, status)
+	app := data["application"].(map[string]interface{})
+	require.Equal(t, "Shop", app["name"])
+	require.Equal(t, "shop.example.com", app["domain"])
+	require.Equal(t, float64(5), app["rate_limit_per_minute"])
+	for _, body := range []string{`{"name":""}`, `{"rate_limit_per_minute":0}`, `{"allowed_origins":["not a url"]}`} {
+		status, _ = adminCall(t, r, rootKey, "PUT", path, body)
+		require.Equal(t, http.StatusBadRequest, status, body)
+	}
+	status, _ = adminCall(t, r, rootKey, "PUT", "/api/v1/admin/applications/999999", `{"name":"x"}`)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// a deactivated application's keys stop working until it is activated again
+	register := func() int {
+		status, _ := adminCall(t, r, targetKey, "POST", "/api/v1/auth/register", `{"email":"jane@example.com","password":"pw"}`)
+		return status
+	}
+	status, data = adminCall(t, r, rootKey, "POST", path+"/deactivate", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, false, data["application"].(map[string]interface{})["active"])
+	require.Equal(t, http.StatusUnauthorized, register())
+	status, _ = adminCall(t, r, rootKey, "POST", path+"/activate", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusCreated, register())
+
+	// the calling application cannot switch itself off or delete itself
+	rootPath := "/api/v1/admin/applications/" + strconv.FormatInt(root.ID, 10)
+	status, _ = adminCall(t, r, rootKey, "POST", rootPath+"/deactivate", "")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = adminCall(t, r, rootKey, "DELETE", rootPath, "")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestDeleteApplicationCascadesOrReassigns(t *testing.T) {
+	a, r, rootKey := newAdminTestApp(t)
+	source, sourceKey := addTestApplication(t, a, "source", true)
+	target, _ := addTestApplication(t, a, "target", true)
+	doomed, doomedKey := addTestApplication(t, a, "doomed", true)
+	for _, email := range []string{"jane@example.com", "bob@example.com"} {
+		status, _ := callAs(t, a, sourceKey, a.HandleRegister, `{"email":"`+email+`","password":"pw"}`)
+		require.Equal(t, http.StatusCreated, status)
+	}
+	_, err := a.DB.CreateUser("jane@example.com", "x", &target.ID, userNamespace(target))
+	require.NoError(t, err)
+	status, reg := callAs(t, a, doomedKey, a.HandleRegister, `{"email":"gone@example.com","password":"pw"}`)
+	require.Equal(t, http.StatusCreated, status)
+	del := func(app *Application, query string) (int, map[string]interface{}) {
+		return adminCall(t, r, rootKey, "DELETE", "/api/v1/admin/applications/"+strconv.FormatInt(app.ID, 10)+query, "")
+	}
+
+	status, _ = del(source, "?reassign_to=999999")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = del(source, "?reassign_to="+strconv.FormatInt(source.ID, 10))
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// moving users into a namespace that already has one of their emails changes nothing
+	status, body := del(source, "?reassign_to="+strconv.FormatInt(target.ID, 10))
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, "USER_EXISTS", body["error_code"])
+	require.Equal(t, errNamespaceConflict, a.DB.DeleteApplication(source.ID, &target.ID))
+	still, err := a.DB.GetApplicationByID(source.ID)
+	require.NoError(t, err)
+	require.NotNil(t, still)
+	bob, err := a.DB.GetUserByEmail(userNamespace(source), "bob@example.com")
+	require.NoError(t, err)
+	require.NotNil(t, bob)
+
+	// without a conflict the users move to the target's namespace
+	jane, err := a.DB.GetUserByEmail(userNamespace(target), "jane@example.com")
+	require.NoError(t, err)
+	require.NoError(t, a.DB.DeleteUser(jane.ID))
+	status, data := del(source, "?reassign_to="+strconv.FormatInt(target.ID, 10))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(target.ID), data["reassign_to"])
+	moved, err := a.DB.GetUserByEmail(userNamespace(target), "bob@example.com")
+	require.NoError(t, err)
+	require.NotNil(t, moved)
+	require.Equal(t, bob.ID, moved.ID)
+	gone, err := a.DB.GetApplicationByID(source.ID)
+	require.NoError(t, err)
+	require.Nil(t, gone)
+
+	// without reassign_to the isolated users and their tokens go with the application
+	status, _ = del(doomed, "")
+	require.Equal(t, http.StatusOK, status)
+	user, err := a.DB.GetUserByEmail(userNamespace(doomed), "gone@example.com")
+	require.NoError(t, err)
+	require.Nil(t, user)
+	token, err := a.DB.GetRefreshToken(reg["refreshToken"].(string))
+	require.NoError(t, err)
+	require.Nil(t, token)
+	app, _ := a.validateAPIKey(doomedKey)
+	require.Nil(t, app)
+}
+
+func TestApplicationsAdminCannotGrantUsersAdmin(t *testing.T) {
+	a, r, rootKey := newAdminTestApp(t)
+	ops, opsKey := addTestApplication(t, a, "ops", false)
+	scope, err := a.DB.GetScopeByName(scopeAdminApplications)
+	require.NoError(t, err)
+	require.NoError(t, a.DB.SetApplicationScopes(ops.ID, []int64{scope.ID}))
+	opsScopes := "/api/v1/admin/applications/" + strconv.FormatInt(ops.ID, 10) + "/scopes"
+
+	// admin scopes the caller does not hold cannot be handed out, to itself or a new app
+	status, body := adminCall(t, r, opsKey, "PUT", opsScopes, `{"scopes":["admin:applications","admin:users"]}`)
+	require.Equal(t, http.StatusForbidden, status)
+	require.Equal(t, "FORBIDDEN", body["error_code"])
+	status, _ = adminCall(t, r, opsKey, "POST", "/api/v1/admin/applications", `{"name":"sidekick","domain":"sidekick.example.com","scopes":["admin:users"]}`)
+	require.Equal(t, http.StatusForbidden, status)
+	held, err := a.applicationHasScope(ops.ID, scopeAdminUsers)
+	require.NoError(t, err)
+	require.False(t, held)
+
+	// scopes the caller holds can still be granted
+	status, _ = adminCall(t, r, opsKey, "POST", "/api/v1/admin/applications", `{"name":"sidekick","domain":"sidekick.example.com","scopes":["admin:applications","read:user"]}`)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = adminCall(t, r, rootKey, "PUT", opsScopes, `{"scopes":["admin:applications","admin:users"]}`)
+	require.Equal(t, http.StatusOK, status)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// identityProviderNamePattern keeps provider names usable in login URLs
+var identityProviderNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+func identityProviderJSON(p *IdentityProvider) map[string]interface{} {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultIdentityProviderScopes
+	}
+	mapping := p.ClaimMapping
+	if mapping == nil {
+		mapping = map[string]string{}
+	}
+	return map[string]interface{}{
+		"id":                p.ID,
+		"application_id":    p.ApplicationID,
+		"name":              p.Name,
+		"display_name":      p.DisplayName,
+		"issuer":            p.Issuer,
+		"client_id":         p.ClientID,
+		"client_secret_set": p.ClientSecret != "",
+		"scopes":            scopes,
+		"claim_mapping":     mapping,
+		"active":            p.Active,
+		"created_at":        p.CreatedAt,
+		"updated_at":        p.UpdatedAt,
+	}
+}
+
+// normalizeIdentityProvider validates a provider before it is stored
+func normalizeIdentityProvider(p *IdentityProvider) error {
+	p.Name = strings.ToLower(strings.TrimSpace(p.Name))
+	if !identityProviderNamePattern.MatchString(p.Name) {
+		return errors.New("name must be 1-63 lowercase letters, digits, dashes or underscores")
+	}
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	if p.DisplayName == "" {
+		p.DisplayName = p.Name
+	}
+	issuer, err := normalizeIssuer(p.Issuer)
+	if err != nil {
+		return err
+	}
+	p.Issuer = issuer
+	p.ClientID = strings.TrimSpace(p.ClientID)
+	if p.ClientID == "" {
+		return errors.New("client_id is required")
+	}
+	scopes := []string{}
+	hasOpenID := false
+	for _, s := range p.Scopes {
+		if s = strings.TrimSpace(s); s != "" {
+			hasOpenID = hasOpenID || s == "openid"
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) > 0 && !hasOpenID {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	p.Scopes = scopes
+	return validateClaimMapping(p.ClaimMapping)
+}
+
+// loadIdentityProvider resolves the {id} route variable, writing an error response and
+// returning nil when the provider does not exist
+func (a *App) loadIdentityProvider(w http.ResponseWriter, r *http.Request) *IdentityProvider {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil
+	}
+	p, err := a.DB.GetIdentityProviderByID(id)
+	if err != nil || p == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Identity provider not found")
+		return nil
+	}
+	return p
+}
+
+// HandleCreateIdentityProvider registers an upstream OpenID Connect provider
+// POST /api/v1/admin/identity-providers
+func (a *App) HandleCreateIdentityProvider(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ApplicationID *int64            `json:"application_id"`
+		Name          string            `json:"name"`
+		DisplayName   string            `json:"display_name"`
+		Issuer        string            `json:"issuer"`
+		ClientID      string            `json:"client_id"`
+		ClientSecret  string            `json:"client_secret"`
+		Scopes        []string          `json:"scopes"`
+		ClaimMapping  map[string]string `json:"claim_mapping"`
+		Active        *bool             `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	p := &IdentityProvider{
+		ApplicationID: req.ApplicationID,
+		Name:          req.Name,
+		DisplayName:   req.DisplayName,
+		Issuer:        req.Issuer,
+		ClientID:      req.ClientID,
+		ClientSecret:  req.ClientSecret,
+		Scopes:        req.Scopes,
+		ClaimMapping:  req.ClaimMapping,
+		Active:        req.Active == nil || *req.Active,
+	}
+	if err := normalizeIdentityProvider(p); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if p.ApplicationID != nil {
+		if app, err := a.DB.GetApplicationByID(*p.ApplicationID); err != nil || app == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Application not found")
+			return
+		}
+	}
+	if existing, err := a.DB.GetIdentityProviderByName(p.Name); err != nil || existing != nil {
+		writeError(w, http.StatusConflict, "IDENTITY_PROVIDER_EXISTS", "Identity provider with this name already exists")
+		return
+	}
+	if err := a.DB.CreateIdentityProvider(p); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create identity provider")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{"identity_provider": identityProviderJSON(p)})
+}
+
+// HandleListIdentityProviders lists identity providers, optionally those usable by one
+// application
+// GET /api/v1/admin/identity-providers
+func (a *App) HandleListIdentityProviders(w http.ResponseWriter, r *http.Request) {
+	appID, err := queryApplicationID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid application_id")
+		return
+	}
+	providers, err := a.DB.ListIdentityProviders(appID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list identity providers")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(providers))
+	for _, p := range providers {
+		out = append(out, identityProviderJSON(p))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"identity_providers": out})
+}
+
+// HandleGetIdentityProvider returns one identity provider
+// GET /api/v1/admin/identity-providers/{id}
+func (a *App) HandleGetIdentityProvider(w http.ResponseWriter, r *http.Request) {
+	p := a.loadIdentityProvider(w, r)
+	if p == nil {
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"identity_provider": identityProviderJSON(p)})
+}
+
+// HandleUpdateIdentityProvider changes the settings of an identity provider; omitted
+// fields keep their value
+// PUT /api/v1/admin/identity-providers/{id}
+func (a *App) HandleUpdateIdentityProvider(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name         *string            `json:"name"`
+		DisplayName  *string            `json:"display_name"`
+		Issuer       *string            `json:"issuer"`
+		ClientID     *string            `json:"client_id"`
+		ClientSecret *string            `json:"client_secret"`
+		Scopes       *[]string          `json:"scopes"`
+		ClaimMapping *map[string]string `json:"claim_mapping"`
+		Active       *bool              `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	target := a.loadIdentityProvider(w, r)
+	if target == nil {
+		return
+	}
+
+	updated := *target
+	if req.Name != nil {
+		updated.Name = *req.Name
+	}
+	if req.DisplayName != nil {
+		updated.DisplayName = *req.DisplayName
+	}
+	if req.Issuer != nil {
+		updated.Issuer = *req.Issuer
+	}
+	if req.ClientID != nil {
+		updated.ClientID = *req.ClientID
+	}
+	if req.ClientSecret != nil {
+		updated.ClientSecret = *req.ClientSecret
+	}
+	if req.Scopes != nil {
+		updated.Scopes = *req.Scopes
+	}
+	if req.ClaimMapping != nil {
+		updated.ClaimMapping = *req.ClaimMapping
+	}
+	if req.Active != nil {
+		updated.Active = *req.Active
+	}
+	if err := normalizeIdentityProvider(&updated); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if updated.Name != target.Name {
+		if existing, err := a.DB.GetIdentityProviderByName(updated.Name); err != nil || existing != nil {
+			writeError(w, http.StatusConflict, "IDENTITY_PROVIDER_EXISTS", "Identity provider with this name already exists")
+			return
+		}
+	}
+	if err := a.DB.UpdateIdentityProvider(&updated); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update identity provider")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"identity_provider": identityProviderJSON(&updated)})
+}
+
+// HandleDeleteIdentityProvider removes an identity provider and unlinks every account
+// linked through it
+// DELETE /api/v1/admin/identity-providers/{id}
+func (a *App) HandleDeleteIdentityProvider(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := a.DB.DeleteIdentityProvider(id); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Identity provider not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// HandleListIdentities lists the provider accounts linked to the calling user and the
+// providers they can still link
+// GET /api/v1/auth/identities
+func (a *App) HandleListIdentities(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	identities, err := a.DB.ListUserIdentities(user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list identities")
+		return
+	}
+	out := []map[string]interface{}{}
+	for _, i := range identities {
+		entry := map[string]interface{}{
+			"id":       i.ID,
+			"subject":  i.Subject,
+			"email":    i.Email,
+			"linkedAt": i.CreatedAt,
+		}
+		if p, err := a.DB.GetIdentityProviderByID(i.ProviderID); err == nil && p != nil {
+			entry["provider"] = p.Name
+			entry["providerDisplayName"] = p.DisplayName
+		}
+		out = append(out, entry)
+	}
+	available := []map[string]interface{}{}
+	if providers, err := a.availableIdentityProviders(applicationFromRequest(r)); err == nil {
+		for _, p := range providers {
+			available = append(available, map[string]interface{}{"name": p.Name, "displayName": p.DisplayName})
+		}
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"identities": out, "providers": available})
+}
+
+// HandleLinkIdentity starts linking an identity provider to the calling user. The
+// application sends the browser to the returned URL; after signing in at the provider it
+// comes back to redirectUri with linked=<provider>, or with error=identity_taken when the
+// account belongs to someone else.
+// POST /api/v1/auth/identities/{provider}/link
+func (a *App) HandleLinkIdentity(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RedirectURI string `json:"redirectUri"`
+		State       string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	app := applicationFromRequest(r)
+	provider, err := a.DB.GetIdentityProviderByName(mux.Vars(r)["provider"])
+	if err != nil || provider == nil || !identityProviderAvailable(provider, app) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Identity provider not found")
+		return
+	}
+	if !registeredRedirectURI(app, req.RedirectURI) {
+		writeError(w, http.StatusBadRequest, "INVALID_REDIRECT_URI", "redirectUri is not registered for this application")
+		return
+	}
+	token, err := signIdentityLink(app, user, req.RedirectURI, req.State)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to start linking")
+		return
+	}
+	base, ok := a.linkBaseURL(r, app)
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "PUBLIC_URL_REQUIRED", "Linking needs PUBLIC_URL, or a request host of the application's domain")
+		return
+	}
+	link := base + "/hosted/idp/" + url.PathEscape(provider.Name) + "?" + url.Values{"link_token": {token}}.Encode()
+	writeSuccess(w, http.StatusOK, map[string]string{"authorizationUrl": link})
+}
+
+// HandleUnlinkIdentity removes a provider account from the calling user
+// DELETE /api/v1/auth/identities/{id}
+func (a *App) HandleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	if err := a.DB.DeleteUserIdentity(user.ID, id); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Identity not found")
+		return
+	}
+	a.audit(r, auditIdentityUnlinked, &user.ID, map[string]interface{}{"identity_id": id})
+	writeSuccess(w, http.StatusOK, map[string]bool{"unlinked": true})
+}
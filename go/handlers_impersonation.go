@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Impersonation tokens are short-lived access tokens that let support staff act as a
+// user. They carry an "act" claim naming the administrator (RFC 8693), never come with
+// a refresh token and cannot change the user's account settings.
+const (
+	defaultImpersonationTTL = 15 * time.Minute
+	maxImpersonationTTL     = time.Hour
+)
+
+// impersonationActor returns the act claim of an impersonation token, or nil
+func impersonationActor(claims jwt.MapClaims) map[string]interface{} {
+	act, _ := claims["act"].(map[string]interface{})
+	return act
+}
+
+// impersonationPermissions narrows a user's permissions to the requested ones, or keeps
+// them all when none are requested. Admin scopes are never handed out.
+func impersonationPermissions(perms, requested []string) []string {
+	wanted := map[string]bool{}
+	for _, s := range requested {
+		wanted[s] = true
+	}
+	out := []string{}
+	for _, p := range perms {
+		if strings.HasPrefix(p, "admin:") || (len(requested) > 0 && !wanted[p]) {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// HandleImpersonateUser issues a short-lived, non-refreshable access token for a user
+// on behalf of the calling admin application
+// POST /api/v1/admin/users/{id}/impersonate
+func (a *App) HandleImpersonateUser(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	var req struct {
+		// Reason is recorded in the audit log, for example a support ticket
+		Reason string `json:"reason"`
+		// Operator identifies the person behind the admin application
+		Operator      string   `json:"operator"`
+		ApplicationID *int64   `json:"application_id"`
+		Scopes        []string `json:"scopes"`
+		TTLSeconds    int      `json:"ttl_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "reason is required")
+		return
+	}
+	ttl := defaultImpersonationTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+		if req.TTLSeconds < 0 || ttl > maxImpersonationTTL {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("ttl_seconds must be between 1 and %d", int(maxImpersonationTTL.Seconds())))
+			return
+		}
+	}
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "USER_DISABLED", "User account is disabled")
+		return
+	}
+
+	// The token is for the application the user signed up with unless another one in
+	// the same user pool is named
+	appID := req.ApplicationID
+	if appID == nil {
+		appID = user.ApplicationID
+	}
+	if appID != nil {
+		target, err := a.DB.GetApplicationByID(*appID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application")
+			return
+		}
+		if target == nil || userNamespace(target) != user.NamespaceID {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "The user cannot sign in to this application")
+			return
+		}
+	}
+
+	perms, err := a.DB.GetUserPermissions(user.ID, appID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load permissions")
+		return
+	}
+	perms = impersonationPermissions(perms, req.Scopes)
+	jti, err := genToken(16)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue token")
+		return
+	}
+	act := map[string]interface{}{"sub": "admin"}
+	if admin := applicationFromRequest(r); admin != nil {
+		act["sub"] = "application:" + fmt.Sprint(admin.ID)
+		act["app_id"] = admin.ID
+	}
+	if key := apiKeyFromRequest(r); key != nil {
+		act["api_key_id"] = key.ID
+	}
+	if req.Operator != "" {
+		act["sub"] = req.Operator
+	}
+	expiresAt := time.Now().Add(ttl)
+	access, err := createAccessToken(user, appID, jwt.MapClaims{
+		"exp":         expiresAt.Unix(),
+		"jti":         jti,
+		"act":         act,
+		"permissions": perms,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue token")
+		return
+	}
+
+	a.audit(r, auditUserImpersonated, &user.ID, map[string]interface{}{
+		"reason":         req.Reason,
+		"actor":          act["sub"],
+		"application_id": appID,
+		"permissions":    perms,
+		"jti":            jti,
+		"expires_at":     expiresAt.Unix(),
+	})
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"act":          act,
+		"permissions":  perms,
+	})
+}
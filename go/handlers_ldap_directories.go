@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// directoryClaimPattern restricts mapped claim names to plain identifiers
+var directoryClaimPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,63}$`)
+
+// reservedDirectoryClaims are access token claims a directory mapping may not set
+var reservedDirectoryClaims = map[string]bool{
+	"userId": true, "ns": true, "appId": true, "org_id": true, "org_role": true, "permissions": true,
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true,
+	"scope": true, "act": true, "auth_time": true, "amr": true, "acr": true,
+}
+
+func ldapDirectoryJSON(d *LDAPDirectory) map[string]interface{} {
+	mapping := d.AttributeMapping
+	if mapping == nil {
+		mapping = map[string]string{}
+	}
+	return map[string]interface{}{
+		"application_id":    d.ApplicationID,
+		"url":               d.URL,
+		"start_tls":         d.StartTLS,
+		"ca_certificate":    d.CACertificate,
+		"bind_dn":           d.BindDN,
+		"bind_password_set": d.BindPassword != "",
+		"search_base":       d.SearchBase,
+		"search_filter":     d.SearchFilter,
+		"attribute_mapping": mapping,
+		"active":            d.Active,
+		"created_at":        d.CreatedAt,
+		"updated_at":        d.UpdatedAt,
+	}
+}
+
+// normalizeLDAPDirectory validates a directory before it is stored
+func normalizeLDAPDirectory(d *LDAPDirectory) error {
+	d.URL = strings.TrimSpace(d.URL)
+	u, err := url.Parse(d.URL)
+	if err != nil || u.Hostname() == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("url must look like ldaps://host:port")
+	}
+	switch {
+	case u.Scheme == "ldaps":
+		d.StartTLS = false
+	case u.Scheme != "ldap":
+		return errors.New("url must use ldap:// or ldaps://")
+	case !d.StartTLS && !isLoopbackHost(u.Hostname()):
+		// Passwords would cross the network in the clear
+		return errors.New("url must use ldaps:// or enable start_tls")
+	}
+	d.CACertificate = strings.TrimSpace(d.CACertificate)
+	if d.CACertificate != "" {
+		if _, err := ldapTLSConfig(d, u.Hostname()); err != nil {
+			return err
+		}
+	}
+	d.BindDN = strings.TrimSpace(d.BindDN)
+	if d.BindDN == "" {
+		d.BindPassword = ""
+	} else if d.BindPassword == "" {
+		return errors.New("bind_password is required with bind_dn")
+	}
+	d.SearchBase = strings.TrimSpace(d.SearchBase)
+	if d.SearchBase == "" {
+		return errors.New("search_base is required")
+	}
+	d.SearchFilter = strings.TrimSpace(d.SearchFilter)
+	if !strings.Contains(d.SearchFilter, "{username}") {
+		return errors.New("search_filter must contain {username}")
+	}
+	if _, err := parseLDAPFilter(strings.ReplaceAll(d.SearchFilter, "{username}", "user")); err != nil {
+		return errors.New("search_filter is not a valid LDAP filter")
+	}
+	mapping := map[string]string{}
+	for claim, attr := range d.AttributeMapping {
+		attr = strings.TrimSpace(attr)
+		if claim != "email" && (!directoryClaimPattern.MatchString(claim) || reservedDirectoryClaims[claim]) {
+			return errors.New("attribute_mapping claim " + claim + " is not allowed")
+		}
+		if !ldapAttributePattern(attr) {
+			return errors.New("attribute_mapping attribute for " + claim + " is invalid")
+		}
+		mapping[claim] = attr
+	}
+	d.AttributeMapping = mapping
+	return nil
+}
+
+// HandleGetLDAPDirectory returns the LDAP directory an application checks passwords against
+// GET /api/v1/admin/applications/{id}/ldap
+func (a *App) HandleGetLDAPDirectory(w http.ResponseWriter, r *http.Request) {
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	d, err := a.DB.GetLDAPDirectory(target.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load LDAP directory")
+		return
+	}
+	if d == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "LDAP directory not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"ldap_directory": ldapDirectoryJSON(d)})
+}
+
+// HandleUpdateLDAPDirectory configures an application's LDAP directory. While the
+// directory is active, logins bind to it instead of checking local passwords. Omitted
+// fields keep their value, so the bind password need not be sent again.
+// PUT /api/v1/admin/applications/{id}/ldap
+func (a *App) HandleUpdateLDAPDirectory(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL              *string            `json:"url"`
+		StartTLS         *bool              `json:"start_tls"`
+		CACertificate    *string            `json:"ca_certificate"`
+		BindDN           *string            `json:"bind_dn"`
+		BindPassword     *string            `json:"bind_password"`
+		SearchBase       *string            `json:"search_base"`
+		SearchFilter     *string            `json:"search_filter"`
+		AttributeMapping *map[string]string `json:"attribute_mapping"`
+		Active           *bool              `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	existing, err := a.DB.GetLDAPDirectory(target.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load LDAP directory")
+		return
+	}
+	d := LDAPDirectory{ApplicationID: target.ID, SearchFilter: "(uid={username})", Active: true}
+	if existing != nil {
+		d = *existing
+	}
+	if req.URL != nil {
+		d.URL = *req.URL
+	}
+	if req.StartTLS != nil {
+		d.StartTLS = *req.StartTLS
+	}
+	if req.CACertificate != nil {
+		d.CACertificate = *req.CACertificate
+	}
+	if req.BindDN != nil {
+		d.BindDN = *req.BindDN
+	}
+	if req.BindPassword != nil {
+		d.BindPassword = *req.BindPassword
+	}
+	if req.SearchBase != nil {
+		d.SearchBase = *req.SearchBase
+	}
+	if req.SearchFilter != nil {
+		d.SearchFilter = *req.SearchFilter
+	}
+	if req.AttributeMapping != nil {
+		d.AttributeMapping = *req.AttributeMapping
+	}
+	if req.Active != nil {
+		d.Active = *req.Active
+	}
+	if err := normalizeLDAPDirectory(&d); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if err := a.DB.UpsertLDAPDirectory(&d); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save LDAP directory")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"ldap_directory": ldapDirectoryJSON(&d)})
+}
+
+// HandleDeleteLDAPDirectory switches an application back to local passwords. Shadow
+// users keep their accounts but lose their directory claims.
+// DELETE /api/v1/admin/applications/{id}/ldap
+func (a *App) HandleDeleteLDAPDirectory(w http.ResponseWriter, r *http.Request) {
+	target := a.loadApplication(w, r)
+	if target == nil {
+		return
+	}
+	if err := a.DB.DeleteLDAPDirectory(target.ID); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "LDAP directory not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"deleted": true})
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Organization roles, from most to least privileged
+const (
+	orgRoleOwner  = "owner"
+	orgRoleAdmin  = "admin"
+	orgRoleMember = "member"
+)
+
+// invitationTTL is how long an organization invitation can be accepted
+const invitationTTL = 7 * 24 * time.Hour
+
+func validOrgRole(role string) bool {
+	return role == orgRoleOwner || role == orgRoleAdmin || role == orgRoleMember
+}
+
+func organizationJSON(org *Organization) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             org.ID,
+		"name":           org.Name,
+		"application_id": org.ApplicationID,
+		"created_at":     org.CreatedAt,
+		"updated_at":     org.UpdatedAt,
+	}
+}
+
+func memberJSON(m *OrganizationMember) map[string]interface{} {
+	return map[string]interface{}{
+		"organization_id": m.OrganizationID,
+		"user_id":         m.UserID,
+		"role":            m.Role,
+		"created_at":      m.CreatedAt,
+	}
+}
+
+func invitationJSON(inv *OrganizationInvitation) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              inv.ID,
+		"organization_id": inv.OrganizationID,
+		"email":           inv.Email,
+		"role":            inv.Role,
+		"expires_at":      inv.ExpiresAt,
+		"accepted_at":     inv.AcceptedAt,
+		"created_at":      inv.CreatedAt,
+	}
+}
+
+// organizationVisible reports whether an organization belongs to the calling application
+func organizationVisible(org *Organization, app *Application) bool {
+	if org == nil {
+		return false
+	}
+	if app == nil || org.ApplicationID == nil {
+		return true
+	}
+	return *org.ApplicationID == app.ID
+}
+
+// loadOrganization resolves the {id} route variable to an organization owned by the
+// calling application, writing a 404 and returning nil otherwise
+func (a *App) loadOrganization(w http.ResponseWriter, r *http.Request) *Organization {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid organization id")
+		return nil
+	}
+	org, err := a.DB.GetOrganizationByID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load organization")
+		return nil
+	}
+	if !organizationVisible(org, applicationFromRequest(r)) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Organization not found")
+		return nil
+	}
+	return org
+}
+
+// loadNamespaceUser returns a user if it exists in the calling application's namespace
+func (a *App) loadNamespaceUser(userID int64, app *Application) (*User, error) {
+	user, err := a.DB.GetUserByID(userID)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if user.NamespaceID != userNamespace(app) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// requireOrganizationMember checks that a user may scope a session to an organization,
+// writing an error response and returning false otherwise
+func (a *App) requireOrganizationMember(w http.ResponseWriter, orgID, userID int64, app *Application) bool {
+	org, err := a.DB.GetOrganizationByID(orgID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load organization")
+		return false
+	}
+	if !organizationVisible(org, app) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Organization not found")
+		return false
+	}
+	member, err := a.DB.GetOrganizationMember(orgID, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load membership")
+		return false
+	}
+	if member == nil {
+		writeError(w, http.StatusForbidden, "NOT_ORGANIZATION_MEMBER", "User is not a member of this organization")
+		return false
+	}
+	return true
+}
+
+// isLastOwner reports whether userID is the only owner left in an organization
+func (a *App) isLastOwner(orgID, userID int64) (bool, error) {
+	members, err := a.DB.ListOrganizationMembers(orgID)
+	if err != nil {
+		return false, err
+	}
+	owners := 0
+	isOwner := false
+	for _, m := range members {
+		if m.Role == orgRoleOwner {
+			owners++
+			if m.UserID == userID {
+				isOwner = true
+			}
+		}
+	}
+	return isOwner && owners == 1, nil
+}
+
+// HandleCreateOrganization creates an organization owned by the calling application
+// POST /api/v1/organizations
+func (a *App) HandleCreateOrganization(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string `json:"name"`
+		OwnerUserID *int64 `json:"owner_user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Name is required")
+		return
+	}
+
+	app := applicationFromRequest(r)
+	var appID *int64
+	if app != nil {
+		appID = &app.ID
+	}
+
+	if req.OwnerUserID != nil {
+		owner, err := a.loadNamespaceUser(*req.OwnerUserID, app)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load user")
+			return
+		}
+		if owner == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Owner user not found")
+			return
+		}
+	}
+
+	org, err := a.DB.CreateOrganization(req.Name, appID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create organization")
+		return
+	}
+	if req.OwnerUserID != nil {
+		if err := a.DB.UpsertOrganizationMember(org.ID, *req.OwnerUserID, orgRoleOwner); err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to add organization owner")
+			return
+		}
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{"organization": organizationJSON(org)})
+}
+
+// HandleListOrganizations lists the organizations owned by the calling application
+// GET /api/v1/organizations
+func (a *App) HandleListOrganizations(w http.ResponseWriter, r *http.Request) {
+	var appID *int64
+	if app := applicationFromRequest(r); app != nil {
+		appID = &app.ID
+	}
+	orgs, err := a.DB.ListOrganizations(appID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list organizations")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(orgs))
+	for _, org := range orgs {
+		out = append(out, organizationJSON(org))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"organizations": out})
+}
+
+// HandleGetOrganization returns a single organization
+// GET /api/v1/organizations/{id}
+func (a *App) HandleGetOrganization(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"organization": organizationJSON(org)})
+}
+
+// HandleUpdateOrganization renames an organization
+// PUT /api/v1/organizations/{id}
+func (a *App) HandleUpdateOrganization(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Name is required")
+		return
+	}
+	if err := a.DB.UpdateOrganization(org.ID, req.Name); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update organization")
+		return
+	}
+	org, err := a.DB.GetOrganizationByID(org.ID)
+	if err != nil || org == nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load organization")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"organization": organizationJSON(org)})
+}
+
+// HandleDeleteOrganization deletes an organization with its memberships and invitations
+// DELETE /api/v1/organizations/{id}
+func (a *App) HandleDeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	if err := a.DB.DeleteOrganization(org.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete organization")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// HandleListOrganizationMembers lists the members of an organization
+// GET /api/v1/organizations/{id}/members
+func (a *App) HandleListOrganizationMembers(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	members, err := a.DB.ListOrganizationMembers(org.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list members")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(members))
+	for _, m := range members {
+		out = append(out, memberJSON(m))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"members": out})
+}
+
+// HandlePutOrganizationMember adds a user to an organization or changes their role
+// PUT /api/v1/organizations/{id}/members/{userId}
+func (a *App) HandlePutOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	userID, err := strconv.ParseInt(mux.Vars(r)["userId"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid user id")
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if !validOrgRole(req.Role) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Role must be one of owner, admin, member")
+		return
+	}
+	user, err := a.loadNamespaceUser(userID, applicationFromRequest(r))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load user")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "User not found")
+		return
+	}
+	if req.Role != orgRoleOwner {
+		last, err := a.isLastOwner(org.ID, userID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load members")
+			return
+		}
+		if last {
+			writeError(w, http.StatusConflict, "LAST_OWNER", "An organization must keep at least one owner")
+			return
+		}
+	}
+	if err := a.DB.UpsertOrganizationMember(org.ID, userID, req.Role); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to save member")
+		return
+	}
+	member, err := a.DB.GetOrganizationMember(org.ID, userID)
+	if err != nil || member == nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load member")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"member": memberJSON(member)})
+}
+
+// HandleRemoveOrganizationMember removes a user from an organization
+// DELETE /api/v1/organizations/{id}/members/{userId}
+func (a *App) HandleRemoveOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	userID, err := strconv.ParseInt(mux.Vars(r)["userId"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid user id")
+		return
+	}
+	last, err := a.isLastOwner(org.ID, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load members")
+		return
+	}
+	if last {
+		writeError(w, http.StatusConflict, "LAST_OWNER", "An organization must keep at least one owner")
+		return
+	}
+	if err := a.DB.RemoveOrganizationMember(org.ID, userID); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Member not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"removed": true})
+}
+
+// HandleCreateOrganizationInvitation invites an email address to join an organization.
+// The invitation token is only delivered by email; accept_url, when given, receives it
+// as a token query parameter.
+// POST /api/v1/organizations/{id}/invitations
+func (a *App) HandleCreateOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	var req struct {
+		Email     string `json:"email"`
+		Role      string `json:"role"`
+		AcceptURL string `json:"accept_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.Email == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Email is required")
+		return
+	}
+	if req.Role == "" {
+		req.Role = orgRoleMember
+	}
+	if !validOrgRole(req.Role) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Role must be one of owner, admin, member")
+		return
+	}
+	var acceptURL *url.URL
+	if req.AcceptURL != "" {
+		u, err := url.Parse(req.AcceptURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "accept_url must be an absolute http(s) URL")
+			return
+		}
+		acceptURL = u
+	}
+
+	token, err := genToken(32)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate invitation token")
+		return
+	}
+	inv := &OrganizationInvitation{
+		OrganizationID: org.ID,
+		Email:          req.Email,
+		Role:           req.Role,
+		TokenHash:      hashToken(token),
+		ExpiresAt:      time.Now().Add(invitationTTL).Unix(),
+	}
+	if err := a.DB.CreateOrganizationInvitation(inv); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create invitation")
+		return
+	}
+
+	body := fmt.Sprintf("You have been invited to join %s as %s.\n\n", org.Name, inv.Role)
+	if acceptURL != nil {
+		q := acceptURL.Query()
+		q.Set("token", token)
+		acceptURL.RawQuery = q.Encode()
+		body += "Accept the invitation: " + acceptURL.String() + "\n"
+	} else {
+		body += "Invitation code: " + token + "\n"
+	}
+	body += fmt.Sprintf("\nThis invitation expires on %s.\n", time.Unix(inv.ExpiresAt, 0).UTC().Format(time.RFC1123))
+	if err := a.Mailer.Send(inv.Email, "Invitation to join "+org.Name, body); err != nil {
+		log.Printf("invitation %d: send mail: %v", inv.ID, err)
+		a.DB.DeleteOrganizationInvitation(inv.ID)
+		writeError(w, http.StatusBadGateway, "EMAIL_DELIVERY_FAILED", "Failed to send invitation email")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{"invitation": invitationJSON(inv)})
+}
+
+// HandleListOrganizationInvitations lists invitations of an organization
+// GET /api/v1/organizations/{id}/invitations
+func (a *App) HandleListOrganizationInvitations(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	invitations, err := a.DB.ListOrganizationInvitations(org.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list invitations")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(invitations))
+	for _, inv := range invitations {
+		out = append(out, invitationJSON(inv))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"invitations": out})
+}
+
+// HandleDeleteOrganizationInvitation withdraws a pending invitation
+// DELETE /api/v1/organizations/{id}/invitations/{invitationId}
+func (a *App) HandleDeleteOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	org := a.loadOrganization(w, r)
+	if org == nil {
+		return
+	}
+	invID, err := strconv.ParseInt(mux.Vars(r)["invitationId"], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid invitation id")
+		return
+	}
+	invitations, err := a.DB.ListOrganizationInvitations(org.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load invitations")
+		return
+	}
+	for _, inv := range invitations {
+		if inv.ID == invID {
+			if err := a.DB.DeleteOrganizationInvitation(invID); err != nil {
+				writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete invitation")
+				return
+			}
+			writeSuccess(w, http.StatusOK, map[string]bool{"deleted": true})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "NOT_FOUND", "Invitation not found")
+}
+
+// HandleAcceptOrganizationInvitation adds a user to an organization using an invitation token.
+// The user's email must match the invited address.
+// POST /api/v1/organizations/invitations/accept
+func (a *App) HandleAcceptOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token  string `json:"token"`
+		UserID int64  `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.Token == "" || req.UserID == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Token and user_id are required")
+		return
+	}
+
+	inv, err := a.DB.GetOrganizationInvitationByTokenHash(hashToken(req.Token))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load invitation")
+		return
+	}
+	if inv == nil || inv.AcceptedAt != nil || inv.ExpiresAt < time.Now().Unix() {
+		writeError(w, http.StatusBadRequest, "INVALID_INVITATION", "Invitation is invalid, expired or already accepted")
+		return
+	}
+	app := applicationFromRequest(r)
+	org, err := a.DB.GetOrganizationByID(inv.OrganizationID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load organization")
+		return
+	}
+	if !organizationVisible(org, app) {
+		writeError(w, http.StatusBadRequest, "INVALID_INVITATION", "Invitation is invalid, expired or already accepted")
+		return
+	}
+	user, err := a.loadNamespaceUser(req.UserID, app)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load user")
+		return
+	}
+	if user == nil || !strings.EqualFold(user.Email, inv.Email) {
+		writeError(w, http.StatusForbidden, "FORBIDDEN", "Invitation was issued to a different email address")
+		return
+	}
+
+	// The invitation is used up before the membership is granted, so concurrent accepts
+	// cannot both succeed
+	accepted, err := a.DB.MarkOrganizationInvitationAccepted(inv.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to accept invitation")
+		return
+	}
+	if !accepted {
+		writeError(w, http.StatusBadRequest, "INVALID_INVITATION", "Invitation is invalid, expired or already accepted")
+		return
+	}
+
+	// Accepting never downgrades an existing membership
+	role := inv.Role
+	if existing, err := a.DB.GetOrganizationMember(org.ID, user.ID); err == nil && existing != nil && orgRoleRank(existing.Role) > orgRoleRank(role) {
+		role = existing.Role
+	}
+	if err := a.DB.UpsertOrganizationMember(org.ID, user.ID, role); err != nil {
+		log.Printf("invitation %d: adding user %d: %v", inv.ID, user.ID, err)
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to add member")
+		return
+	}
+	member, err := a.DB.GetOrganizationMember(org.ID, user.ID)
+	if err != nil || member == nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load member")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"organization": organizationJSON(org),
+		"member":       memberJSON(member),
+	})
+}
+
+func orgRoleRank(role string) int {
+	switch role {
+	case orgRoleOwner:
+		return 3
+	case orgRoleAdmin:
+		return 2
+	case orgRoleMember:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrganizationInvitationsAndLogin(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	mailer := &recordingMailer{}
+	a.Mailer = mailer
+	app, _ := a.validateAPIKey(plain)
+	_, otherKey := addTestApplication(t, a, "other", false)
+
+	hashed, err := hashPassword("secret-pw")
+	require.NoError(t, err)
+	owner, err := a.DB.CreateUser("owner@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	jane, err := a.DB.CreateUser("jane@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	bob, err := a.DB.CreateUser("bob@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/organizations", a.HandleCreateOrganization).Methods("POST")
+	r.HandleFunc("/organizations/invitations/accept", a.HandleAcceptOrganizationInvitation).Methods("POST")
+	r.HandleFunc("/organizations/{id:[0-9]+}/members", a.HandleListOrganizationMembers).Methods("GET")
+	r.HandleFunc("/organizations/{id:[0-9]+}/invitations", a.HandleCreateOrganizationInvitation).Methods("POST")
+	call := func(key, method, path, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(r).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		if data, ok := out["data"].(map[string]interface{}); ok {
+			return rec.Code, data
+		}
+		return rec.Code, out
+	}
+
+	status, data := call(plain, "POST", "/organizations", `{"name":"Acme","owner_user_id":`+strconv.FormatInt(owner.ID, 10)+`}`)
+	require.Equal(t, http.StatusCreated, status)
+	orgID := int64(data["organization"].(map[string]interface{})["id"].(float64))
+	orgPath := "/organizations/" + strconv.FormatInt(orgID, 10)
+
+	// the invitation code is only sent by email
+	status, data = call(plain, "POST", orgPath+"/invitations", `{"email":"jane@example.com","role":"admin"}`)
+	require.Equal(t, http.StatusCreated, status)
+	require.NotContains(t, data["invitation"], "token")
+	require.Len(t, mailer.sent, 1)
+	code := mailer.sent[0][strings.Index(mailer.sent[0], "Invitation code: ")+len("Invitation code: "):]
+	code = code[:strings.Index(code, "\n")]
+
+	accept := func(key, token string, userID int64) (int, map[string]interface{}) {
+		return call(key, "POST", "/organizations/invitations/accept", `{"token":"`+token+`","user_id":`+strconv.FormatInt(userID, 10)+`}`)
+	}
+	// only the invited address can accept, only through the owning application, and once
+	status, _ = accept(plain, code, bob.ID)
+	require.Equal(t, http.StatusForbidden, status)
+	status, body := accept(otherKey, code, jane.ID)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "INVALID_INVITATION", body["error_code"])
+	status, data = accept(plain, code, jane.ID)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, orgRoleAdmin, data["member"].(map[string]interface{})["role"])
+	status, _ = accept(plain, code, jane.ID)
+	require.Equal(t, http.StatusBadRequest, status)
+	// a concurrent accept that loaded the invitation before it was used up is refused too
+	inv, err := a.DB.GetOrganizationInvitationByTokenHash(hashToken(code))
+	require.NoError(t, err)
+	accepted, err := a.DB.MarkOrganizationInvitationAccepted(inv.ID)
+	require.NoError(t, err)
+	require.False(t, accepted)
+
+	// expired invitations are refused
+	require.NoError(t, a.DB.CreateOrganizationInvitation(&OrganizationInvitation{
+		OrganizationID: orgID, Email: "bob@example.com", Role: orgRoleMember,
+		TokenHash: hashToken("expired-code"), ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+	}))
+	status, body = accept(plain, "expired-code", bob.ID)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "INVALID_INVITATION", body["error_code"])
+
+	status, data = call(plain, "GET", orgPath+"/members", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, data["members"], 2)
+
+	// sessions are scoped only to organizations the user belongs to
+	login := func(key, email string) (int, map[string]interface{}) {
+		return callAs(t, a, key, a.HandleLogin, `{"email":"`+email+`","password":"secret-pw","organizationId":`+strconv.FormatInt(orgID, 10)+`}`)
+	}
+	status, body = login(plain, "bob@example.com")
+	require.Equal(t, http.StatusForbidden, status)
+	require.Equal(t, "NOT_ORGANIZATION_MEMBER", body["error_code"])
+	status, _ = login(otherKey, "bob@example.com")
+	require.Equal(t, http.StatusNotFound, status)
+	status, body = login(plain, "jane@example.com")
+	require.Equal(t, http.StatusOK, status)
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(body["accessToken"].(string), claims, func(*jwt.Token) (interface{}, error) { return jwtSecret, nil })
+	require.NoError(t, err)
+	require.Equal(t, float64(orgID), claims["org_id"])
+	require.Equal(t, orgRoleAdmin, claims["org_role"])
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// passwordResetTTL is how long a password reset token stays valid
+const passwordResetTTL = time.Hour
+
+// HandleForgotPassword emails a password reset token to a user. The response is the same
+// whether or not the email is registered, so it cannot be used to probe for accounts.
+// POST /api/v1/auth/password/forgot
+func (a *App) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string `json:"email"`
+		ResetURL string `json:"resetUrl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.Email == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Email is required")
+		return
+	}
+	app := applicationFromRequest(r)
+	var resetURL *url.URL
+	if req.ResetURL != "" {
+		u, err := url.Parse(req.ResetURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "resetUrl must be an absolute http(s) URL")
+			return
+		}
+		if !applicationOwnsURL(app, u) {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "resetUrl must point to the application's domain or allowed origins")
+			return
+		}
+		resetURL = u
+	}
+	if !a.checkRateLimitRules(w, r, "password_reset", rateLimitIdentity{Email: req.Email}) {
+		return
+	}
+
+	user, err := a.DB.GetUserByEmail(userNamespace(app), req.Email)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to look up user")
+		return
+	}
+	if user != nil {
+		if err := a.sendPasswordReset(user, resetURL); err != nil {
+			log.Printf("password reset for user %d: %v", user.ID, err)
+		} else {
+			a.audit(r, auditPasswordResetRequested, &user.ID, nil)
+		}
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"requested": true})
+}
+
+// sendPasswordReset stores a new reset token for a user and emails it
+func (a *App) sendPasswordReset(user *User, resetURL *url.URL) error {
+	token, err := genToken(32)
+	if err != nil {
+		return err
+	}
+	pr := &PasswordReset{UserID: user.ID, TokenHash: hashToken(token), ExpiresAt: time.Now().Add(passwordResetTTL).Unix()}
+	if err := a.DB.CreatePasswordReset(pr); err != nil {
+		return err
+	}
+
+	body := "A password reset was requested for your account.\n\n"
+	if resetURL != nil {
+		link := *resetURL
+		q := link.Query()
+		q.Set("token", token)
+		link.RawQuery = q.Encode()
+		body += "Choose a new password: " + link.String() + "\n"
+	} else {
+		body += "Reset code: " + token + "\n"
+	}
+	body += fmt.Sprintf("\nThis link expires on %s. If you did not request it, you can ignore this email.\n", time.Unix(pr.ExpiresAt, 0).UTC().Format(time.RFC1123))
+	return a.Mailer.Send(user.Email, "Reset your password", body)
+}
+
+// HandleResetPassword sets a new password using a reset token and signs the user out of
+// every session
+// POST /api/v1/auth/password/reset
+func (a *App) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Token and password are required")
+		return
+	}
+	if !a.checkRateLimitRules(w, r, "password_reset", rateLimitIdentity{}) {
+		return
+	}
+
+	if _, err := a.redeemPasswordReset(r, req.Token, req.Password); err != nil {
+		if err == errInvalidResetToken {
+			writeError(w, http.StatusBadRequest, "INVALID_TOKEN", "Reset token is invalid or expired")
+		} else {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to reset password")
+		}
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"reset": true})
+}
+
+// errInvalidResetToken is returned for unknown, used, expired or foreign reset tokens
+var errInvalidResetToken = errors.New("reset token is invalid or expired")
+
+// redeemPasswordReset consumes a reset token, sets the new password and signs the user
+// out of every session
+func (a *App) redeemPasswordReset(r *http.Request, token, password string) (*User, error) {
+	pr, err := a.DB.GetPasswordResetByTokenHash(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	var user *User
+	if pr != nil && pr.UsedAt == nil && pr.ExpiresAt > time.Now().Unix() {
+		user, _ = a.DB.GetUserByID(pr.UserID)
+	}
+	// Reset tokens can only be redeemed from within the user's namespace
+	if user == nil || user.NamespaceID != userNamespace(applicationFromRequest(r)) {
+		return nil, errInvalidResetToken
+	}
+
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.DB.MarkPasswordResetUsed(pr.ID); err != nil {
+		return nil, errInvalidResetToken
+	}
+	if err := a.DB.UpdateUserPassword(user.ID, hashed); err != nil {
+		return nil, err
+	}
+	if err := a.DB.RevokeAllRefreshTokensForUser(user.ID); err != nil {
+		log.Printf("password reset for user %d: revoking sessions: %v", user.ID, err)
+	}
+	a.audit(r, auditPasswordResetCompleted, &user.ID, nil)
+	return user, nil
+}
+
+// applicationOwnsURL reports whether a URL points at the application's domain (or one of
+// its subdomains) or at one of its allowed origins; "*" does not count
+func applicationOwnsURL(app *Application, u *url.URL) bool {
+	if app == nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	domain := strings.ToLower(app.Domain)
+	if host == domain || strings.HasSuffix(host, "."+domain) {
+		return true
+	}
+	origin := u.Scheme + "://" + u.Host
+	for _, pattern := range app.AllowedOrigins {
+		if pattern != originWildcard && originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+func scopeJSON(scope *Scope) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          scope.ID,
+		"name":        scope.Name,
+		"description": scope.Description,
+	}
+}
+
+func roleJSON(role *Role) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          role.ID,
+		"name":        role.Name,
+		"description": role.Description,
+		"scopes":      role.Scopes,
+		"created_at":  role.CreatedAt,
+	}
+}
+
+func userRoleJSON(ur *UserRole) map[string]interface{} {
+	return map[string]interface{}{
+		"role_id":        ur.RoleID,
+		"role":           ur.RoleName,
+		"application_id": ur.ApplicationID,
+		"created_at":     ur.CreatedAt,
+	}
+}
+
+// pathID parses a numeric route variable, writing a 400 and returning false when invalid
+func pathID(w http.ResponseWriter, r *http.Request, name string) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)[name], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid "+name)
+		return 0, false
+	}
+	return id, true
+}
+
+// queryApplicationID parses the optional application_id query parameter
+func queryApplicationID(r *http.Request) (*int64, error) {
+	raw := r.URL.Query().Get("application_id")
+	if raw == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// HandleListScopes lists all scopes
+// GET /api/v1/admin/scopes
+func (a *App) HandleListScopes(w http.ResponseWriter, r *http.Request) {
+	scopes, err := a.DB.ListScopes()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list scopes")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(scopes))
+	for _, scope := range scopes {
+		out = append(out, scopeJSON(scope))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"scopes": out})
+}
+
+// HandleCreateScope defines a new scope
+// POST /api/v1/admin/scopes
+func (a *App) HandleCreateScope(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" || strings.ContainsAny(req.Name, " \t") {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Name is required and must not contain whitespace")
+		return
+	}
+	scope, err := a.DB.CreateScope(req.Name, req.Description)
+	if err != nil {
+		writeError(w, http.StatusConflict, "SCOPE_EXISTS", "Scope with this name already exists")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{"scope": scopeJSON(scope)})
+}
+
+// HandleListRoles lists all roles with their scopes
+// GET /api/v1/admin/roles
+func (a *App) HandleListRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := a.DB.ListRoles()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list roles")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(roles))
+	for _, role := range roles {
+		out = append(out, roleJSON(role))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"roles": out})
+}
+
+// HandleCreateRole creates a role, optionally with an initial set of scopes
+// POST /api/v1/admin/roles
+func (a *App) HandleCreateRole(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Scopes      []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Name is required")
+		return
+	}
+	scopeIDs, ok := a.resolveScopes(w, req.Scopes)
+	if !ok {
+		return
+	}
+	role, err := a.DB.CreateRole(req.Name, req.Description)
+	if err != nil {
+		writeError(w, http.StatusConflict, "ROLE_EXISTS", "Role with this name already exists")
+		return
+	}
+	if len(scopeIDs) > 0 {
+		if err := a.DB.SetRoleScopes(role.ID, scopeIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to set role scopes")
+			return
+		}
+	}
+	role, err = a.DB.GetRoleByID(role.ID)
+	if err != nil || role == nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load role")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{"role": roleJSON(role)})
+}
+
+// resolveScopes maps scope names to IDs, writing a 400 for unknown scopes
+func (a *App) resolveScopes(w http.ResponseWriter, names []string) ([]int64, bool) {
+	ids := make([]int64, 0, len(names))
+	for _, name := range names {
+		scope, err := a.DB.GetScopeByName(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load scope")
+			return nil, false
+		}
+		if scope == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Unknown scope: "+name)
+			return nil, false
+		}
+		ids = append(ids, scope.ID)
+	}
+	return ids, true
+}
+
+// HandleGetRole returns a role with its scopes
+// GET /api/v1/admin/roles/{id}
+func (a *App) HandleGetRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	role, err := a.DB.GetRoleByID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load role")
+		return
+	}
+	if role == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Role not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"role": roleJSON(role)})
+}
+
+// HandleSetRoleScopes replaces the scopes bundled in a role
+// PUT /api/v1/admin/roles/{id}/scopes
+func (a *App) HandleSetRoleScopes(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	role, err := a.DB.GetRoleByID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load role")
+		return
+	}
+	if role == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Role not found")
+		return
+	}
+	scopeIDs, ok := a.resolveScopes(w, req.Scopes)
+	if !ok {
+		return
+	}
+	if err := a.DB.SetRoleScopes(id, scopeIDs); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to set role scopes")
+		return
+	}
+	role, err = a.DB.GetRoleByID(id)
+	if err != nil || role == nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load role")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"role": roleJSON(role)})
+}
+
+// HandleDeleteRole deletes a role and all of its assignments
+// DELETE /api/v1/admin/roles/{id}
+func (a *App) HandleDeleteRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := a.DB.DeleteRole(id); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Role not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// HandleListUserRoles lists the roles assigned to a user
+// GET /api/v1/admin/users/{id}/roles
+func (a *App) HandleListUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	roles, err := a.DB.ListUserRoles(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list user roles")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(roles))
+	for _, ur := range roles {
+		out = append(out, userRoleJSON(ur))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"roles": out})
+}
+
+// HandleAssignUserRole assigns a role to a user, for every application or only the given one
+// POST /api/v1/admin/users/{id}/roles
+func (a *App) HandleAssignUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		RoleID        int64  `json:"role_id"`
+		ApplicationID *int64 `json:"application_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	user, err := a.DB.GetUserByID(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load user")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "User not found")
+		return
+	}
+	role, err := a.DB.GetRoleByID(req.RoleID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load role")
+		return
+	}
+	if role == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Role not found")
+		return
+	}
+	if req.ApplicationID != nil {
+		target, err := a.DB.GetApplicationByID(*req.ApplicationID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application")
+			return
+		}
+		if target == nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Application not found")
+			return
+		}
+	}
+	if err := a.DB.AssignUserRole(userID, req.RoleID, req.ApplicationID); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to assign role")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{"assigned": true})
+}
+
+// HandleRemoveUserRole removes a role assignment; pass application_id to remove a per-application assignment
+// DELETE /api/v1/admin/users/{id}/roles/{roleId}
+func (a *App) HandleRemoveUserRole(w http.ResponseWriter, r *http.Request) {
+	userID, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	roleID, ok := pathID(w, r, "roleId")
+	if !ok {
+		return
+	}
+	appID, err := queryApplicationID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid application_id")
+		return
+	}
+	if err := a.DB.RemoveUserRole(userID, roleID, appID); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Role assignment not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"removed": true})
+}
+
+// HandleGetUserPermissions shows a user's roles and effective permissions for debugging.
+// Defaults to the calling application; pass application_id to inspect another one.
+// GET /api/v1/users/{id}/permissions
+func (a *App) HandleGetUserPermissions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	app := applicationFromRequest(r)
+	appID, err := queryApplicationID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid application_id")
+		return
+	}
+	if appID == nil && app != nil {
+		appID = &app.ID
+	}
+	user, err := a.loadNamespaceUser(userID, app)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load user")
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "User not found")
+		return
+	}
+	roles, err := a.DB.ListUserRoles(userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list user roles")
+		return
+	}
+	perms, err := a.DB.GetUserPermissions(userID, appID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load permissions")
+		return
+	}
+	effective := make([]map[string]interface{}, 0, len(roles))
+	for _, ur := range roles {
+		if ur.ApplicationID == nil || (appID != nil && *ur.ApplicationID == *appID) {
+			effective = append(effective, userRoleJSON(ur))
+		}
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"user_id":        userID,
+		"application_id": appID,
+		"roles":          effective,
+		"permissions":    perms,
+	})
+}
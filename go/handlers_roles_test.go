@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleAssignmentsAndPermissions(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	other, otherKey := addTestApplication(t, a, "other", false)
+	hashed, err := hashPassword("secret-pw")
+	require.NoError(t, err)
+	user, err := a.DB.CreateUser("jane@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/roles", a.HandleCreateRole).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/roles", a.HandleListUserRoles).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}/roles", a.HandleAssignUserRole).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/roles/{roleId:[0-9]+}", a.HandleRemoveUserRole).Methods("DELETE")
+	admin := func(method, path, body string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		data, _ := out["data"].(map[string]interface{})
+		return rec.Code, data
+	}
+	createRole := func(name, scope string) int64 {
+		status, data := admin("POST", "/roles", `{"name":"`+name+`","scopes":["`+scope+`"]}`)
+		require.Equal(t, http.StatusCreated, status)
+		return int64(data["role"].(map[string]interface{})["id"].(float64))
+	}
+	// permissions returns the permissions of a fresh access token, checking that
+	// introspection reports the same ones
+	permissions := func(key string) []string {
+		status, body := callAs(t, a, key, a.HandleLogin, `{"email":"jane@example.com","password":"secret-pw"}`)
+		require.Equal(t, http.StatusOK, status)
+		access := body["accessToken"].(string)
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(access, claims, func(*jwt.Token) (interface{}, error) { return jwtSecret, nil })
+		require.NoError(t, err)
+		perms := claimsPermissions(claims)
+		_, info := callAs(t, a, key, a.HandleTokenIntrospect, `{"token":"`+access+`"}`)
+		require.Equal(t, true, info["Active"])
+		introspected := []string{}
+		if scopes, ok := info["Scopes"].([]interface{}); ok {
+			for _, s := range scopes {
+				introspected = append(introspected, s.(string))
+			}
+		}
+		require.ElementsMatch(t, perms, introspected)
+		return perms
+	}
+
+	status, _ := admin("POST", "/roles", `{"name":"bad","scopes":["no:such:scope"]}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	reader := createRole("reader", "read:user")
+	writer := createRole("writer", "write:user")
+	status, _ = admin("POST", "/roles", `{"name":"reader"}`)
+	require.Equal(t, http.StatusConflict, status)
+
+	userPath := "/users/" + strconv.FormatInt(user.ID, 10) + "/roles"
+	require.Empty(t, permissions(plain))
+	status, _ = admin("POST", userPath, `{"role_id":999999}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = admin("POST", "/users/999999/roles", `{"role_id":`+strconv.FormatInt(reader, 10)+`}`)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// a global role applies in every application, an application role only in its own
+	status, _ = admin("POST", userPath, `{"role_id":`+strconv.FormatInt(reader, 10)+`}`)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = admin("POST", userPath, `{"role_id":`+strconv.FormatInt(writer, 10)+`,"application_id":`+strconv.FormatInt(app.ID, 10)+`}`)
+	require.Equal(t, http.StatusCreated, status)
+	_, data := admin("GET", userPath, "")
+	require.Len(t, data["roles"], 2)
+	require.ElementsMatch(t, []string{"read:user", "write:user"}, permissions(plain))
+	require.Equal(t, []string{"read:user"}, permissions(otherKey))
+	otherPerms, err := a.DB.GetUserPermissions(user.ID, &other.ID)
+	require.NoError(t, err)
+	require.Equal(t, []string{"read:user"}, otherPerms)
+
+	// application assignments are removed by naming their application
+	writerPath := userPath + "/" + strconv.FormatInt(writer, 10)
+	status, _ = admin("DELETE", writerPath, "")
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = admin("DELETE", writerPath+"?application_id="+strconv.FormatInt(app.ID, 10), "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{"read:user"}, permissions(plain))
+
+	status, _ = admin("DELETE", userPath+"/"+strconv.FormatInt(reader, 10), "")
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, permissions(plain))
+	_, data = admin("GET", userPath, "")
+	require.Empty(t, data["roles"])
+}
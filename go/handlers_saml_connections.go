@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func samlConnectionJSON(c *SAMLConnection, sp samlServiceProvider) map[string]interface{} {
+	domains := c.Domains
+	if domains == nil {
+		domains = []string{}
+	}
+	return map[string]interface{}{
+		"id":              c.ID,
+		"application_id":  c.ApplicationID,
+		"organization_id": c.OrganizationID,
+		"name":            c.Name,
+		"idp_entity_id":   c.IdPEntityID,
+		"idp_sso_url":     c.IdPSSOURL,
+		"idp_certificate": c.IdPCertificate,
+		"email_attribute": c.EmailAttribute,
+		"domains":         domains,
+		"active":          c.Active,
+		"sp_entity_id":    sp.EntityID,
+		"metadata_url":    sp.EntityID,
+		"acs_url":         sp.ACSURL,
+		"sp_certificate":  c.SPCertificate,
+		"created_at":      c.CreatedAt,
+		"updated_at":      c.UpdatedAt,
+	}
+}
+
+// normalizeSAMLConnection validates a connection before it is stored
+func normalizeSAMLConnection(c *SAMLConnection) error {
+	c.Name = strings.ToLower(strings.TrimSpace(c.Name))
+	if !identityProviderNamePattern.MatchString(c.Name) {
+		return errors.New("name must be 1-63 lowercase letters, digits, dashes or underscores")
+	}
+	c.IdPEntityID = strings.TrimSpace(c.IdPEntityID)
+	if c.IdPEntityID == "" {
+		return errors.New("idp_entity_id is required")
+	}
+	c.IdPSSOURL = strings.TrimSpace(c.IdPSSOURL)
+	u, err := url.Parse(c.IdPSSOURL)
+	if err != nil || u.Host == "" || u.Fragment != "" || u.User != nil {
+		return errors.New("idp_sso_url must be an absolute URL")
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname())) {
+		return errors.New("idp_sso_url must use https")
+	}
+	c.IdPCertificate = strings.TrimSpace(c.IdPCertificate)
+	if _, err := parseCertificates(c.IdPCertificate); err != nil {
+		return errors.New("idp_certificate must hold a PEM or base64 X.509 certificate")
+	}
+	c.EmailAttribute = strings.TrimSpace(c.EmailAttribute)
+	domains := []string{}
+	seen := map[string]bool{}
+	for _, d := range c.Domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "" || seen[d] {
+			continue
+		}
+		if !strings.Contains(d, ".") || strings.ContainsAny(d, "@/ ") {
+			return errors.New("domains must be plain email domains such as example.com")
+		}
+		seen[d] = true
+		domains = append(domains, d)
+	}
+	if len(domains) == 0 {
+		return errors.New("domains is required")
+	}
+	c.Domains = domains
+	return nil
+}
+
+// loadSAMLConnection resolves the {id} route variable, writing an error response and
+// returning nil when the connection does not exist
+func (a *App) loadSAMLConnection(w http.ResponseWriter, r *http.Request) *SAMLConnection {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil
+	}
+	c, err := a.DB.GetSAMLConnectionByID(id)
+	if err != nil || c == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "SAML connection not found")
+		return nil
+	}
+	return c
+}
+
+// HandleCreateSAMLConnection connects an application, or one of its organizations, to a
+// SAML identity provider. The service provider key pair is generated here; its
+// certificate is returned and published in the connection's metadata.
+// POST /api/v1/admin/saml-connections
+func (a *App) HandleCreateSAMLConnection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ApplicationID  int64    `json:"application_id"`
+		OrganizationID *int64   `json:"organization_id"`
+		Name           string   `json:"name"`
+		IdPEntityID    string   `json:"idp_entity_id"`
+		IdPSSOURL      string   `json:"idp_sso_url"`
+		IdPCertificate string   `json:"idp_certificate"`
+		EmailAttribute string   `json:"email_attribute"`
+		Domains        []string `json:"domains"`
+		Active         *bool    `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	c := &SAMLConnection{
+		ApplicationID:  req.ApplicationID,
+		OrganizationID: req.OrganizationID,
+		Name:           req.Name,
+		IdPEntityID:    req.IdPEntityID,
+		IdPSSOURL:      req.IdPSSOURL,
+		IdPCertificate: req.IdPCertificate,
+		EmailAttribute: req.EmailAttribute,
+		Domains:        req.Domains,
+		Active:         req.Active == nil || *req.Active,
+	}
+	if err := normalizeSAMLConnection(c); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if app, err := a.DB.GetApplicationByID(c.ApplicationID); err != nil || app == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Application not found")
+		return
+	}
+	if c.OrganizationID != nil {
+		org, err := a.DB.GetOrganizationByID(*c.OrganizationID)
+		if err != nil || org == nil || org.ApplicationID == nil || *org.ApplicationID != c.ApplicationID {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Organization not found in this application")
+			return
+		}
+	}
+	if existing, err := a.DB.GetSAMLConnectionByName(c.Name); err != nil || existing != nil {
+		writeError(w, http.StatusConflict, "SAML_CONNECTION_EXISTS", "SAML connection with this name already exists")
+		return
+	}
+	key, cert, err := generateSAMLKeyPair(c.Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate service provider key")
+		return
+	}
+	c.SPPrivateKey, c.SPCertificate = key, cert
+	if err := a.DB.CreateSAMLConnection(c); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to create SAML connection")
+		return
+	}
+	writeSuccess(w, http.StatusCreated, map[string]interface{}{"saml_connection": samlConnectionJSON(c, a.samlServiceProvider(r, c))})
+}
+
+// HandleListSAMLConnections lists SAML connections, optionally those of one application
+// GET /api/v1/admin/saml-connections
+func (a *App) HandleListSAMLConnections(w http.ResponseWriter, r *http.Request) {
+	appID, err := queryApplicationID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid application_id")
+		return
+	}
+	conns, err := a.DB.ListSAMLConnections(appID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list SAML connections")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(conns))
+	for _, c := range conns {
+		out = append(out, samlConnectionJSON(c, a.samlServiceProvider(r, c)))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"saml_connections": out})
+}
+
+// HandleGetSAMLConnection returns one SAML connection
+// GET /api/v1/admin/saml-connections/{id}
+func (a *App) HandleGetSAMLConnection(w http.ResponseWriter, r *http.Request) {
+	c := a.loadSAMLConnection(w, r)
+	if c == nil {
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"saml_connection": samlConnectionJSON(c, a.samlServiceProvider(r, c))})
+}
+
+// HandleUpdateSAMLConnection changes the identity provider settings of a connection;
+// omitted fields keep their value. The application, organization and service provider
+// key are fixed when the connection is created.
+// PUT /api/v1/admin/saml-connections/{id}
+func (a *App) HandleUpdateSAMLConnection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name           *string   `json:"name"`
+		IdPEntityID    *string   `json:"idp_entity_id"`
+		IdPSSOURL      *string   `json:"idp_sso_url"`
+		IdPCertificate *string   `json:"idp_certificate"`
+		EmailAttribute *string   `json:"email_attribute"`
+		Domains        *[]string `json:"domains"`
+		Active         *bool     `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	target := a.loadSAMLConnection(w, r)
+	if target == nil {
+		return
+	}
+
+	updated := *target
+	if req.Name != nil {
+		updated.Name = *req.Name
+	}
+	if req.IdPEntityID != nil {
+		updated.IdPEntityID = *req.IdPEntityID
+	}
+	if req.IdPSSOURL != nil {
+		updated.IdPSSOURL = *req.IdPSSOURL
+	}
+	if req.IdPCertificate != nil {
+		updated.IdPCertificate = *req.IdPCertificate
+	}
+	if req.EmailAttribute != nil {
+		updated.EmailAttribute = *req.EmailAttribute
+	}
+	if req.Domains != nil {
+		updated.Domains = *req.Domains
+	}
+	if req.Active != nil {
+		updated.Active = *req.Active
+	}
+	if err := normalizeSAMLConnection(&updated); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if updated.Name != target.Name {
+		if existing, err := a.DB.GetSAMLConnectionByName(updated.Name); err != nil || existing != nil {
+			writeError(w, http.StatusConflict, "SAML_CONNECTION_EXISTS", "SAML connection with this name already exists")
+			return
+		}
+	}
+	if err := a.DB.UpdateSAMLConnection(&updated); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update SAML connection")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"saml_connection": samlConnectionJSON(&updated, a.samlServiceProvider(r, &updated))})
+}
+
+// HandleDeleteSAMLConnection removes a SAML connection; users it provisioned keep their
+// accounts
+// DELETE /api/v1/admin/saml-connections/{id}
+func (a *App) HandleDeleteSAMLConnection(w http.ResponseWriter, r *http.Request) {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return
+	}
+	if err := a.DB.DeleteSAMLConnection(id); err != nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "SAML connection not found")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]bool{"deleted": true})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// addTestApplication creates another application with its own API key
+func addTestApplication(tb testing.TB, a *App, name string, isolatedUsers bool) (*Application, string) {
+	tb.Helper()
+	plain, err := generateAPIKey()
+	require.NoError(tb, err)
+	key, err := newAPIKeyRecord(plain, "test")
+	require.NoError(tb, err)
+	app, err := a.DB.CreateApplication(name, name+".example.com", key, 100, nil, isolatedUsers)
+	require.NoError(tb, err)
+	return app, plain
+}
+
+// callAs runs an auth handler as the application owning key and decodes its JSON response
+func callAs(tb testing.TB, a *App, key string, handler http.HandlerFunc, body string) (int, map[string]interface{}) {
+	tb.Helper()
+	req := httptest.NewRequest("POST", "/api/v1/auth", strings.NewReader(body))
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	a.APIKeyAuth(handler).ServeHTTP(rec, req)
+	var out map[string]interface{}
+	require.NoError(tb, json.Unmarshal(rec.Body.Bytes(), &out))
+	return rec.Code, out
+}
+
+func TestIsolatedUserNamespaces(t *testing.T) {
+	shared, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, shared)
+	one, keyOne := addTestApplication(t, a, "one", true)
+	two, keyTwo := addTestApplication(t, a, "two", true)
+
+	// the same email signs up separately in each isolated application
+	status, regOne := callAs(t, a, keyOne, a.HandleRegister, `{"email":"jane@example.com","password":"pw-one"}`)
+	require.Equal(t, http.StatusCreated, status)
+	status, regTwo := callAs(t, a, keyTwo, a.HandleRegister, `{"email":"jane@example.com","password":"pw-two"}`)
+	require.Equal(t, http.StatusCreated, status)
+	idOne := int64(regOne["user"].(map[string]interface{})["id"].(float64))
+	idTwo := int64(regTwo["user"].(map[string]interface{})["id"].(float64))
+	require.NotEqual(t, idOne, idTwo)
+	status, _ = callAs(t, a, keyOne, a.HandleRegister, `{"email":"jane@example.com","password":"pw-three"}`)
+	require.Equal(t, http.StatusConflict, status)
+	// the shared namespace has no jane at all
+	status, _ = callAs(t, a, shared, a.HandleLogin, `{"email":"jane@example.com","password":"pw-one"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	// each account only knows its own password
+	status, _ = callAs(t, a, keyTwo, a.HandleLogin, `{"email":"jane@example.com","password":"pw-one"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = callAs(t, a, keyTwo, a.HandleLogin, `{"email":"jane@example.com","password":"pw-two"}`)
+	require.Equal(t, http.StatusOK, status)
+
+	require.True(t, a.userInNamespace(idOne, one))
+	require.False(t, a.userInNamespace(idOne, two))
+	require.True(t, a.userInNamespace(idOne, nil))
+
+	// tokens from one application are refused by the other
+	refresh := regOne["refreshToken"].(string)
+	status, body := callAs(t, a, keyTwo, a.HandleRefresh, `{"refreshToken":"`+refresh+`"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "INVALID_TOKEN", body["error_code"])
+	for _, token := range []string{regOne["accessToken"].(string), refresh} {
+		_, info := callAs(t, a, keyTwo, a.HandleTokenIntrospect, `{"token":"`+token+`"}`)
+		require.Equal(t, false, info["Active"])
+		_, info = callAs(t, a, keyOne, a.HandleTokenIntrospect, `{"token":"`+token+`"}`)
+		require.Equal(t, true, info["Active"])
+	}
+	// the refused refresh did not use up the token
+	status, _ = callAs(t, a, keyOne, a.HandleRefresh, `{"refreshToken":"`+refresh+`"}`)
+	require.Equal(t, http.StatusOK, status)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func adminUserJSON(u *User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             u.ID,
+		"email":          u.Email,
+		"application_id": u.ApplicationID,
+		"namespace_id":   u.NamespaceID,
+		"mfa_enabled":    u.TOTPSecret != "",
+		"disabled":       u.Disabled,
+		"created_at":     u.CreatedAt,
+	}
+}
+
+// sessionJSON describes a refresh token without revealing it
+func sessionJSON(t *RefreshToken) map[string]interface{} {
+	return map[string]interface{}{
+		"application_id":  t.ApplicationID,
+		"organization_id": t.OrganizationID,
+		"created_at":      t.CreatedAt,
+		"expires_at":      time.Unix(t.ExpiresAt, 0).UTC(),
+	}
+}
+
+// loginEventJSON describes an entry of a user's login history
+func loginEventJSON(e *LoginEvent) map[string]interface{} {
+	reasons := e.RiskReasons
+	if reasons == nil {
+		reasons = []string{}
+	}
+	return map[string]interface{}{
+		"id":             e.ID,
+		"application_id": e.ApplicationID,
+		"outcome":        e.Outcome,
+		"ip":             e.IP,
+		"user_agent":     e.UserAgent,
+		"device_id":      e.DeviceID,
+		"country":        e.Country,
+		"city":           e.City,
+		"latitude":       e.Latitude,
+		"longitude":      e.Longitude,
+		"risk_score":     e.RiskScore,
+		"risk_level":     e.RiskLevel,
+		"risk_reasons":   reasons,
+		"created_at":     e.CreatedAt,
+	}
+}
+
+// loadUser loads the user named by the {id} route variable, writing an error response
+// and returning nil if it does not exist
+func (a *App) loadUser(w http.ResponseWriter, r *http.Request) *User {
+	id, ok := pathID(w, r, "id")
+	if !ok {
+		return nil
+	}
+	user, err := a.DB.GetUserByID(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load user")
+		return nil
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "User not found")
+		return nil
+	}
+	return user
+}
+
+// setUserDisabled disables or re-enables a user. Disabling revokes every refresh token,
+// so the user's sessions end when their access tokens expire.
+func (a *App) setUserDisabled(r *http.Request, user *User, disabled bool, details map[string]interface{}) error {
+	if user.Disabled == disabled {
+		return nil
+	}
+	if err := a.DB.SetUserDisabled(user.ID, disabled); err != nil {
+		return err
+	}
+	user.Disabled = disabled
+	action := auditUserEnabled
+	if disabled {
+		if err := a.DB.RevokeAllRefreshTokensForUser(user.ID); err != nil {
+			return err
+		}
+		action = auditUserDisabled
+	}
+	a.audit(r, action, &user.ID, details)
+	return nil
+}
+
+// userFilterFromQuery reads the email, application_id and disabled search parameters
+func userFilterFromQuery(r *http.Request) (UserFilter, error) {
+	filter := UserFilter{EmailPrefix: r.URL.Query().Get("email")}
+	var err error
+	if filter.ApplicationID, err = queryApplicationID(r); err != nil {
+		return filter, errors.New("Invalid application_id")
+	}
+	if raw := r.URL.Query().Get("disabled"); raw != "" {
+		disabled, err := strconv.ParseBool(raw)
+		if err != nil {
+			return filter, errors.New("Invalid disabled filter")
+		}
+		filter.Disabled = &disabled
+	}
+	return filter, nil
+}
+
+// HandleListUsers searches users by email prefix, application and disabled state
+// GET /api/v1/admin/users?email=jane&application_id=3&disabled=false&limit=50&offset=0
+func (a *App) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	filter, err := userFilterFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	filter.Limit, filter.Offset = limit, offset
+
+	users, total, err := a.DB.ListUsers(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list users")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(users))
+	for _, u := range users {
+		out = append(out, adminUserJSON(u))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"users":  out,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// HandleGetUser returns a user with their active sessions
+// GET /api/v1/admin/users/{id}
+func (a *App) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	tokens, err := a.DB.ListRefreshTokensForUser(user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list sessions")
+		return
+	}
+	sessions := make([]map[string]interface{}, 0, len(tokens))
+	for _, t := range tokens {
+		sessions = append(sessions, sessionJSON(t))
+	}
+	out := adminUserJSON(user)
+	out["sessions"] = sessions
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"user": out})
+}
+
+// HandleListUserLogins returns a user's password logins, newest first, with the risk
+// each was scored at
+// GET /api/v1/admin/users/{id}/logins?limit=50&offset=0
+func (a *App) HandleListUserLogins(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	events, total, err := a.DB.ListLoginEvents(LoginEventFilter{UserID: user.ID, Limit: limit, Offset: offset})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to list logins")
+		return
+	}
+	out := make([]map[string]interface{}, 0, len(events))
+	for _, e := range events {
+		out = append(out, loginEventJSON(e))
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"logins": out,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// HandleDisableUser disables a user. They can no longer log in or refresh, and their
+// refresh tokens are revoked.
+// POST /api/v1/admin/users/{id}/disable
+func (a *App) HandleDisableUser(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabledByAdmin(w, r, true)
+}
+
+// HandleEnableUser re-enables a disabled user
+// POST /api/v1/admin/users/{id}/enable
+func (a *App) HandleEnableUser(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabledByAdmin(w, r, false)
+}
+
+func (a *App) setUserDisabledByAdmin(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := a.setUserDisabled(r, user, disabled, nil); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to update user")
+		return
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"user": adminUserJSON(user)})
+}
+
+// HandleForceUserPasswordReset replaces a user's password with an unusable one, revokes
+// their refresh tokens and emails them a reset code. The user can only sign in with a
+// password again after choosing a new one.
+// POST /api/v1/admin/users/{id}/password-reset
+func (a *App) HandleForceUserPasswordReset(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	random, err := genToken(32)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to reset password")
+		return
+	}
+	hashed, err := hashPassword(random)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to reset password")
+		return
+	}
+	if err := a.DB.UpdateUserPassword(user.ID, hashed); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to reset password")
+		return
+	}
+	if err := a.DB.RevokeAllRefreshTokensForUser(user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to revoke sessions")
+		return
+	}
+	a.audit(r, auditPasswordResetForced, &user.ID, nil)
+	// The old password is gone either way; a user who misses the email can still use the
+	// forgot password flow
+	sent := true
+	if err := a.sendPasswordReset(user, nil); err != nil {
+		log.Printf("forced password reset for user %d: %v", user.ID, err)
+		sent = false
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{"reset": true, "email_sent": sent})
+}
+
+// HandleRevokeUserTokens revokes every refresh token of a user, ending their sessions
+// once their access tokens expire
+// POST /api/v1/admin/users/{id}/revoke-tokens
+func (a *App) HandleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := a.DB.RevokeAllRefreshTokensForUser(user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to revoke sessions")
+		return
+	}
+	a.audit(r, auditUserSessionsRevoked, &user.ID, nil)
+	writeSuccess(w, http.StatusOK, map[string]bool{"revoked": true})
+}
+
+// HandleDeleteUser permanently deletes a user with their sessions, memberships, role
+// assignments and linked accounts. Audit events about the user are kept.
+// DELETE /api/v1/admin/users/{id}
+func (a *App) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := a.loadUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := a.DB.DeleteUser(user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to delete user")
+		return
+	}
+	a.audit(r, auditUserDeleted, &user.ID, map[string]interface{}{"email": user.Email})
+	writeSuccess(w, http.StatusOK, map[string]bool{"deleted": true})
+}
+
+// HandleImportUsers upserts users from a JSONL or CSV body into the user pool of
+// application_id, or the global pool. With dry_run=true rows are checked and reported
+// without writing anything.
+// POST /api/v1/admin/users/import?application_id=3&format=csv&dry_run=true
+func (a *App) HandleImportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = userFileJSONL
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = userFileCSV
+		}
+	}
+	if format != userFileJSONL && format != userFileCSV {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "format must be jsonl or csv")
+		return
+	}
+	dryRun := false
+	if raw := r.URL.Query().Get("dry_run"); raw != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid dry_run")
+			return
+		}
+	}
+	appID, err := queryApplicationID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid application_id")
+		return
+	}
+	var target *Application
+	if appID != nil {
+		if target, err = a.DB.GetApplicationByID(*appID); err != nil {
+			writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application")
+			return
+		}
+		if target == nil {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Application not found")
+			return
+		}
+	}
+
+	failures := []userImportResult{}
+	body := http.MaxBytesReader(w, r.Body, maxImportBodyBytes)
+	summary, err := newUserImporter(a.DB, target, dryRun).run(body, format, func(res userImportResult) {
+		if res.Action == importFailed {
+			failures = append(failures, res)
+		}
+	})
+	// Rows before an unreadable part of the body are already written, so they are audited
+	// and reported either way
+	rows := summary.Created + summary.Updated + summary.Unchanged + summary.Failed
+	if !dryRun && (err == nil || rows > 0) {
+		a.audit(r, auditUsersImported, nil, map[string]interface{}{
+			"application_id": appID,
+			"created":        summary.Created,
+			"updated":        summary.Updated,
+			"failed":         summary.Failed,
+			"complete":       err == nil,
+		})
+	}
+	results := map[string]interface{}{
+		"dry_run":   dryRun,
+		"created":   summary.Created,
+		"updated":   summary.Updated,
+		"unchanged": summary.Unchanged,
+		"failed":    summary.Failed,
+		"errors":    failures,
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error_code":    "INVALID_REQUEST",
+			"error_message": fmt.Sprintf("Could not read the import after %d rows: %v", rows, err),
+			"data":          results,
+		})
+		return
+	}
+	writeSuccess(w, http.StatusOK, results)
+}
+
+// HandleExportUsers streams the users matching the list filters as JSONL or CSV.
+// Password hashes are only included with include_password_hashes=true.
+// GET /api/v1/admin/users/export?format=csv&application_id=3&include_password_hashes=false
+func (a *App) HandleExportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = userFileJSONL
+	}
+	contentType := map[string]string{userFileJSONL: "application/x-ndjson", userFileCSV: "text/csv"}[format]
+	if contentType == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "format must be jsonl or csv")
+		return
+	}
+	filter, err := userFilterFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	withHashes := false
+	if raw := r.URL.Query().Get("include_password_hashes"); raw != "" {
+		if withHashes, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid include_password_hashes")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+	// The status is already sent, so a failure can only cut the stream short
+	count, err := exportUsers(a.DB, w, format, filter, withHashes)
+	if err != nil {
+		log.Printf("exporting users: %v", err)
+	}
+	a.audit(r, auditUsersExported, nil, map[string]interface{}{
+		"application_id":          filter.ApplicationID,
+		"count":                   count,
+		"include_password_hashes": withHashes,
+	})
+}
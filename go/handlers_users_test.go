@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingMailer keeps sent messages for assertions
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, to+"\n"+subject+"\n"+body)
+	return nil
+}
+
+func TestAdminUserManagement(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	mailer := &recordingMailer{}
+	a.Mailer = mailer
+	app, _ := a.validateAPIKey(plain)
+
+	hashed, err := hashPassword("secret-pw")
+	require.NoError(t, err)
+	jane, err := a.DB.CreateUser("jane@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	for _, email := range []string{"jan_e@example.com", "janet@example.com", "bob@example.com"} {
+		_, err := a.DB.CreateUser(email, hashed, nil, globalNamespace)
+		require.NoError(t, err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", a.HandleListUsers).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}", a.HandleGetUser).Methods("GET")
+	r.HandleFunc("/users/{id:[0-9]+}", a.HandleDeleteUser).Methods("DELETE")
+	r.HandleFunc("/users/{id:[0-9]+}/disable", a.HandleDisableUser).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/enable", a.HandleEnableUser).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/password-reset", a.HandleForceUserPasswordReset).Methods("POST")
+	r.HandleFunc("/users/{id:[0-9]+}/revoke-tokens", a.HandleRevokeUserTokens).Methods("POST")
+	admin := func(method, path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		data, _ := out["data"].(map[string]interface{})
+		return rec.Code, data
+	}
+	auth := func(handler http.HandlerFunc, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/v1/auth", strings.NewReader(body))
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(handler).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec.Code, out
+	}
+	userPath := "/users/" + strconv.FormatInt(jane.ID, 10)
+
+	// searches match the email prefix literally and can be narrowed to an application
+	status, data := admin("GET", "/users?email=JAN")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(3), data["total"])
+	_, data = admin("GET", "/users?email=jan_")
+	require.Equal(t, float64(1), data["total"])
+	_, data = admin("GET", "/users?application_id="+strconv.FormatInt(app.ID, 10))
+	require.Equal(t, float64(1), data["total"])
+	_, data = admin("GET", "/users?limit=2&offset=3")
+	require.Len(t, data["users"], 1)
+	status, _ = admin("GET", "/users?disabled=maybe")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// the user's sessions are listed without their tokens
+	status, login := auth(a.HandleLogin, `{"email":"jane@example.com","password":"secret-pw"}`)
+	require.Equal(t, http.StatusOK, status)
+	_, data = admin("GET", userPath)
+	sessions := data["user"].(map[string]interface{})["sessions"].([]interface{})
+	require.Len(t, sessions, 1)
+	require.NotContains(t, sessions[0], "token")
+	require.Equal(t, float64(app.ID), sessions[0].(map[string]interface{})["application_id"])
+
+	// disabled users are rejected at login and refresh until re-enabled
+	status, data = admin("POST", userPath+"/disable")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, true, data["user"].(map[string]interface{})["disabled"])
+	status, body := auth(a.HandleLogin, `{"email":"jane@example.com","password":"secret-pw"}`)
+	require.Equal(t, http.StatusForbidden, status)
+	require.Equal(t, "USER_DISABLED", body["error_code"])
+	_, data = admin("GET", "/users?disabled=true")
+	require.Equal(t, float64(1), data["total"])
+	admin("POST", userPath+"/enable")
+	status, login = auth(a.HandleLogin, `{"email":"jane@example.com","password":"secret-pw"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, a.DB.SetUserDisabled(jane.ID, true))
+	status, body = auth(a.HandleRefresh, `{"refreshToken":"`+login["refreshToken"].(string)+`"}`)
+	require.Equal(t, http.StatusForbidden, status)
+	require.Equal(t, "USER_DISABLED", body["error_code"])
+	require.NoError(t, a.DB.SetUserDisabled(jane.ID, false))
+
+	// revoking tokens ends every session
+	status, _ = admin("POST", userPath+"/revoke-tokens")
+	require.Equal(t, http.StatusOK, status)
+	_, data = admin("GET", userPath)
+	require.Empty(t, data["user"].(map[string]interface{})["sessions"])
+
+	// a forced reset makes the old password unusable and emails a reset code
+	status, data = admin("POST", userPath+"/password-reset")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, true, data["email_sent"])
+	status, _ = auth(a.HandleLogin, `{"email":"jane@example.com","password":"secret-pw"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Len(t, mailer.sent, 1)
+	code := mailer.sent[0][strings.Index(mailer.sent[0], "Reset code: ")+len("Reset code: "):]
+	code = code[:strings.Index(code, "\n")]
+	status, _ = auth(a.HandleResetPassword, `{"token":"`+code+`","password":"new-secret-pw"}`)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = auth(a.HandleLogin, `{"email":"jane@example.com","password":"new-secret-pw"}`)
+	require.Equal(t, http.StatusOK, status)
+
+	// deleting removes the user for good
+	status, _ = admin("DELETE", userPath)
+	require.Equal(t, http.StatusOK, status)
+	status, _ = admin("GET", userPath)
+	require.Equal(t, http.StatusNotFound, status)
+	gone, err := a.DB.GetUserByEmail(userNamespace(app), "jane@example.com")
+	require.NoError(t, err)
+	require.Nil(t, gone)
+}
+
+func TestAdminImpersonation(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, false, plain)
+	app, _ := a.validateAPIKey(plain)
+	user, err := a.DB.CreateUser("jane@example.com", "x", &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	role, err := a.DB.CreateRole("support-target", "")
+	require.NoError(t, err)
+	var scopeIDs []int64
+	for _, name := range []string{"read:user", "write:user", "admin:users"} {
+		scope, err := a.DB.GetScopeByName(name)
+		require.NoError(t, err)
+		scopeIDs = append(scopeIDs, scope.ID)
+	}
+	require.NoError(t, a.DB.SetRoleScopes(role.ID, scopeIDs))
+	require.NoError(t, a.DB.AssignUserRole(user.ID, role.ID, nil))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id:[0-9]+}/impersonate", a.HandleImpersonateUser).Methods("POST")
+	impersonate := func(body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/users/"+strconv.FormatInt(user.ID, 10)+"/impersonate", strings.NewReader(body))
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(r).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		data, _ := out["data"].(map[string]interface{})
+		return rec.Code, data
+	}
+
+	status, _ := impersonate(`{}`)
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = impersonate(`{"reason":"T-1","ttl_seconds":7200}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// admin scopes are dropped and requested scopes narrow the rest
+	status, data := impersonate(`{"reason":"T-1"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []interface{}{"read:user", "write:user"}, data["permissions"])
+	status, data = impersonate(`{"reason":"T-2","operator":"agent@support.example.com","scopes":["read:user"],"ttl_seconds":300}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []interface{}{"read:user"}, data["permissions"])
+	require.Equal(t, float64(300), data["expires_in"])
+	require.NotContains(t, data, "refresh_token")
+	access := data["access_token"].(string)
+
+	// introspection names the administrator
+	req := httptest.NewRequest("POST", "/introspect", strings.NewReader(`{"token":"`+access+`"}`))
+	rec := httptest.NewRecorder()
+	a.HandleTokenIntrospect(rec, req)
+	var info TokenInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	require.True(t, info.Active)
+	require.Equal(t, []string{"read:user"}, info.Scopes)
+	require.Equal(t, "agent@support.example.com", info.Act["sub"])
+	require.Equal(t, float64(app.ID), info.Act["app_id"])
+
+	// the token can look at the account but not change it
+	selfService := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/mfa", nil)
+		req.Header.Set("X-API-Key", plain)
+		req.Header.Set("Authorization", "Bearer "+access)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := a.authenticatedUser(w, r); ok {
+				w.WriteHeader(http.StatusOK)
+			}
+		})).ServeHTTP(rec, req)
+		return rec
+	}
+	for method, want := range map[string]int{"GET": http.StatusOK, "POST": http.StatusForbidden} {
+		require.Equal(t, want, selfService(method).Code, method)
+	}
+
+	// every issuance is audited
+	events, total, err := a.DB.ListAuditEvents(AuditEventFilter{Action: auditUserImpersonated})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, "T-2", events[0].Details["reason"])
+	require.Equal(t, "agent@support.example.com", events[0].Details["actor"])
+
+	// disabled users can neither be impersonated nor reached with tokens issued earlier
+	require.NoError(t, a.DB.SetUserDisabled(user.ID, true))
+	status, _ = impersonate(`{"reason":"T-3"}`)
+	require.Equal(t, http.StatusForbidden, status)
+	rec = selfService("GET")
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), "USER_DISABLED")
+}
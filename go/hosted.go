@@ -0,0 +1,906 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// hostedTemplates holds one template set per hosted page, each combined with the layout
+var hostedTemplates = func() map[string]*template.Template {
+	pages := map[string]*template.Template{}
+	for _, name := range []string{"login", "register", "forgot", "reset", "mfa", "confirm", "consent", "link", "error"} {
+		pages[name] = template.Must(template.ParseFS(templateFS, "templates/layout.html", "templates/"+name+".html"))
+	}
+	return pages
+}()
+
+// Lifetimes of the hosted flow
+const (
+	// hostedFlowTTL bounds the time between the password check and the MFA or consent step
+	hostedFlowTTL = 10 * time.Minute
+	// authorizationCodeTTL is how long an application has to exchange a code for tokens
+	authorizationCodeTTL = 2 * time.Minute
+)
+
+const (
+	purposeHostedFlow = "hosted_flow"
+	hostedCSRFCookie  = "nile_hosted_csrf"
+)
+
+// defaultBranding applies to every field an application leaves empty
+var defaultBranding = Branding{PrimaryColor: "#2563eb", BackgroundColor: "#f5f7fa"}
+
+// defaultCopy is the text of the hosted pages; applications override entries by key.
+// "{app}" is replaced with the application's name.
+var defaultCopy = map[string]string{
+	"page.title":      "{app}",
+	"footer":          "",
+	"field.email":     "Email",
+	"field.username":  "Username",
+	"field.password":  "Password",
+	"field.code":      "One-time code",
+	"back.login":      "Back to sign in",
+	"login.title":     "Sign in to {app}",
+	"login.submit":    "Sign in",
+	"login.forgot":    "Forgot your password?",
+	"login.register":  "Create an account",
+	"login.invalid":   "Invalid email or password",
+	"login.offline":   "Signing in is unavailable right now. Please try again later.",
+	"login.disabled":  "This account has been disabled.",
+	"register.title":  "Create your {app} account",
+	"register.submit": "Create account",
+	"register.login":  "Already have an account? Sign in",
+	"register.exists": "An account with this email already exists",
+	"forgot.title":    "Reset your password",
+	"forgot.intro":    "Enter your email and we will send you a link to choose a new password.",
+	"forgot.submit":   "Send reset link",
+	"forgot.sent":     "If an account exists for that email, a reset link is on its way.",
+	"forgot.offline":  "Password reset by email is not available here. Please contact support.",
+	"reset.title":     "Choose a new password",
+	"reset.submit":    "Update password",
+	"reset.done":      "Your password has been updated. You can now sign in.",
+	"reset.invalid":   "This reset link is invalid or has expired.",
+	"mfa.title":       "Two-step verification",
+	"mfa.intro":       "Enter the 6-digit code from your authenticator app.",
+	"mfa.submit":      "Verify",
+	"mfa.invalid":     "Invalid one-time code",
+	"confirm.title":   "Confirm it's you",
+	"confirm.intro":   "We do not recognize this device or place. Enter the 6-digit code we sent to your email.",
+	"confirm.submit":  "Confirm",
+	"confirm.invalid": "Invalid confirmation code",
+	"consent.title":   "{app} wants to access your account",
+	"consent.intro":   "Signed in as",
+	"consent.allow":   "Allow",
+	"consent.deny":    "Deny",
+	"link.title":      "Link your account",
+	"link.identity":   "You signed in as",
+	"link.account":    "Link it to the {app} account",
+	"link.intro":      "You can then sign in to this account with it. Only continue if you started linking these accounts yourself.",
+	"link.confirm":    "Link accounts",
+	"link.cancel":     "Cancel",
+	"error.title":     "Something went wrong",
+	"error.throttled": "Too many attempts, try again later.",
+	"error.expired":   "Your session expired. Please start again.",
+	"login.providers": "Or continue with",
+	"idp.unavailable": "This sign-in option is not available.",
+	"idp.failed":      "Signing in with the identity provider failed. Please try again.",
+	"idp.unverified":  "An account with this email already exists. Sign in with your password, then link the provider from your account.",
+	"idp.taken":       "This account is linked to a user of another application.",
+	"saml.failed":     "Single sign-on failed. Please try again or contact your administrator.",
+	"saml.exists":     "An account with this email already exists. Sign in with your password.",
+}
+
+var brandingColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// normalizeBranding validates branding set through the admin API
+func normalizeBranding(b Branding) (Branding, error) {
+	for field, color := range map[string]string{"primary_color": b.PrimaryColor, "background_color": b.BackgroundColor} {
+		if color != "" && !brandingColorPattern.MatchString(color) {
+			return Branding{}, fmt.Errorf("branding.%s must be a hex color such as #2563eb", field)
+		}
+	}
+	if b.LogoURL != "" {
+		u, err := url.Parse(b.LogoURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" || len(b.LogoURL) > 2048 {
+			return Branding{}, errors.New("branding.logo_url must be an https URL")
+		}
+	}
+	for key, text := range b.Copy {
+		if _, ok := defaultCopy[key]; !ok {
+			return Branding{}, fmt.Errorf("branding.copy: unknown key %q", key)
+		}
+		if len(text) > 500 {
+			return Branding{}, fmt.Errorf("branding.copy.%s is longer than 500 characters", key)
+		}
+	}
+	return b, nil
+}
+
+// empty reports whether an application uses the default branding
+func (b Branding) empty() bool {
+	return b.LogoURL == "" && b.PrimaryColor == "" && b.BackgroundColor == "" && len(b.Copy) == 0
+}
+
+// authorizeRequest is what an application asks the hosted pages for. It travels with every
+// form as hidden fields and is validated again on each request.
+type authorizeRequest struct {
+	ClientID      string
+	RedirectURI   string
+	State         string
+	Scope         string
+	CodeChallenge string
+	// Prompt "consent" shows the consent page even when no scopes are requested
+	Prompt string
+}
+
+func authorizeRequestFrom(form url.Values) authorizeRequest {
+	return authorizeRequest{
+		ClientID:      form.Get("client_id"),
+		RedirectURI:   form.Get("redirect_uri"),
+		State:         form.Get("state"),
+		Scope:         form.Get("scope"),
+		CodeChallenge: form.Get("code_challenge"),
+		Prompt:        form.Get("prompt"),
+	}
+}
+
+func (q authorizeRequest) values() url.Values {
+	v := url.Values{}
+	for name, value := range map[string]string{
+		"client_id":      q.ClientID,
+		"redirect_uri":   q.RedirectURI,
+		"state":          q.State,
+		"scope":          q.Scope,
+		"code_challenge": q.CodeChallenge,
+		"prompt":         q.Prompt,
+	} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	if q.CodeChallenge != "" {
+		v.Set("code_challenge_method", "S256")
+	}
+	return v
+}
+
+// authorization is a validated authorizeRequest
+type authorization struct {
+	authorizeRequest
+	App    *Application
+	Scopes []*Scope
+	// Login is how the user authenticated once they have
+	Login authentication
+	// Challenge is the login waiting on the MFA or confirmation page for the user's code
+	Challenge *mfaChallenge
+}
+
+// errBadClient marks requests whose client or redirect URI cannot be trusted; they are
+// answered with an error page instead of a redirect
+var errBadClient = errors.New("invalid client_id or redirect_uri")
+
+// validateAuthorizeRequest resolves the application and checks the redirect URI, PKCE
+// parameters and requested scopes
+func (a *App) validateAuthorizeRequest(form url.Values) (*authorization, error) {
+	q := authorizeRequestFrom(form)
+	id, err := strconv.ParseInt(q.ClientID, 10, 64)
+	if err != nil {
+		return nil, errBadClient
+	}
+	app, err := a.DB.GetApplicationByID(id)
+	if err != nil || app == nil || !app.Active {
+		return nil, errBadClient
+	}
+	if !registeredRedirectURI(app, q.RedirectURI) {
+		return nil, errBadClient
+	}
+
+	if method := form.Get("code_challenge_method"); method != "" && method != "S256" {
+		return nil, errors.New("code_challenge_method must be S256")
+	}
+	if q.CodeChallenge != "" && (len(q.CodeChallenge) < 43 || len(q.CodeChallenge) > 128) {
+		return nil, errors.New("code_challenge must be a base64url SHA-256 digest")
+	}
+	if q.CodeChallenge == "" && app.ClientType == clientTypePublic {
+		return nil, errors.New("code_challenge is required for public clients")
+	}
+
+	auth := &authorization{authorizeRequest: q, App: app}
+	if q.Scope != "" {
+		granted, err := a.DB.GetScopesByApplicationID(app.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range strings.Fields(q.Scope) {
+			var found *Scope
+			for _, s := range granted {
+				if s.Name == name {
+					found = s
+				}
+			}
+			if found == nil {
+				return nil, fmt.Errorf("scope %q is not available to this application", name)
+			}
+			auth.Scopes = append(auth.Scopes, found)
+		}
+	}
+	return auth, nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+// hostedPage is the data every hosted template renders
+type hostedPage struct {
+	App      *Application
+	Branding Branding
+	// Request is the authorize request, repeated as hidden form fields
+	Request url.Values
+	// Query is the same request encoded for links between pages
+	Query  template.URL
+	CSRF   string
+	Flow   string
+	Token  string
+	Email  string
+	Scopes []*Scope
+	// Providers are the identity providers offered on the login page
+	Providers []*IdentityProvider
+	// Directory is set when the application checks passwords against an LDAP directory
+	Directory bool
+	Error     string
+	Notice    string
+	// Provider and Identity name the provider account the link page is about
+	Provider string
+	Identity string
+}
+
+// T returns the text of a message key, preferring the application's copy
+func (p *hostedPage) T(key string) string {
+	text, ok := p.Branding.Copy[key]
+	if !ok {
+		text = defaultCopy[key]
+	}
+	name := "nileAuth"
+	if p.App != nil {
+		name = p.App.Name
+	}
+	return strings.ReplaceAll(text, "{app}", name)
+}
+
+// newHostedPage prepares the page data of an authorization
+func (a *App) newHostedPage(w http.ResponseWriter, r *http.Request, auth *authorization) *hostedPage {
+	p := &hostedPage{Branding: defaultBranding, CSRF: hostedCSRFToken(w, r)}
+	if auth == nil {
+		return p
+	}
+	p.App = auth.App
+	values := auth.values()
+	p.Request = values
+	p.Query = template.URL(values.Encode())
+	b := auth.App.Branding
+	p.Branding.LogoURL = b.LogoURL
+	p.Branding.Copy = b.Copy
+	if b.PrimaryColor != "" {
+		p.Branding.PrimaryColor = b.PrimaryColor
+	}
+	if b.BackgroundColor != "" {
+		p.Branding.BackgroundColor = b.BackgroundColor
+	}
+	return p
+}
+
+// render writes a hosted page
+func (a *App) render(w http.ResponseWriter, status int, name string, p *hostedPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src https:; frame-ancestors 'none'; base-uri 'none'")
+	w.WriteHeader(status)
+	if err := hostedTemplates[name].ExecuteTemplate(w, "layout", p); err != nil {
+		log.Printf("hosted page %s: %v", name, err)
+	}
+}
+
+// renderError shows an error page without sending the user anywhere
+func (a *App) renderError(w http.ResponseWriter, r *http.Request, status int, auth *authorization, message string) {
+	p := a.newHostedPage(w, r, auth)
+	p.Error = message
+	a.render(w, status, "error", p)
+}
+
+// hostedCSRFToken returns the double-submit token of the browser, setting the cookie on
+// the first visit
+func hostedCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(hostedCSRFCookie); err == nil && len(c.Value) == 64 {
+		return c.Value
+	}
+	token, err := genToken(32)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: hostedCSRFCookie, Value: token, Path: "/hosted", HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+	r.AddCookie(&http.Cookie{Name: hostedCSRFCookie, Value: token})
+	return token
+}
+
+// checkHostedCSRF compares the form's token with the browser's cookie
+func checkHostedCSRF(r *http.Request) bool {
+	c, err := r.Cookie(hostedCSRFCookie)
+	return err == nil && c.Value != "" && subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostFormValue("csrf"))) == 1
+}
+
+// beginHosted parses and validates the authorize request of a hosted page. The
+// application is put in the request context so rate limits and the audit log attribute
+// the request to it. It reports false after rendering an error.
+func (a *App) beginHosted(w http.ResponseWriter, r *http.Request) (*http.Request, *authorization, bool) {
+	if err := r.ParseForm(); err != nil {
+		a.renderError(w, r, http.StatusBadRequest, nil, "Invalid request")
+		return r, nil, false
+	}
+	if r.Method == http.MethodPost && !checkHostedCSRF(r) {
+		a.renderError(w, r, http.StatusForbidden, nil, defaultCopy["error.expired"])
+		return r, nil, false
+	}
+	auth, err := a.validateAuthorizeRequest(r.Form)
+	if err == errBadClient {
+		a.renderError(w, r, http.StatusBadRequest, nil, "This sign-in link is invalid: unknown client_id or unregistered redirect_uri.")
+		return r, nil, false
+	}
+	if err != nil {
+		// The redirect URI is trusted, so the application learns about the error
+		a.redirectWithResult(w, r, authorizeRequestFrom(r.Form), url.Values{"error": {"invalid_request"}, "error_description": {err.Error()}})
+		return r, nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), "application", auth.App)), auth, true
+}
+
+// redirectWithResult sends the browser back to the application
+func (a *App) redirectWithResult(w http.ResponseWriter, r *http.Request, q authorizeRequest, result url.Values) {
+	u, _ := url.Parse(q.RedirectURI)
+	params := u.Query()
+	for k, v := range result {
+		params[k] = v
+	}
+	if q.State != "" {
+		params.Set("state", q.State)
+	}
+	u.RawQuery = params.Encode()
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// hostedFlow is a user who proved their password, carried through the MFA, confirmation
+// and consent steps in a signed form field
+type hostedFlow struct {
+	Stage   string // "mfa", "confirm" or "consent"
+	UserID  int64
+	Request authorizeRequest
+	Login   authentication
+	// Challenge makes the MFA and confirmation stages single-use
+	Challenge *mfaChallenge
+	// CodeHash is the hash of the code emailed for the confirmation stage
+	CodeHash string
+}
+
+func signHostedFlow(f hostedFlow) (string, error) {
+	claims := jwt.MapClaims{}
+	if f.Challenge != nil {
+		claims = f.Challenge.claims()
+	}
+	if f.CodeHash != "" {
+		claims["code"] = f.CodeHash
+	}
+	claims["stage"], claims["userId"], claims["req"] = f.Stage, f.UserID, f.Request.values().Encode()
+	claims["auth_time"], claims["amr"] = f.Login.Time, f.Login.AMR
+	return signPurposeToken(purposeHostedFlow, claims, hostedFlowTTL)
+}
+
+// beginHostedStep restores the flow of an MFA, confirmation or consent form and validates its authorize
+// request again. It reports false after rendering an error.
+func (a *App) beginHostedStep(w http.ResponseWriter, r *http.Request, stage string) (*http.Request, *authorization, *User, bool) {
+	if err := r.ParseForm(); err != nil || !checkHostedCSRF(r) {
+		a.renderError(w, r, http.StatusForbidden, nil, defaultCopy["error.expired"])
+		return r, nil, nil, false
+	}
+	claims, err := parsePurposeToken(purposeHostedFlow, r.PostFormValue("flow"))
+	raw, _ := claims["req"].(string)
+	form, qerr := url.ParseQuery(raw)
+	userID, _ := claimInt64(claims, "userId")
+	if err != nil || qerr != nil || claims["stage"] != stage {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return r, nil, nil, false
+	}
+	auth, err := a.validateAuthorizeRequest(form)
+	if err != nil {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return r, nil, nil, false
+	}
+	user, _ := a.DB.GetUserByID(userID)
+	if user == nil || user.NamespaceID != userNamespace(auth.App) {
+		a.renderError(w, r, http.StatusBadRequest, auth, defaultCopy["error.expired"])
+		return r, nil, nil, false
+	}
+	auth.Login = claimsAuthentication(claims)
+	if stage == "mfa" || stage == "confirm" {
+		if auth.Challenge, err = challengeFromClaims(claims, auth.App); err != nil {
+			a.renderError(w, r, http.StatusBadRequest, auth, defaultCopy["error.expired"])
+			return r, nil, nil, false
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), "application", auth.App)), auth, user, true
+}
+
+// continueHosted moves an authenticated user on to consent, or straight back to the
+// application with an authorization code when they already approved the requested scopes
+func (a *App) continueHosted(w http.ResponseWriter, r *http.Request, auth *authorization, user *User) {
+	needsConsent := auth.Prompt == "consent"
+	if !needsConsent && len(auth.Scopes) > 0 {
+		consent, err := a.DB.GetConsent(user.ID, auth.App.ID)
+		if err != nil {
+			a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+			return
+		}
+		needsConsent = !consentCovers(consent, auth.Scopes)
+	}
+	if needsConsent {
+		flow, err := signHostedFlow(hostedFlow{Stage: "consent", UserID: user.ID, Request: auth.authorizeRequest, Login: auth.Login})
+		if err != nil {
+			a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+			return
+		}
+		p := a.newHostedPage(w, r, auth)
+		p.Flow = flow
+		p.Email = user.Email
+		p.Scopes = auth.Scopes
+		a.render(w, http.StatusOK, "consent", p)
+		return
+	}
+	a.completeHosted(w, r, auth, user)
+}
+
+// completeHosted issues an authorization code and redirects back to the application
+func (a *App) completeHosted(w http.ResponseWriter, r *http.Request, auth *authorization, user *User) {
+	code, err := genToken(32)
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	scopes := []string{}
+	for _, s := range auth.Scopes {
+		scopes = append(scopes, s.Name)
+	}
+	err = a.DB.CreateAuthorizationCode(&AuthorizationCode{
+		CodeHash:      hashToken(code),
+		ApplicationID: auth.App.ID,
+		UserID:        user.ID,
+		RedirectURI:   auth.RedirectURI,
+		Scopes:        scopes,
+		CodeChallenge: auth.CodeChallenge,
+		ExpiresAt:     time.Now().Add(authorizationCodeTTL).Unix(),
+		AuthTime:      auth.Login.Time,
+		AMR:           auth.Login.AMR,
+	})
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	a.redirectWithResult(w, r, auth.authorizeRequest, url.Values{"code": {code}})
+}
+
+// HandleHostedLogin shows the login page and checks the submitted credentials
+// GET, POST /hosted/login
+func (a *App) HandleHostedLogin(w http.ResponseWriter, r *http.Request) {
+	r, auth, ok := a.beginHosted(w, r)
+	if !ok {
+		return
+	}
+	p := a.newHostedPage(w, r, auth)
+	if providers, err := a.availableIdentityProviders(auth.App); err == nil {
+		p.Providers = providers
+	} else {
+		log.Printf("hosted login: listing identity providers: %v", err)
+	}
+	if dir, err := a.DB.GetLDAPDirectory(auth.App.ID); err == nil {
+		p.Directory = dir != nil && dir.Active
+	} else {
+		log.Printf("hosted login: loading LDAP directory: %v", err)
+	}
+	if r.Method != http.MethodPost {
+		a.render(w, http.StatusOK, "login", p)
+		return
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	p.Email = email
+	if _, exceeded := a.exceededRateLimitRule(r, "login", rateLimitIdentity{Email: email}); exceeded {
+		p.Error = p.T("error.throttled")
+		a.render(w, http.StatusTooManyRequests, "login", p)
+		return
+	}
+	user, err := a.verifyCredentials(r, auth.App, email, r.PostFormValue("password"))
+	if err == errDirectoryUnavailable {
+		p.Error = p.T("login.offline")
+		a.render(w, http.StatusServiceUnavailable, "login", p)
+		return
+	}
+	if err != nil {
+		log.Printf("hosted login: %v", err)
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	if user == nil {
+		a.recordFailedLogin(r, auth.App, email, "")
+		p.Error = p.T("login.invalid")
+		a.render(w, http.StatusUnauthorized, "login", p)
+		return
+	}
+	a.authenticatedHosted(w, r, auth, p, user, amrPassword)
+}
+
+// authenticatedHosted continues the flow of a user who proved their password or signed in
+// at an identity provider. The login is scored like one through the API: the user is
+// asked for their one-time code when MFA is on, or for a code sent by email when the
+// login is high-risk.
+func (a *App) authenticatedHosted(w http.ResponseWriter, r *http.Request, auth *authorization, p *hostedPage, user *User, method string) {
+	if user.Disabled {
+		p.Error = p.T("login.disabled")
+		a.render(w, http.StatusForbidden, "login", p)
+		return
+	}
+	auth.Login = newAuthentication(method)
+	login := a.assessLogin(r, user, auth.App, "")
+	if login.RiskLevel == riskMedium {
+		a.notifyUnusualLogin(user, login)
+	}
+	flow := hostedFlow{UserID: user.ID, Request: auth.authorizeRequest, Login: auth.Login}
+	challenge := mfaChallenge{UserID: user.ID, ApplicationID: &auth.App.ID}
+	var err error
+	switch {
+	case user.TOTPSecret != "":
+		a.recordLogin(login, loginChallenged)
+		challenge.LoginEventID = login.ID
+		flow.Stage = "mfa"
+		challenge, err = newMFAChallenge(challenge)
+	case login.RiskLevel == riskHigh:
+		a.recordLogin(login, loginChallenged)
+		challenge.LoginEventID = login.ID
+		flow.Stage = "confirm"
+		challenge, flow.CodeHash, err = a.sendLoginConfirmation(user, challenge, login)
+	default:
+		a.recordLogin(login, loginSucceeded)
+		a.continueHosted(w, r, auth, user)
+		return
+	}
+	if err == nil {
+		flow.Challenge = &challenge
+		p.Flow, err = signHostedFlow(flow)
+	}
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	a.render(w, http.StatusOK, flow.Stage, p)
+}
+
+// HandleHostedMFA checks the one-time code of a user whose password checked out
+// POST /hosted/mfa
+func (a *App) HandleHostedMFA(w http.ResponseWriter, r *http.Request) {
+	r, auth, user, ok := a.beginHostedStep(w, r, "mfa")
+	if !ok {
+		return
+	}
+	p := a.newHostedPage(w, r, auth)
+	p.Flow = r.PostFormValue("flow")
+	if _, exceeded := a.exceededRateLimitRule(r, "login", rateLimitIdentity{Email: user.Email}); exceeded {
+		p.Error = p.T("error.throttled")
+		a.render(w, http.StatusTooManyRequests, "mfa", p)
+		return
+	}
+	accepted, err := a.acceptTOTP(user.ID, user.TOTPSecret, r.PostFormValue("code"))
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	if !accepted {
+		p.Error = p.T("mfa.invalid")
+		a.render(w, http.StatusUnauthorized, "mfa", p)
+		return
+	}
+	// The code was fresh, but the same page may not be submitted again with a later one
+	used, err := a.useChallenge(auth.Challenge)
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	if !used {
+		a.renderError(w, r, http.StatusBadRequest, auth, defaultCopy["error.expired"])
+		return
+	}
+	auth.Login = newAuthentication(append(auth.Login.AMR, amrOTP)...)
+	a.continueHosted(w, r, auth, user)
+}
+
+// HandleHostedConfirm checks the code emailed to the user of a high-risk login
+// POST /hosted/confirm
+func (a *App) HandleHostedConfirm(w http.ResponseWriter, r *http.Request) {
+	r, auth, user, ok := a.beginHostedStep(w, r, "confirm")
+	if !ok {
+		return
+	}
+	p := a.newHostedPage(w, r, auth)
+	p.Flow = r.PostFormValue("flow")
+	if _, exceeded := a.exceededRateLimitRule(r, "login", rateLimitIdentity{Email: user.Email}); exceeded {
+		p.Error = p.T("error.throttled")
+		a.render(w, http.StatusTooManyRequests, "confirm", p)
+		return
+	}
+	claims, _ := parsePurposeToken(purposeHostedFlow, p.Flow)
+	want, _ := claims["code"].(string)
+	if !hmac.Equal([]byte(want), []byte(loginConfirmationCodeHash(strings.TrimSpace(r.PostFormValue("code"))))) {
+		p.Error = p.T("confirm.invalid")
+		a.render(w, http.StatusUnauthorized, "confirm", p)
+		return
+	}
+	used, err := a.useChallenge(auth.Challenge)
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	if !used {
+		a.renderError(w, r, http.StatusBadRequest, auth, defaultCopy["error.expired"])
+		return
+	}
+	a.continueHosted(w, r, auth, user)
+}
+
+// HandleHostedConsent records the user's decision on the scopes an application asked for
+// POST /hosted/consent
+func (a *App) HandleHostedConsent(w http.ResponseWriter, r *http.Request) {
+	r, auth, user, ok := a.beginHostedStep(w, r, "consent")
+	if !ok {
+		return
+	}
+	if r.PostFormValue("decision") != "allow" {
+		a.redirectWithResult(w, r, auth.authorizeRequest, url.Values{"error": {"access_denied"}})
+		return
+	}
+	if err := a.recordConsent(r, user, auth.App, auth.Scopes); err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	a.completeHosted(w, r, auth, user)
+}
+
+// HandleHostedRegister shows the registration page and creates the account
+// GET, POST /hosted/register
+func (a *App) HandleHostedRegister(w http.ResponseWriter, r *http.Request) {
+	r, auth, ok := a.beginHosted(w, r)
+	if !ok {
+		return
+	}
+	p := a.newHostedPage(w, r, auth)
+	if r.Method != http.MethodPost {
+		a.render(w, http.StatusOK, "register", p)
+		return
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	password := r.PostFormValue("password")
+	p.Email = email
+	if email == "" || password == "" {
+		p.Error = "Email and password are required"
+		a.render(w, http.StatusBadRequest, "register", p)
+		return
+	}
+	if _, exceeded := a.exceededRateLimitRule(r, "register", rateLimitIdentity{Email: email}); exceeded {
+		p.Error = p.T("error.throttled")
+		a.render(w, http.StatusTooManyRequests, "register", p)
+		return
+	}
+	hashed, err := hashPassword(password)
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	user, err := a.DB.CreateUser(email, hashed, &auth.App.ID, userNamespace(auth.App))
+	if err != nil {
+		p.Error = p.T("register.exists")
+		a.render(w, http.StatusConflict, "register", p)
+		return
+	}
+	auth.Login = newAuthentication(amrPassword)
+	a.continueHosted(w, r, auth, user)
+}
+
+// HandleHostedForgotPassword emails a link to the hosted reset page
+// GET, POST /hosted/forgot
+func (a *App) HandleHostedForgotPassword(w http.ResponseWriter, r *http.Request) {
+	r, auth, ok := a.beginHosted(w, r)
+	if !ok {
+		return
+	}
+	p := a.newHostedPage(w, r, auth)
+	if r.Method != http.MethodPost {
+		a.render(w, http.StatusOK, "forgot", p)
+		return
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	p.Email = email
+	base, ok := a.linkBaseURL(r, auth.App)
+	if !ok {
+		log.Printf("hosted forgot: not emailing a reset link to host %q; set PUBLIC_URL", r.Host)
+		p.Error = p.T("forgot.offline")
+		a.render(w, http.StatusServiceUnavailable, "forgot", p)
+		return
+	}
+	if _, exceeded := a.exceededRateLimitRule(r, "password_reset", rateLimitIdentity{Email: email}); exceeded {
+		p.Error = p.T("error.throttled")
+		a.render(w, http.StatusTooManyRequests, "forgot", p)
+		return
+	}
+	user, err := a.DB.GetUserByEmail(userNamespace(auth.App), email)
+	if err == nil && user != nil {
+		resetURL, _ := url.Parse(base + "/hosted/reset?" + string(p.Query))
+		if err := a.sendPasswordReset(user, resetURL); err != nil {
+			log.Printf("password reset for user %d: %v", user.ID, err)
+		} else {
+			a.audit(r, auditPasswordResetRequested, &user.ID, nil)
+		}
+	}
+	p.Notice = p.T("forgot.sent")
+	a.render(w, http.StatusOK, "forgot", p)
+}
+
+// HandleHostedResetPassword lets a user choose a new password from an emailed link
+// GET, POST /hosted/reset
+func (a *App) HandleHostedResetPassword(w http.ResponseWriter, r *http.Request) {
+	r, auth, ok := a.beginHosted(w, r)
+	if !ok {
+		return
+	}
+	p := a.newHostedPage(w, r, auth)
+	p.Token = r.FormValue("token")
+	if r.Method != http.MethodPost {
+		a.render(w, http.StatusOK, "reset", p)
+		return
+	}
+
+	if _, exceeded := a.exceededRateLimitRule(r, "password_reset", rateLimitIdentity{}); exceeded {
+		p.Error = p.T("error.throttled")
+		a.render(w, http.StatusTooManyRequests, "reset", p)
+		return
+	}
+	password := r.PostFormValue("password")
+	if password == "" {
+		p.Error = "Password is required"
+		a.render(w, http.StatusBadRequest, "reset", p)
+		return
+	}
+	if _, err := a.redeemPasswordReset(r, p.Token, password); err != nil {
+		p.Error = p.T("reset.invalid")
+		status := http.StatusBadRequest
+		if err != errInvalidResetToken {
+			log.Printf("hosted password reset: %v", err)
+			status = http.StatusInternalServerError
+		}
+		a.render(w, status, "reset", p)
+		return
+	}
+	p.Notice = p.T("reset.done")
+	a.render(w, http.StatusOK, "reset", p)
+}
+
+// linkBaseURL is the base URL of links that are emailed or handed to another party. Without
+// PUBLIC_URL it comes from the request's Host header, which any client can forge, so it is
+// only used when the host belongs to the application's domain or allowed origins.
+func (a *App) linkBaseURL(r *http.Request, app *Application) (string, bool) {
+	base := a.publicURL(r)
+	if a.PublicURL != "" {
+		return base, true
+	}
+	u, err := url.Parse(base)
+	if err != nil || !applicationOwnsURL(app, u) {
+		return "", false
+	}
+	return base, true
+}
+
+// publicURL is the external base URL of the service. Without PUBLIC_URL it is derived
+// from the request, trusting X-Forwarded-Proto only from trusted proxies.
+func (a *App) publicURL(r *http.Request) string {
+	if a.PublicURL != "" {
+		return a.PublicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil && a.isTrustedProxy(addr.Unmap()) {
+			if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+				scheme = proto
+			}
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// HandleAuthorizationCode exchanges a code from the hosted pages for tokens
+// POST /api/v1/auth/token
+func (a *App) HandleAuthorizationCode(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code         string `json:"code"`
+		RedirectURI  string `json:"redirectUri"`
+		CodeVerifier string `json:"codeVerifier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.Code == "" || req.RedirectURI == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "code and redirectUri are required")
+		return
+	}
+	app := applicationFromRequest(r)
+	code, err := a.DB.ConsumeAuthorizationCode(hashToken(req.Code))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to look up authorization code")
+		return
+	}
+	if code == nil || app == nil || code.ApplicationID != app.ID || code.ExpiresAt < time.Now().Unix() || code.RedirectURI != req.RedirectURI {
+		writeError(w, http.StatusBadRequest, "INVALID_GRANT", "Authorization code is invalid or expired")
+		return
+	}
+	if code.CodeChallenge != "" {
+		sum := sha256.Sum256([]byte(req.CodeVerifier))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(code.CodeChallenge)) != 1 {
+			writeError(w, http.StatusBadRequest, "INVALID_GRANT", "codeVerifier does not match the code challenge")
+			return
+		}
+	}
+	user, _ := a.DB.GetUserByID(code.UserID)
+	if user == nil || user.Disabled {
+		writeError(w, http.StatusBadRequest, "INVALID_GRANT", "Authorization code is invalid or expired")
+		return
+	}
+
+	access, ref, err := a.issueTokens(tokenGrant{User: user, ApplicationID: &app.ID, Login: authentication{Time: code.AuthTime, AMR: code.AMR}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue tokens")
+		return
+	}
+	writeSession(w, r, http.StatusOK, app, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":    user.ID,
+			"email": user.Email,
+		},
+		"accessToken": access,
+		"scope":       strings.Join(code.Scopes, " "),
+	}, ref)
+}
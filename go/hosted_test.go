@@ -0,0 +1,485 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPMatchesRFC6238(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	for counter, want := range map[uint64]string{1: "287082", 37037036: "081804", 37037037: "050471", 41152263: "005924"} {
+		code, err := totpCode(secret, counter)
+		require.NoError(t, err)
+		require.Equal(t, want, code)
+	}
+	now := time.Unix(59, 0)
+	step, ok := verifyTOTP(secret, "287 082", now)
+	require.True(t, ok)
+	require.Equal(t, int64(1), step)
+	_, ok = verifyTOTP(secret, "287083", now)
+	require.False(t, ok)
+	_, ok = verifyTOTP(secret, "287082", now.Add(5*time.Minute))
+	require.False(t, ok)
+}
+
+// hostedBrowser submits hosted page forms, keeping cookies between requests like a browser
+type hostedBrowser struct {
+	t       *testing.T
+	cookies []*http.Cookie
+	ip      string // the client address, when set
+	host    string // the Host header, when set
+}
+
+func (b *hostedBrowser) do(handler http.HandlerFunc, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var req *http.Request
+	if method == "GET" {
+		req = httptest.NewRequest(method, path+"?"+form.Encode(), nil)
+	} else {
+		req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if b.host != "" {
+		req.Host = b.host
+	}
+	if b.ip != "" {
+		req.RemoteAddr = netip.AddrPortFrom(netip.MustParseAddr(b.ip), 4000).String()
+	}
+	for _, c := range b.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	b.cookies = append(b.cookies, rec.Result().Cookies()...)
+	return rec
+}
+
+// field returns the value of a hidden form field
+func (b *hostedBrowser) field(body, name string) string {
+	m := regexp.MustCompile(`name="` + name + `" value="([^"]*)"`).FindStringSubmatch(body)
+	require.NotNil(b.t, m, "field %s", name)
+	return m[1]
+}
+
+// login signs in on the hosted login page and returns the response to the credentials
+func (b *hostedBrowser) login(a *App, authorize url.Values, email, password string) *httptest.ResponseRecorder {
+	rec := b.do(a.HandleHostedLogin, "GET", "/hosted/login", authorize)
+	require.Equal(b.t, http.StatusOK, rec.Code)
+	form := url.Values{"csrf": {b.field(rec.Body.String(), "csrf")}, "email": {email}, "password": {password}}
+	for k, v := range authorize {
+		form[k] = v
+	}
+	return b.do(a.HandleHostedLogin, "POST", "/hosted/login", form)
+}
+
+func TestHostedLoginWithMFAAndPKCE(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	require.NotNil(t, app)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	app.ClientType = clientTypePublic
+	app.Branding = Branding{PrimaryColor: "#112233", Copy: map[string]string{"login.title": "Welcome to {app}"}}
+	require.NoError(t, a.DB.UpdateApplication(app))
+
+	hashed, err := hashPassword("secret123")
+	require.NoError(t, err)
+	user, err := a.DB.CreateUser("h@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	secret, err := generateTOTPSecret()
+	require.NoError(t, err)
+	require.NoError(t, a.DB.SetUserTOTPSecret(user.ID, secret))
+
+	verifier := strings.Repeat("v", 50)
+	sum := sha256.Sum256([]byte(verifier))
+	authorize := url.Values{
+		"client_id":             {strconv.FormatInt(app.ID, 10)},
+		"redirect_uri":          {"https://bench.example.com/callback"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	browser := &hostedBrowser{t: t}
+	call, field := browser.do, browser.field
+
+	// redirect URIs must match a registered one exactly
+	for _, uri := range []string{"https://evil.example.net/cb", "https://bench.example.com/callback/x", "https://bench.example.com/callback?x=1"} {
+		bad := url.Values{"client_id": authorize["client_id"], "redirect_uri": {uri}}
+		require.Equal(t, http.StatusBadRequest, call(a.HandleHostedLogin, "GET", "/hosted/login", bad).Code)
+	}
+	// public clients must use PKCE
+	noPKCE := url.Values{"client_id": authorize["client_id"], "redirect_uri": authorize["redirect_uri"]}
+	rec := call(a.HandleHostedLogin, "GET", "/hosted/login", noPKCE)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Contains(t, rec.Header().Get("Location"), "error=invalid_request")
+
+	rec = call(a.HandleHostedLogin, "GET", "/hosted/login", authorize)
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := rec.Body.String()
+	require.Contains(t, page, "Welcome to bench")
+	require.Contains(t, page, "#112233")
+	require.NotEmpty(t, rec.Header().Get("Content-Security-Policy"))
+
+	form := url.Values{}
+	for k, v := range authorize {
+		form[k] = v
+	}
+	form.Set("csrf", field(page, "csrf"))
+	form.Set("email", "h@example.com")
+	form.Set("password", "wrong")
+	require.Equal(t, http.StatusUnauthorized, call(a.HandleHostedLogin, "POST", "/hosted/login", form).Code)
+
+	// the form must echo the CSRF cookie
+	form.Set("password", "secret123")
+	forged := url.Values{}
+	for k, v := range form {
+		forged[k] = v
+	}
+	forged.Set("csrf", "forged")
+	require.Equal(t, http.StatusForbidden, call(a.HandleHostedLogin, "POST", "/hosted/login", forged).Code)
+
+	rec = call(a.HandleHostedLogin, "POST", "/hosted/login", form)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `action="/hosted/mfa"`)
+	code, err := totpCode(secret, uint64(time.Now().Unix()/30))
+	require.NoError(t, err)
+	mfaForm := url.Values{
+		"csrf": {form.Get("csrf")},
+		"flow": {field(rec.Body.String(), "flow")},
+		"code": {code},
+	}
+	rec = call(a.HandleHostedMFA, "POST", "/hosted/mfa", mfaForm)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	redirect := rec.Header().Get("Location")
+	// neither the code nor the MFA page can be used twice
+	require.Equal(t, http.StatusUnauthorized, call(a.HandleHostedMFA, "POST", "/hosted/mfa", mfaForm).Code)
+	next, err := totpCode(secret, uint64(time.Now().Unix()/30)+1)
+	require.NoError(t, err)
+	mfaForm.Set("code", next)
+	require.Equal(t, http.StatusBadRequest, call(a.HandleHostedMFA, "POST", "/hosted/mfa", mfaForm).Code)
+	location, err := url.Parse(redirect)
+	require.NoError(t, err)
+	require.Equal(t, "bench.example.com", location.Host)
+	require.Equal(t, "xyz", location.Query().Get("state"))
+	authCode := location.Query().Get("code")
+	require.NotEmpty(t, authCode)
+
+	exchange := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/auth/token", strings.NewReader(body))
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(http.HandlerFunc(a.HandleAuthorizationCode)).ServeHTTP(rec, req)
+		return rec
+	}
+	require.Equal(t, http.StatusBadRequest, exchange(`{"code":"`+authCode+`","redirectUri":"https://bench.example.com/callback","codeVerifier":"wrong"}`).Code)
+	// a failed exchange still consumes the code
+	require.Equal(t, http.StatusBadRequest, exchange(`{"code":"`+authCode+`","redirectUri":"https://bench.example.com/callback","codeVerifier":"`+verifier+`"}`).Code)
+
+	codeRow, err := genToken(32)
+	require.NoError(t, err)
+	require.NoError(t, a.DB.CreateAuthorizationCode(&AuthorizationCode{
+		CodeHash: hashToken(codeRow), ApplicationID: app.ID, UserID: user.ID,
+		RedirectURI: "https://bench.example.com/callback", CodeChallenge: authorize.Get("code_challenge"),
+		Scopes: []string{}, ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		AuthTime: 1700000000, AMR: []string{amrPassword, amrOTP},
+	}))
+	rec = exchange(`{"code":"` + codeRow + `","redirectUri":"https://bench.example.com/callback","codeVerifier":"` + verifier + `"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.NotEmpty(t, body["accessToken"])
+	require.NotEmpty(t, body["refreshToken"])
+	// the tokens describe the hosted login, not the exchange
+	token, err := jwt.Parse(body["accessToken"].(string), func(*jwt.Token) (interface{}, error) { return jwtSecret, nil })
+	require.NoError(t, err)
+	require.Equal(t, float64(1700000000), token.Claims.(jwt.MapClaims)["auth_time"])
+	require.Equal(t, "aal2", token.Claims.(jwt.MapClaims)["acr"])
+	require.Equal(t, http.StatusBadRequest, exchange(`{"code":"`+codeRow+`","redirectUri":"https://bench.example.com/callback","codeVerifier":"`+verifier+`"}`).Code)
+}
+
+func TestLoginRequiresMFAWhenEnrolled(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	hashed, err := hashPassword("secret123")
+	require.NoError(t, err)
+	user, err := a.DB.CreateUser("m@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	secret, err := generateTOTPSecret()
+	require.NoError(t, err)
+	require.NoError(t, a.DB.SetUserTOTPSecret(user.ID, secret))
+
+	call := func(handler http.HandlerFunc, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(body))
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(handler).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec.Code, out
+	}
+
+	status, body := call(a.HandleLogin, `{"email":"m@example.com","password":"secret123"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "MFA_REQUIRED", body["error_code"])
+	require.NotContains(t, body, "accessToken")
+	challenge := body["mfaToken"].(string)
+
+	// the challenge is not an access token
+	_, err = jwt.Parse(challenge, func(*jwt.Token) (interface{}, error) { return jwtSecret, nil })
+	require.Error(t, err)
+
+	status, _ = call(a.HandleVerifyMFA, `{"mfaToken":"`+challenge+`","code":"000000"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	code, err := totpCode(secret, uint64(time.Now().Unix()/30))
+	require.NoError(t, err)
+	status, body = call(a.HandleVerifyMFA, `{"mfaToken":"`+challenge+`","code":"`+code+`"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEmpty(t, body["accessToken"])
+
+	// a code is accepted once, even for another login with the same password
+	_, body = call(a.HandleLogin, `{"email":"m@example.com","password":"secret123"}`)
+	status, body = call(a.HandleVerifyMFA, `{"mfaToken":"`+body["mfaToken"].(string)+`","code":"`+code+`"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "INVALID_MFA_CODE", body["error_code"])
+	// and a challenge completes one login only
+	next, err := totpCode(secret, uint64(time.Now().Unix()/30)+1)
+	require.NoError(t, err)
+	status, body = call(a.HandleVerifyMFA, `{"mfaToken":"`+challenge+`","code":"`+next+`"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "INVALID_TOKEN", body["error_code"])
+}
+
+func TestHostedResetLinksIgnoreForgedHosts(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	mailer := &recordingMailer{}
+	a.Mailer = mailer
+	app, _ := a.validateAPIKey(plain)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+	_, err = a.DB.CreateUser("r@example.com", "x", &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	authorize := url.Values{
+		"client_id":    {strconv.FormatInt(app.ID, 10)},
+		"redirect_uri": {"https://bench.example.com/callback"},
+	}
+	forgot := func(host string) *httptest.ResponseRecorder {
+		browser := &hostedBrowser{t: t, host: host}
+		rec := browser.do(a.HandleHostedForgotPassword, "GET", "/hosted/forgot", authorize)
+		require.Equal(t, http.StatusOK, rec.Code)
+		form := url.Values{"csrf": {browser.field(rec.Body.String(), "csrf")}, "email": {"r@example.com"}}
+		for k, v := range authorize {
+			form[k] = v
+		}
+		return browser.do(a.HandleHostedForgotPassword, "POST", "/hosted/forgot", form)
+	}
+
+	// without PUBLIC_URL a host the application does not own gets no reset link
+	require.Equal(t, http.StatusServiceUnavailable, forgot("evil.example").Code)
+	require.Empty(t, mailer.sent)
+	require.Equal(t, http.StatusOK, forgot("auth.bench.example.com").Code)
+	require.Len(t, mailer.sent, 1)
+	require.Contains(t, mailer.sent[0], "http://auth.bench.example.com/hosted/reset?")
+
+	// PUBLIC_URL is used whatever the request's host
+	a.PublicURL = "https://auth.example.com"
+	require.Equal(t, http.StatusOK, forgot("evil.example").Code)
+	require.Len(t, mailer.sent, 2)
+	require.Contains(t, mailer.sent[1], "https://auth.example.com/hosted/reset?")
+	require.NotContains(t, mailer.sent[1], "evil.example")
+}
+
+func TestHostedConsentIsRememberedUntilRevoked(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+	scope, err := a.DB.GetScopeByName("read:user")
+	require.NoError(t, err)
+	require.NoError(t, a.DB.SetApplicationScopes(app.ID, []int64{scope.ID}))
+	hashed, err := hashPassword("secret123")
+	require.NoError(t, err)
+	user, err := a.DB.CreateUser("c@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+
+	authorize := url.Values{
+		"client_id":    {strconv.FormatInt(app.ID, 10)},
+		"redirect_uri": {"https://bench.example.com/callback"},
+		"scope":        {"read:user"},
+	}
+	browser := &hostedBrowser{t: t}
+
+	// scopes the application was not granted are refused
+	rec := browser.do(a.HandleHostedLogin, "GET", "/hosted/login", url.Values{"client_id": authorize["client_id"], "redirect_uri": authorize["redirect_uri"], "scope": {"write:user"}})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Contains(t, rec.Header().Get("Location"), "error=invalid_request")
+
+	rec = browser.login(a, authorize, "c@example.com", "secret123")
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := rec.Body.String()
+	require.Contains(t, page, "Read user information")
+	rec = browser.do(a.HandleHostedConsent, "POST", "/hosted/consent", url.Values{
+		"csrf":     {browser.field(page, "csrf")},
+		"flow":     {browser.field(page, "flow")},
+		"decision": {"allow"},
+	})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Contains(t, rec.Header().Get("Location"), "code=")
+
+	// approved scopes are not asked for again
+	rec = browser.login(a, authorize, "c@example.com", "secret123")
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+
+	access, refresh, err := a.issueTokens(tokenGrant{User: user, ApplicationID: &app.ID})
+	require.NoError(t, err)
+	api := func(method, path string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", plain)
+		req.Header.Set("Authorization", "Bearer "+access)
+		req = mux.SetURLVars(req, map[string]string{"applicationId": strconv.FormatInt(app.ID, 10)})
+		rec := httptest.NewRecorder()
+		handler := a.HandleListConsents
+		if method == "DELETE" {
+			handler = a.HandleRevokeConsent
+		}
+		a.APIKeyAuth(http.HandlerFunc(handler)).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec.Code, out
+	}
+	status, body := api("GET", "/api/v1/auth/consents")
+	require.Equal(t, http.StatusOK, status)
+	consents := body["data"].(map[string]interface{})["consents"].([]interface{})
+	require.Len(t, consents, 1)
+	require.Equal(t, []interface{}{"read:user"}, consents[0].(map[string]interface{})["scopes"])
+
+	status, _ = api("DELETE", "/api/v1/auth/consents/1")
+	require.Equal(t, http.StatusOK, status)
+	row, err := a.DB.GetRefreshToken(refresh)
+	require.NoError(t, err)
+	require.Nil(t, row)
+	status, _ = api("DELETE", "/api/v1/auth/consents/1")
+	require.Equal(t, http.StatusNotFound, status)
+	rec = browser.login(a, authorize, "c@example.com", "secret123")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `action="/hosted/consent"`)
+}
+
+func TestStepUpAuthentication(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	hashed, err := hashPassword("secret123")
+	require.NoError(t, err)
+	user, err := a.DB.CreateUser("s@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+
+	call := func(handler http.HandlerFunc, method, target, access, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("X-API-Key", plain)
+		if access != "" {
+			req.Header.Set("Authorization", "Bearer "+access)
+		}
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(handler).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec, out
+	}
+	claimsOf := func(access string) jwt.MapClaims {
+		token, err := jwt.Parse(access, func(*jwt.Token) (interface{}, error) { return jwtSecret, nil })
+		require.NoError(t, err)
+		return token.Claims.(jwt.MapClaims)
+	}
+
+	// a password login is single-factor
+	rec, body := call(a.HandleLogin, "POST", "/login", "", `{"email":"s@example.com","password":"secret123"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	claims := claimsOf(body["accessToken"].(string))
+	require.Equal(t, []interface{}{"pwd"}, claims["amr"])
+	require.Equal(t, "aal1", claims["acr"])
+	require.InDelta(t, time.Now().Unix(), claims["auth_time"], 5)
+
+	// refreshing keeps the time of the original login
+	hourAgo := time.Now().Add(-time.Hour).Unix()
+	_, refresh, err := a.issueTokens(tokenGrant{User: user, ApplicationID: &app.ID, Login: authentication{Time: hourAgo, AMR: []string{amrPassword}}})
+	require.NoError(t, err)
+	rec, body = call(a.HandleRefresh, "POST", "/refresh", "", `{"refreshToken":"`+refresh+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	stale := body["accessToken"].(string)
+	require.Equal(t, float64(hourAgo), claimsOf(stale)["auth_time"])
+	refresh = body["refreshToken"].(string)
+
+	// validate and introspect hold the token to max_age and acr
+	rec, _ = call(a.HandleTokenValidate, "GET", "/validate?max_age=7200", stale, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec, body = call(a.HandleTokenValidate, "GET", "/validate?max_age=300", stale, "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, "INSUFFICIENT_AUTHENTICATION", body["error_code"])
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`)
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), "max_age=300")
+	rec, _ = call(a.HandleTokenValidate, "GET", "/validate?acr=aal2", stale, "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec, _ = call(a.HandleTokenValidate, "GET", "/validate?acr=gold", stale, "")
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec, body = call(a.HandleTokenIntrospect, "POST", "/introspect", "", `{"token":"`+stale+`","max_age":300}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, false, body["Active"])
+	require.Equal(t, true, body["StepUpRequired"])
+	_, body = call(a.HandleTokenIntrospect, "POST", "/introspect", "", `{"token":"`+stale+`"}`)
+	require.Equal(t, true, body["Active"])
+	require.Equal(t, float64(hourAgo), body["AuthTime"])
+
+	// re-authenticating refreshes the login and rotates the session
+	rec, _ = call(a.HandleReauthenticate, "POST", "/reauthenticate", stale, `{"password":"wrong"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec, body = call(a.HandleReauthenticate, "POST", "/reauthenticate", stale, `{"password":"secret123","refreshToken":"`+refresh+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	fresh := body["accessToken"].(string)
+	rec, _ = call(a.HandleTokenValidate, "GET", "/validate?max_age=300", fresh, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec, body = call(a.HandleRefresh, "POST", "/refresh", "", `{"refreshToken":"`+body["refreshToken"].(string)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.InDelta(t, time.Now().Unix(), claimsOf(body["accessToken"].(string))["auth_time"], 5)
+	rec, _ = call(a.HandleRefresh, "POST", "/refresh", "", `{"refreshToken":"`+refresh+`"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// with MFA on, the one-time code is required and raises the acr
+	secret, err := generateTOTPSecret()
+	require.NoError(t, err)
+	require.NoError(t, a.DB.SetUserTOTPSecret(user.ID, secret))
+	rec, body = call(a.HandleReauthenticate, "POST", "/reauthenticate", fresh, `{"password":"secret123"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, "MFA_REQUIRED", body["error_code"])
+	code, err := totpCode(secret, uint64(time.Now().Unix()/30))
+	require.NoError(t, err)
+	rec, body = call(a.HandleReauthenticate, "POST", "/reauthenticate", fresh, `{"password":"secret123","code":"`+code+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	strong := body["accessToken"].(string)
+	require.Equal(t, []interface{}{"pwd", "otp"}, claimsOf(strong)["amr"])
+	rec, body = call(a.HandleTokenValidate, "GET", "/validate?acr=aal2&max_age=60", strong, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "aal2", body["data"].(map[string]interface{})["acr"])
+}
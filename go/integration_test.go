@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"testing"
@@ -65,25 +66,266 @@ func TestPostgresIntegration(t *testing.T) {
 	defer pg.close()
 
 	// basic user create/get
-	u, err := pg.CreateUser("it@example.com", "pwd123", nil)
+	u, err := pg.CreateUser("it@example.com", "pwd123", nil, globalNamespace)
 	require.NoError(t, err)
 	require.NotZero(t, u.ID)
 
-	got, err := pg.GetUserByEmail("it@example.com")
+	got, err := pg.GetUserByEmail(globalNamespace, "it@example.com")
 	require.NoError(t, err)
 	require.NotNil(t, got)
 	require.Equal(t, u.Email, got.Email)
 
+	// isolated namespaces may reuse an email from the global pool
+	isolated, err := pg.CreateApplication("isolated", "isolated.example.com", &APIKey{KeyHash: "hash-isolated", KeyPrefix: "isolated"}, 100, nil, true)
+	require.NoError(t, err)
+	nsUser, err := pg.CreateUser("it@example.com", "pwd456", &isolated.ID, isolated.ID)
+	require.NoError(t, err)
+	require.NotEqual(t, u.ID, nsUser.ID)
+	_, err = pg.CreateUser("it@example.com", "pwd789", &isolated.ID, isolated.ID)
+	require.Error(t, err)
+
+	// application management: filter, deactivate, cascade delete
+	apps, total, err := pg.ListApplications(ApplicationFilter{Domain: "ISOLATED.example.com", Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Len(t, apps, 1)
+	isolated.Active = false
+	isolated.IPAllowlist = []string{"203.0.113.0/24"}
+	isolated.SessionCookie = "lax"
+	isolated.Branding = Branding{PrimaryColor: "#112233", Copy: map[string]string{"login.title": "Hi"}}
+	isolated.RedirectURIs = []string{"https://isolated.example.com/cb"}
+	isolated.ClientType = clientTypePublic
+	require.NoError(t, pg.UpdateApplication(isolated))
+	reloaded, err := pg.GetApplicationByID(isolated.ID)
+	require.NoError(t, err)
+	require.False(t, reloaded.Active)
+	require.Equal(t, []string{"203.0.113.0/24"}, reloaded.IPAllowlist)
+	require.Equal(t, "lax", reloaded.SessionCookie)
+	require.Equal(t, isolated.Branding, reloaded.Branding)
+	require.Equal(t, isolated.RedirectURIs, reloaded.RedirectURIs)
+	require.Equal(t, clientTypePublic, reloaded.ClientType)
+
+	// api keys: the creation key is registered, rotation caps the old key's lifetime
+	keys, err := pg.ListAPIKeys(isolated.ID)
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	graceEnd := time.Now().Add(time.Hour)
+	require.NoError(t, pg.RotateAPIKeys(&APIKey{ApplicationID: isolated.ID, Label: "next", KeyHash: "hash-next", KeyPrefix: "isolated"}, graceEnd))
+	candidates, err := pg.GetAPIKeysByPrefix("isolated")
+	require.NoError(t, err)
+	require.Len(t, candidates, 2)
+	require.NoError(t, pg.RevokeAPIKey(isolated.ID, keys[0].ID))
+	candidates, err = pg.GetAPIKeysByPrefix("isolated")
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+	require.Equal(t, "next", candidates[0].Label)
+	require.NoError(t, pg.SetAPIKeyLookupHash(candidates[0].ID, "lookup-next"))
+	indexed, err := pg.GetAPIKeyByLookupHash("lookup-next")
+	require.NoError(t, err)
+	require.NotNil(t, indexed)
+	require.Equal(t, candidates[0].ID, indexed.ID)
+	require.NoError(t, pg.SetAPIKeyOperations(isolated.ID, indexed.ID, []string{"auth:login", "tokens:*"}))
+	indexed, err = pg.GetAPIKeyByLookupHash("lookup-next")
+	require.NoError(t, err)
+	require.Equal(t, []string{"auth:login", "tokens:*"}, indexed.Operations)
+
+	// invitations are accepted once
+	org, err := pg.CreateOrganization("Acme", &isolated.ID)
+	require.NoError(t, err)
+	require.NoError(t, pg.CreateOrganizationInvitation(&OrganizationInvitation{OrganizationID: org.ID, Email: "it@example.com", Role: orgRoleMember, TokenHash: "invite-hash", ExpiresAt: time.Now().Add(time.Hour).Unix()}))
+	inv, err := pg.GetOrganizationInvitationByTokenHash("invite-hash")
+	require.NoError(t, err)
+	for _, want := range []bool{true, false} {
+		accepted, err := pg.MarkOrganizationInvitationAccepted(inv.ID)
+		require.NoError(t, err)
+		require.Equal(t, want, accepted)
+	}
+
+	// mfa secrets and single use authorization codes
+	require.NoError(t, pg.SetUserTOTPSecret(u.ID, "JBSWY3DPEHPK3PXP"))
+	withSecret, err := pg.GetUserByID(u.ID)
+	require.NoError(t, err)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", withSecret.TOTPSecret)
+	// a code's time step is accepted once, and never after a later one
+	for _, tc := range []struct {
+		step int64
+		used bool
+	}{{100, true}, {100, false}, {99, false}, {101, true}} {
+		used, err := pg.UseTOTPStep(u.ID, tc.step)
+		require.NoError(t, err)
+		require.Equal(t, tc.used, used, tc.step)
+	}
+	fresh, err := pg.RecordMFAChallenge("challenge-id", time.Now().Add(time.Minute).Unix())
+	require.NoError(t, err)
+	require.True(t, fresh)
+	fresh, err = pg.RecordMFAChallenge("challenge-id", time.Now().Add(time.Minute).Unix())
+	require.NoError(t, err)
+	require.False(t, fresh)
+	require.NoError(t, pg.CreateAuthorizationCode(&AuthorizationCode{CodeHash: "code-hash", ApplicationID: isolated.ID, UserID: nsUser.ID, RedirectURI: "https://it.example.com/cb", Scopes: []string{"read"}, ExpiresAt: time.Now().Add(time.Minute).Unix(), AuthTime: 1700000000, AMR: []string{"pwd", "otp"}}))
+	consumed, err := pg.ConsumeAuthorizationCode("code-hash")
+	require.NoError(t, err)
+	require.Equal(t, []string{"read"}, consumed.Scopes)
+	require.Equal(t, int64(1700000000), consumed.AuthTime)
+	require.Equal(t, []string{"pwd", "otp"}, consumed.AMR)
+	consumed, err = pg.ConsumeAuthorizationCode("code-hash")
+	require.NoError(t, err)
+	require.Nil(t, consumed)
+
+	// consents are replaced per user and application
+	require.NoError(t, pg.UpsertConsent(nsUser.ID, isolated.ID, []string{"read:user"}))
+	require.NoError(t, pg.UpsertConsent(nsUser.ID, isolated.ID, []string{"read:user", "write:user"}))
+	consents, err := pg.ListConsents(nsUser.ID)
+	require.NoError(t, err)
+	require.Len(t, consents, 1)
+	require.Equal(t, []string{"read:user", "write:user"}, consents[0].Scopes)
+	require.NoError(t, pg.DeleteApplicationRefreshTokensForUser(nsUser.ID, isolated.ID))
+	require.NoError(t, pg.DeleteConsent(nsUser.ID, isolated.ID))
+	require.Error(t, pg.DeleteConsent(nsUser.ID, isolated.ID))
+
+	// identity providers scoped to an application, with identities linked through them
+	idp := &IdentityProvider{ApplicationID: &isolated.ID, Name: "it-idp", DisplayName: "IT", Issuer: "https://idp.example.com", ClientID: "c", Scopes: []string{"openid"}, ClaimMapping: map[string]string{"email": "upn"}, Active: true}
+	require.NoError(t, pg.CreateIdentityProvider(idp))
+	gotIdP, err := pg.GetIdentityProviderByName("it-idp")
+	require.NoError(t, err)
+	require.Equal(t, "upn", gotIdP.ClaimMapping["email"])
+	providers, err := pg.ListIdentityProviders(&isolated.ID)
+	require.NoError(t, err)
+	require.Len(t, providers, 1)
+	require.NoError(t, pg.CreateUserIdentity(&UserIdentity{UserID: nsUser.ID, ProviderID: idp.ID, Subject: "sub-1"}))
+	require.Error(t, pg.CreateUserIdentity(&UserIdentity{UserID: nsUser.ID, ProviderID: idp.ID, Subject: "sub-1"}))
+	identity, err := pg.GetUserIdentity(idp.ID, "sub-1")
+	require.NoError(t, err)
+	require.Equal(t, nsUser.ID, identity.UserID)
+
+	// SAML connections, their pending requests and the assertion replay cache
+	samlConn := &SAMLConnection{ApplicationID: isolated.ID, Name: "it-saml", IdPEntityID: "https://idp.example.com", IdPSSOURL: "https://idp.example.com/sso", Domains: []string{"example.com"}, Active: true}
+	require.NoError(t, pg.CreateSAMLConnection(samlConn))
+	gotSAML, err := pg.GetSAMLConnectionByName("it-saml")
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com"}, gotSAML.Domains)
+	require.NoError(t, pg.CreateSAMLRequest(&SAMLRequest{ID: "_req", ConnectionID: samlConn.ID, Request: "client_id=1", ExpiresAt: time.Now().Add(time.Minute).Unix()}))
+	pending, err := pg.ConsumeSAMLRequest("_req")
+	require.NoError(t, err)
+	require.Equal(t, "client_id=1", pending.Request)
+	pending, err = pg.ConsumeSAMLRequest("_req")
+	require.NoError(t, err)
+	require.Nil(t, pending)
+	fresh, err = pg.RecordSAMLAssertion(samlConn.ID, "_a", time.Now().Add(time.Minute).Unix())
+	require.NoError(t, err)
+	require.True(t, fresh)
+	fresh, err = pg.RecordSAMLAssertion(samlConn.ID, "_a", time.Now().Add(time.Minute).Unix())
+	require.NoError(t, err)
+	require.False(t, fresh)
+	bound, err := pg.SAMLUserBound(samlConn.ID, nsUser.ID)
+	require.NoError(t, err)
+	require.False(t, bound)
+	require.NoError(t, pg.BindSAMLUser(samlConn.ID, nsUser.ID))
+	require.NoError(t, pg.BindSAMLUser(samlConn.ID, nsUser.ID))
+	bound, err = pg.SAMLUserBound(samlConn.ID, nsUser.ID)
+	require.NoError(t, err)
+	require.True(t, bound)
+
+	// LDAP directories and the directory accounts of their shadow users
+	require.NoError(t, pg.UpsertLDAPDirectory(&LDAPDirectory{ApplicationID: isolated.ID, URL: "ldaps://ldap.example.com", SearchBase: "dc=example", SearchFilter: "(uid={username})", AttributeMapping: map[string]string{"dept": "ou"}, Active: true}))
+	gotDir, err := pg.GetLDAPDirectory(isolated.ID)
+	require.NoError(t, err)
+	require.Equal(t, "ou", gotDir.AttributeMapping["dept"])
+	require.NoError(t, pg.UpsertDirectoryAccount(&DirectoryAccount{ApplicationID: isolated.ID, UserID: nsUser.ID, DN: "uid=it,dc=example", Claims: map[string]interface{}{"dept": "qa"}}))
+	require.NoError(t, pg.UpsertDirectoryAccount(&DirectoryAccount{ApplicationID: isolated.ID, UserID: nsUser.ID, DN: "uid=it2,dc=example"}))
+	acct, err := pg.GetDirectoryAccount(isolated.ID, "uid=it,dc=example")
+	require.NoError(t, err)
+	require.Nil(t, acct)
+	acct, err = pg.GetDirectoryAccountByUser(isolated.ID, nsUser.ID)
+	require.NoError(t, err)
+	require.Equal(t, "uid=it2,dc=example", acct.DN)
+	require.NoError(t, pg.UpdateUserEmail(nsUser.ID, "it-renamed@example.com"))
+	require.NoError(t, pg.UpdateUserEmail(nsUser.ID, "it@example.com"))
+
+	// SCIM resources, their external IDs and disabled users
+	require.NoError(t, pg.UpsertSCIMResource(&SCIMResource{ApplicationID: isolated.ID, Type: scimTypeUser, ResourceID: nsUser.ID, ExternalID: "ext-1", Attributes: map[string]interface{}{"displayName": "It"}}))
+	require.Error(t, pg.UpsertSCIMResource(&SCIMResource{ApplicationID: isolated.ID, Type: scimTypeUser, ResourceID: u.ID, ExternalID: "ext-1"}))
+	scimRes, err := pg.GetSCIMResource(isolated.ID, scimTypeUser, nsUser.ID)
+	require.NoError(t, err)
+	require.Equal(t, "It", scimRes.Attributes["displayName"])
+	scimList, err := pg.ListSCIMResources(isolated.ID, scimTypeUser)
+	require.NoError(t, err)
+	require.Len(t, scimList, 1)
+	byExternalID, err := pg.GetSCIMResourceByExternalID(isolated.ID, scimTypeUser, "ext-1")
+	require.NoError(t, err)
+	require.Equal(t, nsUser.ID, byExternalID.ResourceID)
+	scimUsers, total, err := pg.ListSCIMUsers(SCIMUserFilter{ApplicationID: isolated.ID, UserName: "IT@example.com", ExternalID: "ext-1", Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, "it@example.com", scimUsers[0].User.Email)
+	require.Equal(t, "It", scimUsers[0].Resource.Attributes["displayName"])
+	require.NoError(t, pg.SetUserDisabled(nsUser.ID, true))
+	disabledUser, err := pg.GetUserByID(nsUser.ID)
+	require.NoError(t, err)
+	require.True(t, disabledUser.Disabled)
+
+	require.NoError(t, pg.DeleteApplication(isolated.ID, nil))
+	gone, err := pg.GetUserByEmail(isolated.ID, "it@example.com")
+	require.NoError(t, err)
+	require.Nil(t, gone)
+	gotIdP, err = pg.GetIdentityProviderByID(idp.ID)
+	require.NoError(t, err)
+	require.Nil(t, gotIdP)
+	gotSAML, err = pg.GetSAMLConnectionByID(samlConn.ID)
+	require.NoError(t, err)
+	require.Nil(t, gotSAML)
+	gotDir, err = pg.GetLDAPDirectory(isolated.ID)
+	require.NoError(t, err)
+	require.Nil(t, gotDir)
+	scimRes, err = pg.GetSCIMResource(isolated.ID, scimTypeUser, nsUser.ID)
+	require.NoError(t, err)
+	require.Nil(t, scimRes)
+
+	// password resets are single use
+	pr := &PasswordReset{UserID: u.ID, TokenHash: "reset-hash", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	require.NoError(t, pg.CreatePasswordReset(pr))
+	gotReset, err := pg.GetPasswordResetByTokenHash("reset-hash")
+	require.NoError(t, err)
+	require.Equal(t, u.ID, gotReset.UserID)
+	require.NoError(t, pg.MarkPasswordResetUsed(pr.ID))
+	require.Error(t, pg.MarkPasswordResetUsed(pr.ID))
+	require.NoError(t, pg.UpdateUserPassword(u.ID, "pwd-new"))
+
+	// audit log
+	require.NoError(t, pg.CreateAuditEvent(&AuditEvent{UserID: &u.ID, Action: "it.test", IP: "192.0.2.1", Details: map[string]interface{}{"k": "v"}}))
+	events, total, err := pg.ListAuditEvents(AuditEventFilter{Action: "it.test", Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, "v", events[0].Details["k"])
+
+	// login history
+	lat, lon := 51.5, -0.1
+	require.NoError(t, pg.CreateLoginEvent(&LoginEvent{UserID: u.ID, Outcome: loginSucceeded, IP: "192.0.2.1", Country: "GB", Latitude: &lat, Longitude: &lon}))
+	challenged := &LoginEvent{UserID: u.ID, Outcome: loginChallenged, IP: "192.0.2.2", RiskScore: 80, RiskLevel: riskHigh, RiskReasons: []string{"new_device", "impossible_travel"}}
+	require.NoError(t, pg.CreateLoginEvent(challenged))
+	logins, total, err := pg.ListLoginEvents(LoginEventFilter{UserID: u.ID, Since: time.Now().Add(-time.Hour), Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	require.Equal(t, []string{"new_device", "impossible_travel"}, logins[0].RiskReasons)
+	require.InDelta(t, lat, *logins[1].Latitude, 1e-9)
+	completed, err := pg.CompleteLoginEvent(challenged.ID)
+	require.NoError(t, err)
+	require.True(t, completed)
+	completed, err = pg.CompleteLoginEvent(challenged.ID)
+	require.NoError(t, err)
+	require.False(t, completed)
+
 	// refresh token lifecycle
 	token := "rt-test-123"
 	expires := time.Now().Add(24 * time.Hour).Unix()
-	err = pg.CreateRefreshToken(token, u.ID, expires, nil)
+	err = pg.CreateRefreshToken(&RefreshToken{Token: token, UserID: u.ID, ExpiresAt: expires, AuthTime: 1700000000, AMR: []string{"pwd"}})
 	require.NoError(t, err)
 
 	rt, err := pg.GetRefreshToken(token)
 	require.NoError(t, err)
 	require.NotNil(t, rt)
 	require.Equal(t, token, rt.Token)
+	require.Equal(t, int64(1700000000), rt.AuthTime)
+	require.Equal(t, []string{"pwd"}, rt.AMR)
 
 	// revoke
 	err = pg.RevokeRefreshToken(token)
@@ -93,10 +335,39 @@ func TestPostgresIntegration(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, rt2.Revoked)
 
+	sessions, err := pg.ListRefreshTokensForUser(u.ID)
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
 	// revoke all
 	err = pg.RevokeAllRefreshTokensForUser(u.ID)
 	require.NoError(t, err)
 
+	// user search and deletion
+	found, total, err := pg.ListUsers(UserFilter{EmailPrefix: "IT@", ApplicationID: &isolated.ID, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, nsUser.ID, found[0].ID)
+	require.NoError(t, pg.DeleteUser(nsUser.ID))
+	require.Error(t, pg.DeleteUser(nsUser.ID))
+
+	// shared rate limiter: a second instance sees the first one's requests
+	ctx := context.Background()
+	first, second := NewPostgresRateLimiter(pg), NewPostgresRateLimiter(pg)
+	for i := 0; i < 2; i++ {
+		res, err := first.Allow(ctx, "it:shared", 3, time.Hour)
+		require.NoError(t, err)
+		require.True(t, res.Allowed)
+	}
+	res, err := second.Allow(ctx, "it:shared", 3, time.Hour)
+	require.NoError(t, err)
+	require.True(t, res.Allowed)
+	require.Equal(t, 0, res.Remaining)
+	res, err = first.Allow(ctx, "it:shared", 3, time.Hour)
+	require.NoError(t, err)
+	require.False(t, res.Allowed)
+	require.Greater(t, res.RetryAfter, time.Duration(0))
+
 	// ensure ping works
 	require.True(t, pg.ping())
 
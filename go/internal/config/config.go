@@ -1,11 +1,15 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -16,12 +20,103 @@ type Config struct {
 	LogLevel   string
 	// PostgreSQL connection settings
 	PostgresDSN      string
-	PostgresHost    string
-	PostgresPort    string
-	PostgresUser    string
+	PostgresHost     string
+	PostgresPort     string
+	PostgresUser     string
 	PostgresPassword string
 	PostgresDB       string
 	PostgresSSLMode  string
+	// Outgoing email settings (invitations and notifications are logged when SMTPHost is empty)
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	// AdminAPIKey, when set, is provisioned on startup as the API key of a root
+	// application holding every admin scope
+	AdminAPIKey string
+	// APIKeyPepper keys the SHA-256 lookup hashes of API keys (defaults to JwtSecret)
+	APIKeyPepper string
+	// APIKeyRotationGrace is how long replaced API keys keep working after a rotation
+	APIKeyRotationGrace time.Duration
+	// TrustedProxies lists the proxies allowed to report the client address in X-Forwarded-For
+	TrustedProxies []netip.Prefix
+	// RateLimitBackend selects where rate limit counters live: "memory" (per instance)
+	// or "postgres" (shared by every instance using the same database)
+	RateLimitBackend string
+	// RateLimitRules are the per-endpoint, per-identity limits on credential endpoints
+	RateLimitRules []RateLimitRule
+	// PublicURL is the external base URL of the service, used in links to the hosted
+	// pages; when empty it is derived from each request
+	PublicURL string
+	// GeoIPDatabase is the path of a MaxMind DB file (such as GeoLite2 City) used to
+	// locate logins; location signals are skipped when empty
+	GeoIPDatabase string
+	// RiskMediumScore and RiskHighScore are the login risk scores (0-100) from which a
+	// login triggers a notification email or must be confirmed with MFA or an emailed code
+	RiskMediumScore int
+	RiskHighScore   int
+}
+
+// RateLimitRule gives one credential endpoint its own budget per client IP, target email
+// or user ID
+type RateLimitRule struct {
+	Endpoint string // login, register, refresh or password_reset
+	Key      string // ip, email or user
+	Limit    int    // requests allowed per window
+	Window   time.Duration
+}
+
+// rateLimitRuleKeys lists the identities each credential endpoint can be limited by
+var rateLimitRuleKeys = map[string][]string{
+	"login":          {"ip", "email"},
+	"register":       {"ip", "email"},
+	"refresh":        {"ip", "user"},
+	"password_reset": {"ip", "email"},
+}
+
+// defaultRateLimitRules apply when RATE_LIMIT_RULES is unset
+var defaultRateLimitRules = []RateLimitRule{
+	{Endpoint: "login", Key: "ip", Limit: 20, Window: time.Minute},
+	{Endpoint: "login", Key: "email", Limit: 10, Window: 15 * time.Minute},
+	{Endpoint: "register", Key: "ip", Limit: 10, Window: time.Hour},
+	{Endpoint: "refresh", Key: "user", Limit: 30, Window: time.Minute},
+	{Endpoint: "password_reset", Key: "ip", Limit: 10, Window: time.Hour},
+	{Endpoint: "password_reset", Key: "email", Limit: 3, Window: time.Hour},
+}
+
+// parseRateLimitRules reads rules from JSON such as
+// [{"endpoint":"login","key":"email","limit":5,"window":"15m"}]
+func parseRateLimitRules(raw string) ([]RateLimitRule, error) {
+	var entries []struct {
+		Endpoint string `json:"endpoint"`
+		Key      string `json:"key"`
+		Limit    int    `json:"limit"`
+		Window   string `json:"window"`
+	}
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, err
+	}
+	rules := make([]RateLimitRule, 0, len(entries))
+	for _, e := range entries {
+		keys, ok := rateLimitRuleKeys[e.Endpoint]
+		if !ok {
+			return nil, fmt.Errorf("unknown endpoint %q", e.Endpoint)
+		}
+		valid := false
+		for _, k := range keys {
+			valid = valid || k == e.Key
+		}
+		if !valid {
+			return nil, fmt.Errorf("%s cannot be limited by %q (use one of %s)", e.Endpoint, e.Key, strings.Join(keys, ", "))
+		}
+		window, err := time.ParseDuration(e.Window)
+		if err != nil || window <= 0 || e.Limit <= 0 {
+			return nil, fmt.Errorf("%s/%s: limit and window must be positive", e.Endpoint, e.Key)
+		}
+		rules = append(rules, RateLimitRule{Endpoint: e.Endpoint, Key: e.Key, Limit: e.Limit, Window: window})
+	}
+	return rules, nil
 }
 
 func getenv(key, def string) string {
@@ -85,7 +180,19 @@ func New() (*Config, error) {
 		PostgresPassword: getenv("POSTGRES_PASSWORD", getenv("DB_PASSWORD", "nilepass")),
 		PostgresDB:       getenv("POSTGRES_DB", getenv("DB_NAME", "nileauth")),
 		PostgresSSLMode:  getenv("POSTGRES_SSLMODE", getenv("DB_SSLMODE", "disable")),
+		// Email settings
+		SMTPHost:     getenv("SMTP_HOST", ""),
+		SMTPPort:     getenv("SMTP_PORT", "587"),
+		SMTPUsername: getenv("SMTP_USERNAME", ""),
+		SMTPPassword: getenv("SMTP_PASSWORD", ""),
+		SMTPFrom:     getenv("SMTP_FROM", "no-reply@localhost"),
+		AdminAPIKey:  getenv("ADMIN_API_KEY", ""),
+		// Rate limiting
+		RateLimitBackend: strings.ToLower(getenv("RATE_LIMIT_BACKEND", "memory")),
+		PublicURL:        strings.TrimSuffix(getenv("PUBLIC_URL", ""), "/"),
+		GeoIPDatabase:    getenv("GEOIP_DATABASE", ""),
 	}
+	c.APIKeyPepper = getenv("API_KEY_PEPPER", c.JwtSecret)
 
 	// Validate PostgreSQL configuration if using postgres
 	if c.DBAdapter == "postgres" {
@@ -111,6 +218,77 @@ func New() (*Config, error) {
 		}
 	}
 
+	grace, err := time.ParseDuration(getenv("API_KEY_ROTATION_GRACE", "24h"))
+	if err != nil || grace < 0 {
+		return nil, fmt.Errorf("invalid API_KEY_ROTATION_GRACE: %s", getenv("API_KEY_ROTATION_GRACE", ""))
+	}
+	c.APIKeyRotationGrace = grace
+
+	for _, entry := range strings.Split(getenv("TRUSTED_PROXIES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %s", entry)
+			}
+			c.TrustedProxies = append(c.TrustedProxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry: %s", entry)
+		}
+		c.TrustedProxies = append(c.TrustedProxies, p.Masked())
+	}
+
+	c.RateLimitRules = defaultRateLimitRules
+	if raw := os.Getenv("RATE_LIMIT_RULES"); raw != "" {
+		rules, err := parseRateLimitRules(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_RULES: %w", err)
+		}
+		c.RateLimitRules = rules
+	}
+
+	switch c.RateLimitBackend {
+	case "memory":
+	case "postgres":
+		if c.DBAdapter != "postgres" {
+			return nil, errors.New("RATE_LIMIT_BACKEND=postgres requires DB_ADAPTER=postgres")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported RATE_LIMIT_BACKEND: %s (supported: memory, postgres)", c.RateLimitBackend)
+	}
+
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid PUBLIC_URL: %s", c.PublicURL)
+		}
+	}
+
+	for _, score := range []struct {
+		name string
+		dst  *int
+		def  string
+	}{{"RISK_MEDIUM_SCORE", &c.RiskMediumScore, "30"}, {"RISK_HIGH_SCORE", &c.RiskHighScore, "60"}} {
+		v, err := strconv.Atoi(getenv(score.name, score.def))
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("invalid %s: %s", score.name, getenv(score.name, ""))
+		}
+		*score.dst = v
+	}
+	if c.RiskMediumScore > c.RiskHighScore {
+		return nil, errors.New("RISK_MEDIUM_SCORE must not be above RISK_HIGH_SCORE")
+	}
+
+	if c.AdminAPIKey != "" && len(c.AdminAPIKey) < 32 {
+		return nil, errors.New("ADMIN_API_KEY must be at least 32 characters")
+	}
+
 	// normalize port
 	if _, err := strconv.Atoi(c.Port); err == nil {
 		// ok
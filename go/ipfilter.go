@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parseIPPrefix parses a CIDR range, accepting a bare address as a single-host range
+func parseIPPrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// normalizeIPList validates a list of CIDR ranges and returns them in canonical form
+func normalizeIPList(field string, list []string) ([]string, error) {
+	out := make([]string, 0, len(list))
+	for _, s := range list {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		p, err := parseIPPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid CIDR %q", field, s)
+		}
+		out = append(out, p.String())
+	}
+	return out, nil
+}
+
+// ipInList reports whether an address falls in one of the given ranges. Entries that do
+// not parse never match.
+func ipInList(addr netip.Addr, list []string) bool {
+	for _, s := range list {
+		if p, err := parseIPPrefix(s); err == nil && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// applicationAllowsIP applies an application's IP lists: denied ranges always lose, and
+// a non-empty allowlist must contain the address
+func applicationAllowsIP(app *Application, addr netip.Addr) bool {
+	if len(app.IPAllowlist) == 0 && len(app.IPDenylist) == 0 {
+		return true
+	}
+	if !addr.IsValid() || ipInList(addr, app.IPDenylist) {
+		return false
+	}
+	return len(app.IPAllowlist) == 0 || ipInList(addr, app.IPAllowlist)
+}
+
+// clientIP returns the address a request originates from. X-Forwarded-For is only
+// honored when the connection comes from a trusted proxy; it is walked from the right,
+// skipping further trusted proxies, so a client cannot spoof its address by prepending
+// entries.
+func (a *App) clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	remote = remote.Unmap()
+	if !a.isTrustedProxy(remote) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !a.isTrustedProxy(client) {
+			break
+		}
+	}
+	return client
+}
+
+func (a *App) isTrustedProxy(addr netip.Addr) bool {
+	for _, p := range a.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
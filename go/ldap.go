@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal LDAPv3 client (RFC 4511): just enough BER to bind, search and StartTLS
+
+const (
+	berClassApplication = 0x40
+	berClassContext     = 0x80
+	berConstructed      = 0x20
+
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	// berMaxPacket bounds the size of a message read from a directory server
+	berMaxPacket = 4 << 20
+	berMaxDepth  = 32
+)
+
+// LDAP protocol operations, tagged in the application class
+const (
+	ldapBindRequest      = berClassApplication | berConstructed | 0
+	ldapBindResponse     = berClassApplication | berConstructed | 1
+	ldapUnbindRequest    = berClassApplication | 2
+	ldapSearchRequest    = berClassApplication | berConstructed | 3
+	ldapSearchEntry      = berClassApplication | berConstructed | 4
+	ldapSearchDone       = berClassApplication | berConstructed | 5
+	ldapExtendedRequest  = berClassApplication | berConstructed | 23
+	ldapExtendedResponse = berClassApplication | berConstructed | 24
+)
+
+const (
+	ldapStartTLSOID    = "1.3.6.1.4.1.1466.20037"
+	ldapDefaultPort    = "389"
+	ldapDefaultTLSPort = "636"
+	ldapTimeout        = 10 * time.Second
+
+	ldapResultSuccess      = 0
+	ldapResultSizeLimit    = 4
+	ldapResultInvalidCreds = 49
+)
+
+// berPacket is one BER element; constructed elements carry children instead of a value
+type berPacket struct {
+	Tag      byte
+	Value    []byte
+	Children []*berPacket
+}
+
+func berPrimitive(tag byte, value []byte) *berPacket {
+	return &berPacket{Tag: tag, Value: value}
+}
+
+func berString(tag byte, s string) *berPacket {
+	return berPrimitive(tag, []byte(s))
+}
+
+func berInt(tag byte, n int64) *berPacket {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		if (n < 0x80 && n >= -0x80) || len(b) == 8 {
+			break
+		}
+		n >>= 8
+	}
+	return berPrimitive(tag, b)
+}
+
+func berBool(v bool) *berPacket {
+	if v {
+		return berPrimitive(berBoolean, []byte{0xff})
+	}
+	return berPrimitive(berBoolean, []byte{0})
+}
+
+func berNode(tag byte, children ...*berPacket) *berPacket {
+	return &berPacket{Tag: tag | berConstructed, Children: children}
+}
+
+func (p *berPacket) constructed() bool {
+	return p.Tag&berConstructed != 0
+}
+
+func (p *berPacket) encode() []byte {
+	value := p.Value
+	if p.constructed() {
+		value = nil
+		for _, c := range p.Children {
+			value = append(value, c.encode()...)
+		}
+	}
+	out := []byte{p.Tag}
+	if n := len(value); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		out = append(out, 0x80|byte(len(l)))
+		out = append(out, l...)
+	}
+	return append(out, value...)
+}
+
+// int decodes an INTEGER or ENUMERATED value
+func (p *berPacket) int() (int64, error) {
+	if p == nil || p.constructed() || len(p.Value) == 0 || len(p.Value) > 8 {
+		return 0, errors.New("ber: malformed integer")
+	}
+	n := int64(int8(p.Value[0]))
+	for _, b := range p.Value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+func (p *berPacket) child(i int) *berPacket {
+	if p == nil || i >= len(p.Children) {
+		return nil
+	}
+	return p.Children[i]
+}
+
+func (p *berPacket) str() string {
+	if p == nil {
+		return ""
+	}
+	return string(p.Value)
+}
+
+// readBERPacket reads one element. Only definite lengths and single-byte tags are
+// supported, which is all LDAP uses.
+func readBERPacket(r io.Reader) (*berPacket, error) {
+	return readBERElement(r, berMaxPacket, 0)
+}
+
+func readBERElement(r io.Reader, limit, depth int) (*berPacket, error) {
+	if depth > berMaxDepth {
+		return nil, errors.New("ber: nesting too deep")
+	}
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0]&0x1f == 0x1f {
+		return nil, errors.New("ber: multi-byte tags are not supported")
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return nil, errors.New("ber: unsupported length")
+		}
+		l := make([]byte, size)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return nil, err
+		}
+		n = 0
+		for _, b := range l {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > limit {
+		return nil, errors.New("ber: element too large")
+	}
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	p := &berPacket{Tag: head[0]}
+	if !p.constructed() {
+		p.Value = value
+		return p, nil
+	}
+	body := bytes.NewReader(value)
+	for body.Len() > 0 {
+		c, err := readBERElement(body, body.Len(), depth+1)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errors.New("ber: truncated element")
+			}
+			return nil, err
+		}
+		p.Children = append(p.Children, c)
+	}
+	return p, nil
+}
+
+// ldapError is a non-success LDAPResult
+type ldapError struct {
+	Code    int64
+	Message string
+}
+
+func (e *ldapError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap result %d", e.Code)
+	}
+	return fmt.Sprintf("ldap result %d: %s", e.Code, e.Message)
+}
+
+func isLDAPResult(err error, code int64) bool {
+	var le *ldapError
+	return errors.As(err, &le) && le.Code == code
+}
+
+// ldapResult checks the resultCode of an LDAPResult
+func ldapResult(op *berPacket) error {
+	code, err := op.child(0).int()
+	if err != nil {
+		return err
+	}
+	if code != ldapResultSuccess {
+		return &ldapError{Code: code, Message: op.child(2).str()}
+	}
+	return nil
+}
+
+type ldapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	msgID  int64
+}
+
+// ldapEntry is a search result; attribute names are lowercased
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+func (e *ldapEntry) first(attr string) string {
+	if values := e.Attributes[strings.ToLower(attr)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ldapTLSConfig trusts the directory's CA certificate when one is configured and the
+// system roots otherwise
+func ldapTLSConfig(d *LDAPDirectory, host string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if d.CACertificate != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(d.CACertificate)) {
+			return nil, errors.New("ca_certificate holds no PEM certificate")
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// dialLDAP connects to a directory; the whole conversation shares one deadline
+func dialLDAP(d *LDAPDirectory) (*ldapConn, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = ldapDefaultPort
+		if u.Scheme == "ldaps" {
+			port = ldapDefaultTLSPort
+		}
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	cfg, err := ldapTLSConfig(d, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: ldapTimeout}
+	var conn net.Conn
+	if u.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	c := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+	if u.Scheme == "ldap" && d.StartTLS {
+		if _, err := c.request(berNode(ldapExtendedRequest, berString(berClassContext|0, ldapStartTLSOID)), ldapExtendedResponse); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+		c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+	return c, nil
+}
+
+func (c *ldapConn) send(op *berPacket) (int64, error) {
+	c.msgID++
+	msg := berNode(berSequence, berInt(berInteger, c.msgID), op)
+	_, err := c.conn.Write(msg.encode())
+	return c.msgID, err
+}
+
+// receive reads the next message answering id, returning its protocol operation
+func (c *ldapConn) receive(id int64) (*berPacket, error) {
+	for {
+		msg, err := readBERPacket(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Tag != berSequence || len(msg.Children) < 2 {
+			return nil, errors.New("ldap: malformed message")
+		}
+		got, err := msg.child(0).int()
+		if err != nil {
+			return nil, err
+		}
+		if got == 0 {
+			// Unsolicited notification, in practice a notice of disconnection
+			return nil, fmt.Errorf("ldap: server disconnected: %v", ldapResult(msg.child(1)))
+		}
+		if got == id {
+			return msg.child(1), nil
+		}
+	}
+}
+
+// request sends an operation and checks the result of its single response
+func (c *ldapConn) request(op *berPacket, resultTag byte) (*berPacket, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if res.Tag != resultTag {
+		return nil, fmt.Errorf("ldap: unexpected response tag %#x", res.Tag)
+	}
+	return res, ldapResult(res)
+}
+
+// bind performs a simple bind
+func (c *ldapConn) bind(dn, password string) error {
+	_, err := c.request(berNode(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(berClassContext|0, password),
+	), ldapBindResponse)
+	return err
+}
+
+// search runs a subtree search returning at most sizeLimit entries
+func (c *ldapConn) search(base string, filter *berPacket, attrs []string, sizeLimit int64) ([]*ldapEntry, error) {
+	attrList := berNode(berSequence)
+	for _, a := range attrs {
+		attrList.Children = append(attrList.Children, berString(berOctetString, a))
+	}
+	id, err := c.send(berNode(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, sizeLimit),
+		berInt(berInteger, int64(ldapTimeout/time.Second)),
+		berBool(false),
+		filter,
+		attrList,
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ldapEntry
+	for {
+		res, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch res.Tag {
+		case ldapSearchEntry:
+			e := &ldapEntry{DN: res.child(0).str(), Attributes: map[string][]string{}}
+			if list := res.child(1); list != nil {
+				for _, attr := range list.Children {
+					name := strings.ToLower(attr.child(0).str())
+					if vals := attr.child(1); vals != nil {
+						for _, v := range vals.Children {
+							e.Attributes[name] = append(e.Attributes[name], v.str())
+						}
+					}
+				}
+			}
+			entries = append(entries, e)
+		case ldapSearchDone:
+			return entries, ldapResult(res)
+		}
+		// Search result references are not followed
+	}
+}
+
+func (c *ldapConn) close() {
+	c.send(berPrimitive(ldapUnbindRequest, nil))
+	c.conn.Close()
+}
+
+// parseLDAPFilter compiles an RFC 4515 string filter. Extensible matches are not
+// supported.
+func parseLDAPFilter(s string) (*berPacket, error) {
+	p := &ldapFilterParser{s: s}
+	f, err := p.filter(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(s) {
+		return nil, errors.New("filter: trailing characters")
+	}
+	return f, nil
+}
+
+type ldapFilterParser struct {
+	s   string
+	pos int
+}
+
+func (p *ldapFilterParser) filter(depth int) (*berPacket, error) {
+	if depth > berMaxDepth {
+		return nil, errors.New("filter: nesting too deep")
+	}
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		return nil, errors.New("filter: expected (")
+	}
+	p.pos++
+	var f *berPacket
+	var err error
+	if p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '&', '|':
+			tag := byte(berClassContext | 0)
+			if p.s[p.pos] == '|' {
+				tag = berClassContext | 1
+			}
+			p.pos++
+			f = berNode(tag)
+			for p.pos < len(p.s) && p.s[p.pos] == '(' {
+				c, err := p.filter(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				f.Children = append(f.Children, c)
+			}
+			if len(f.Children) == 0 {
+				return nil, errors.New("filter: empty filter list")
+			}
+		case '!':
+			p.pos++
+			c, err := p.filter(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			f = berNode(berClassContext|2, c)
+		default:
+			f, err = p.item()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+		return nil, errors.New("filter: expected )")
+	}
+	p.pos++
+	return f, nil
+}
+
+func (p *ldapFilterParser) item() (*berPacket, error) {
+	end := strings.IndexAny(p.s[p.pos:], "()")
+	if end < 0 {
+		return nil, errors.New("filter: expected )")
+	}
+	item := p.s[p.pos : p.pos+end]
+	p.pos += end
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, fmt.Errorf("filter: invalid item %q", item)
+	}
+	attr, raw := item[:eq], item[eq+1:]
+	tag := byte(berClassContext | 3)
+	switch attr[len(attr)-1] {
+	case '~':
+		tag = berClassContext | 8
+	case '>':
+		tag = berClassContext | 5
+	case '<':
+		tag = berClassContext | 6
+	case ':':
+		return nil, errors.New("filter: extensible matches are not supported")
+	}
+	if tag != berClassContext|3 {
+		attr = attr[:len(attr)-1]
+	}
+	if !ldapAttributePattern(attr) {
+		return nil, fmt.Errorf("filter: invalid attribute %q", attr)
+	}
+	if tag == berClassContext|3 && raw == "*" {
+		return berString(berClassContext|7, attr), nil
+	}
+	parts := strings.Split(raw, "*")
+	if tag != berClassContext|3 && len(parts) > 1 {
+		return nil, fmt.Errorf("filter: wildcard in %q", item)
+	}
+	values := make([]string, len(parts))
+	for i, part := range parts {
+		v, err := unescapeLDAPFilterValue(part)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	if len(values) == 1 {
+		return berNode(tag, berString(berOctetString, attr), berString(berOctetString, values[0])), nil
+	}
+	subs := berNode(berSequence)
+	for i, v := range values {
+		switch {
+		case v == "":
+			continue
+		case i == 0:
+			subs.Children = append(subs.Children, berString(berClassContext|0, v))
+		case i == len(values)-1:
+			subs.Children = append(subs.Children, berString(berClassContext|2, v))
+		default:
+			subs.Children = append(subs.Children, berString(berClassContext|1, v))
+		}
+	}
+	return berNode(berClassContext|4, berString(berOctetString, attr), subs), nil
+}
+
+// ldapAttributePattern accepts attribute descriptions: a name or OID with options
+func ldapAttributePattern(attr string) bool {
+	if attr == "" {
+		return false
+	}
+	for _, r := range attr {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == ';') {
+			return false
+		}
+	}
+	return true
+}
+
+func unescapeLDAPFilterValue(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", errors.New("filter: truncated escape")
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.New("filter: invalid escape")
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// escapeLDAPFilterValue escapes user input for use as a filter assertion value
+func escapeLDAPFilterValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// stubLDAPServer is an in-process directory answering simple binds and searches with
+// and, or, not, equality and presence filters
+type stubLDAPServer struct {
+	net.Listener
+	mu        sync.Mutex
+	passwords map[string]string
+	entries   []*ldapEntry
+}
+
+func newStubLDAPServer(t *testing.T) *stubLDAPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &stubLDAPServer{Listener: l, passwords: map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *stubLDAPServer) add(dn, password string, attrs map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[dn] = password
+	s.entries = append(s.entries, &ldapEntry{DN: dn, Attributes: attrs})
+}
+
+func (s *stubLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	bound := ""
+	for {
+		msg, err := readBERPacket(r)
+		if err != nil {
+			return
+		}
+		id, _ := msg.child(0).int()
+		reply := func(op *berPacket) {
+			conn.Write(berNode(berSequence, berInt(berInteger, id), op).encode())
+		}
+		result := func(tag byte, code int64) *berPacket {
+			return berNode(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, ""))
+		}
+		op := msg.child(1)
+		s.mu.Lock()
+		switch op.Tag {
+		case ldapBindRequest:
+			dn, password := op.child(1).str(), op.child(2).str()
+			if want, ok := s.passwords[dn]; ok && password != "" && password == want {
+				bound = dn
+				reply(result(ldapBindResponse, ldapResultSuccess))
+			} else {
+				bound = ""
+				reply(result(ldapBindResponse, ldapResultInvalidCreds))
+			}
+		case ldapSearchRequest:
+			if bound != "cn=svc,dc=corp" {
+				reply(result(ldapSearchDone, 50)) // insufficientAccessRights
+				break
+			}
+			for _, e := range s.entries {
+				if !stubLDAPMatch(op.child(6), e) {
+					continue
+				}
+				attrs := berNode(berSequence)
+				for name, values := range e.Attributes {
+					set := berNode(berSet)
+					for _, v := range values {
+						set.Children = append(set.Children, berString(berOctetString, v))
+					}
+					attrs.Children = append(attrs.Children, berNode(berSequence, berString(berOctetString, name), set))
+				}
+				reply(berNode(ldapSearchEntry, berString(berOctetString, e.DN), attrs))
+			}
+			reply(result(ldapSearchDone, ldapResultSuccess))
+		case ldapUnbindRequest:
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+}
+
+func stubLDAPMatch(f *berPacket, e *ldapEntry) bool {
+	switch f.Tag {
+	case berClassContext | berConstructed | 0:
+		for _, c := range f.Children {
+			if !stubLDAPMatch(c, e) {
+				return false
+			}
+		}
+		return true
+	case berClassContext | berConstructed | 1:
+		for _, c := range f.Children {
+			if stubLDAPMatch(c, e) {
+				return true
+			}
+		}
+		return false
+	case berClassContext | berConstructed | 2:
+		return !stubLDAPMatch(f.child(0), e)
+	case berClassContext | berConstructed | 3:
+		for _, v := range e.Attributes[strings.ToLower(f.child(0).str())] {
+			if strings.EqualFold(v, f.child(1).str()) {
+				return true
+			}
+		}
+		return false
+	case berClassContext | 7:
+		return len(e.Attributes[strings.ToLower(f.str())]) > 0
+	}
+	return false
+}
+
+func TestLDAPFilterParsing(t *testing.T) {
+	f, err := parseLDAPFilter(`(&(objectClass=person)(!(uid=a\2ab))(cn=J*n*e)(mail=*))`)
+	require.NoError(t, err)
+	require.Len(t, f.Children, 4)
+	require.Equal(t, "a*b", f.child(1).child(0).child(1).str())
+	subs := f.child(2).child(1)
+	require.Equal(t, []byte{berClassContext | 0, berClassContext | 1, berClassContext | 2}, []byte{subs.child(0).Tag, subs.child(1).Tag, subs.child(2).Tag})
+	require.Equal(t, byte(berClassContext|7), f.child(3).Tag)
+
+	// the encoding survives a round trip through the reader
+	decoded, err := readBERPacket(strings.NewReader(string(f.encode())))
+	require.NoError(t, err)
+	require.Equal(t, f.encode(), decoded.encode())
+
+	for _, bad := range []string{"", "uid=x", "(uid=x", "(&)", "(uid:dn:=x)", "(uid=x))", "(u id=x)", `(uid=\4)`} {
+		_, err := parseLDAPFilter(bad)
+		require.Error(t, err, bad)
+	}
+	require.Equal(t, `\2a\28x\29\5c`, escapeLDAPFilterValue(`*(x)\`))
+}
+
+func TestLDAPLogin(t *testing.T) {
+	dir := newStubLDAPServer(t)
+	dir.add("cn=svc,dc=corp", "svc-secret", map[string][]string{})
+	dir.add("uid=jane,ou=people,dc=corp", "directory-pw", map[string][]string{
+		"objectclass": {"person"},
+		"uid":         {"jane"},
+		"mail":        {"jane@corp.example"},
+		"ou":          {"engineering"},
+		"memberof":    {"cn=admins,dc=corp", "cn=staff,dc=corp"},
+	})
+
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	hashed, err := hashPassword("local-pw")
+	require.NoError(t, err)
+	_, err = a.DB.CreateUser("local@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+
+	d := &LDAPDirectory{
+		ApplicationID:    app.ID,
+		URL:              "ldap://" + dir.Addr().String(),
+		BindDN:           "cn=svc,dc=corp",
+		BindPassword:     "svc-secret",
+		SearchBase:       "dc=corp",
+		SearchFilter:     "(&(objectClass=person)(uid={username}))",
+		AttributeMapping: map[string]string{"email": "mail", "department": "ou", "groups": "memberOf"},
+		Active:           true,
+	}
+	require.NoError(t, normalizeLDAPDirectory(d))
+	require.NoError(t, a.DB.UpsertLDAPDirectory(d))
+
+	login := func(email, password string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"email":"`+email+`","password":"`+password+`"}`))
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(http.HandlerFunc(a.HandleLogin)).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec.Code, out
+	}
+
+	// a successful bind provisions a shadow user whose tokens carry the mapped claims
+	status, body := login("jane", "directory-pw")
+	require.Equal(t, http.StatusOK, status, body)
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(body["accessToken"].(string), claims, func(*jwt.Token) (interface{}, error) { return jwtSecret, nil })
+	require.NoError(t, err)
+	require.Equal(t, "engineering", claims["department"])
+	require.Equal(t, []interface{}{"cn=admins,dc=corp", "cn=staff,dc=corp"}, claims["groups"])
+	user, err := a.DB.GetUserByEmail(userNamespace(app), "jane@corp.example")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	require.Equal(t, user.ID, int64(claims["userId"].(float64)))
+
+	// wrong passwords, filter injection and local passwords are refused
+	for _, c := range [][2]string{{"jane", "wrong"}, {"jane", ""}, {"*", "directory-pw"}, {"local@example.com", "local-pw"}} {
+		status, body = login(c[0], c[1])
+		require.Equal(t, http.StatusUnauthorized, status, c)
+		require.Equal(t, "INVALID_CREDENTIALS", body["error_code"])
+	}
+
+	// the directory is authoritative for the shadow user's email
+	dir.mu.Lock()
+	dir.entries[1].Attributes["mail"] = []string{"jane.doe@corp.example"}
+	dir.mu.Unlock()
+	status, _ = login("jane", "directory-pw")
+	require.Equal(t, http.StatusOK, status)
+	renamed, err := a.DB.GetUserByID(user.ID)
+	require.NoError(t, err)
+	require.Equal(t, "jane.doe@corp.example", renamed.Email)
+
+	// an unreachable directory is reported as such
+	dir.Close()
+	status, body = login("jane", "directory-pw")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "DIRECTORY_UNAVAILABLE", body["error_code"])
+
+	// without an active directory the application is back to local passwords
+	require.NoError(t, a.DB.DeleteLDAPDirectory(app.ID))
+	status, _ = login("local@example.com", "local-pw")
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestNormalizeLDAPDirectory(t *testing.T) {
+	valid := func() *LDAPDirectory {
+		return &LDAPDirectory{URL: "ldaps://ldap.corp.example", SearchBase: "dc=corp", SearchFilter: "(uid={username})"}
+	}
+	require.NoError(t, normalizeLDAPDirectory(valid()))
+	refused := map[string]func(d *LDAPDirectory){
+		"cleartext": func(d *LDAPDirectory) { d.URL = "ldap://ldap.corp.example" },
+		"scheme":    func(d *LDAPDirectory) { d.URL = "https://ldap.corp.example" },
+		"base":      func(d *LDAPDirectory) { d.SearchBase = "" },
+		"username":  func(d *LDAPDirectory) { d.SearchFilter = "(uid=jane)" },
+		"filter":    func(d *LDAPDirectory) { d.SearchFilter = "uid={username}" },
+		"password":  func(d *LDAPDirectory) { d.BindDN = "cn=svc,dc=corp" },
+		"reserved":  func(d *LDAPDirectory) { d.AttributeMapping = map[string]string{"userId": "uid"} },
+		"claim":     func(d *LDAPDirectory) { d.AttributeMapping = map[string]string{"Dept Name": "ou"} },
+		"attribute": func(d *LDAPDirectory) { d.AttributeMapping = map[string]string{"dept": "o u"} },
+		"ca":        func(d *LDAPDirectory) { d.CACertificate = "not a certificate" },
+	}
+	for name, change := range refused {
+		d := valid()
+		change(d)
+		require.Error(t, normalizeLDAPDirectory(d), name)
+	}
+	d := valid()
+	d.URL, d.StartTLS = "ldap://ldap.corp.example", true
+	require.NoError(t, normalizeLDAPDirectory(d))
+}
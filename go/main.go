@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,9 +19,29 @@ import (
 
 var jwtSecret []byte
 
+// apiKeyPepper keys the lookup hashes of API keys
+var apiKeyPepper []byte
+
 type App struct {
-	DB          DB
-	rateLimiter *RateLimiter
+	DB     DB
+	Mailer Mailer
+	// KeyRotationGrace is how long replaced API keys stay valid after a rotation
+	KeyRotationGrace time.Duration
+	// TrustedProxies are the proxies whose X-Forwarded-For header identifies the client
+	TrustedProxies []netip.Prefix
+	// RateLimitRules limit credential endpoints per client IP, email or user
+	RateLimitRules []cfg.RateLimitRule
+	// PublicURL is the external base URL used in links to the hosted pages
+	PublicURL string
+	// GeoIP locates login clients for risk scoring; logins are scored without locations when nil
+	GeoIP *GeoIPDatabase
+	// RiskMediumScore and RiskHighScore are the risk scores from which a login is
+	// reported to the user or has to be confirmed
+	RiskMediumScore, RiskHighScore int
+	// rateLimiter is set once before serving; no limits are enforced when it is nil
+	rateLimiter RateLimiter
+	// preflightOrigins caches the origins preflight requests are checked against
+	preflightOrigins originCache
 }
 
 func writeJSON(w http.ResponseWriter, status int, v interface{}) {
@@ -34,27 +55,21 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	}
 }
 
-func main() {
-	c, err := cfg.New()
-	if err != nil {
-		log.Fatalf("config: %v", err)
-	}
-	jwtSecret = []byte(c.JwtSecret)
-
-	var db DB
+// openDB connects to the configured database adapter, applying Postgres migrations first
+func openDB(c *cfg.Config) (DB, error) {
 	switch c.DBAdapter {
 	case "sqlite":
 		s, err := NewSQLiteDB(c.SQLiteFile)
 		if err != nil {
-			log.Fatalf("sqlite init: %v", err)
+			return nil, fmt.Errorf("sqlite init: %w", err)
 		}
-		db = s
+		return s, nil
 	case "postgres":
 		dsn, err := c.BuildPostgresDSN()
 		if err != nil {
-			log.Fatalf("postgres config error: %v", err)
+			return nil, fmt.Errorf("postgres config error: %w", err)
 		}
-		
+
 		// Apply migrations before connecting
 		log.Println("Applying database migrations...")
 		if err := ApplyMigrations("./migrations", dsn); err != nil {
@@ -66,27 +81,106 @@ func main() {
 		} else {
 			log.Println("Migrations applied successfully")
 		}
-		
+
 		p, err := NewPostgresDB(dsn)
 		if err != nil {
-			log.Fatalf("postgres init: %v", err)
+			return nil, fmt.Errorf("postgres init: %w", err)
 		}
-		db = p
 		log.Println("Connected to PostgreSQL database")
+		return p, nil
 	case "memory":
 		log.Println("Using in-memory database (not recommended for production)")
-		db = NewMemoryDB()
+		return NewMemoryDB(), nil
 	default:
-		log.Fatalf("unsupported DB_ADAPTER: %s (supported: postgres, sqlite, memory)", c.DBAdapter)
+		return nil, fmt.Errorf("unsupported DB_ADAPTER: %s (supported: postgres, sqlite, memory)", c.DBAdapter)
+	}
+}
+
+func main() {
+	c, err := cfg.New()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	jwtSecret = []byte(c.JwtSecret)
+	apiKeyPepper = []byte(c.APIKeyPepper)
+
+	if len(os.Args) > 1 {
+		commands := map[string]func(*cfg.Config, []string) error{
+			"bootstrap-admin": runBootstrapAdmin,
+			"import-users":    runImportUsers,
+			"export-users":    runExportUsers,
+		}
+		if run, ok := commands[os.Args[1]]; ok {
+			if err := run(c, os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	db, err := openDB(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if c.AdminAPIKey != "" {
+		adminApp, created, err := bootstrapAdminApplication(db, "admin", "localhost", c.AdminAPIKey)
+		if err != nil {
+			log.Fatalf("admin bootstrap: %v", err)
+		}
+		if created {
+			log.Printf("Created admin application %d from ADMIN_API_KEY", adminApp.ID)
+		}
+	}
+
+	app := &App{DB: db, Mailer: NewMailer(c), KeyRotationGrace: c.APIKeyRotationGrace, TrustedProxies: c.TrustedProxies, RateLimitRules: c.RateLimitRules, PublicURL: c.PublicURL, RiskMediumScore: c.RiskMediumScore, RiskHighScore: c.RiskHighScore}
+	if c.GeoIPDatabase != "" {
+		geoIP, err := OpenGeoIPDatabase(c.GeoIPDatabase)
+		if err != nil {
+			log.Fatalf("geoip database: %v", err)
+		}
+		app.GeoIP = geoIP
+		log.Printf("Locating logins with %s", c.GeoIPDatabase)
+	}
+	if c.RateLimitBackend == "postgres" {
+		app.rateLimiter = NewPostgresRateLimiter(db.(*PostgresDB))
+		log.Println("Rate limits are shared through PostgreSQL")
+	} else {
+		app.rateLimiter = NewMemoryRateLimiter()
+	}
+	r := newRouter(app)
+
+	// CORS wraps the router so preflight requests are answered before route matching
+	srv := &http.Server{Handler: app.CORS(r), Addr: ":" + c.Port, ReadTimeout: 5 * time.Second, WriteTimeout: 10 * time.Second}
+
+	go func() {
+		fmt.Println("Starting Go server on", c.Port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if closer, ok := app.DB.(interface{ close() error }); ok {
+		_ = closer.close()
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("shutdown failed:%+v", err)
 	}
+	fmt.Println("Server exited properly")
+}
 
-	app := &App{DB: db}
+// newRouter registers every route of the service on a new router
+func newRouter(app *App) *mux.Router {
 	r := mux.NewRouter()
 
 	// Apply global middleware
 	r.Use(SecurityHeaders)
 	r.Use(app.Logging)
-	r.Use(app.CORS)
 
 	// Health check endpoints (no auth required)
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
@@ -107,53 +201,172 @@ func main() {
 		w.Write([]byte(`{"ready":true}`))
 	}).Methods("GET")
 
-	// API v1 routes with authentication and rate limiting
+	// Hosted login pages. Browsers reach them without an API key; the client_id and
+	// redirect_uri of each request are checked against the application instead.
+	hosted := r.PathPrefix("/hosted").Subrouter()
+	hosted.HandleFunc("/login", app.HandleHostedLogin).Methods("GET", "POST")
+	hosted.HandleFunc("/register", app.HandleHostedRegister).Methods("GET", "POST")
+	hosted.HandleFunc("/forgot", app.HandleHostedForgotPassword).Methods("GET", "POST")
+	hosted.HandleFunc("/reset", app.HandleHostedResetPassword).Methods("GET", "POST")
+	hosted.HandleFunc("/mfa", app.HandleHostedMFA).Methods("POST")
+	hosted.HandleFunc("/confirm", app.HandleHostedConfirm).Methods("POST")
+	hosted.HandleFunc("/consent", app.HandleHostedConsent).Methods("POST")
+	hosted.HandleFunc("/idp/callback", app.HandleHostedIdPCallback).Methods("GET")
+	hosted.HandleFunc("/idp/link", app.HandleHostedIdPLink).Methods("POST")
+	hosted.HandleFunc("/idp/{name}", app.HandleHostedIdP).Methods("GET")
+	hosted.HandleFunc("/saml/{name}", app.HandleHostedSAML).Methods("GET")
+	hosted.HandleFunc("/saml/{name}/metadata", app.HandleSAMLMetadata).Methods("GET")
+	hosted.HandleFunc("/saml/{name}/acs", app.HandleSAMLACS).Methods("POST")
+
+	// API v1 routes with authentication and rate limiting. Each route is named after the
+	// operation an API key must be allowed to call it.
 	v1 := r.PathPrefix("/api/v1").Subrouter()
 	v1.Use(app.APIKeyAuth)
 	v1.Use(app.RateLimit)
+	v1.Use(app.RequireOperation)
 
 	// Authentication endpoints
-	v1.HandleFunc("/auth/register", app.HandleRegister).Methods("POST")
-	v1.HandleFunc("/auth/login", app.HandleLogin).Methods("POST")
-	v1.HandleFunc("/auth/refresh", app.HandleRefresh).Methods("POST")
-	v1.HandleFunc("/auth/logout", app.HandleLogout).Methods("POST")
-	v1.HandleFunc("/auth/validate", app.HandleTokenValidate).Methods("GET")
-	v1.HandleFunc("/auth/introspect", app.HandleTokenIntrospect).Methods("POST")
-	v1.HandleFunc("/auth/revoke", app.HandleRevokeToken).Methods("POST")
+	v1.HandleFunc("/auth/register", app.HandleRegister).Methods("POST").Name(opAuthRegister)
+	v1.HandleFunc("/auth/login", app.HandleLogin).Methods("POST").Name(opAuthLogin)
+	v1.HandleFunc("/auth/login/confirm", app.HandleConfirmLogin).Methods("POST").Name(opAuthLogin)
+	v1.HandleFunc("/auth/refresh", app.HandleRefresh).Methods("POST").Name(opAuthRefresh)
+	v1.HandleFunc("/auth/reauthenticate", app.HandleReauthenticate).Methods("POST").Name(opAuthLogin)
+	v1.HandleFunc("/auth/logout", app.HandleLogout).Methods("POST").Name(opAuthLogout)
+	v1.HandleFunc("/auth/password/forgot", app.HandleForgotPassword).Methods("POST").Name(opAuthPasswordReset)
+	v1.HandleFunc("/auth/password/reset", app.HandleResetPassword).Methods("POST").Name(opAuthPasswordReset)
+	v1.HandleFunc("/auth/token", app.HandleAuthorizationCode).Methods("POST").Name(opAuthLogin)
+	v1.HandleFunc("/auth/mfa/verify", app.HandleVerifyMFA).Methods("POST").Name(opAuthLogin)
+	v1.HandleFunc("/auth/mfa/totp/setup", app.HandleSetupTOTP).Methods("POST").Name(opAuthMFA)
+	v1.HandleFunc("/auth/mfa/totp/confirm", app.HandleConfirmTOTP).Methods("POST").Name(opAuthMFA)
+	v1.HandleFunc("/auth/mfa/totp/disable", app.HandleDisableTOTP).Methods("POST").Name(opAuthMFA)
+	v1.HandleFunc("/auth/consents", app.HandleListConsents).Methods("GET").Name(opAuthConsents)
+	v1.HandleFunc("/auth/consents/{applicationId:[0-9]+}", app.HandleRevokeConsent).Methods("DELETE").Name(opAuthConsents)
+	v1.HandleFunc("/auth/identities", app.HandleListIdentities).Methods("GET").Name(opAuthIdentities)
+	v1.HandleFunc("/auth/identities/{provider}/link", app.HandleLinkIdentity).Methods("POST").Name(opAuthIdentities)
+	v1.HandleFunc("/auth/identities/{id:[0-9]+}", app.HandleUnlinkIdentity).Methods("DELETE").Name(opAuthIdentities)
+	v1.HandleFunc("/auth/validate", app.HandleTokenValidate).Methods("GET").Name(opTokensValidate)
+	v1.HandleFunc("/auth/introspect", app.HandleTokenIntrospect).Methods("POST").Name(opTokensIntrospect)
+	v1.HandleFunc("/auth/revoke", app.HandleRevokeToken).Methods("POST").Name(opTokensRevoke)
 
-	// Admin endpoints (for managing applications)
+	// Organization endpoints (B2B tenants owned by the calling application)
+	v1.HandleFunc("/organizations", app.HandleCreateOrganization).Methods("POST").Name(opOrganizationsWrite)
+	v1.HandleFunc("/organizations", app.HandleListOrganizations).Methods("GET").Name(opOrganizationsRead)
+	v1.HandleFunc("/organizations/invitations/accept", app.HandleAcceptOrganizationInvitation).Methods("POST").Name(opOrganizationsJoin)
+	v1.HandleFunc("/organizations/{id:[0-9]+}", app.HandleGetOrganization).Methods("GET").Name(opOrganizationsRead)
+	v1.HandleFunc("/organizations/{id:[0-9]+}", app.HandleUpdateOrganization).Methods("PUT").Name(opOrganizationsWrite)
+	v1.HandleFunc("/organizations/{id:[0-9]+}", app.HandleDeleteOrganization).Methods("DELETE").Name(opOrganizationsWrite)
+	v1.HandleFunc("/organizations/{id:[0-9]+}/members", app.HandleListOrganizationMembers).Methods("GET").Name(opOrganizationsRead)
+	v1.HandleFunc("/organizations/{id:[0-9]+}/members/{userId:[0-9]+}", app.HandlePutOrganizationMember).Methods("PUT").Name(opOrganizationsWrite)
+	v1.HandleFunc("/organizations/{id:[0-9]+}/members/{userId:[0-9]+}", app.HandleRemoveOrganizationMember).Methods("DELETE").Name(opOrganizationsWrite)
+	v1.HandleFunc("/organizations/{id:[0-9]+}/invitations", app.HandleCreateOrganizationInvitation).Methods("POST").Name(opOrganizationsWrite)
+	v1.HandleFunc("/organizations/{id:[0-9]+}/invitations", app.HandleListOrganizationInvitations).Methods("GET").Name(opOrganizationsRead)
+	v1.HandleFunc("/organizations/{id:[0-9]+}/invitations/{invitationId:[0-9]+}", app.HandleDeleteOrganizationInvitation).Methods("DELETE").Name(opOrganizationsWrite)
+
+	// Effective permissions of a user (debugging aid)
+	v1.HandleFunc("/users/{id:[0-9]+}/permissions", app.HandleGetUserPermissions).Methods("GET").Name(opUsersPermissions)
+
+	// Admin endpoints, each group guarded by an admin scope on the calling application
 	admin := v1.PathPrefix("/admin").Subrouter()
-	admin.HandleFunc("/applications", app.HandleCreateApplication).Methods("POST")
-	admin.HandleFunc("/applications", app.HandleGetApplications).Methods("GET")
+	adminGroup := func(prefix, scope string) *mux.Router {
+		group := admin.PathPrefix(prefix).Subrouter()
+		group.Use(app.RequireScope(scope))
+		return group
+	}
+
+	// Admin endpoints (for managing applications)
+	adminApps := adminGroup("/applications", scopeAdminApplications)
+	adminApps.HandleFunc("", app.HandleCreateApplication).Methods("POST").Name(opAdminApplications)
+	adminApps.HandleFunc("", app.HandleGetApplications).Methods("GET").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}", app.HandleGetApplication).Methods("GET").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}", app.HandleUpdateApplication).Methods("PUT").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}", app.HandleDeleteApplication).Methods("DELETE").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/deactivate", app.HandleDeactivateApplication).Methods("POST").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/activate", app.HandleActivateApplication).Methods("POST").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/scopes", app.HandleSetApplicationScopes).Methods("PUT").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/keys", app.HandleListAPIKeys).Methods("GET").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/keys", app.HandleCreateAPIKey).Methods("POST").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/keys/rotate", app.HandleRotateAPIKey).Methods("POST").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/keys/{keyId:[0-9]+}", app.HandleUpdateAPIKey).Methods("PUT").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/keys/{keyId:[0-9]+}", app.HandleRevokeAPIKey).Methods("DELETE").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/ldap", app.HandleGetLDAPDirectory).Methods("GET").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/ldap", app.HandleUpdateLDAPDirectory).Methods("PUT").Name(opAdminApplications)
+	adminApps.HandleFunc("/{id:[0-9]+}/ldap", app.HandleDeleteLDAPDirectory).Methods("DELETE").Name(opAdminApplications)
+
+	// Admin endpoints (upstream OpenID Connect identity providers)
+	adminIdPs := adminGroup("/identity-providers", scopeAdminApplications)
+	adminIdPs.HandleFunc("", app.HandleCreateIdentityProvider).Methods("POST").Name(opAdminApplications)
+	adminIdPs.HandleFunc("", app.HandleListIdentityProviders).Methods("GET").Name(opAdminApplications)
+	adminIdPs.HandleFunc("/{id:[0-9]+}", app.HandleGetIdentityProvider).Methods("GET").Name(opAdminApplications)
+	adminIdPs.HandleFunc("/{id:[0-9]+}", app.HandleUpdateIdentityProvider).Methods("PUT").Name(opAdminApplications)
+	adminIdPs.HandleFunc("/{id:[0-9]+}", app.HandleDeleteIdentityProvider).Methods("DELETE").Name(opAdminApplications)
+
+	// Admin endpoints (SAML connections)
+	adminSAML := adminGroup("/saml-connections", scopeAdminApplications)
+	adminSAML.HandleFunc("", app.HandleCreateSAMLConnection).Methods("POST").Name(opAdminApplications)
+	adminSAML.HandleFunc("", app.HandleListSAMLConnections).Methods("GET").Name(opAdminApplications)
+	adminSAML.HandleFunc("/{id:[0-9]+}", app.HandleGetSAMLConnection).Methods("GET").Name(opAdminApplications)
+	adminSAML.HandleFunc("/{id:[0-9]+}", app.HandleUpdateSAMLConnection).Methods("PUT").Name(opAdminApplications)
+	adminSAML.HandleFunc("/{id:[0-9]+}", app.HandleDeleteSAMLConnection).Methods("DELETE").Name(opAdminApplications)
+
+	// Admin endpoints (audit log)
+	adminAudit := adminGroup("/audit-events", scopeAdminApplications)
+	adminAudit.HandleFunc("", app.HandleListAuditEvents).Methods("GET").Name(opAdminApplications)
+
+	// Admin endpoints (for managing scopes, roles and role assignments)
+	adminScopeRoutes := adminGroup("/scopes", scopeAdminUsers)
+	adminScopeRoutes.HandleFunc("", app.HandleListScopes).Methods("GET").Name(opAdminUsers)
+	adminScopeRoutes.HandleFunc("", app.HandleCreateScope).Methods("POST").Name(opAdminUsers)
+	adminRoles := adminGroup("/roles", scopeAdminUsers)
+	adminRoles.HandleFunc("", app.HandleListRoles).Methods("GET").Name(opAdminUsers)
+	adminRoles.HandleFunc("", app.HandleCreateRole).Methods("POST").Name(opAdminUsers)
+	adminRoles.HandleFunc("/{id:[0-9]+}", app.HandleGetRole).Methods("GET").Name(opAdminUsers)
+	adminRoles.HandleFunc("/{id:[0-9]+}", app.HandleDeleteRole).Methods("DELETE").Name(opAdminUsers)
+	adminRoles.HandleFunc("/{id:[0-9]+}/scopes", app.HandleSetRoleScopes).Methods("PUT").Name(opAdminUsers)
+	adminUsers := adminGroup("/users", scopeAdminUsers)
+	adminUsers.HandleFunc("", app.HandleListUsers).Methods("GET").Name(opAdminUsers)
+	adminUsers.HandleFunc("/import", app.HandleImportUsers).Methods("POST").Name(opAdminUsers)
+	adminUsers.HandleFunc("/export", app.HandleExportUsers).Methods("GET").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}", app.HandleGetUser).Methods("GET").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}", app.HandleDeleteUser).Methods("DELETE").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/disable", app.HandleDisableUser).Methods("POST").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/enable", app.HandleEnableUser).Methods("POST").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/password-reset", app.HandleForceUserPasswordReset).Methods("POST").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/revoke-tokens", app.HandleRevokeUserTokens).Methods("POST").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/logins", app.HandleListUserLogins).Methods("GET").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/impersonate", app.HandleImpersonateUser).Methods("POST").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/roles", app.HandleListUserRoles).Methods("GET").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/roles", app.HandleAssignUserRole).Methods("POST").Name(opAdminUsers)
+	adminUsers.HandleFunc("/{id:[0-9]+}/roles/{roleId:[0-9]+}", app.HandleRemoveUserRole).Methods("DELETE").Name(opAdminUsers)
+
+	// SCIM 2.0 provisioning. Identity management systems send an API key of the application
+	// as a bearer token; resources are confined to that application.
+	scim := r.PathPrefix("/scim/v2").Subrouter()
+	scim.Use(app.APIKeyAuth)
+	scim.Use(app.RateLimit)
+	scim.Use(app.RequireOperation)
+	scim.HandleFunc("/ServiceProviderConfig", app.HandleSCIMServiceProviderConfig).Methods("GET").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Users", app.HandleSCIMListUsers).Methods("GET").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Users", app.HandleSCIMCreateUser).Methods("POST").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Users/{id}", app.HandleSCIMGetUser).Methods("GET").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Users/{id}", app.HandleSCIMReplaceUser).Methods("PUT").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Users/{id}", app.HandleSCIMPatchUser).Methods("PATCH").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Users/{id}", app.HandleSCIMDeleteUser).Methods("DELETE").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Groups", app.HandleSCIMListGroups).Methods("GET").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Groups", app.HandleSCIMCreateGroup).Methods("POST").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Groups/{id}", app.HandleSCIMGetGroup).Methods("GET").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Groups/{id}", app.HandleSCIMReplaceGroup).Methods("PUT").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Groups/{id}", app.HandleSCIMPatchGroup).Methods("PATCH").Name(opSCIMProvisioning)
+	scim.HandleFunc("/Groups/{id}", app.HandleSCIMDeleteGroup).Methods("DELETE").Name(opSCIMProvisioning)
 
 	// Legacy endpoints (backward compatibility, will be deprecated)
 	legacy := r.PathPrefix("/api/auth").Subrouter()
 	legacy.Use(app.APIKeyAuth)
 	legacy.Use(app.RateLimit)
-	legacy.HandleFunc("/register", app.HandleRegister).Methods("POST")
-	legacy.HandleFunc("/login", app.HandleLogin).Methods("POST")
-	legacy.HandleFunc("/refresh", app.HandleRefresh).Methods("POST")
-	legacy.HandleFunc("/logout", app.HandleLogout).Methods("POST")
-
-	srv := &http.Server{Handler: r, Addr: ":" + c.Port, ReadTimeout: 5 * time.Second, WriteTimeout: 10 * time.Second}
+	legacy.Use(app.RequireOperation)
+	legacy.HandleFunc("/register", app.HandleRegister).Methods("POST").Name(opAuthRegister)
+	legacy.HandleFunc("/login", app.HandleLogin).Methods("POST").Name(opAuthLogin)
+	legacy.HandleFunc("/refresh", app.HandleRefresh).Methods("POST").Name(opAuthRefresh)
+	legacy.HandleFunc("/logout", app.HandleLogout).Methods("POST").Name(opAuthLogout)
 
-	go func() {
-		fmt.Println("Starting Go server on", c.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
-		}
-	}()
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if closer, ok := app.DB.(interface{ close() error }); ok {
-		_ = closer.close()
-	}
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("shutdown failed:%+v", err)
-	}
-	fmt.Println("Server exited properly")
+	return r
 }
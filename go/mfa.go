@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TOTP parameters, the RFC 6238 defaults authenticator apps assume
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// totpSkew accepts codes from one period either side of the current one
+	totpSkew = 1
+)
+
+// mfaChallengeTTL is how long a password-verified login waits for its second factor
+const mfaChallengeTTL = 5 * time.Minute
+
+// Purposes of the short-lived tokens signed with signPurposeToken
+const (
+	purposeMFAChallenge   = "mfa_challenge"
+	purposeTOTPEnrollment = "totp_enrollment"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a random 160-bit secret in base32
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the code of a secret for one time step (RFC 4226 truncation)
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// verifyTOTP checks a code against the time steps around now and returns the step it
+// matched
+func verifyTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if secret == "" || len(code) != totpDigits {
+		return 0, false
+	}
+	step := now.Unix() / int64(totpPeriod/time.Second)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected, err := totpCode(secret, uint64(step+int64(i)))
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return step + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// acceptTOTP checks a user's code against secret and uses it up: a code is refused once
+// the user had a code from the same or a later time step accepted
+func (a *App) acceptTOTP(userID int64, secret, code string) (bool, error) {
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return a.DB.UseTOTPStep(userID, step)
+}
+
+// totpURI builds the otpauth:// URI authenticator apps enroll from, usually shown as a QR code
+func totpURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + q.Encode()
+}
+
+// purposeKey derives the signing key of one kind of purpose token from the JWT secret, so
+// these tokens are never accepted where an access token is expected, or for each other
+func purposeKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("purpose:" + purpose))
+	return mac.Sum(nil)
+}
+
+// signPurposeToken signs a short-lived token carrying state between two requests, such as
+// a login waiting for its second factor
+func signPurposeToken(purpose string, claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	claims["exp"] = time.Now().Add(ttl).Unix()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(purposeKey(purpose))
+}
+
+// parsePurposeToken verifies a token signed with signPurposeToken for the same purpose
+func parsePurposeToken(purpose, token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return purposeKey(purpose), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// claimInt64 reads an integer claim; JSON numbers decode as float64
+func claimInt64(claims jwt.MapClaims, name string) (int64, bool) {
+	v, ok := claims[name].(float64)
+	return int64(v), ok
+}
+
+// mfaChallenge is a password-verified login waiting for its second factor, or for the
+// code emailed after a high-risk login
+type mfaChallenge struct {
+	// ID makes the challenge single-use; it is recorded until ExpiresAt once answered
+	ID             string
+	ExpiresAt      int64
+	UserID         int64
+	ApplicationID  *int64
+	OrganizationID *int64
+	// LoginEventID is the login history entry completed once the challenge is answered
+	LoginEventID int64
+}
+
+// newMFAChallenge returns a challenge with a fresh ID
+func newMFAChallenge(c mfaChallenge) (mfaChallenge, error) {
+	id, err := genToken(16)
+	if err != nil {
+		return c, err
+	}
+	c.ID = id
+	return c, nil
+}
+
+// claims are the token claims that identify the challenge
+func (c mfaChallenge) claims() jwt.MapClaims {
+	claims := jwt.MapClaims{"jti": c.ID, "userId": c.UserID}
+	if c.ApplicationID != nil {
+		claims["appId"] = *c.ApplicationID
+	}
+	if c.OrganizationID != nil {
+		claims["org_id"] = *c.OrganizationID
+	}
+	if c.LoginEventID != 0 {
+		claims["loginEvent"] = c.LoginEventID
+	}
+	return claims
+}
+
+// signMFAChallenge issues the token a client exchanges, together with a code, for tokens
+func signMFAChallenge(c mfaChallenge) (string, error) {
+	return signPurposeToken(purposeMFAChallenge, c.claims(), mfaChallengeTTL)
+}
+
+// parseMFAChallenge verifies an MFA challenge token and checks it was issued to app
+func parseMFAChallenge(token string, app *Application) (*mfaChallenge, error) {
+	claims, err := parsePurposeToken(purposeMFAChallenge, token)
+	if err != nil {
+		return nil, err
+	}
+	return challengeFromClaims(claims, app)
+}
+
+// challengeFromClaims reads a challenge token's claims and checks it was issued to app
+func challengeFromClaims(claims jwt.MapClaims, app *Application) (*mfaChallenge, error) {
+	c := &mfaChallenge{}
+	var ok bool
+	if c.ID, _ = claims["jti"].(string); c.ID == "" {
+		return nil, errors.New("missing challenge ID")
+	}
+	if c.UserID, ok = claimInt64(claims, "userId"); !ok {
+		return nil, errors.New("missing user")
+	}
+	c.ExpiresAt, _ = claimInt64(claims, "exp")
+	if appID, ok := claimInt64(claims, "appId"); ok {
+		c.ApplicationID = &appID
+	}
+	if orgID, ok := claimInt64(claims, "org_id"); ok {
+		c.OrganizationID = &orgID
+	}
+	c.LoginEventID, _ = claimInt64(claims, "loginEvent")
+	if (app == nil) != (c.ApplicationID == nil) || (app != nil && app.ID != *c.ApplicationID) {
+		return nil, errors.New("issued to another application")
+	}
+	return c, nil
+}
+
+// writeMFARequired answers a login whose password checked out but which still needs a code
+func writeMFARequired(w http.ResponseWriter, c mfaChallenge) {
+	c, err := newMFAChallenge(c)
+	var token string
+	if err == nil {
+		token, err = signMFAChallenge(c)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to start MFA challenge")
+		return
+	}
+	writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+		"error_code":    "MFA_REQUIRED",
+		"error_message": "A one-time code is required to complete the login",
+		"mfaToken":      token,
+	})
+}
+
+// HandleVerifyMFA completes a login that answered MFA_REQUIRED
+// POST /api/v1/auth/mfa/verify
+func (a *App) HandleVerifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MFAToken string `json:"mfaToken"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.MFAToken == "" || req.Code == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "mfaToken and code are required")
+		return
+	}
+	app := applicationFromRequest(r)
+	challenge, err := parseMFAChallenge(req.MFAToken, app)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "MFA token is invalid or expired")
+		return
+	}
+	user, _ := a.DB.GetUserByID(challenge.UserID)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "MFA token is invalid or expired")
+		return
+	}
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "USER_DISABLED", "User account is disabled")
+		return
+	}
+	if !a.checkRateLimitRules(w, r, "login", rateLimitIdentity{Email: user.Email}) {
+		return
+	}
+	accepted, err := a.acceptTOTP(user.ID, user.TOTPSecret, req.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to verify one-time code")
+		return
+	}
+	if !accepted {
+		writeError(w, http.StatusUnauthorized, "INVALID_MFA_CODE", "Invalid one-time code")
+		return
+	}
+	if !a.completeLogin(w, challenge) {
+		return
+	}
+
+	access, ref, err := a.issueTokens(tokenGrant{User: user, ApplicationID: challenge.ApplicationID, OrganizationID: challenge.OrganizationID, Login: newAuthentication(amrPassword, amrOTP)})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue tokens")
+		return
+	}
+	writeSession(w, r, http.StatusOK, app, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":    user.ID,
+			"email": user.Email,
+		},
+		"accessToken": access,
+	}, ref)
+}
+
+// HandleSetupTOTP starts enrolling the signed-in user's authenticator app. MFA is only
+// turned on once a code from the app is confirmed.
+// POST /api/v1/auth/mfa/totp/setup
+func (a *App) HandleSetupTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPSecret != "" {
+		writeError(w, http.StatusConflict, "MFA_ALREADY_ENABLED", "MFA is already enabled")
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to generate secret")
+		return
+	}
+	enrollment, err := signPurposeToken(purposeTOTPEnrollment, jwt.MapClaims{"userId": user.ID, "secret": secret}, 15*time.Minute)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to start enrollment")
+		return
+	}
+	issuer := "nileAuth"
+	if app := applicationFromRequest(r); app != nil {
+		issuer = app.Name
+	}
+	writeSuccess(w, http.StatusOK, map[string]interface{}{
+		"secret":          secret,
+		"otpauthUrl":      totpURI(issuer, user.Email, secret),
+		"enrollmentToken": enrollment,
+	})
+}
+
+// HandleConfirmTOTP turns on MFA once the user proves their app produces valid codes
+// POST /api/v1/auth/mfa/totp/confirm
+func (a *App) HandleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		EnrollmentToken string `json:"enrollmentToken"`
+		Code            string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	claims, err := parsePurposeToken(purposeTOTPEnrollment, req.EnrollmentToken)
+	if uid, _ := claimInt64(claims, "userId"); err != nil || uid != user.ID {
+		writeError(w, http.StatusBadRequest, "INVALID_TOKEN", "Enrollment token is invalid or expired")
+		return
+	}
+	secret, _ := claims["secret"].(string)
+	accepted, err := a.acceptTOTP(user.ID, secret, req.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to verify one-time code")
+		return
+	}
+	if !accepted {
+		writeError(w, http.StatusBadRequest, "INVALID_MFA_CODE", "Invalid one-time code")
+		return
+	}
+	if err := a.DB.SetUserTOTPSecret(user.ID, secret); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to enable MFA")
+		return
+	}
+	a.audit(r, auditMFAEnabled, &user.ID, nil)
+	writeSuccess(w, http.StatusOK, map[string]bool{"enabled": true})
+}
+
+// HandleDisableTOTP turns off MFA after checking a current code
+// POST /api/v1/auth/mfa/totp/disable
+func (a *App) HandleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	user, ok := a.authenticatedUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPSecret == "" {
+		writeError(w, http.StatusConflict, "MFA_NOT_ENABLED", "MFA is not enabled")
+		return
+	}
+	accepted, err := a.acceptTOTP(user.ID, user.TOTPSecret, req.Code)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to verify one-time code")
+		return
+	}
+	if !accepted {
+		writeError(w, http.StatusBadRequest, "INVALID_MFA_CODE", "Invalid one-time code")
+		return
+	}
+	if err := a.DB.SetUserTOTPSecret(user.ID, ""); err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to disable MFA")
+		return
+	}
+	a.audit(r, auditMFADisabled, &user.ID, nil)
+	writeSuccess(w, http.StatusOK, map[string]bool{"enabled": false})
+}
+
+// authenticatedUser returns the user whose access token is sent as an Authorization
+// bearer token next to an X-API-Key header. It reports false after writing an error.
+func (a *App) authenticatedUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	auth := r.Header.Get("Authorization")
+	if r.Header.Get("X-API-Key") == "" || !strings.HasPrefix(auth, "Bearer ") {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Access token required (send the API key in X-API-Key)")
+		return nil, false
+	}
+	token, err := jwt.Parse(strings.TrimPrefix(auth, "Bearer "), func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Token is invalid or expired")
+		return nil, false
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	userID, ok := claimInt64(claims, "userId")
+	if !ok || claimsNamespace(claims) != userNamespace(applicationFromRequest(r)) {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Token is invalid or expired")
+		return nil, false
+	}
+	// Support staff may look at an account they impersonate but not change it
+	if impersonationActor(claims) != nil && r.Method != http.MethodGet {
+		writeError(w, http.StatusForbidden, "IMPERSONATION_NOT_ALLOWED", "Impersonation tokens cannot change account settings")
+		return nil, false
+	}
+	user, err := a.DB.GetUserByID(userID)
+	if err != nil || user == nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Token is invalid or expired")
+		return nil, false
+	}
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "USER_DISABLED", "User account is disabled")
+		return nil, false
+	}
+	return user, true
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/time/rate"
 )
 
 // APIKeyAuth middleware validates API keys
@@ -23,133 +27,355 @@ func (a *App) APIKeyAuth(next http.Handler) http.Handler {
 			return
 		}
 
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey == "" {
-			// Try Authorization header: Bearer <api-key>
-			auth := r.Header.Get("Authorization")
-			if strings.HasPrefix(auth, "Bearer ") {
-				apiKey = strings.TrimPrefix(auth, "Bearer ")
-			}
-		}
-
+		apiKey := requestAPIKey(r)
 		if apiKey == "" {
 			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "API key required")
 			return
 		}
 
-		// Validate API key by checking against all applications
-		// In production, you'd want to optimize this with a cache or index
-		app := a.validateAPIKey(apiKey)
+		// Validate API key against the stored keys of all applications
+		app, key := a.resolveAPIKey(r, apiKey)
 		if app == nil || !app.Active {
 			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid API key")
 			return
 		}
+		if ip := a.clientIP(r); !applicationAllowsIP(app, ip) {
+			log.Printf("application %s blocked: request from %s outside its IP allowlist or in its denylist", app.APIKeyPrefix, ip)
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "Requests from this IP address are not allowed")
+			return
+		}
 
-		// Store application in context
+		// Store application and the key it authenticated with in context
 		ctx := context.WithValue(r.Context(), "application", app)
+		ctx = context.WithValue(ctx, "apiKey", key)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// validateAPIKey validates an API key by checking it against stored hashes
-func (a *App) validateAPIKey(apiKey string) *Application {
-	// Get prefix to narrow down candidates
-	prefix := getAPIKeyPrefix(apiKey)
+// requestAPIKey returns the API key sent in X-API-Key or as an Authorization bearer token
+func requestAPIKey(r *http.Request) string {
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		return apiKey
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
 
-	// Get applications by prefix
-	apps, err := a.DB.GetApplicationByAPIKeyPrefix(prefix)
-	if err != nil || len(apps) == 0 {
-		return nil
+// resolveAPIKey validates an API key, reusing the result of an earlier lookup made for the
+// same request by CORS
+func (a *App) resolveAPIKey(r *http.Request, apiKey string) (*Application, *APIKey) {
+	if resolved, ok := r.Context().Value("resolvedAPIKey").(*resolvedAPIKey); ok {
+		return resolved.app, resolved.key
 	}
+	return a.validateAPIKey(apiKey)
+}
+
+// resolvedAPIKey carries the outcome of a key lookup from CORS to APIKeyAuth
+type resolvedAPIKey struct {
+	app *Application
+	key *APIKey
+}
+
+// applicationFromRequest returns the application resolved by APIKeyAuth, if any
+func applicationFromRequest(r *http.Request) *Application {
+	app, _ := r.Context().Value("application").(*Application)
+	return app
+}
 
-	// Compare API key against each candidate using bcrypt
-	for _, app := range apps {
-		if err := bcrypt.CompareHashAndPassword([]byte(app.APIKeyHash), []byte(apiKey)); err == nil {
-			return app
+// apiKeyFromRequest returns the API key the request was authenticated with, if any
+func apiKeyFromRequest(r *http.Request) *APIKey {
+	key, _ := r.Context().Value("apiKey").(*APIKey)
+	return key
+}
+
+// apiKeyTouchInterval limits how often a key's last-used time is written back
+const apiKeyTouchInterval = time.Minute
+
+// validateAPIKey resolves an API key through its lookup hash and returns the matching
+// key together with its application
+func (a *App) validateAPIKey(apiKey string) (*Application, *APIKey) {
+	lookupHash := apiKeyLookupHash(apiKey)
+	key, err := a.DB.GetAPIKeyByLookupHash(lookupHash)
+	if err != nil {
+		return nil, nil
+	}
+	now := time.Now()
+	if key == nil {
+		// Keys stored without a lookup hash, or hashed under a previous pepper, are
+		// verified with bcrypt once and indexed for subsequent requests
+		key = a.findAPIKeyByPrefix(apiKey, now)
+		if key == nil {
+			return nil, nil
 		}
+		if err := a.DB.SetAPIKeyLookupHash(key.ID, lookupHash); err != nil {
+			log.Printf("api key %d: storing lookup hash: %v", key.ID, err)
+		}
+	}
+	if key.ExpiresAt != nil && !now.Before(*key.ExpiresAt) {
+		return nil, nil
 	}
 
-	return nil
+	app, err := a.DB.GetApplicationByID(key.ApplicationID)
+	if err != nil || app == nil {
+		return nil, nil
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := a.DB.TouchAPIKey(key.ID, now); err != nil {
+			log.Printf("api key %d: recording last use: %v", key.ID, err)
+		}
+	}
+	return app, key
 }
 
-// CORS middleware handles CORS headers
-func (a *App) CORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get application from context if available
-		var allowedOrigins []string
-		if app, ok := r.Context().Value("application").(*Application); ok && app != nil {
-			allowedOrigins = app.AllowedOrigins
+// findAPIKeyByPrefix compares an API key against the bcrypt hashes of the unexpired keys
+// sharing its prefix that are not indexed under the current pepper
+func (a *App) findAPIKeyByPrefix(apiKey string, now time.Time) *APIKey {
+	keys, err := a.DB.GetAPIKeysByPrefix(getAPIKeyPrefix(apiKey))
+	if err != nil {
+		return nil
+	}
+	indexed := apiKeyPepperFingerprint() + "$"
+	for _, key := range keys {
+		if strings.HasPrefix(key.LookupHash, indexed) || (key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)) {
+			continue
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(key.KeyHash), []byte(apiKey)); err == nil {
+			return key
 		}
+	}
+	return nil
+}
 
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			// Check if origin is allowed
-			allowed := false
-			for _, o := range allowedOrigins {
-				if o == origin || o == "*" {
-					allowed = true
-					break
-				}
+// Application scopes guarding the admin API
+const (
+	scopeAdminApplications = "admin:applications"
+	scopeAdminUsers        = "admin:users"
+)
+
+// RequireScope middleware rejects applications that were not granted the given scope.
+// It must run after APIKeyAuth.
+func (a *App) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			app := applicationFromRequest(r)
+			if app == nil {
+				writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "API key required")
+				return
 			}
-			if allowed || len(allowedOrigins) == 0 {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
+			ok, err := a.applicationHasScope(app.ID, scope)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to load application scopes")
+				return
 			}
+			if !ok {
+				log.Printf("application %s denied: missing scope %s", app.APIKeyPrefix, scope)
+				writeError(w, http.StatusForbidden, "FORBIDDEN", "Application is missing the "+scope+" scope")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// applicationHasScope reports whether an application was granted a scope
+func (a *App) applicationHasScope(appID int64, scope string) (bool, error) {
+	scopes, err := a.DB.GetScopesByApplicationID(appID)
+	if err != nil {
+		return false, err
+	}
+	for _, s := range scopes {
+		if s.Name == scope {
+			return true, nil
 		}
+	}
+	return false, nil
+}
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Max-Age", "3600")
+// Operations an API key can be restricted to. Routes carry their operation as the mux
+// route name; "<group>:*" grants every operation of a group and "*" grants all of them.
+const (
+	opAuthRegister         = "auth:register"
+	opAuthLogin            = "auth:login"
+	opAuthRefresh          = "auth:refresh"
+	opAuthLogout           = "auth:logout"
+	opAuthPasswordReset    = "auth:password_reset"
+	opAuthMFA              = "auth:mfa"
+	opAuthConsents         = "auth:consents"
+	opAuthIdentities       = "auth:identities"
+	opTokensValidate       = "tokens:validate"
+	opTokensIntrospect     = "tokens:introspect"
+	opTokensRevoke         = "tokens:revoke"
+	opOrganizationsRead    = "organizations:read"
+	opOrganizationsWrite   = "organizations:write"
+	opOrganizationsJoin    = "organizations:join"
+	opUsersPermissions     = "users:permissions"
+	opAdminApplications    = "admin:applications"
+	opAdminUsers           = "admin:users"
+	opSCIMProvisioning     = "scim:provisioning"
+	operationWildcard      = "*"
+	operationGroupWildcard = ":*"
+)
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+var knownOperations = []string{
+	opAuthRegister, opAuthLogin, opAuthRefresh, opAuthLogout, opAuthPasswordReset, opAuthMFA, opAuthConsents, opAuthIdentities,
+	opTokensValidate, opTokensIntrospect, opTokensRevoke,
+	opOrganizationsRead, opOrganizationsWrite, opOrganizationsJoin,
+	opUsersPermissions,
+	opAdminApplications, opAdminUsers,
+	opSCIMProvisioning,
+}
 
-		next.ServeHTTP(w, r)
-	})
+// validateOperations normalizes a list of allowed operations, rejecting unknown names
+func validateOperations(ops []string) ([]string, error) {
+	out := make([]string, 0, len(ops))
+	seen := map[string]bool{}
+	for _, op := range ops {
+		op = strings.TrimSpace(op)
+		if op == "" || seen[op] {
+			continue
+		}
+		if !isKnownOperation(op) {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+		seen[op] = true
+		out = append(out, op)
+	}
+	return out, nil
 }
 
-// RateLimiter implements per-application rate limiting
-type RateLimiter struct {
-	limiters map[int64]*rate.Limiter
-	mu       sync.RWMutex
+func isKnownOperation(op string) bool {
+	if op == operationWildcard {
+		return true
+	}
+	for _, known := range knownOperations {
+		if op == known {
+			return true
+		}
+		if group := strings.TrimSuffix(op, operationGroupWildcard); group != op && strings.HasPrefix(known, group+":") {
+			return true
+		}
+	}
+	return false
 }
 
-func NewRateLimiter() *RateLimiter {
-	return &RateLimiter{
-		limiters: make(map[int64]*rate.Limiter),
+// apiKeyAllowsOperation reports whether a key may call an operation. Keys without any
+// operations are unrestricted.
+func apiKeyAllowsOperation(key *APIKey, op string) bool {
+	if len(key.Operations) == 0 {
+		return true
+	}
+	if op == "" {
+		return false
+	}
+	group := op
+	if i := strings.Index(op, ":"); i >= 0 {
+		group = op[:i]
+	}
+	for _, allowed := range key.Operations {
+		if allowed == operationWildcard || allowed == op || allowed == group+operationGroupWildcard {
+			return true
+		}
 	}
+	return false
 }
 
-func (rl *RateLimiter) getLimiter(appID int64, limitPerMinute int) *rate.Limiter {
-	rl.mu.RLock()
-	limiter, exists := rl.limiters[appID]
-	rl.mu.RUnlock()
+// RequireOperation middleware rejects calls to routes outside the operations the API key
+// was restricted to. It must run after APIKeyAuth on a router whose routes are named
+// after their operation; unnamed routes are only reachable with unrestricted keys.
+func (a *App) RequireOperation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromRequest(r)
+		if key == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var op string
+		if route := mux.CurrentRoute(r); route != nil {
+			op = route.GetName()
+		}
+		if !apiKeyAllowsOperation(key, op) {
+			log.Printf("api key %s denied: operation %q not allowed", key.KeyPrefix, op)
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "API key is not allowed to call this endpoint")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	if !exists {
-		rl.mu.Lock()
-		// Double-check after acquiring write lock
-		limiter, exists = rl.limiters[appID]
-		if !exists {
-			limiter = rate.NewLimiter(rate.Limit(limitPerMinute)/60, limitPerMinute)
-			rl.limiters[appID] = limiter
+// CORS wraps the router so preflight requests are answered before route matching. Browser
+// origins are checked against the allowed origins of the application owning the API key,
+// and origins that no application allows are rejected instead of echoed back.
+func (a *App) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(r, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		var app *Application
+		if apiKey := requestAPIKey(r); apiKey != "" {
+			var key *APIKey
+			app, key = a.validateAPIKey(apiKey)
+			// Hand the lookup to APIKeyAuth so the key is not resolved twice
+			r = r.WithContext(context.WithValue(r.Context(), "resolvedAPIKey", &resolvedAPIKey{app: app, key: key}))
+			if app != nil && !app.Active {
+				app = nil
+			}
+		}
+
+		var pattern string
+		allowed := false
+		switch {
+		case app != nil:
+			pattern, allowed = matchOrigin(app, origin)
+		case preflight:
+			allowed = a.anyApplicationAllowsOrigin(origin)
+		default:
+			// Requests without a valid API key are turned away by APIKeyAuth
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			log.Printf("origin %s rejected for %s %s", origin, r.Method, r.URL.Path)
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "Origin not allowed")
+			return
 		}
-		rl.mu.Unlock()
-	}
 
-	return limiter
+		if pattern == originWildcard {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, "+csrfHeaderName)
+			w.Header().Set("Access-Control-Max-Age", "3600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether a browser origin is the host serving the request, which needs
+// no CORS headers
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
 }
 
 // RateLimit middleware enforces rate limits per application
 func (a *App) RateLimit(next http.Handler) http.Handler {
-	if a.rateLimiter == nil {
-		a.rateLimiter = NewRateLimiter()
-	}
-
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip rate limiting for health/ready endpoints
-		if strings.HasPrefix(r.URL.Path, "/health") || strings.HasPrefix(r.URL.Path, "/ready") {
+		// Skip rate limiting for health/ready endpoints, and everything when no limiter is configured
+		if a.rateLimiter == nil || strings.HasPrefix(r.URL.Path, "/health") || strings.HasPrefix(r.URL.Path, "/ready") {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -161,8 +387,16 @@ func (a *App) RateLimit(next http.Handler) http.Handler {
 			return
 		}
 
-		limiter := a.rateLimiter.getLimiter(app.ID, app.RateLimitPerMinute)
-		if !limiter.Allow() {
+		// The application is loaded on every request, so changed limits apply immediately
+		result, err := a.rateLimiter.Allow(r.Context(), fmt.Sprintf("app:%d", app.ID), app.RateLimitPerMinute, time.Minute)
+		if err != nil {
+			// Fail open: an unavailable limiter backend must not take authentication down
+			log.Printf("rate limiter: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		setRateLimitHeaders(w, result)
+		if !result.Allowed {
 			writeError(w, http.StatusTooManyRequests, "RATE_LIMIT_EXCEEDED", "Rate limit exceeded")
 			return
 		}
@@ -171,6 +405,29 @@ func (a *App) RateLimit(next http.Handler) http.Handler {
 	})
 }
 
+// setRateLimitHeaders reports the remaining budget using the IETF RateLimit header fields,
+// adding Retry-After when the request was rejected
+func setRateLimitHeaders(w http.ResponseWriter, result RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		retryAfter := ceilSeconds(result.RetryAfter)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
 // Logging middleware logs requests
 func (a *App) Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -224,6 +481,30 @@ func hashAPIKey(apiKey string) (string, error) {
 	return string(hash), err
 }
 
+// apiKeyLookupHash returns the keyed SHA-256 used to look an API key up by index.
+// It is prefixed with the pepper fingerprint so hashes made under an earlier pepper
+// can be told apart and re-verified with bcrypt.
+func apiKeyLookupHash(apiKey string) string {
+	mac := hmac.New(sha256.New, apiKeyPepper)
+	mac.Write([]byte(apiKey))
+	return apiKeyPepperFingerprint() + "$" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func apiKeyPepperFingerprint() string {
+	mac := hmac.New(sha256.New, apiKeyPepper)
+	mac.Write([]byte("nileauth-api-key-pepper"))
+	return hex.EncodeToString(mac.Sum(nil))[:8]
+}
+
+// newAPIKeyRecord hashes a plaintext API key for storage
+func newAPIKeyRecord(apiKey, label string) (*APIKey, error) {
+	hash, err := hashAPIKey(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return &APIKey{Label: label, KeyHash: hash, LookupHash: apiKeyLookupHash(apiKey), KeyPrefix: getAPIKeyPrefix(apiKey)}, nil
+}
+
 func getAPIKeyPrefix(apiKey string) string {
 	if len(apiKey) >= 8 {
 		return apiKey[:8]
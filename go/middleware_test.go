@@ -0,0 +1,366 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// newAPIKeyTestApp creates an application holding the given plaintext keys. Unindexed keys
+// are stored without a lookup hash, like keys created before lookup hashes existed.
+func newAPIKeyTestApp(tb testing.TB, indexed bool, plainKeys ...string) *App {
+	tb.Helper()
+	db := NewMemoryDB()
+	var app *Application
+	for i, plain := range plainKeys {
+		key, err := newAPIKeyRecord(plain, "test")
+		require.NoError(tb, err)
+		if !indexed {
+			key.LookupHash = ""
+		}
+		if i == 0 {
+			app, err = db.CreateApplication("bench", "bench.example.com", key, 100, nil, false)
+		} else {
+			key.ApplicationID = app.ID
+			err = db.CreateAPIKey(key)
+		}
+		require.NoError(tb, err)
+	}
+	return &App{DB: db, RiskMediumScore: 30, RiskHighScore: 60}
+}
+
+func TestValidateAPIKeyIndexesLegacyKeys(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, false, plain)
+
+	app, key := a.validateAPIKey(plain)
+	require.NotNil(t, app)
+	require.NotNil(t, key)
+
+	keys, err := a.DB.ListAPIKeys(app.ID)
+	require.NoError(t, err)
+	require.Equal(t, apiKeyLookupHash(plain), keys[0].LookupHash)
+
+	// same prefix, different key
+	wrong := plain[:8] + plain[9:] + "0"
+	app, _ = a.validateAPIKey(wrong)
+	require.Nil(t, app)
+
+	require.NoError(t, a.DB.RevokeAPIKey(key.ApplicationID, key.ID))
+	app, _ = a.validateAPIKey(plain)
+	require.Nil(t, app)
+}
+
+func TestValidateAPIKeyRejectsExpiredKeys(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, key := a.validateAPIKey(plain)
+	require.NotNil(t, app)
+
+	next, _, err := newAPIKey(app.ID, "next")
+	require.NoError(t, err)
+	require.NoError(t, a.DB.RotateAPIKeys(next, time.Now().Add(-time.Second)))
+	app, _ = a.validateAPIKey(plain)
+	require.Nil(t, app)
+	keys, err := a.DB.ListAPIKeys(key.ApplicationID)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+}
+
+// BenchmarkValidateAPIKey compares the bcrypt prefix scan used before lookup hashes
+// with the indexed lookup, including the case of several keys sharing a prefix.
+func BenchmarkValidateAPIKey(b *testing.B) {
+	colliding := func(n int) []string {
+		keys := make([]string, n)
+		for i := range keys {
+			k, err := generateAPIKey()
+			require.NoError(b, err)
+			keys[i] = "deadbeef" + k[8:]
+		}
+		return keys
+	}
+
+	for _, tc := range []struct {
+		name string
+		keys []string
+	}{
+		{"single", colliding(1)},
+		{"4-colliding-prefixes", colliding(4)},
+	} {
+		// the last key is the worst case for the prefix scan
+		plain := tc.keys[len(tc.keys)-1]
+
+		b.Run("bcrypt/"+tc.name, func(b *testing.B) {
+			a := newAPIKeyTestApp(b, false, tc.keys...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if a.findAPIKeyByPrefix(plain, time.Now()) == nil {
+					b.Fatal("key not found")
+				}
+			}
+		})
+
+		b.Run("lookup-hash/"+tc.name, func(b *testing.B) {
+			a := newAPIKeyTestApp(b, true, tc.keys...)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if app, _ := a.validateAPIKey(plain); app == nil {
+					b.Fatal("key not found")
+				}
+			}
+		})
+	}
+}
+
+func TestRequireOperationRestrictsScopedKeys(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	_, key := a.validateAPIKey(plain)
+	require.NotNil(t, key)
+
+	r := mux.NewRouter()
+	v1 := r.PathPrefix("/api/v1").Subrouter()
+	v1.Use(a.APIKeyAuth)
+	v1.Use(a.RequireOperation)
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	v1.HandleFunc("/auth/login", ok).Methods("POST").Name(opAuthLogin)
+	v1.HandleFunc("/auth/introspect", ok).Methods("POST").Name(opTokensIntrospect)
+	v1.HandleFunc("/admin/applications", ok).Methods("GET").Name(opAdminApplications)
+	v1.HandleFunc("/unnamed", ok).Methods("GET")
+
+	call := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// keys without operations are unrestricted
+	require.Equal(t, http.StatusNoContent, call("POST", "/api/v1/auth/introspect"))
+	require.Equal(t, http.StatusNoContent, call("GET", "/api/v1/unnamed"))
+
+	require.NoError(t, a.DB.SetAPIKeyOperations(key.ApplicationID, key.ID, []string{opAuthLogin, "admin:*"}))
+	require.Equal(t, http.StatusNoContent, call("POST", "/api/v1/auth/login"))
+	require.Equal(t, http.StatusNoContent, call("GET", "/api/v1/admin/applications"))
+	require.Equal(t, http.StatusForbidden, call("POST", "/api/v1/auth/introspect"))
+	require.Equal(t, http.StatusForbidden, call("GET", "/api/v1/unnamed"))
+}
+
+func TestValidateOperations(t *testing.T) {
+	ops, err := validateOperations([]string{" auth:login ", "tokens:*", "auth:login", "*"})
+	require.NoError(t, err)
+	require.Equal(t, []string{opAuthLogin, "tokens:*", "*"}, ops)
+
+	for _, bad := range []string{"auth:everything", "billing:*", "admin"} {
+		_, err := validateOperations([]string{bad})
+		require.Error(t, err, bad)
+	}
+}
+
+func TestClientIPHonorsTrustedProxiesOnly(t *testing.T) {
+	a := &App{TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		{"203.0.113.9:5000", "198.51.100.1", "203.0.113.9"},
+		{"10.0.0.2:5000", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.2:5000", "1.1.1.1, 198.51.100.1, 10.0.0.3", "198.51.100.1"},
+		{"10.0.0.2:5000", "", "10.0.0.2"},
+		{"[::ffff:10.0.0.2]:5000", "2001:db8::1", "2001:db8::1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		require.Equal(t, tc.want, a.clientIP(req).String(), tc.remote+" "+tc.xff)
+	}
+}
+
+func TestAPIKeyAuthEnforcesIPLists(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	require.NotNil(t, app)
+	app.IPAllowlist = []string{"192.0.2.0/24"}
+	app.IPDenylist = []string{"192.0.2.66/32"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+
+	handler := a.APIKeyAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	call := func(remote string) int {
+		req := httptest.NewRequest("GET", "/api/v1/auth/validate", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(t, http.StatusNoContent, call("192.0.2.10:4000"))
+	require.Equal(t, http.StatusForbidden, call("192.0.2.66:4000"))
+	require.Equal(t, http.StatusForbidden, call("198.51.100.7:4000"))
+}
+
+func TestOriginPatterns(t *testing.T) {
+	origins, err := normalizeOriginList([]string{"https://App.Example.com/", "https://*.example.com", "*", " "})
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://app.example.com", "https://*.example.com", "*"}, origins)
+	for _, bad := range []string{"app.example.com", "ftp://example.com", "https://example.com/path", "https://*.com", "https://a.*.example.com", "https://*"} {
+		_, err := normalizeOriginList([]string{bad})
+		require.Error(t, err, bad)
+	}
+
+	require.True(t, originMatches("https://*.example.com", "https://app.example.com"))
+	require.True(t, originMatches("https://*.example.com", "https://a.b.example.com"))
+	require.False(t, originMatches("https://*.example.com", "https://example.com"))
+	require.False(t, originMatches("https://*.example.com", "http://app.example.com"))
+	require.False(t, originMatches("https://*.example.com", "https://app.example.com.evil.net"))
+	require.False(t, originMatches("https://*.example.com", "https://evilexample.com"))
+	require.False(t, originMatches("https://*.example.com", "https://app.example.com:8443"))
+	require.True(t, originMatches("https://*.example.com:8443", "https://app.example.com:8443"))
+}
+
+func TestCORSChecksOriginsOfKeyApplication(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	require.NotNil(t, app)
+	app.AllowedOrigins = []string{"https://*.example.com"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+
+	handler := a.CORS(a.APIKeyAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+	call := func(method, origin string, withKey bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/auth/validate", nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		if withKey {
+			req.Header.Set("X-API-Key", plain)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := call(http.MethodOptions, "https://app.example.com", false)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, http.StatusForbidden, call(http.MethodOptions, "https://evil.net", false).Code)
+
+	rec = call(http.MethodGet, "https://app.example.com", true)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+
+	rec = call(http.MethodGet, "https://evil.net", true)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// Another application's origins do not carry over to this key
+	_, err = a.DB.CreateApplication("other", "evil.net", &APIKey{KeyHash: "x", KeyPrefix: "x"}, 100, []string{"https://evil.net"}, false)
+	require.NoError(t, err)
+	a.preflightOrigins.invalidate()
+	require.Equal(t, http.StatusNoContent, call(http.MethodOptions, "https://evil.net", false).Code)
+	require.Equal(t, http.StatusForbidden, call(http.MethodGet, "https://evil.net", true).Code)
+}
+
+// listCountingDB counts the reads of the application list
+type listCountingDB struct {
+	DB
+	lists int
+}
+
+func (d *listCountingDB) ListApplications(filter ApplicationFilter) ([]*Application, int, error) {
+	d.lists++
+	return d.DB.ListApplications(filter)
+}
+
+func TestPreflightOriginsAreCached(t *testing.T) {
+	a, r, rootKey := newAdminTestApp(t)
+	db := &listCountingDB{DB: a.DB}
+	a.DB = db
+	cors := a.CORS(http.NotFoundHandler())
+	preflight := func(origin string) int {
+		req := httptest.NewRequest(http.MethodOptions, "/api/v1/auth/validate", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rec := httptest.NewRecorder()
+		cors.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusForbidden, preflight("https://shop.example.com"))
+	}
+	require.Equal(t, 1, db.lists)
+
+	// changes made through the admin API apply to the next preflight
+	shop, _ := addTestApplication(t, a, "shop", false)
+	status, _ := adminCall(t, r, rootKey, "PUT", "/api/v1/admin/applications/"+strconv.FormatInt(shop.ID, 10), `{"allowed_origins":["https://shop.example.com"]}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusNoContent, preflight("https://shop.example.com"))
+	status, _ = adminCall(t, r, rootKey, "POST", "/api/v1/admin/applications/"+strconv.FormatInt(shop.ID, 10)+"/deactivate", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusForbidden, preflight("https://shop.example.com"))
+}
+
+func TestAdminGroupsRequireAdminScopes(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	usersAdmin, usersKey := addTestApplication(t, a, "support", false)
+	scope, err := a.DB.GetScopeByName(scopeAdminUsers)
+	require.NoError(t, err)
+	require.NoError(t, a.DB.SetApplicationScopes(usersAdmin.ID, []int64{scope.ID}))
+	// bootstrapping an existing application grants it every admin scope
+	_, rootKey := addTestApplication(t, a, "root", false)
+	_, _, err = bootstrapAdminApplication(a.DB, "root", "root.example.com", rootKey)
+	require.NoError(t, err)
+	r := newRouter(a)
+
+	groups := map[string]string{
+		"/api/v1/admin/applications":       scopeAdminApplications,
+		"/api/v1/admin/identity-providers": scopeAdminApplications,
+		"/api/v1/admin/saml-connections":   scopeAdminApplications,
+		"/api/v1/admin/audit-events":       scopeAdminApplications,
+		"/api/v1/admin/scopes":             scopeAdminUsers,
+		"/api/v1/admin/roles":              scopeAdminUsers,
+		"/api/v1/admin/users":              scopeAdminUsers,
+	}
+	get := func(key, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for path, scope := range groups {
+		require.Equal(t, http.StatusUnauthorized, get("", path), path)
+		// any valid key is not enough
+		require.Equal(t, http.StatusForbidden, get(plain, path), path)
+		want := http.StatusForbidden
+		if scope == scopeAdminUsers {
+			want = http.StatusOK
+		}
+		require.Equal(t, want, get(usersKey, path), path)
+		require.Equal(t, http.StatusOK, get(rootKey, path), path)
+	}
+}
@@ -0,0 +1,10 @@
+-- Fixed-window request counters backing the shared sliding-window rate limiter
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+  key TEXT NOT NULL,
+  window_start TIMESTAMPTZ NOT NULL,
+  count INTEGER NOT NULL DEFAULT 0,
+  expires_at TIMESTAMPTZ NOT NULL,
+  PRIMARY KEY (key, window_start)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_counters_expires_at ON rate_limit_counters(expires_at);
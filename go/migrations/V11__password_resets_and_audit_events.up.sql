@@ -0,0 +1,24 @@
+-- Single-use password reset tokens, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS password_resets (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  expires_at BIGINT NOT NULL,
+  used_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- Audit log of security-relevant events. No foreign keys: entries outlive the
+-- applications and users they refer to.
+CREATE TABLE IF NOT EXISTS audit_events (
+  id BIGSERIAL PRIMARY KEY,
+  application_id INTEGER,
+  user_id INTEGER,
+  action TEXT NOT NULL,
+  ip TEXT NOT NULL DEFAULT '',
+  details JSONB,
+  created_at TIMESTAMPTZ DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_application_id ON audit_events(application_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action);
@@ -0,0 +1,2 @@
+-- SameSite mode of the refresh token cookie; empty keeps refresh tokens in response bodies
+ALTER TABLE applications ADD COLUMN IF NOT EXISTS session_cookie TEXT NOT NULL DEFAULT '';
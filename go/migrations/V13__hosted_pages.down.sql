@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS authorization_codes;
+ALTER TABLE applications DROP COLUMN IF EXISTS branding;
+ALTER TABLE users DROP COLUMN IF EXISTS totp_secret;
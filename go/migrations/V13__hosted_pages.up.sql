@@ -0,0 +1,19 @@
+-- Authenticator app secret; empty while MFA is off
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT '';
+
+-- Logo, colors and copy of the application's hosted pages
+ALTER TABLE applications ADD COLUMN IF NOT EXISTS branding JSONB;
+
+-- Single-use codes the hosted pages redirect back with, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS authorization_codes (
+  id BIGSERIAL PRIMARY KEY,
+  code_hash TEXT UNIQUE NOT NULL,
+  application_id INTEGER NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  redirect_uri TEXT NOT NULL,
+  scopes TEXT[],
+  code_challenge TEXT NOT NULL DEFAULT '',
+  expires_at BIGINT NOT NULL,
+  used_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ DEFAULT now()
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS consents;
+ALTER TABLE applications DROP COLUMN IF EXISTS client_type;
+ALTER TABLE applications DROP COLUMN IF EXISTS redirect_uris;
@@ -0,0 +1,13 @@
+-- Exact redirect URIs the hosted pages may return to, and whether the client can keep a secret
+ALTER TABLE applications ADD COLUMN IF NOT EXISTS redirect_uris TEXT[];
+ALTER TABLE applications ADD COLUMN IF NOT EXISTS client_type TEXT NOT NULL DEFAULT 'confidential';
+
+-- Scopes each user approved for an application on the consent page
+CREATE TABLE IF NOT EXISTS consents (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  application_id INTEGER NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+  scopes TEXT[],
+  created_at TIMESTAMPTZ DEFAULT now(),
+  updated_at TIMESTAMPTZ DEFAULT now(),
+  PRIMARY KEY (user_id, application_id)
+);
@@ -0,0 +1,27 @@
+-- Upstream OpenID Connect providers users can sign in with, globally or for one application
+CREATE TABLE IF NOT EXISTS identity_providers (
+  id SERIAL PRIMARY KEY,
+  application_id INTEGER REFERENCES applications(id) ON DELETE CASCADE,
+  name TEXT UNIQUE NOT NULL,
+  display_name TEXT NOT NULL DEFAULT '',
+  issuer TEXT NOT NULL,
+  client_id TEXT NOT NULL,
+  client_secret TEXT NOT NULL DEFAULT '',
+  scopes TEXT[],
+  claim_mapping JSONB,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMPTZ DEFAULT now(),
+  updated_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- Upstream accounts linked to local users, keyed by the provider's subject
+CREATE TABLE IF NOT EXISTS user_identities (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  provider_id INTEGER NOT NULL REFERENCES identity_providers(id) ON DELETE CASCADE,
+  subject TEXT NOT NULL,
+  email TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMPTZ DEFAULT now(),
+  UNIQUE (provider_id, subject)
+);
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
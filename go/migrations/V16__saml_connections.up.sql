@@ -0,0 +1,34 @@
+-- SAML 2.0 identity providers of an application or one of its organizations
+CREATE TABLE IF NOT EXISTS saml_connections (
+  id SERIAL PRIMARY KEY,
+  application_id INTEGER NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+  organization_id INTEGER REFERENCES organizations(id) ON DELETE CASCADE,
+  name TEXT UNIQUE NOT NULL,
+  idp_entity_id TEXT NOT NULL,
+  idp_sso_url TEXT NOT NULL,
+  idp_certificate TEXT NOT NULL,
+  email_attribute TEXT NOT NULL DEFAULT '',
+  domains TEXT[],
+  sp_private_key TEXT NOT NULL,
+  sp_certificate TEXT NOT NULL,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMPTZ DEFAULT now(),
+  updated_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- AuthnRequests waiting for the identity provider's response
+CREATE TABLE IF NOT EXISTS saml_requests (
+  id TEXT PRIMARY KEY,
+  connection_id INTEGER NOT NULL REFERENCES saml_connections(id) ON DELETE CASCADE,
+  request TEXT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  created_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- Accepted assertion IDs, kept until the assertions expire to reject replays
+CREATE TABLE IF NOT EXISTS saml_assertions (
+  connection_id INTEGER NOT NULL REFERENCES saml_connections(id) ON DELETE CASCADE,
+  assertion_id TEXT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  PRIMARY KEY (connection_id, assertion_id)
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS directory_accounts;
+DROP TABLE IF EXISTS ldap_directories;
@@ -0,0 +1,26 @@
+-- LDAP directories applications check passwords against
+CREATE TABLE IF NOT EXISTS ldap_directories (
+  application_id INTEGER PRIMARY KEY REFERENCES applications(id) ON DELETE CASCADE,
+  url TEXT NOT NULL,
+  start_tls BOOLEAN NOT NULL DEFAULT FALSE,
+  ca_certificate TEXT NOT NULL DEFAULT '',
+  bind_dn TEXT NOT NULL DEFAULT '',
+  bind_password TEXT NOT NULL DEFAULT '',
+  search_base TEXT NOT NULL,
+  search_filter TEXT NOT NULL,
+  attribute_mapping JSONB,
+  active BOOLEAN NOT NULL DEFAULT TRUE,
+  created_at TIMESTAMPTZ DEFAULT now(),
+  updated_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- Shadow users of directory entries, with the claims mapped at their last login
+CREATE TABLE IF NOT EXISTS directory_accounts (
+  application_id INTEGER NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  dn TEXT NOT NULL,
+  claims JSONB,
+  updated_at TIMESTAMPTZ DEFAULT now(),
+  PRIMARY KEY (application_id, dn),
+  UNIQUE (application_id, user_id)
+);
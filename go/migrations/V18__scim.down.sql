@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS scim_resources;
+ALTER TABLE users DROP COLUMN IF EXISTS disabled;
@@ -0,0 +1,17 @@
+-- Disabled users cannot sign in or refresh their sessions
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Users and organizations managed by an application's SCIM client. resource_id points
+-- at users(id) or organizations(id) depending on resource_type.
+CREATE TABLE IF NOT EXISTS scim_resources (
+  application_id INTEGER NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+  resource_type TEXT NOT NULL,
+  resource_id INTEGER NOT NULL,
+  external_id TEXT NOT NULL DEFAULT '',
+  attributes JSONB,
+  created_at TIMESTAMPTZ DEFAULT now(),
+  updated_at TIMESTAMPTZ DEFAULT now(),
+  PRIMARY KEY (application_id, resource_type, resource_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_scim_resources_external_id ON scim_resources(application_id, resource_type, external_id) WHERE external_id <> '';
@@ -0,0 +1,4 @@
+ALTER TABLE authorization_codes DROP COLUMN IF EXISTS amr;
+ALTER TABLE authorization_codes DROP COLUMN IF EXISTS auth_time;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS amr;
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS auth_time;
@@ -0,0 +1,8 @@
+-- When and how the user authenticated, kept with sessions and authorization codes so
+-- refreshed and exchanged access tokens report the original login. auth_time is a unix
+-- timestamp, 0 for sessions started before it was recorded.
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS auth_time BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS amr TEXT[];
+
+ALTER TABLE authorization_codes ADD COLUMN IF NOT EXISTS auth_time BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE authorization_codes ADD COLUMN IF NOT EXISTS amr TEXT[];
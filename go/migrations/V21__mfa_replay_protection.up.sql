@@ -0,0 +1,9 @@
+-- One-time codes and MFA challenges can only be used once. totp_last_step is the time
+-- step of the user's last accepted TOTP code; codes from that step or earlier are refused.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- Answered MFA and login confirmation challenges, kept until their tokens expire
+CREATE TABLE IF NOT EXISTS mfa_challenges (
+  id TEXT PRIMARY KEY,
+  expires_at BIGINT NOT NULL
+);
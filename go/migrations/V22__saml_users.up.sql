@@ -0,0 +1,8 @@
+-- Users a SAML connection signs in: those it provisioned, and existing users of an
+-- application's own namespace it adopted. Other accounts with the same email are refused.
+CREATE TABLE IF NOT EXISTS saml_users (
+  connection_id INTEGER NOT NULL REFERENCES saml_connections(id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  PRIMARY KEY (connection_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_saml_users_user_id ON saml_users(user_id);
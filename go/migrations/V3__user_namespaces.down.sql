@@ -0,0 +1,6 @@
+-- Restore global email uniqueness (fails if the same email exists in several namespaces)
+DROP INDEX IF EXISTS idx_users_namespace_email;
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
+
+ALTER TABLE users DROP COLUMN IF EXISTS namespace_id;
+ALTER TABLE applications DROP COLUMN IF EXISTS isolated_users;
@@ -0,0 +1,9 @@
+-- Applications can keep their users in an isolated namespace instead of the global pool
+ALTER TABLE applications ADD COLUMN IF NOT EXISTS isolated_users BOOLEAN DEFAULT false;
+
+-- Users belong to a namespace: 0 is the global pool, otherwise the owning application's id
+ALTER TABLE users ADD COLUMN IF NOT EXISTS namespace_id INTEGER NOT NULL DEFAULT 0;
+
+-- Email uniqueness is scoped to the namespace
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_namespace_email ON users(namespace_id, email);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_organization_invitations_organization_id;
+DROP INDEX IF EXISTS idx_organization_members_user_id;
+DROP INDEX IF EXISTS idx_organizations_application_id;
+
+ALTER TABLE refresh_tokens DROP COLUMN IF EXISTS organization_id;
+
+DROP TABLE IF EXISTS organization_invitations;
+DROP TABLE IF EXISTS organization_members;
+DROP TABLE IF EXISTS organizations;
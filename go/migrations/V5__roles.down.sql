@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_user_roles_unique;
+
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS role_scopes;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1,24 @@
+-- Roles bundle scopes so they can be granted to users together
+CREATE TABLE IF NOT EXISTS roles (
+  id SERIAL PRIMARY KEY,
+  name TEXT UNIQUE NOT NULL,
+  description TEXT,
+  created_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- Role scopes: which scopes each role grants
+CREATE TABLE IF NOT EXISTS role_scopes (
+  role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+  scope_id INTEGER NOT NULL REFERENCES scopes(id) ON DELETE CASCADE,
+  PRIMARY KEY (role_id, scope_id)
+);
+
+-- User roles: roles assigned to users, globally (application_id NULL) or for one application
+CREATE TABLE IF NOT EXISTS user_roles (
+  user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  role_id INTEGER NOT NULL REFERENCES roles(id) ON DELETE CASCADE,
+  application_id INTEGER REFERENCES applications(id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ DEFAULT now()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_roles_unique ON user_roles(user_id, role_id, COALESCE(application_id, 0));
@@ -0,0 +1,20 @@
+-- API keys: an application may hold several keys so they can be rotated without downtime
+CREATE TABLE IF NOT EXISTS api_keys (
+  id SERIAL PRIMARY KEY,
+  application_id INTEGER NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+  label TEXT NOT NULL DEFAULT '',
+  key_hash TEXT UNIQUE NOT NULL,
+  key_prefix TEXT NOT NULL, -- First 8 chars for lookup
+  created_at TIMESTAMPTZ DEFAULT now(),
+  last_used_at TIMESTAMPTZ,
+  expires_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_key_prefix ON api_keys(key_prefix);
+CREATE INDEX IF NOT EXISTS idx_api_keys_application_id ON api_keys(application_id);
+
+-- Existing applications keep authenticating with their original key
+INSERT INTO api_keys (application_id, label, key_hash, key_prefix, created_at)
+SELECT id, 'default', api_key_hash, api_key_prefix, created_at FROM applications
+ON CONFLICT (key_hash) DO NOTHING;
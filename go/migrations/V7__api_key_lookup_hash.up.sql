@@ -0,0 +1,5 @@
+-- Keyed SHA-256 of each API key so requests can be authenticated with an index lookup
+-- instead of bcrypt comparisons. Existing keys are filled in the first time they are used.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS lookup_hash TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_lookup_hash ON api_keys(lookup_hash);
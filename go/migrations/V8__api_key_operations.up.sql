@@ -0,0 +1,2 @@
+-- Operations an API key may call (e.g. 'auth:login', 'admin:*'); NULL or empty allows every operation
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS operations TEXT[];
@@ -0,0 +1,2 @@
+ALTER TABLE applications DROP COLUMN IF EXISTS ip_denylist;
+ALTER TABLE applications DROP COLUMN IF EXISTS ip_allowlist;
@@ -0,0 +1,3 @@
+-- CIDR ranges API key requests must (allowlist) or must not (denylist) come from
+ALTER TABLE applications ADD COLUMN IF NOT EXISTS ip_allowlist TEXT[];
+ALTER TABLE applications ADD COLUMN IF NOT EXISTS ip_denylist TEXT[];
@@ -4,35 +4,74 @@ import "time"
 
 // User represents a user in the system
 type User struct {
-	ID           int64
-	Email        string
-	Password     string
+	ID            int64
+	Email         string
+	Password      string
 	ApplicationID *int64 // Optional: for multi-tenant support
-	CreatedAt    time.Time
+	NamespaceID   int64  // 0 for the global user pool, otherwise the owning application's ID
+	// TOTPSecret is the base32 secret of the user's authenticator app; empty while MFA is off
+	TOTPSecret string
+	// Disabled users cannot sign in or refresh their sessions
+	Disabled  bool
+	CreatedAt time.Time
 }
 
 // RefreshToken represents a refresh token
 type RefreshToken struct {
-	Token        string
-	UserID       int64
-	ApplicationID *int64 // Which application issued this token
-	ExpiresAt    int64
-	Revoked      bool
-	CreatedAt    time.Time
+	Token          string
+	UserID         int64
+	ApplicationID  *int64 // Which application issued this token
+	OrganizationID *int64 // Organization the session is scoped to
+	ExpiresAt      int64
+	Revoked        bool
+	AuthTime       int64    // When the user logged in (unix seconds); 0 if unknown
+	AMR            []string // How the user logged in, e.g. pwd and otp
+	CreatedAt      time.Time
 }
 
 // Application represents a registered application/client
 type Application struct {
-	ID                int64
-	Name              string
-	Domain            string
-	APIKeyHash        string
-	APIKeyPrefix      string
+	ID                 int64
+	Name               string
+	Domain             string
+	APIKeyHash         string
+	APIKeyPrefix       string
 	RateLimitPerMinute int
-	AllowedOrigins    []string
-	Active            bool
-	CreatedAt         time.Time
-	UpdatedAt         time.Time
+	AllowedOrigins     []string
+	IsolatedUsers      bool // Users live in a namespace private to this application
+	// IPAllowlist and IPDenylist are CIDR ranges API key requests must come from or must
+	// not come from; an empty allowlist allows every address not denied
+	IPAllowlist []string
+	IPDenylist  []string
+	// SessionCookie turns on cookie sessions for browsers: refresh tokens are set as an
+	// HttpOnly cookie with this SameSite mode (strict, lax or none) instead of being
+	// returned in the body. Empty keeps refresh tokens in the body.
+	SessionCookie string
+	// Branding customizes the hosted login pages
+	Branding Branding
+	// RedirectURIs are the exact URLs the hosted pages may send users back to
+	RedirectURIs []string
+	// ClientType is "confidential" for applications that keep their API key on a server,
+	// or "public" for browser and native apps, which must use PKCE
+	ClientType string
+	Active     bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// APIKey is one of possibly several keys an application authenticates with
+type APIKey struct {
+	ID            int64
+	ApplicationID int64
+	Label         string
+	KeyHash       string   // bcrypt hash
+	LookupHash    string   // Keyed SHA-256 of the key for indexed lookup; empty for keys created before it existed
+	KeyPrefix     string   // First 8 chars for lookup and identification
+	Operations    []string // Operations the key may call, e.g. "auth:login" or "admin:*"; empty allows all
+	CreatedAt     time.Time
+	LastUsedAt    *time.Time
+	ExpiresAt     *time.Time // Keys stop working after this time; nil never expires
+	RevokedAt     *time.Time
 }
 
 // Scope represents a permission scope
@@ -50,5 +89,254 @@ type TokenInfo struct {
 	Scopes    []string
 	ExpiresAt *int64
 	ClientID  *string
+	// Act names the administrator behind an impersonation token
+	Act map[string]interface{}
+	// AuthTime, AMR and ACR describe the login behind an access token
+	AuthTime *int64
+	AMR      []string
+	ACR      string
+	// StepUpRequired marks a valid token whose login fails the max_age or acr requirement
+	StepUpRequired bool
+}
+
+// Organization groups users of an application into a B2B tenant
+type Organization struct {
+	ID            int64
+	Name          string
+	ApplicationID *int64 // Application that owns the organization
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// OrganizationMember links a user to an organization with a role
+type OrganizationMember struct {
+	OrganizationID int64
+	UserID         int64
+	Role           string
+	CreatedAt      time.Time
+}
+
+// OrganizationInvitation is a pending invitation for an email address to join an organization
+type OrganizationInvitation struct {
+	ID             int64
+	OrganizationID int64
+	Email          string
+	Role           string
+	TokenHash      string
+	ExpiresAt      int64
+	AcceptedAt     *time.Time
+	CreatedAt      time.Time
+}
+
+// Role bundles scopes so they can be granted to users together
+type Role struct {
+	ID          int64
+	Name        string
+	Description string
+	Scopes      []string
+	CreatedAt   time.Time
+}
+
+// UserRole assigns a role to a user, either for every application or for a single one
+type UserRole struct {
+	UserID        int64
+	RoleID        int64
+	RoleName      string
+	ApplicationID *int64 // nil: the role applies in every application
+	CreatedAt     time.Time
+}
+
+// PasswordReset is a single-use token letting a user choose a new password
+type PasswordReset struct {
+	ID        int64
+	UserID    int64
+	TokenHash string
+	ExpiresAt int64
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// AuditEvent records a security-relevant action such as a rate limit violation
+type AuditEvent struct {
+	ID            int64
+	ApplicationID *int64
+	UserID        *int64
+	Action        string
+	IP            string
+	Details       map[string]interface{}
+	CreatedAt     time.Time
+}
+
+// LoginEvent is one password login attempt. Later logins of the user are scored against
+// the successful ones.
+type LoginEvent struct {
+	ID            int64
+	UserID        int64
+	ApplicationID *int64
+	Outcome       string // success, failure or challenged
+	IP            string
+	UserAgent     string
+	DeviceID      string // hash of the device ID the client sent, if any
+	Country       string
+	City          string
+	Latitude      *float64
+	Longitude     *float64
+	RiskScore     int
+	RiskLevel     string
+	RiskReasons   []string
+	CreatedAt     time.Time
+}
+
+// Branding customizes an application's hosted pages
+type Branding struct {
+	LogoURL         string `json:"logo_url,omitempty"`
+	PrimaryColor    string `json:"primary_color,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+	// Copy overrides page text by message key, such as "login.title"
+	Copy map[string]string `json:"copy,omitempty"`
+}
+
+// IdentityProvider is an external OpenID Connect provider users can sign in with
+type IdentityProvider struct {
+	ID int64
+	// ApplicationID restricts the provider to one application; nil offers it to every
+	// application sharing the global user namespace
+	ApplicationID *int64
+	Name          string // URL-safe identifier used in login links
+	DisplayName   string
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	Scopes        []string
+	// ClaimMapping names the ID token claims holding the subject, email and email_verified;
+	// missing entries use the standard claim names
+	ClaimMapping map[string]string
+	Active       bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// UserIdentity links a local user to an account at an identity provider
+type UserIdentity struct {
+	ID         int64
+	UserID     int64
+	ProviderID int64
+	Subject    string
+	Email      string
+	CreatedAt  time.Time
+}
+
+// SAMLConnection makes nileAuth a SAML 2.0 service provider for the identity provider
+// of an application or of one of its organizations
+type SAMLConnection struct {
+	ID            int64
+	ApplicationID int64
+	// OrganizationID adds users signing in through the connection to the organization
+	OrganizationID *int64
+	Name           string // URL-safe identifier used in the service provider endpoints
+	IdPEntityID    string
+	IdPSSOURL      string
+	// IdPCertificate holds the PEM certificates that may sign responses and assertions
+	IdPCertificate string
+	// EmailAttribute names the assertion attribute holding the email; empty uses the NameID
+	EmailAttribute string
+	// Domains are the email domains the identity provider may assert
+	Domains []string
+	// SPPrivateKey and SPCertificate sign AuthnRequests; they are generated with the
+	// connection and the certificate is published in the metadata
+	SPPrivateKey  string
+	SPCertificate string
+	Active        bool
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// SAMLRequest is an AuthnRequest waiting for the identity provider's response
+type SAMLRequest struct {
+	ID           string // ID of the AuthnRequest, echoed as InResponseTo
+	ConnectionID int64
+	// Request is the hosted authorize request the login continues with
+	Request   string
+	ExpiresAt int64
+	CreatedAt time.Time
 }
 
+// LDAPDirectory makes an application check passwords with an LDAP bind instead of the
+// local password hashes
+type LDAPDirectory struct {
+	ApplicationID int64
+	URL           string // ldap:// or ldaps://
+	StartTLS      bool
+	// CACertificate holds PEM roots for the directory's TLS certificate; empty uses the
+	// system roots
+	CACertificate string
+	// BindDN and BindPassword are the service account that searches for users; empty
+	// searches anonymously
+	BindDN       string
+	BindPassword string
+	SearchBase   string
+	// SearchFilter finds the entry of a login; {username} is replaced with the escaped login
+	SearchFilter string
+	// AttributeMapping maps access token claims to entry attributes; "email" names the
+	// attribute holding the user's email
+	AttributeMapping map[string]string
+	Active           bool
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+// DirectoryAccount links a shadow user to their directory entry and keeps the claims
+// mapped from the entry at the last login
+type DirectoryAccount struct {
+	ApplicationID int64
+	UserID        int64
+	DN            string
+	Claims        map[string]interface{}
+	UpdatedAt     time.Time
+}
+
+// SCIMResource marks a user or organization as managed by an application's SCIM client
+type SCIMResource struct {
+	ApplicationID int64
+	Type          string // scimTypeUser or scimTypeGroup
+	ResourceID    int64  // ID of the user or organization
+	ExternalID    string // The client's own identifier; unique per application and type when set
+	// Attributes holds SCIM attributes nileAuth has no column for, such as a user's name
+	Attributes map[string]interface{}
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// SCIMUser is a user managed by an application's SCIM client, with its resource
+type SCIMUser struct {
+	Resource *SCIMResource
+	User     *User
+}
+
+// Consent records the scopes a user approved for an application
+type Consent struct {
+	UserID        int64
+	ApplicationID int64
+	Scopes        []string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// AuthorizationCode is a single-use code the hosted pages redirect back with, exchanged
+// by the application for tokens
+type AuthorizationCode struct {
+	ID            int64
+	CodeHash      string
+	ApplicationID int64
+	UserID        int64
+	RedirectURI   string
+	Scopes        []string
+	// CodeChallenge is the PKCE S256 challenge the exchange must answer, if any
+	CodeChallenge string
+	ExpiresAt     int64
+	UsedAt        *time.Time
+	CreatedAt     time.Time
+	// AuthTime and AMR describe the login the code was issued for
+	AuthTime int64
+	AMR      []string
+}
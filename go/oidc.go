@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// oidcHTTPClient talks to upstream identity providers
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+const (
+	// oidcMetadataTTL is how long a provider's discovery document is reused
+	oidcMetadataTTL = time.Hour
+	// oidcKeysRefetchInterval limits how often an unknown key ID triggers a JWKS fetch
+	oidcKeysRefetchInterval = time.Minute
+	// identityLinkTTL bounds the time a user has to finish linking a provider
+	identityLinkTTL = 10 * time.Minute
+
+	purposeIdPState       = "idp_state"
+	purposeIdPLink        = "idp_link"
+	purposeIdPLinkConfirm = "idp_link_confirm"
+	idpNonceCookie        = "nile_idp_nonce"
+)
+
+// defaultIdentityProviderScopes are requested when a provider configures none
+var defaultIdentityProviderScopes = []string{"openid", "email", "profile"}
+
+// oidcClaimKeys are the profile fields a claim mapping may point at other claims, with
+// the standard claim each defaults to
+var oidcClaimKeys = map[string]string{"subject": "sub", "email": "email", "email_verified": "email_verified"}
+
+var (
+	errIdentityTaken   = errors.New("this account is already linked to another user")
+	errUnverifiedEmail = errors.New("identity provider did not verify the email of an existing user")
+)
+
+// normalizeIssuer validates an issuer URL. Issuers must use https; http is accepted on
+// loopback for development.
+func normalizeIssuer(raw string) (string, error) {
+	raw = strings.TrimSuffix(strings.TrimSpace(raw), "/")
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", errors.New("issuer must be an absolute URL without query or fragment")
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopbackHost(u.Hostname())) {
+		return "", errors.New("issuer must use https")
+	}
+	return raw, nil
+}
+
+// validateClaimMapping rejects mappings for fields the login does not read
+func validateClaimMapping(mapping map[string]string) error {
+	for key, claim := range mapping {
+		if _, ok := oidcClaimKeys[key]; !ok {
+			return fmt.Errorf("claim_mapping: unknown field %q (use subject, email or email_verified)", key)
+		}
+		if strings.TrimSpace(claim) == "" {
+			return fmt.Errorf("claim_mapping: %q needs a claim name", key)
+		}
+	}
+	return nil
+}
+
+// identityProviderAvailable reports whether users of an application may sign in with a
+// provider. Global providers serve applications in the global user namespace only.
+func identityProviderAvailable(p *IdentityProvider, app *Application) bool {
+	if !p.Active {
+		return false
+	}
+	if p.ApplicationID == nil {
+		return !app.IsolatedUsers
+	}
+	return *p.ApplicationID == app.ID
+}
+
+// availableIdentityProviders lists the providers offered on an application's login page
+func (a *App) availableIdentityProviders(app *Application) ([]*IdentityProvider, error) {
+	providers, err := a.DB.ListIdentityProviders(&app.ID)
+	if err != nil {
+		return nil, err
+	}
+	out := []*IdentityProvider{}
+	for _, p := range providers {
+		if identityProviderAvailable(p, app) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// oidcIssuer is the cached discovery document and signing keys of an issuer
+type oidcIssuer struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	fetchedAt     time.Time
+	mu            sync.Mutex
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+var oidcIssuers = struct {
+	sync.Mutex
+	byIssuer map[string]*oidcIssuer
+}{byIssuer: map[string]*oidcIssuer{}}
+
+// discoverOIDC returns the metadata of an issuer, fetching
+// /.well-known/openid-configuration when it is not cached
+func discoverOIDC(issuer string) (*oidcIssuer, error) {
+	oidcIssuers.Lock()
+	defer oidcIssuers.Unlock()
+	if cached := oidcIssuers.byIssuer[issuer]; cached != nil && time.Since(cached.fetchedAt) < oidcMetadataTTL {
+		return cached, nil
+	}
+	var doc oidcIssuer
+	if err := getJSON(issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery: document is for issuer %q", doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, errors.New("discovery: document lacks authorization, token or jwks endpoint")
+	}
+	doc.fetchedAt = time.Now()
+	oidcIssuers.byIssuer[issuer] = &doc
+	return &doc, nil
+}
+
+func getJSON(u string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// signingKey returns the RSA key with the given ID, refetching the JWKS when the provider
+// rotated its keys
+func (iss *oidcIssuer) signingKey(kid string) (*rsa.PublicKey, error) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	if key, ok := iss.keys[kid]; ok {
+		return key, nil
+	}
+	if iss.keys != nil && time.Since(iss.keysFetchedAt) < oidcKeysRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(iss.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	iss.keys = map[string]*rsa.PublicKey{}
+	iss.keysFetchedAt = time.Now()
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, nerr := base64.RawURLEncoding.DecodeString(k.N)
+		e, eerr := base64.RawURLEncoding.DecodeString(k.E)
+		if nerr != nil || eerr != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		iss.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, ok := iss.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// authorizeURL is where the browser signs in at the provider
+func (iss *oidcIssuer) authorizeURL(p *IdentityProvider, redirectURI, state, nonce string) string {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultIdentityProviderScopes
+	}
+	u, _ := url.Parse(iss.AuthorizationEndpoint)
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// exchangeCode redeems an authorization code at the provider's token endpoint and returns
+// the ID token
+func (iss *oidcIssuer) exchangeCode(p *IdentityProvider, code, redirectURI string) (string, error) {
+	resp, err := oidcHTTPClient.PostForm(iss.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: status %d", resp.StatusCode)
+	}
+	var body struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %w", err)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token in response")
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of an ID token.
+// The issuer must match the discovery document exactly, trailing slash included.
+func (iss *oidcIssuer) verifyIDToken(p *IdentityProvider, raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return iss.signingKey(kid)
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(iss.Issuer), jwt.WithAudience(p.ClientID))
+	if err != nil {
+		return nil, fmt.Errorf("id_token: %w", err)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("id_token: exp is required")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("id_token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// oidcProfile is what a login reads from an ID token
+type oidcProfile struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// mapOIDCClaims reads the profile from ID token claims using the provider's claim mapping
+func mapOIDCClaims(p *IdentityProvider, claims jwt.MapClaims) (oidcProfile, error) {
+	claim := func(key string) interface{} {
+		if name, ok := p.ClaimMapping[key]; ok {
+			return claims[name]
+		}
+		return claims[oidcClaimKeys[key]]
+	}
+	var profile oidcProfile
+	profile.Subject, _ = claim("subject").(string)
+	if profile.Subject == "" {
+		return profile, errors.New("id_token: no subject claim")
+	}
+	email, _ := claim("email").(string)
+	profile.Email = strings.TrimSpace(email)
+	switch v := claim("email_verified").(type) {
+	case bool:
+		profile.EmailVerified = v
+	case string:
+		profile.EmailVerified = v == "true"
+	}
+	return profile, nil
+}
+
+// identityLink is a signed-in user linking a provider to their account, carried to the
+// provider and back in a signed link token
+type identityLink struct {
+	App         *Application
+	User        *User
+	RedirectURI string
+	State       string
+}
+
+func signIdentityLink(app *Application, user *User, redirectURI, state string) (string, error) {
+	return signPurposeToken(purposeIdPLink, jwt.MapClaims{"appId": app.ID, "userId": user.ID, "redirectUri": redirectURI, "state": state}, identityLinkTTL)
+}
+
+// parseIdentityLink verifies a link token and loads its application and user
+func (a *App) parseIdentityLink(token string) (*identityLink, error) {
+	claims, err := parsePurposeToken(purposeIdPLink, token)
+	if err != nil {
+		return nil, err
+	}
+	appID, _ := claimInt64(claims, "appId")
+	userID, _ := claimInt64(claims, "userId")
+	link := &identityLink{}
+	link.RedirectURI, _ = claims["redirectUri"].(string)
+	link.State, _ = claims["state"].(string)
+	if link.App, err = a.DB.GetApplicationByID(appID); err != nil || link.App == nil || !link.App.Active || !registeredRedirectURI(link.App, link.RedirectURI) {
+		return nil, errBadClient
+	}
+	if link.User, err = a.DB.GetUserByID(userID); err != nil || link.User == nil || link.User.NamespaceID != userNamespace(link.App) {
+		return nil, errors.New("user not found")
+	}
+	return link, nil
+}
+
+// linkIdentity records that a user owns an account at a provider; linking the same
+// account twice is a no-op
+func (a *App) linkIdentity(r *http.Request, user *User, p *IdentityProvider, profile oidcProfile) error {
+	existing, err := a.DB.GetUserIdentity(p.ID, profile.Subject)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.UserID == user.ID {
+			return nil
+		}
+		return errIdentityTaken
+	}
+	if err := a.DB.CreateUserIdentity(&UserIdentity{UserID: user.ID, ProviderID: p.ID, Subject: profile.Subject, Email: profile.Email}); err != nil {
+		return err
+	}
+	a.audit(r, auditIdentityLinked, &user.ID, map[string]interface{}{"provider": p.Name, "subject": profile.Subject})
+	return nil
+}
+
+// upstreamUser finds the user an upstream login belongs to. Unknown accounts are linked to
+// the user with the same email when the provider verified it, or get a new user.
+func (a *App) upstreamUser(r *http.Request, app *Application, p *IdentityProvider, profile oidcProfile) (*User, error) {
+	identity, err := a.DB.GetUserIdentity(p.ID, profile.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		user, err := a.DB.GetUserByID(identity.UserID)
+		if err != nil || user == nil || user.NamespaceID != userNamespace(app) {
+			return nil, errIdentityTaken
+		}
+		return user, nil
+	}
+	if profile.Email == "" {
+		return nil, errors.New("identity provider returned no email")
+	}
+	user, err := a.DB.GetUserByEmail(userNamespace(app), profile.Email)
+	if err != nil {
+		return nil, err
+	}
+	if user != nil && !profile.EmailVerified {
+		return nil, errUnverifiedEmail
+	}
+	if user == nil {
+		if user, err = a.provisionUser(r, app, profile.Email, map[string]interface{}{"provider": p.Name}); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.linkIdentity(r, user, p, profile); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (a *App) idpCallbackURL(r *http.Request) string {
+	return a.publicURL(r) + "/hosted/idp/callback"
+}
+
+// provisionUser creates the account of someone who first signs in through a federated
+// login. The account has no usable password until the user sets one with a reset.
+func (a *App) provisionUser(r *http.Request, app *Application, email string, details map[string]interface{}) (*User, error) {
+	random, err := genToken(32)
+	if err != nil {
+		return nil, err
+	}
+	hashed, err := hashPassword(random)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.DB.CreateUser(email, hashed, &app.ID, userNamespace(app))
+	if err != nil {
+		return nil, err
+	}
+	a.audit(r, auditUserProvisioned, &user.ID, details)
+	return user, nil
+}
+
+// HandleHostedIdP sends the browser to an identity provider, either to sign in for an
+// authorize request or, with a link_token, to link the provider to a signed-in user
+// GET /hosted/idp/{name}
+func (a *App) HandleHostedIdP(w http.ResponseWriter, r *http.Request) {
+	var auth *authorization
+	var app *Application
+	state := jwt.MapClaims{}
+	if token := r.URL.Query().Get("link_token"); token != "" {
+		link, err := a.parseIdentityLink(token)
+		if err != nil {
+			a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+			return
+		}
+		app = link.App
+		state["link"] = token
+	} else {
+		var ok bool
+		if r, auth, ok = a.beginHosted(w, r); !ok {
+			return
+		}
+		app = auth.App
+		state["req"] = auth.values().Encode()
+	}
+
+	provider, err := a.DB.GetIdentityProviderByName(mux.Vars(r)["name"])
+	if err != nil || provider == nil || !identityProviderAvailable(provider, app) {
+		a.renderError(w, r, http.StatusNotFound, auth, defaultCopy["idp.unavailable"])
+		return
+	}
+	issuer, err := discoverOIDC(provider.Issuer)
+	if err != nil {
+		log.Printf("identity provider %s: %v", provider.Name, err)
+		a.renderError(w, r, http.StatusBadGateway, auth, defaultCopy["idp.failed"])
+		return
+	}
+	// The nonce binds the provider's answer to this browser: the cookie holds a secret
+	// whose hash travels in the signed state and comes back in the ID token
+	secret, err := genToken(32)
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	nonce := hashToken(secret)
+	state["provider"] = provider.ID
+	state["nonce"] = nonce
+	signed, err := signPurposeToken(purposeIdPState, state, hostedFlowTTL)
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: idpNonceCookie, Value: secret, Path: "/hosted/idp", MaxAge: int(hostedFlowTTL.Seconds()), HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, issuer.authorizeURL(provider, a.idpCallbackURL(r), signed, nonce), http.StatusSeeOther)
+}
+
+// HandleHostedIdPCallback finishes a sign-in or link at an identity provider
+// GET /hosted/idp/callback
+func (a *App) HandleHostedIdPCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	claims, err := parsePurposeToken(purposeIdPState, q.Get("state"))
+	cookie, cerr := r.Cookie(idpNonceCookie)
+	if err != nil || cerr != nil || claims["nonce"] != hashToken(cookie.Value) {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return
+	}
+	nonce := claims["nonce"].(string)
+	http.SetCookie(w, &http.Cookie{Name: idpNonceCookie, Value: "", Path: "/hosted/idp", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteLaxMode})
+
+	var auth *authorization
+	var link *identityLink
+	var app *Application
+	if token, _ := claims["link"].(string); token != "" {
+		link, err = a.parseIdentityLink(token)
+		if err == nil {
+			app = link.App
+		}
+	} else {
+		raw, _ := claims["req"].(string)
+		form, qerr := url.ParseQuery(raw)
+		if auth, err = a.validateAuthorizeRequest(form); qerr == nil && err == nil {
+			app = auth.App
+		}
+	}
+	if app == nil {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "application", app))
+	// Results go back to the application: the authorize request's redirect URI, or the
+	// redirect URI the link was started with
+	back := func(result url.Values) {
+		if link != nil {
+			a.redirectWithResult(w, r, authorizeRequest{RedirectURI: link.RedirectURI, State: link.State}, result)
+			return
+		}
+		a.redirectWithResult(w, r, auth.authorizeRequest, result)
+	}
+
+	providerID, _ := claimInt64(claims, "provider")
+	provider, err := a.DB.GetIdentityProviderByID(providerID)
+	if err != nil || provider == nil || !identityProviderAvailable(provider, app) {
+		a.renderError(w, r, http.StatusNotFound, auth, defaultCopy["idp.unavailable"])
+		return
+	}
+	if q.Get("error") != "" {
+		back(url.Values{"error": {"access_denied"}})
+		return
+	}
+	profile, err := a.upstreamProfile(r, provider, q.Get("code"), nonce)
+	if err != nil {
+		log.Printf("identity provider %s: %v", provider.Name, err)
+		a.renderError(w, r, http.StatusBadGateway, auth, defaultCopy["idp.failed"])
+		return
+	}
+
+	if link != nil {
+		// Whoever opens a link URL signs in at the provider, so the user confirms which
+		// account they are linking before anything is written
+		flow, err := signPurposeToken(purposeIdPLinkConfirm, jwt.MapClaims{"link": claims["link"], "provider": provider.ID, "sub": profile.Subject, "email": profile.Email}, hostedFlowTTL)
+		if err != nil {
+			a.renderError(w, r, http.StatusInternalServerError, nil, defaultCopy["error.title"])
+			return
+		}
+		p := a.newHostedPage(w, r, nil)
+		p.App = app
+		p.Flow = flow
+		p.Email = link.User.Email
+		p.Provider = provider.DisplayName
+		p.Identity = profile.Email
+		if p.Identity == "" {
+			p.Identity = profile.Subject
+		}
+		a.render(w, http.StatusOK, "link", p)
+		return
+	}
+	user, err := a.upstreamUser(r, app, provider, profile)
+	switch {
+	case err == errUnverifiedEmail:
+		a.renderError(w, r, http.StatusConflict, auth, defaultCopy["idp.unverified"])
+		return
+	case err == errIdentityTaken:
+		a.renderError(w, r, http.StatusConflict, auth, defaultCopy["idp.taken"])
+		return
+	case err != nil:
+		log.Printf("identity provider %s: %v", provider.Name, err)
+		a.renderError(w, r, http.StatusBadGateway, auth, defaultCopy["idp.failed"])
+		return
+	}
+	a.authenticatedHosted(w, r, auth, a.newHostedPage(w, r, auth), user, amrFederated)
+}
+
+// HandleHostedIdPLink links a provider account once the user confirmed it on the link page
+// POST /hosted/idp/link
+func (a *App) HandleHostedIdPLink(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || !checkHostedCSRF(r) {
+		a.renderError(w, r, http.StatusForbidden, nil, defaultCopy["error.expired"])
+		return
+	}
+	claims, err := parsePurposeToken(purposeIdPLinkConfirm, r.PostFormValue("flow"))
+	var link *identityLink
+	if err == nil {
+		token, _ := claims["link"].(string)
+		link, err = a.parseIdentityLink(token)
+	}
+	if err != nil {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "application", link.App))
+	back := func(result url.Values) {
+		a.redirectWithResult(w, r, authorizeRequest{RedirectURI: link.RedirectURI, State: link.State}, result)
+	}
+	providerID, _ := claimInt64(claims, "provider")
+	provider, err := a.DB.GetIdentityProviderByID(providerID)
+	if err != nil || provider == nil || !identityProviderAvailable(provider, link.App) {
+		a.renderError(w, r, http.StatusNotFound, nil, defaultCopy["idp.unavailable"])
+		return
+	}
+	if r.PostFormValue("decision") != "link" {
+		back(url.Values{"error": {"access_denied"}})
+		return
+	}
+	profile := oidcProfile{}
+	profile.Subject, _ = claims["sub"].(string)
+	profile.Email, _ = claims["email"].(string)
+	if err := a.linkIdentity(r, link.User, provider, profile); err != nil {
+		if err != errIdentityTaken {
+			log.Printf("identity provider %s: linking user %d: %v", provider.Name, link.User.ID, err)
+		}
+		back(url.Values{"error": {"identity_taken"}})
+		return
+	}
+	back(url.Values{"linked": {provider.Name}})
+}
+
+// upstreamProfile redeems the provider's code and reads the verified ID token
+func (a *App) upstreamProfile(r *http.Request, p *IdentityProvider, code, nonce string) (oidcProfile, error) {
+	if code == "" {
+		return oidcProfile{}, errors.New("callback without code")
+	}
+	issuer, err := discoverOIDC(p.Issuer)
+	if err != nil {
+		return oidcProfile{}, err
+	}
+	raw, err := issuer.exchangeCode(p, code, a.idpCallbackURL(r))
+	if err != nil {
+		return oidcProfile{}, err
+	}
+	claims, err := issuer.verifyIDToken(p, raw, nonce)
+	if err != nil {
+		return oidcProfile{}, err
+	}
+	return mapOIDCClaims(p, claims)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// stubOIDCProvider is an OpenID Connect provider that signs whatever claims a test queues
+// for the next code it hands out
+type stubOIDCProvider struct {
+	*httptest.Server
+	t     *testing.T
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]jwt.MapClaims
+	// issuer is published in discovery and put in ID tokens; the server URL when empty
+	issuer string
+}
+
+func (s *stubOIDCProvider) issuerURL() string {
+	if s.issuer != "" {
+		return s.issuer
+	}
+	return s.URL
+}
+
+func newStubOIDCProvider(t *testing.T) *stubOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	s := &stubOIDCProvider{t: t, key: key, codes: map[string]jwt.MapClaims{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.issuerURL(),
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		claims, ok := s.codes[r.PostFormValue("code")]
+		delete(s.codes, r.PostFormValue("code"))
+		s.mu.Unlock()
+		if !ok || r.PostFormValue("client_id") != "nile" || r.PostFormValue("client_secret") != "shh" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// authorize plays the provider's login page: it returns the callback query for a user
+// with the given claims, echoing the state and nonce of the authorization URL
+func (s *stubOIDCProvider) authorize(location string, claims jwt.MapClaims) url.Values {
+	u, err := url.Parse(location)
+	require.NoError(s.t, err)
+	require.Equal(s.t, s.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	q := u.Query()
+	require.Equal(s.t, "code", q.Get("response_type"))
+	require.Equal(s.t, "nile", q.Get("client_id"))
+	full := jwt.MapClaims{"iss": s.issuerURL(), "aud": "nile", "exp": time.Now().Add(time.Minute).Unix(), "nonce": q.Get("nonce")}
+	for k, v := range claims {
+		full[k] = v
+	}
+	s.mu.Lock()
+	code := strconv.Itoa(len(s.codes)) + q.Get("nonce")[:8]
+	s.codes[code] = full
+	s.mu.Unlock()
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+func TestIdentityProviderLoginAndLinking(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+	provider := &IdentityProvider{
+		ApplicationID: &app.ID,
+		Name:          "stub",
+		Issuer:        stub.URL,
+		ClientID:      "nile",
+		ClientSecret:  "shh",
+		ClaimMapping:  map[string]string{"email": "upn"},
+		Active:        true,
+	}
+	require.NoError(t, normalizeIdentityProvider(provider))
+	require.Equal(t, "stub", provider.DisplayName)
+	require.NoError(t, a.DB.CreateIdentityProvider(provider))
+
+	authorize := url.Values{
+		"client_id":    {strconv.FormatInt(app.ID, 10)},
+		"redirect_uri": {"https://bench.example.com/callback"},
+		"state":        {"xyz"},
+	}
+	start := func(w http.ResponseWriter, r *http.Request) {
+		a.HandleHostedIdP(w, mux.SetURLVars(r, map[string]string{"name": "stub"}))
+	}
+	// signIn goes through the provider and returns the callback response
+	signIn := func(browser *hostedBrowser, query url.Values, claims jwt.MapClaims) *httptest.ResponseRecorder {
+		rec := browser.do(start, "GET", "/hosted/idp/stub", query)
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		return browser.do(a.HandleHostedIdPCallback, "GET", "/hosted/idp/callback", stub.authorize(rec.Header().Get("Location"), claims))
+	}
+
+	// the login page offers the provider
+	rec := (&hostedBrowser{t: t}).do(a.HandleHostedLogin, "GET", "/hosted/login", authorize)
+	require.Contains(t, rec.Body.String(), `href="/hosted/idp/stub?`)
+
+	// an unknown account gets a new user, found again on the next login
+	rec = signIn(&hostedBrowser{t: t}, authorize, jwt.MapClaims{"sub": "u-1", "upn": "new@example.com"})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Contains(t, rec.Header().Get("Location"), "code=")
+	require.Contains(t, rec.Header().Get("Location"), "state=xyz")
+	created, err := a.DB.GetUserByEmail(userNamespace(app), "new@example.com")
+	require.NoError(t, err)
+	require.NotNil(t, created)
+	rec = signIn(&hostedBrowser{t: t}, authorize, jwt.MapClaims{"sub": "u-1", "upn": "renamed@example.com"})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	identities, err := a.DB.ListUserIdentities(created.ID)
+	require.NoError(t, err)
+	require.Len(t, identities, 1)
+
+	// an unverified email never takes over an existing account; a verified one links it
+	hashed, err := hashPassword("secret123")
+	require.NoError(t, err)
+	local, err := a.DB.CreateUser("local@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	rec = signIn(&hostedBrowser{t: t}, authorize, jwt.MapClaims{"sub": "u-2", "upn": "local@example.com"})
+	require.Equal(t, http.StatusConflict, rec.Code)
+	rec = signIn(&hostedBrowser{t: t}, authorize, jwt.MapClaims{"sub": "u-2", "upn": "local@example.com", "email_verified": true})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	linked, err := a.DB.GetUserIdentity(provider.ID, "u-2")
+	require.NoError(t, err)
+	require.Equal(t, local.ID, linked.UserID)
+
+	// ID tokens must carry the nonce of this browser, and the nonce cookie must be present
+	rec = signIn(&hostedBrowser{t: t}, authorize, jwt.MapClaims{"sub": "u-1", "upn": "new@example.com", "nonce": "other"})
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+	browser := &hostedBrowser{t: t}
+	rec = browser.do(start, "GET", "/hosted/idp/stub", authorize)
+	callback := stub.authorize(rec.Header().Get("Location"), jwt.MapClaims{"sub": "u-1", "upn": "new@example.com"})
+	rec = (&hostedBrowser{t: t}).do(a.HandleHostedIdPCallback, "GET", "/hosted/idp/callback", callback)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// linking adds an account to a signed-in user once they confirm it, unless another
+	// user owns it
+	token, err := signIdentityLink(app, local, "https://bench.example.com/callback", "s1")
+	require.NoError(t, err)
+	link := func(claims jwt.MapClaims, decision string) *httptest.ResponseRecorder {
+		browser := &hostedBrowser{t: t}
+		rec := signIn(browser, url.Values{"link_token": {token}}, claims)
+		require.Equal(t, http.StatusOK, rec.Code)
+		page := rec.Body.String()
+		require.Contains(t, page, "local@example.com")
+		form := url.Values{"csrf": {browser.field(page, "csrf")}, "flow": {browser.field(page, "flow")}, "decision": {decision}}
+		// the confirmation must come from the browser that signed in at the provider
+		require.Equal(t, http.StatusForbidden, (&hostedBrowser{t: t}).do(a.HandleHostedIdPLink, "POST", "/hosted/idp/link", form).Code)
+		return browser.do(a.HandleHostedIdPLink, "POST", "/hosted/idp/link", form)
+	}
+	// someone tricked into opening another user's link URL sees whose account it is
+	// and nothing is linked until they confirm
+	rec = link(jwt.MapClaims{"sub": "u-3", "upn": "work@example.com"}, "cancel")
+	require.Equal(t, "https://bench.example.com/callback?error=access_denied&state=s1", rec.Header().Get("Location"))
+	identity, err := a.DB.GetUserIdentity(provider.ID, "u-3")
+	require.NoError(t, err)
+	require.Nil(t, identity)
+	rec = link(jwt.MapClaims{"sub": "u-3", "upn": "work@example.com"}, "link")
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, "https://bench.example.com/callback?linked=stub&state=s1", rec.Header().Get("Location"))
+	identities, err = a.DB.ListUserIdentities(local.ID)
+	require.NoError(t, err)
+	require.Len(t, identities, 2)
+	rec = link(jwt.MapClaims{"sub": "u-1", "upn": "new@example.com"}, "link")
+	require.Contains(t, rec.Header().Get("Location"), "error=identity_taken")
+
+	// unlinking is limited to the user's own identities
+	require.Error(t, a.DB.DeleteUserIdentity(created.ID, identities[1].ID))
+	require.NoError(t, a.DB.DeleteUserIdentity(local.ID, identities[1].ID))
+
+	// inactive providers are not offered
+	provider.Active = false
+	require.NoError(t, a.DB.UpdateIdentityProvider(provider))
+	rec = (&hostedBrowser{t: t}).do(start, "GET", "/hosted/idp/stub", authorize)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestIdentityProviderIssuerIsMatchedAsPublished(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	stub.issuer = stub.URL + "/"
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+	provider := &IdentityProvider{ApplicationID: &app.ID, Name: "slash", Issuer: stub.issuer, ClientID: "nile", ClientSecret: "shh", Active: true}
+	require.NoError(t, normalizeIdentityProvider(provider))
+	require.NoError(t, a.DB.CreateIdentityProvider(provider))
+
+	authorize := url.Values{
+		"client_id":    {strconv.FormatInt(app.ID, 10)},
+		"redirect_uri": {"https://bench.example.com/callback"},
+	}
+	signIn := func(claims jwt.MapClaims) *httptest.ResponseRecorder {
+		browser := &hostedBrowser{t: t}
+		rec := browser.do(func(w http.ResponseWriter, r *http.Request) {
+			a.HandleHostedIdP(w, mux.SetURLVars(r, map[string]string{"name": "slash"}))
+		}, "GET", "/hosted/idp/slash", authorize)
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		return browser.do(a.HandleHostedIdPCallback, "GET", "/hosted/idp/callback", stub.authorize(rec.Header().Get("Location"), claims))
+	}
+
+	// providers such as Auth0 publish their issuer with a trailing slash
+	rec := signIn(jwt.MapClaims{"sub": "u-1", "email": "jane@example.com"})
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Contains(t, rec.Header().Get("Location"), "code=")
+	// and the ID token's iss must be exactly that
+	rec = signIn(jwt.MapClaims{"sub": "u-1", "email": "jane@example.com", "iss": stub.URL})
+	require.Equal(t, http.StatusBadGateway, rec.Code)
+}
+
+func TestLinkIdentityURLIgnoresForgedHosts(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+	provider := &IdentityProvider{ApplicationID: &app.ID, Name: "corp", Issuer: "https://idp.example.com", ClientID: "nile", ClientSecret: "shh", Active: true}
+	require.NoError(t, normalizeIdentityProvider(provider))
+	require.NoError(t, a.DB.CreateIdentityProvider(provider))
+	status, reg := callAs(t, a, plain, a.HandleRegister, `{"email":"jane@example.com","password":"pw"}`)
+	require.Equal(t, http.StatusCreated, status)
+	r := newRouter(a)
+	link := func(host string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/v1/auth/identities/corp/link", strings.NewReader(`{"redirectUri":"https://bench.example.com/callback"}`))
+		req.Host = host
+		req.Header.Set("X-API-Key", plain)
+		req.Header.Set("Authorization", "Bearer "+reg["accessToken"].(string))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec.Code, out
+	}
+
+	status, body := link("evil.example")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "PUBLIC_URL_REQUIRED", body["error_code"])
+	status, body = link("auth.bench.example.com")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, strings.HasPrefix(body["data"].(map[string]interface{})["authorizationUrl"].(string), "http://auth.bench.example.com/hosted/idp/corp?"))
+	a.PublicURL = "https://auth.example.com"
+	status, body = link("evil.example")
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, strings.HasPrefix(body["data"].(map[string]interface{})["authorizationUrl"].(string), "https://auth.example.com/hosted/idp/corp?"))
+}
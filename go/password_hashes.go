@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashes imported from other systems are stored as they are and verified in
+// their own scheme. The first successful login replaces them with bcrypt.
+
+// Limits on imported Argon2 parameters, so a crafted hash cannot make a login
+// allocate more than 256 MiB or spin for minutes
+const (
+	maxArgon2Memory  = 1 << 18 // KiB, 256 MiB
+	maxArgon2Time    = 16
+	maxArgon2Threads = 64
+)
+
+var errUnsupportedPasswordHash = errors.New("unsupported password hash; expected bcrypt, Argon2 ($argon2id$, $argon2i$) or salted SHA ({SSHA}, {SSHA256}, {SSHA512})")
+
+// saltedSHADigests maps the LDAP-style scheme prefixes to their digests. The encoded
+// value is base64(digest(password + salt) + salt).
+var saltedSHADigests = map[string]func() hash.Hash{
+	"{SSHA}":    sha1.New,
+	"{SSHA256}": sha256.New,
+	"{SSHA512}": sha512.New,
+}
+
+func isBcryptHash(h string) bool {
+	return strings.HasPrefix(h, "$2")
+}
+
+// checkPasswordHash reports whether h is a well-formed hash in a supported scheme
+func checkPasswordHash(h string) error {
+	switch {
+	case isBcryptHash(h):
+		if _, err := bcrypt.Cost([]byte(h)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash: %v", err)
+		}
+		return nil
+	case strings.HasPrefix(h, "$argon2"):
+		_, err := parseArgon2Hash(h)
+		return err
+	case strings.HasPrefix(h, "{"):
+		_, _, _, err := parseSaltedSHAHash(h)
+		return err
+	}
+	return errUnsupportedPasswordHash
+}
+
+// compareImportedHash checks a password against a non-bcrypt hash
+func compareImportedHash(h, password string) bool {
+	if strings.HasPrefix(h, "$argon2") {
+		a, err := parseArgon2Hash(h)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(a.derive(password), a.key) == 1
+	}
+	newDigest, digest, salt, err := parseSaltedSHAHash(h)
+	if err != nil {
+		return false
+	}
+	d := newDigest()
+	d.Write([]byte(password))
+	d.Write(salt)
+	return subtle.ConstantTimeCompare(d.Sum(nil), digest) == 1
+}
+
+// argon2Hash is a hash in the PHC string format, for example
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(h string) (*argon2Hash, error) {
+	parts := strings.Split(h, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		return nil, errors.New("invalid Argon2 hash: expected $argon2id$v=19$m=...,t=...,p=...$salt$key")
+	}
+	a := &argon2Hash{variant: parts[1]}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("invalid Argon2 hash: unsupported version %q", parts[2])
+	}
+	var threads uint32
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.memory, &a.time, &threads); err != nil {
+		return nil, fmt.Errorf("invalid Argon2 hash: bad parameters %q", parts[3])
+	}
+	if a.time < 1 || a.time > maxArgon2Time || threads < 1 || threads > maxArgon2Threads || a.memory > maxArgon2Memory {
+		return nil, errors.New("invalid Argon2 hash: parameters out of range")
+	}
+	a.threads = uint8(threads)
+	var err error
+	if a.salt, err = decodePHCBase64(parts[4]); err != nil || len(a.salt) == 0 {
+		return nil, errors.New("invalid Argon2 hash: bad salt")
+	}
+	if a.key, err = decodePHCBase64(parts[5]); err != nil || len(a.key) < 4 {
+		return nil, errors.New("invalid Argon2 hash: bad key")
+	}
+	return a, nil
+}
+
+func (a *argon2Hash) derive(password string) []byte {
+	if a.variant == "argon2i" {
+		return argon2.Key([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+	}
+	return argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+}
+
+// decodePHCBase64 decodes the unpadded base64 of PHC strings, tolerating padding
+func decodePHCBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func parseSaltedSHAHash(h string) (newDigest func() hash.Hash, digest, salt []byte, err error) {
+	end := strings.Index(h, "}")
+	if end < 0 {
+		return nil, nil, nil, errUnsupportedPasswordHash
+	}
+	newDigest = saltedSHADigests[strings.ToUpper(h[:end+1])]
+	if newDigest == nil {
+		return nil, nil, nil, errUnsupportedPasswordHash
+	}
+	raw, err := base64.StdEncoding.DecodeString(h[end+1:])
+	size := newDigest().Size()
+	if err != nil || len(raw) <= size {
+		return nil, nil, nil, fmt.Errorf("invalid %s hash", h[:end+1])
+	}
+	return newDigest, raw[:size], raw[size:], nil
+}
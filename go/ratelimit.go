@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter decides whether one more request identified by key fits in limit requests
+// per window. Implementations must be safe for concurrent use and honor the limit passed
+// on each call, so changed limits apply immediately.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error)
+}
+
+// RateLimitResult describes the budget left after a rate limit check
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the full budget is available again
+	Reset time.Duration
+	// RetryAfter is how long until the next request would be allowed; zero when allowed
+	RetryAfter time.Duration
+}
+
+// memoryRateLimitSweepInterval limits how often idle buckets are dropped
+const memoryRateLimitSweepInterval = time.Minute
+
+// MemoryRateLimiter keeps a token bucket per key in process memory. Every replica
+// counts on its own, so limits are per instance. Buckets left idle for their whole
+// window are full again and are dropped, so keys taken from client input such as
+// emails and IPs cannot grow the map without bound.
+type MemoryRateLimiter struct {
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+	mu        sync.Mutex
+}
+
+type memoryBucket struct {
+	limiter  *rate.Limiter
+	window   time.Duration
+	lastSeen time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets:   make(map[string]*memoryBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (rl *MemoryRateLimiter) Allow(_ context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	every := rate.Limit(float64(limit) / window.Seconds())
+	now := time.Now()
+	limiter := rl.getLimiter(key, every, limit, window, now)
+	allowed := limiter.AllowN(now, 1)
+
+	tokens := limiter.TokensAt(now)
+	result := RateLimitResult{Allowed: allowed, Limit: limit}
+	if tokens > 0 {
+		result.Remaining = int(tokens)
+	}
+	result.Reset = tokensDuration(float64(limit)-tokens, every)
+	if !allowed {
+		result.RetryAfter = tokensDuration(1-tokens, every)
+	}
+	return result, nil
+}
+
+func (rl *MemoryRateLimiter) getLimiter(key string, every rate.Limit, burst int, window time.Duration, now time.Time) *rate.Limiter {
+	rl.mu.Lock()
+	if now.Sub(rl.lastSweep) >= memoryRateLimitSweepInterval {
+		rl.sweepLocked(now)
+	}
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		bucket = &memoryBucket{limiter: rate.NewLimiter(every, burst)}
+		rl.buckets[key] = bucket
+	}
+	bucket.window = window
+	bucket.lastSeen = now
+	rl.mu.Unlock()
+
+	// Pick up limits changed since the bucket was created
+	limiter := bucket.limiter
+	if limiter.Limit() != every || limiter.Burst() != burst {
+		limiter.SetLimit(every)
+		limiter.SetBurst(burst)
+	}
+	return limiter
+}
+
+// sweepLocked drops the buckets unused for at least their window, which have refilled
+// completely and would be recreated identically. rl.mu must be held.
+func (rl *MemoryRateLimiter) sweepLocked(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if now.Sub(bucket.lastSeen) >= bucket.window {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// tokensDuration returns how long a token bucket refilling at every tokens per second
+// takes to gain n tokens
+func tokensDuration(n float64, every rate.Limit) time.Duration {
+	if n <= 0 || every <= 0 {
+		return 0
+	}
+	return time.Duration(n / float64(every) * float64(time.Second))
+}
+
+// postgresRateLimitCleanupInterval limits how often expired counters are deleted
+const postgresRateLimitCleanupInterval = time.Minute
+
+// PostgresRateLimiter shares limits across replicas with a sliding window counter stored
+// in the rate_limit_counters table. A request is allowed when the current window's count
+// plus the previous window's count, weighted by how much of it still overlaps the sliding
+// window, stays below the limit.
+type PostgresRateLimiter struct {
+	db *sql.DB
+
+	mu          sync.Mutex
+	lastCleanup time.Time
+}
+
+func NewPostgresRateLimiter(p *PostgresDB) *PostgresRateLimiter {
+	return &PostgresRateLimiter{db: p.db}
+}
+
+func (rl *PostgresRateLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	now := time.Now().UTC()
+	windowStart := now.Truncate(window)
+	rl.cleanup(ctx, now)
+
+	tx, err := rl.db.BeginTx(ctx, nil)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer tx.Rollback()
+
+	// Lock the current window's counter so concurrent replicas serialize on it
+	if _, err := tx.ExecContext(ctx, `INSERT INTO rate_limit_counters(key,window_start,count,expires_at) VALUES($1,$2,0,$3) ON CONFLICT (key,window_start) DO NOTHING`, key, windowStart, windowStart.Add(2*window)); err != nil {
+		return RateLimitResult{}, err
+	}
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT count FROM rate_limit_counters WHERE key = $1 AND window_start = $2 FOR UPDATE`, key, windowStart).Scan(&current); err != nil {
+		return RateLimitResult{}, err
+	}
+	var previous int
+	err = tx.QueryRowContext(ctx, `SELECT count FROM rate_limit_counters WHERE key = $1 AND window_start = $2`, key, windowStart.Add(-window)).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return RateLimitResult{}, err
+	}
+
+	elapsed := now.Sub(windowStart)
+	if slidingWindowCount(previous, current, elapsed, window) < float64(limit) {
+		if _, err := tx.ExecContext(ctx, `UPDATE rate_limit_counters SET count = count + 1 WHERE key = $1 AND window_start = $2`, key, windowStart); err != nil {
+			return RateLimitResult{}, err
+		}
+		current++
+	} else {
+		// Denied requests are not counted
+		result := slidingWindowResult(previous, current, elapsed, window, limit)
+		result.Allowed = false
+		result.RetryAfter = slidingWindowRetryAfter(previous, current, elapsed, window, limit)
+		return result, tx.Commit()
+	}
+	result := slidingWindowResult(previous, current, elapsed, window, limit)
+	result.Allowed = true
+	return result, tx.Commit()
+}
+
+// cleanup deletes expired counters, at most once per cleanup interval per process
+func (rl *PostgresRateLimiter) cleanup(ctx context.Context, now time.Time) {
+	rl.mu.Lock()
+	if now.Sub(rl.lastCleanup) < postgresRateLimitCleanupInterval {
+		rl.mu.Unlock()
+		return
+	}
+	rl.lastCleanup = now
+	rl.mu.Unlock()
+	_, _ = rl.db.ExecContext(ctx, `DELETE FROM rate_limit_counters WHERE expires_at < $1`, now)
+}
+
+// slidingWindowResult reports the budget left in a sliding window. The full budget is
+// back once both the current and the previous fixed window have slid out.
+func slidingWindowResult(previous, current int, elapsed, window time.Duration, limit int) RateLimitResult {
+	result := RateLimitResult{Limit: limit}
+	if remaining := float64(limit) - slidingWindowCount(previous, current, elapsed, window); remaining > 0 {
+		result.Remaining = int(remaining)
+	}
+	switch {
+	case current > 0:
+		result.Reset = 2*window - elapsed
+	case previous > 0:
+		result.Reset = window - elapsed
+	}
+	return result
+}
+
+// slidingWindowRetryAfter returns how long until the sliding window count drops below
+// the limit again
+func slidingWindowRetryAfter(previous, current int, elapsed, window time.Duration, limit int) time.Duration {
+	if current < limit {
+		// Wait for enough of the previous window to slide out
+		overlap := float64(limit-current) / float64(previous)
+		wait := time.Duration((1-overlap)*float64(window)) - elapsed
+		if wait < 0 {
+			wait = 0
+		}
+		return wait
+	}
+	// The current window alone is full: wait for it to become the previous window and
+	// then for enough of it to slide out
+	wait := window - elapsed
+	return wait + time.Duration((1-float64(limit)/float64(current))*float64(window))
+}
+
+// slidingWindowCount estimates the requests made in the window ending now from the counts
+// of the fixed window in progress and the one before it
+func slidingWindowCount(previous, current int, elapsed, window time.Duration) float64 {
+	overlap := 1 - float64(elapsed)/float64(window)
+	if overlap < 0 {
+		overlap = 0
+	}
+	return float64(previous)*overlap + float64(current)
+}
+
+// rateLimitIdentity is what a credential request is counted against besides its client IP
+type rateLimitIdentity struct {
+	Email  string
+	UserID int64
+}
+
+// checkRateLimitRules counts a request to a credential endpoint against every rule
+// configured for it, scoped to the calling application. It writes a 429 and records the
+// violation in the audit log when a rule's budget is exhausted.
+func (a *App) checkRateLimitRules(w http.ResponseWriter, r *http.Request, endpoint string, id rateLimitIdentity) bool {
+	result, exceeded := a.exceededRateLimitRule(r, endpoint, id)
+	if !exceeded {
+		return true
+	}
+	setRateLimitHeaders(w, result)
+	writeError(w, http.StatusTooManyRequests, "RATE_LIMIT_EXCEEDED", "Too many attempts, try again later")
+	return false
+}
+
+// exceededRateLimitRule counts a request against the rules of an endpoint and reports the
+// first rule whose budget is exhausted, after recording it in the audit log
+func (a *App) exceededRateLimitRule(r *http.Request, endpoint string, id rateLimitIdentity) (RateLimitResult, bool) {
+	if a.rateLimiter == nil {
+		return RateLimitResult{}, false
+	}
+	var appID int64
+	if app := applicationFromRequest(r); app != nil {
+		appID = app.ID
+	}
+	for _, rule := range a.RateLimitRules {
+		if rule.Endpoint != endpoint {
+			continue
+		}
+		var value string
+		switch rule.Key {
+		case "ip":
+			if ip := a.clientIP(r); ip.IsValid() {
+				value = ip.String()
+			}
+		case "email":
+			// Emails are hashed so counters never hold them in the clear
+			if email := strings.ToLower(strings.TrimSpace(id.Email)); email != "" {
+				value = hashToken(email)
+			}
+		case "user":
+			if id.UserID != 0 {
+				value = strconv.FormatInt(id.UserID, 10)
+			}
+		}
+		if value == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("rule:%d:%s:%s:%s", appID, endpoint, rule.Key, value)
+		result, err := a.rateLimiter.Allow(r.Context(), key, rule.Limit, rule.Window)
+		if err != nil {
+			log.Printf("rate limiter: %v", err)
+			continue
+		}
+		if result.Allowed {
+			continue
+		}
+
+		var userID *int64
+		if id.UserID != 0 {
+			userID = &id.UserID
+		}
+		details := map[string]interface{}{
+			"endpoint": endpoint,
+			"key":      rule.Key,
+			"limit":    rule.Limit,
+			"window":   rule.Window.String(),
+		}
+		if rule.Key == "email" {
+			// The hash the counter is keyed by: the audit log gets neither the address nor
+			// whatever a client sent in its place
+			details["email_hash"] = value
+		}
+		a.audit(r, auditRateLimitExceeded, userID, details)
+		return result, true
+	}
+	return RateLimitResult{}, false
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cfg "github.com/example/nileauth/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlidingWindowCount(t *testing.T) {
+	// a quarter into the window, three quarters of the previous window still overlap
+	require.InDelta(t, 75+10, slidingWindowCount(100, 10, 15*time.Second, time.Minute), 0.001)
+	require.InDelta(t, 10, slidingWindowCount(100, 10, time.Minute, time.Minute), 0.001)
+	require.InDelta(t, 100, slidingWindowCount(100, 0, 0, time.Minute), 0.001)
+}
+
+func TestSlidingWindowRetryAfter(t *testing.T) {
+	// at 20s two thirds of the previous 120 overlap (80 + 40); the estimate drops below
+	// 100 once only half of them do, at 30s
+	require.Equal(t, 10*time.Second, slidingWindowRetryAfter(120, 40, 20*time.Second, time.Minute, 100))
+	// the current window alone is full: wait for it to end, then for 1/6 of it to slide out
+	require.InDelta(t, 50*time.Second, slidingWindowRetryAfter(0, 120, 20*time.Second, time.Minute, 100), float64(time.Millisecond))
+}
+
+func TestMemoryRateLimiterSeparatesKeys(t *testing.T) {
+	rl := NewMemoryRateLimiter()
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		res, err := rl.Allow(ctx, "app:1", 3, time.Minute)
+		require.NoError(t, err)
+		require.True(t, res.Allowed)
+		require.Equal(t, 2-i, res.Remaining)
+	}
+	res, _ := rl.Allow(ctx, "app:1", 3, time.Minute)
+	require.False(t, res.Allowed)
+	require.InDelta(t, 20*time.Second, res.RetryAfter, float64(time.Second))
+	res, _ = rl.Allow(ctx, "app:2", 3, time.Minute)
+	require.True(t, res.Allowed)
+}
+
+func TestMemoryRateLimiterPicksUpChangedLimits(t *testing.T) {
+	rl := NewMemoryRateLimiter()
+	ctx := context.Background()
+	res, _ := rl.Allow(ctx, "app:1", 1, time.Minute)
+	require.True(t, res.Allowed)
+	res, _ = rl.Allow(ctx, "app:1", 1, time.Minute)
+	require.False(t, res.Allowed)
+
+	// raising the limit grows the bucket and its refill rate
+	res, _ = rl.Allow(ctx, "app:1", 600, time.Minute)
+	require.Equal(t, 600, res.Limit)
+	time.Sleep(250 * time.Millisecond)
+	res, _ = rl.Allow(ctx, "app:1", 600, time.Minute)
+	require.True(t, res.Allowed)
+}
+
+func TestRateLimitRulesCountPerIdentityAndAudit(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	a.rateLimiter = NewMemoryRateLimiter()
+	a.RateLimitRules = []cfg.RateLimitRule{{Endpoint: "login", Key: "email", Limit: 2, Window: time.Minute}}
+	handler := a.APIKeyAuth(http.HandlerFunc(a.HandleLogin))
+
+	login := func(email string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"email":"`+email+`","password":"wrong"}`))
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusUnauthorized, login("victim@example.com").Code)
+	}
+	rec := login("VICTIM@example.com")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("Retry-After"))
+	// other users of the same application are unaffected
+	require.Equal(t, http.StatusUnauthorized, login("someone@example.com").Code)
+
+	events, total, err := a.DB.ListAuditEvents(AuditEventFilter{Action: auditRateLimitExceeded})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	require.Equal(t, "login", events[0].Details["endpoint"])
+	require.Equal(t, hashToken("victim@example.com"), events[0].Details["email_hash"])
+	require.NotContains(t, events[0].Details, "email")
+	require.NotNil(t, events[0].ApplicationID)
+}
+
+func TestMemoryRateLimiterDropsIdleBuckets(t *testing.T) {
+	rl := NewMemoryRateLimiter()
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		_, err := rl.Allow(ctx, "rule:0:login:email:user"+strconv.Itoa(i)+"@example.com", 5, time.Minute)
+		require.NoError(t, err)
+	}
+	res, _ := rl.Allow(ctx, "app:1", 1, time.Hour)
+	require.True(t, res.Allowed)
+	require.Len(t, rl.buckets, 101)
+
+	// the next request after the sweep interval drops buckets idle for their window
+	rl.mu.Lock()
+	for _, bucket := range rl.buckets {
+		bucket.lastSeen = bucket.lastSeen.Add(-2 * time.Minute)
+	}
+	rl.lastSweep = rl.lastSweep.Add(-memoryRateLimitSweepInterval)
+	rl.mu.Unlock()
+	res, _ = rl.Allow(ctx, "app:2", 1, time.Hour)
+	require.True(t, res.Allowed)
+	require.Len(t, rl.buckets, 2)
+
+	// buckets still refilling are kept with their state
+	res, _ = rl.Allow(ctx, "app:1", 1, time.Hour)
+	require.False(t, res.Allowed)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Risk-based login scores every password and identity provider login against the
+// user's earlier successful ones. Medium-risk logins go through and the user is notified
+// by email; high-risk logins must be confirmed with the user's second factor or a code
+// sent by email.
+
+// Outcomes of a login attempt in the login history
+const (
+	loginSucceeded  = "success"
+	loginFailed     = "failure"
+	loginChallenged = "challenged" // waiting for MFA or an emailed confirmation code
+)
+
+const (
+	riskLow    = "low"
+	riskMedium = "medium"
+	riskHigh   = "high"
+)
+
+// riskWeights are the points each signal adds to a login's risk score, capped at 100
+var riskWeights = map[string]int{
+	"new_device":        20, // the client sent a device ID not seen before
+	"new_user_agent":    15, // no device ID was sent and the user agent is new
+	"new_ip_range":      15, // no earlier login from the /24 (IPv4) or /48 (IPv6)
+	"new_country":       25,
+	"impossible_travel": 60, // too far from the last login to have travelled in between
+	"recent_failures":   20, // three or more wrong passwords in the last hour
+	"many_failures":     40, // ten or more
+}
+
+const (
+	// loginHistoryWindow and loginHistoryLimit bound the history a login is compared with
+	loginHistoryWindow = 90 * 24 * time.Hour
+	loginHistoryLimit  = 500
+	loginFailureWindow = time.Hour
+	// Logins further apart than an airliner could fly in the time between them are
+	// impossible travel. Shorter hops are ignored: GeoIP is only accurate to a region.
+	maxTravelSpeedKmh   = 900
+	minTravelDistanceKm = 500
+)
+
+const (
+	purposeLoginConfirmation = "login_confirmation"
+	loginConfirmationTTL     = 10 * time.Minute
+)
+
+// scoreLogin rates a login attempt against the user's history, newest first, and
+// returns the score with the signals that raised it
+func scoreLogin(attempt *LoginEvent, history []*LoginEvent) (int, []string) {
+	devices, agents, ranges, countries := map[string]bool{}, map[string]bool{}, map[string]bool{}, map[string]bool{}
+	var successes, failures int
+	var previous *LoginEvent // the latest successful login with a location
+	for _, e := range history {
+		switch e.Outcome {
+		case loginFailed:
+			if attempt.CreatedAt.Sub(e.CreatedAt) <= loginFailureWindow {
+				failures++
+			}
+		case loginSucceeded:
+			successes++
+			devices[e.DeviceID] = true
+			agents[e.UserAgent] = true
+			ranges[ipRange(e.IP)] = true
+			if e.Country != "" {
+				countries[e.Country] = true
+			}
+			if previous == nil && e.Latitude != nil && e.Longitude != nil {
+				previous = e
+			}
+		}
+	}
+
+	var reasons []string
+	// A first login has nothing to be compared with
+	if successes > 0 {
+		if attempt.DeviceID != "" && !devices[attempt.DeviceID] {
+			reasons = append(reasons, "new_device")
+		} else if attempt.DeviceID == "" && !agents[attempt.UserAgent] {
+			reasons = append(reasons, "new_user_agent")
+		}
+		if !ranges[ipRange(attempt.IP)] {
+			reasons = append(reasons, "new_ip_range")
+		}
+		if attempt.Country != "" && len(countries) > 0 && !countries[attempt.Country] {
+			reasons = append(reasons, "new_country")
+		}
+		if previous != nil && impossibleTravel(previous, attempt) {
+			reasons = append(reasons, "impossible_travel")
+		}
+	}
+	switch {
+	case failures >= 10:
+		reasons = append(reasons, "many_failures")
+	case failures >= 3:
+		reasons = append(reasons, "recent_failures")
+	}
+
+	score := 0
+	for _, reason := range reasons {
+		score += riskWeights[reason]
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score, reasons
+}
+
+// ipRange returns the network an address belongs to for comparing logins: its /24 for
+// IPv4 and /48 for IPv6
+func ipRange(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	p, _ := addr.Prefix(bits)
+	return p.String()
+}
+
+// impossibleTravel reports whether the user could not have got from one login's
+// location to the other's in the time between them
+func impossibleTravel(from, to *LoginEvent) bool {
+	if to.Latitude == nil || to.Longitude == nil {
+		return false
+	}
+	km := distanceKm(*from.Latitude, *from.Longitude, *to.Latitude, *to.Longitude)
+	if km < minTravelDistanceKm {
+		return false
+	}
+	hours := to.CreatedAt.Sub(from.CreatedAt).Hours()
+	return hours <= 0 || km/hours > maxTravelSpeedKmh
+}
+
+// distanceKm is the great-circle distance between two coordinates
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// riskLevel maps a score to low, medium or high with the configured thresholds
+func (a *App) riskLevel(score int) string {
+	switch {
+	case score >= a.RiskHighScore:
+		return riskHigh
+	case score >= a.RiskMediumScore:
+		return riskMedium
+	}
+	return riskLow
+}
+
+// newLoginEvent describes a login attempt by the request's client
+func (a *App) newLoginEvent(r *http.Request, userID int64, app *Application, deviceID string) *LoginEvent {
+	e := &LoginEvent{UserID: userID, UserAgent: r.UserAgent(), CreatedAt: time.Now()}
+	if len(e.UserAgent) > 512 {
+		e.UserAgent = e.UserAgent[:512]
+	}
+	if app != nil {
+		e.ApplicationID = &app.ID
+	}
+	if deviceID != "" {
+		e.DeviceID = hashToken(deviceID)
+	}
+	ip := a.clientIP(r)
+	if !ip.IsValid() {
+		return e
+	}
+	e.IP = ip.String()
+	if a.GeoIP != nil {
+		loc, err := a.GeoIP.Lookup(ip)
+		if err != nil {
+			log.Printf("geoip lookup %s: %v", e.IP, err)
+		} else if loc != nil {
+			e.Country, e.City, e.Latitude, e.Longitude = loc.Country, loc.City, loc.Latitude, loc.Longitude
+		}
+	}
+	return e
+}
+
+// assessLogin scores a password-verified login. When the history cannot be read the
+// login is scored as if the user had none, so an outage does not lock everyone out.
+func (a *App) assessLogin(r *http.Request, user *User, app *Application, deviceID string) *LoginEvent {
+	e := a.newLoginEvent(r, user.ID, app, deviceID)
+	history, _, err := a.DB.ListLoginEvents(LoginEventFilter{UserID: user.ID, Since: e.CreatedAt.Add(-loginHistoryWindow), Limit: loginHistoryLimit})
+	if err != nil {
+		log.Printf("login history of user %d: %v", user.ID, err)
+	}
+	e.RiskScore, e.RiskReasons = scoreLogin(e, history)
+	e.RiskLevel = a.riskLevel(e.RiskScore)
+	return e
+}
+
+// recordLogin adds a login attempt to the history. Failures are logged and never fail
+// the request.
+func (a *App) recordLogin(e *LoginEvent, outcome string) {
+	e.Outcome = outcome
+	if err := a.DB.CreateLoginEvent(e); err != nil {
+		log.Printf("login event for user %d: %v", e.UserID, err)
+	}
+}
+
+// recordFailedLogin notes a wrong password against the user the login names, if any
+func (a *App) recordFailedLogin(r *http.Request, app *Application, email, deviceID string) {
+	user, err := a.DB.GetUserByEmail(userNamespace(app), email)
+	if err != nil || user == nil {
+		return
+	}
+	a.recordLogin(a.newLoginEvent(r, user.ID, app, deviceID), loginFailed)
+}
+
+// useChallenge uses up an answered challenge and marks its login successful. It reports
+// false when the challenge was already used.
+func (a *App) useChallenge(c *mfaChallenge) (bool, error) {
+	fresh, err := a.DB.RecordMFAChallenge(c.ID, c.ExpiresAt)
+	if err != nil || !fresh || c.LoginEventID == 0 {
+		return fresh, err
+	}
+	return a.DB.CompleteLoginEvent(c.LoginEventID)
+}
+
+// completeLogin uses up an answered challenge. It reports false after writing an error
+// when the challenge was already used.
+func (a *App) completeLogin(w http.ResponseWriter, c *mfaChallenge) bool {
+	ok, err := a.useChallenge(c)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to complete login")
+		return false
+	}
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "This login was already completed")
+		return false
+	}
+	return true
+}
+
+// loginDetails describes a login for the emails sent about it
+func loginDetails(e *LoginEvent) string {
+	details := "Time: " + e.CreatedAt.UTC().Format(time.RFC1123) + "\n"
+	details += "IP address: " + e.IP + "\n"
+	if place := strings.Trim(e.City+", "+e.Country, ", "); place != "" {
+		details += "Location: " + place + "\n"
+	}
+	if e.UserAgent != "" {
+		details += "Device: " + e.UserAgent + "\n"
+	}
+	return details
+}
+
+// notifyUnusualLogin tells the user about a medium-risk login. Failures are logged.
+func (a *App) notifyUnusualLogin(user *User, e *LoginEvent) {
+	body := "Your account was just signed in to from a device or place we have not seen before.\n\n" +
+		loginDetails(e) +
+		"\nIf this was you, there is nothing to do. If not, reset your password now.\n"
+	if err := a.Mailer.Send(user.Email, "New sign-in to your account", body); err != nil {
+		log.Printf("login notification for user %d: %v", user.ID, err)
+	}
+}
+
+// loginConfirmationCodeHash keys the emailed code, so the confirmation token it travels
+// in cannot be brute-forced offline
+func loginConfirmationCodeHash(code string) string {
+	mac := hmac.New(sha256.New, purposeKey(purposeLoginConfirmation+":code"))
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// errConfirmationNotSent means the email carrying a login confirmation code failed
+var errConfirmationNotSent = errors.New("confirmation code could not be sent")
+
+// sendLoginConfirmation emails a high-risk login's user a one-time code. It returns the
+// challenge the code answers and the code's hash to carry with it.
+func (a *App) sendLoginConfirmation(user *User, c mfaChallenge, e *LoginEvent) (mfaChallenge, string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return c, "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	if c, err = newMFAChallenge(c); err != nil {
+		return c, "", err
+	}
+	body := "Someone signed in to your account from a device or place we have not seen before.\n\n" +
+		loginDetails(e) +
+		"\nIf this was you, confirm the sign-in with this code: " + code + "\n" +
+		fmt.Sprintf("\nThe code expires in %d minutes. If this was not you, reset your password: whoever signed in knows it.\n", int(loginConfirmationTTL.Minutes()))
+	if err := a.Mailer.Send(user.Email, "Confirm your sign-in", body); err != nil {
+		log.Printf("login confirmation for user %d: %v", user.ID, err)
+		return c, "", errConfirmationNotSent
+	}
+	return c, loginConfirmationCodeHash(code), nil
+}
+
+// writeLoginConfirmationRequired emails a high-risk login's user a one-time code and
+// answers with the token to send back with it
+func (a *App) writeLoginConfirmationRequired(w http.ResponseWriter, user *User, c mfaChallenge, e *LoginEvent) {
+	c, codeHash, err := a.sendLoginConfirmation(user, c, e)
+	if err == errConfirmationNotSent {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to send confirmation code")
+		return
+	}
+	var token string
+	if err == nil {
+		claims := c.claims()
+		claims["code"] = codeHash
+		token, err = signPurposeToken(purposeLoginConfirmation, claims, loginConfirmationTTL)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to start login confirmation")
+		return
+	}
+	writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+		"error_code":        "LOGIN_CONFIRMATION_REQUIRED",
+		"error_message":     "This login must be confirmed with the code sent by email",
+		"confirmationToken": token,
+	})
+}
+
+// HandleConfirmLogin completes a login that answered LOGIN_CONFIRMATION_REQUIRED
+// POST /api/v1/auth/login/confirm
+func (a *App) HandleConfirmLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ConfirmationToken string `json:"confirmationToken"`
+		Code              string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if req.ConfirmationToken == "" || req.Code == "" {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "confirmationToken and code are required")
+		return
+	}
+	app := applicationFromRequest(r)
+	claims, err := parsePurposeToken(purposeLoginConfirmation, req.ConfirmationToken)
+	var challenge *mfaChallenge
+	if err == nil {
+		challenge, err = challengeFromClaims(claims, app)
+	}
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Confirmation token is invalid or expired")
+		return
+	}
+	user, _ := a.DB.GetUserByID(challenge.UserID)
+	if user == nil {
+		writeError(w, http.StatusUnauthorized, "INVALID_TOKEN", "Confirmation token is invalid or expired")
+		return
+	}
+	if user.Disabled {
+		writeError(w, http.StatusForbidden, "USER_DISABLED", "User account is disabled")
+		return
+	}
+	if !a.checkRateLimitRules(w, r, "login", rateLimitIdentity{Email: user.Email}) {
+		return
+	}
+	want, _ := claims["code"].(string)
+	if !hmac.Equal([]byte(want), []byte(loginConfirmationCodeHash(strings.TrimSpace(req.Code)))) {
+		writeError(w, http.StatusUnauthorized, "INVALID_CONFIRMATION_CODE", "Invalid confirmation code")
+		return
+	}
+	if !a.completeLogin(w, challenge) {
+		return
+	}
+
+	access, ref, err := a.issueTokens(tokenGrant{User: user, ApplicationID: challenge.ApplicationID, OrganizationID: challenge.OrganizationID, Login: newAuthentication(amrPassword)})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Failed to issue tokens")
+		return
+	}
+	writeSession(w, r, http.StatusOK, app, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":    user.ID,
+			"email": user.Email,
+		},
+		"accessToken": access,
+	}, ref)
+}
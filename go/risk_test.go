@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// mmdbTestWriter builds MaxMind DB files for tests. Values are strings, float64s, bools,
+// uint16s, maps and mmdbTestPointer to an earlier value.
+type mmdbTestWriter struct {
+	ipVersion int
+	nodes     [][2]int // node index, mmdbTestEmpty, or mmdbTestData-k for record k
+	data      bytes.Buffer
+	offsets   []int
+}
+
+type mmdbTestPointer int
+
+const (
+	mmdbTestEmpty = -1
+	mmdbTestData  = -2
+)
+
+func newMMDBTestWriter(ipVersion int) *mmdbTestWriter {
+	return &mmdbTestWriter{ipVersion: ipVersion, nodes: [][2]int{{mmdbTestEmpty, mmdbTestEmpty}}}
+}
+
+// insert maps a prefix to a record and returns the record's data offset
+func (w *mmdbTestWriter) insert(prefix string, record interface{}) int {
+	p := netip.MustParsePrefix(prefix)
+	addr, bits := p.Addr().AsSlice(), p.Bits()
+	if w.ipVersion == 6 && p.Addr().Is4() {
+		addr, bits = append(make([]byte, 12), addr...), bits+96
+	}
+	w.offsets = append(w.offsets, w.data.Len())
+	w.encode(&w.data, record)
+	node := 0
+	for i := 0; i < bits; i++ {
+		bit := int(addr[i/8]>>(7-i%8)) & 1
+		if i == bits-1 {
+			w.nodes[node][bit] = mmdbTestData - (len(w.offsets) - 1)
+			break
+		}
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int{mmdbTestEmpty, mmdbTestEmpty})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+	return w.offsets[len(w.offsets)-1]
+}
+
+func (w *mmdbTestWriter) encode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		buf.WriteByte(2<<5 | byte(len(v)))
+		buf.WriteString(v)
+	case float64:
+		buf.WriteByte(3<<5 | 8)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		buf.WriteByte(5<<5 | 2)
+		binary.Write(buf, binary.BigEndian, v)
+	case bool:
+		// bool is an extended type: type 0 in the control byte, then 14-7
+		size := byte(0)
+		if v {
+			size = 1
+		}
+		buf.Write([]byte{size, 14 - 7})
+	case mmdbTestPointer:
+		buf.Write([]byte{1<<5 | byte(v>>8)&7, byte(v)})
+	case map[string]interface{}:
+		buf.WriteByte(7<<5 | byte(len(v)))
+		for key, value := range v {
+			w.encode(buf, key)
+			w.encode(buf, value)
+		}
+	default:
+		panic("mmdbTestWriter: unsupported value")
+	}
+}
+
+func (w *mmdbTestWriter) bytes(recordSize int) []byte {
+	n := len(w.nodes)
+	value := func(r int) uint32 {
+		switch {
+		case r == mmdbTestEmpty:
+			return uint32(n)
+		case r <= mmdbTestData:
+			return uint32(n + 16 + w.offsets[mmdbTestData-r])
+		}
+		return uint32(r)
+	}
+	var out bytes.Buffer
+	for _, node := range w.nodes {
+		l, r := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 28:
+			out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(l>>24)<<4 | byte(r>>24), byte(r >> 16), byte(r >> 8), byte(r)})
+		case 32:
+			binary.Write(&out, binary.BigEndian, [2]uint32{l, r})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(w.data.Bytes())
+	out.Write(mmdbMetadataMarker)
+	w.encode(&out, map[string]interface{}{
+		"node_count":    uint16(n),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(w.ipVersion),
+		"database_type": "Test-City",
+	})
+	return out.Bytes()
+}
+
+func testGeoRecord(country, city string, lat, lon float64) map[string]interface{} {
+	return map[string]interface{}{
+		"country":  map[string]interface{}{"iso_code": country, "is_in_european_union": false},
+		"city":     map[string]interface{}{"names": map[string]interface{}{"en": city, "de": city}},
+		"location": map[string]interface{}{"latitude": lat, "longitude": lon},
+	}
+}
+
+// newTestGeoIPDatabase locates 81.2.69.0/24 and 81.2.71.0/24 in London and 2001:db8::/32
+// in New York
+func newTestGeoIPDatabase(t *testing.T, recordSize int) *GeoIPDatabase {
+	w := newMMDBTestWriter(6)
+	london := w.insert("81.2.69.0/24", testGeoRecord("GB", "London", 51.5142, -0.0931))
+	w.insert("81.2.71.0/24", mmdbTestPointer(london))
+	w.insert("2001:db8::/32", testGeoRecord("US", "New York", 40.7128, -74.006))
+	g, err := parseGeoIPDatabase(w.bytes(recordSize))
+	require.NoError(t, err)
+	return g
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	for _, size := range []int{24, 28, 32} {
+		g := newTestGeoIPDatabase(t, size)
+		loc, err := g.Lookup(netip.MustParseAddr("81.2.69.160"))
+		require.NoError(t, err, size)
+		require.Equal(t, "GB", loc.Country)
+		require.Equal(t, "London", loc.City)
+		require.InDelta(t, 51.5142, *loc.Latitude, 1e-9)
+		require.InDelta(t, -0.0931, *loc.Longitude, 1e-9)
+
+		// pointers resolve to the value they point at
+		loc, err = g.Lookup(netip.MustParseAddr("::ffff:81.2.71.1"))
+		require.NoError(t, err, size)
+		require.Equal(t, "London", loc.City)
+
+		loc, err = g.Lookup(netip.MustParseAddr("2001:db8:1::1"))
+		require.NoError(t, err, size)
+		require.Equal(t, "New York", loc.City)
+
+		for _, ip := range []string{"81.2.70.1", "10.0.0.1", "2001:db9::1"} {
+			loc, err = g.Lookup(netip.MustParseAddr(ip))
+			require.NoError(t, err, ip)
+			require.Nil(t, loc, ip)
+		}
+	}
+
+	// IPv4 databases have no answer for IPv6 addresses
+	w := newMMDBTestWriter(4)
+	w.insert("81.2.69.0/24", testGeoRecord("GB", "London", 51.5142, -0.0931))
+	g, err := parseGeoIPDatabase(w.bytes(24))
+	require.NoError(t, err)
+	loc, err := g.Lookup(netip.MustParseAddr("81.2.69.1"))
+	require.NoError(t, err)
+	require.Equal(t, "London", loc.City)
+	loc, err = g.Lookup(netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	require.Nil(t, loc)
+
+	_, err = parseGeoIPDatabase([]byte("not a database"))
+	require.Error(t, err)
+	// a truncated data section is reported rather than read past
+	raw := w.bytes(24)
+	at := bytes.Index(raw, []byte("London"))
+	truncated := append(append([]byte{}, raw[:at]...), raw[bytes.LastIndex(raw, mmdbMetadataMarker):]...)
+	g, err = parseGeoIPDatabase(truncated)
+	require.NoError(t, err)
+	_, err = g.Lookup(netip.MustParseAddr("81.2.69.1"))
+	require.Error(t, err)
+}
+
+func TestScoreLogin(t *testing.T) {
+	now := time.Now()
+	lat, lon := 51.5, -0.1
+	nyLat, nyLon := 40.7, -74.0
+	known := &LoginEvent{Outcome: loginSucceeded, IP: "81.2.69.10", UserAgent: "Firefox", DeviceID: "laptop", Country: "GB", Latitude: &lat, Longitude: &lon, CreatedAt: now.Add(-2 * time.Hour)}
+	failure := func(ago time.Duration) *LoginEvent {
+		return &LoginEvent{Outcome: loginFailed, CreatedAt: now.Add(-ago)}
+	}
+
+	tests := []struct {
+		name    string
+		attempt LoginEvent
+		history []*LoginEvent
+		score   int
+		reasons []string
+	}{
+		{"first login", LoginEvent{IP: "203.0.113.1", DeviceID: "phone"}, nil, 0, nil},
+		{"familiar", LoginEvent{IP: "81.2.69.200", UserAgent: "Firefox", DeviceID: "laptop", Country: "GB"}, []*LoginEvent{known}, 0, nil},
+		{"new device and range", LoginEvent{IP: "81.2.70.1", DeviceID: "phone"}, []*LoginEvent{known}, 35, []string{"new_device", "new_ip_range"}},
+		{"new user agent", LoginEvent{IP: "81.2.69.10", UserAgent: "curl"}, []*LoginEvent{known}, 15, []string{"new_user_agent"}},
+		{"challenged logins are not familiar", LoginEvent{IP: "81.2.70.1", DeviceID: "laptop"}, []*LoginEvent{{Outcome: loginChallenged, IP: "81.2.70.1"}, known}, 15, []string{"new_ip_range"}},
+		{
+			"impossible travel", LoginEvent{IP: "2001:db8::1", DeviceID: "laptop", Country: "US", Latitude: &nyLat, Longitude: &nyLon},
+			[]*LoginEvent{known}, 100, []string{"new_ip_range", "new_country", "impossible_travel"},
+		},
+		{"failures", LoginEvent{IP: "81.2.69.10", DeviceID: "laptop"}, []*LoginEvent{failure(time.Minute), failure(2 * time.Minute), failure(3 * time.Minute), failure(2 * time.Hour), known}, 20, []string{"recent_failures"}},
+	}
+	for _, tc := range tests {
+		tc.attempt.CreatedAt = now
+		score, reasons := scoreLogin(&tc.attempt, tc.history)
+		require.Equal(t, tc.score, score, tc.name)
+		require.Equal(t, tc.reasons, reasons, tc.name)
+	}
+
+	// the same trip is possible given a day
+	known.CreatedAt = now.Add(-24 * time.Hour)
+	_, reasons := scoreLogin(&LoginEvent{IP: "81.2.69.10", DeviceID: "laptop", Country: "GB", Latitude: &nyLat, Longitude: &nyLon, CreatedAt: now}, []*LoginEvent{known})
+	require.Empty(t, reasons)
+
+	require.Equal(t, "81.2.69.0/24", ipRange("81.2.69.10"))
+	require.Equal(t, "81.2.69.0/24", ipRange("::ffff:81.2.69.10"))
+	require.Equal(t, "2001:db8:1::/48", ipRange("2001:db8:1:2::1"))
+	require.InDelta(t, 5570, distanceKm(51.5, -0.1, 40.7, -74.0), 10)
+}
+
+func TestRiskBasedLogin(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	mailer := &recordingMailer{}
+	a.Mailer = mailer
+	a.GeoIP = newTestGeoIPDatabase(t, 24)
+	app, _ := a.validateAPIKey(plain)
+	hashed, err := hashPassword("secret-pw")
+	require.NoError(t, err)
+	user, err := a.DB.CreateUser("jane@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+
+	auth := func(handler http.HandlerFunc, ip, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/v1/auth", strings.NewReader(body))
+		req.RemoteAddr = netip.AddrPortFrom(netip.MustParseAddr(ip), 4000).String()
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(handler).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec.Code, out
+	}
+	login := func(ip, device, password string) (int, map[string]interface{}) {
+		return auth(a.HandleLogin, ip, `{"email":"jane@example.com","password":"`+password+`","deviceId":"`+device+`"}`)
+	}
+
+	// familiar logins go straight through
+	status, _ := login("81.2.69.10", "laptop", "secret-pw")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = login("81.2.69.11", "laptop", "secret-pw")
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, mailer.sent)
+
+	// a new device on a new network is medium risk: allowed, and the user is told
+	status, _ = login("81.2.70.1", "phone", "secret-pw")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, mailer.sent, 1)
+	require.Contains(t, mailer.sent[0], "New sign-in to your account")
+	require.Contains(t, mailer.sent[0], "IP address: 81.2.70.1")
+
+	// minutes later from across the Atlantic is high risk and must be confirmed by email
+	status, body := login("2001:db8::1", "tablet", "secret-pw")
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "LOGIN_CONFIRMATION_REQUIRED", body["error_code"])
+	require.NotContains(t, body, "accessToken")
+	token := body["confirmationToken"].(string)
+	require.Len(t, mailer.sent, 2)
+	require.Contains(t, mailer.sent[1], "Location: New York, US")
+	code := mailer.sent[1][strings.Index(mailer.sent[1], "this code: ")+len("this code: "):][:6]
+
+	confirm := func(code string) (int, map[string]interface{}) {
+		return auth(a.HandleConfirmLogin, "2001:db8::1", `{"confirmationToken":"`+token+`","code":"`+code+`"}`)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	status, body = confirm(wrong)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "INVALID_CONFIRMATION_CODE", body["error_code"])
+	status, body = confirm(code)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEmpty(t, body["accessToken"])
+	// confirmation codes work once
+	status, body = confirm(code)
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "INVALID_TOKEN", body["error_code"])
+
+	// wrong passwords count against the next login
+	for i := 0; i < 3; i++ {
+		status, _ = login("81.2.70.1", "phone", "wrong")
+		require.Equal(t, http.StatusUnauthorized, status)
+	}
+	status, _ = login("81.2.70.1", "phone", "secret-pw")
+	require.Equal(t, http.StatusOK, status)
+
+	// users with MFA answer risky logins with their one-time code instead
+	secret, err := generateTOTPSecret()
+	require.NoError(t, err)
+	require.NoError(t, a.DB.SetUserTOTPSecret(user.ID, secret))
+	status, body = login("81.2.69.50", "kiosk", "secret-pw")
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "MFA_REQUIRED", body["error_code"])
+	otp, err := totpCode(secret, uint64(time.Now().Unix()/30))
+	require.NoError(t, err)
+	status, _ = auth(a.HandleVerifyMFA, "81.2.69.50", `{"mfaToken":"`+body["mfaToken"].(string)+`","code":"`+otp+`"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, mailer.sent, 2)
+
+	// administrators see the history with its scores
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id:[0-9]+}/logins", a.HandleListUserLogins).Methods("GET")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/users/"+strconv.FormatInt(user.ID, 10)+"/logins?limit=3", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var out struct {
+		Data struct {
+			Logins []map[string]interface{} `json:"logins"`
+			Total  int                      `json:"total"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+	require.Equal(t, 9, out.Data.Total)
+	require.Len(t, out.Data.Logins, 3)
+	mfa, afterFailures := out.Data.Logins[0], out.Data.Logins[1]
+	require.Equal(t, loginSucceeded, mfa["outcome"])
+	require.Equal(t, riskHigh, mfa["risk_level"])
+	require.Equal(t, "GB", mfa["country"])
+	require.Contains(t, mfa["risk_reasons"], "impossible_travel")
+	require.Equal(t, []interface{}{"recent_failures"}, afterFailures["risk_reasons"])
+	require.Equal(t, loginFailed, out.Data.Logins[2]["outcome"])
+}
+
+func TestHostedLoginIsScored(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	mailer := &recordingMailer{}
+	a.Mailer = mailer
+	a.GeoIP = newTestGeoIPDatabase(t, 24)
+	app, _ := a.validateAPIKey(plain)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+	hashed, err := hashPassword("secret-pw")
+	require.NoError(t, err)
+	user, err := a.DB.CreateUser("jane@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	authorize := url.Values{
+		"client_id":    {strconv.FormatInt(app.ID, 10)},
+		"redirect_uri": {"https://bench.example.com/callback"},
+	}
+	browser := &hostedBrowser{t: t, ip: "81.2.69.10"}
+
+	rec := browser.login(a, authorize, "jane@example.com", "secret-pw")
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	// wrong passwords on the hosted page count against the next login, which is reported
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusUnauthorized, browser.login(a, authorize, "jane@example.com", "wrong").Code)
+	}
+	browser.ip = "81.2.70.1"
+	rec = browser.login(a, authorize, "jane@example.com", "secret-pw")
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Len(t, mailer.sent, 1)
+	require.Contains(t, mailer.sent[0], "New sign-in to your account")
+
+	// a high-risk login goes back to the application only with the emailed code
+	browser.ip = "2001:db8::1"
+	rec = browser.login(a, authorize, "jane@example.com", "secret-pw")
+	require.Equal(t, http.StatusOK, rec.Code)
+	page := rec.Body.String()
+	require.Contains(t, page, `action="/hosted/confirm"`)
+	require.Len(t, mailer.sent, 2)
+	code := mailer.sent[1][strings.Index(mailer.sent[1], "this code: ")+len("this code: "):][:6]
+	confirm := func(code string) *httptest.ResponseRecorder {
+		return browser.do(a.HandleHostedConfirm, "POST", "/hosted/confirm", url.Values{
+			"csrf": {browser.field(page, "csrf")},
+			"flow": {browser.field(page, "flow")},
+			"code": {code},
+		})
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	require.Equal(t, http.StatusUnauthorized, confirm(wrong).Code)
+	rec = confirm(code)
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Contains(t, rec.Header().Get("Location"), "code=")
+	require.Equal(t, http.StatusBadRequest, confirm(code).Code)
+
+	logins, total, err := a.DB.ListLoginEvents(LoginEventFilter{UserID: user.ID, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, 6, total)
+	require.Equal(t, loginSucceeded, logins[0].Outcome)
+	require.Equal(t, riskHigh, logins[0].RiskLevel)
+	require.Equal(t, riskMedium, logins[1].RiskLevel)
+	require.Contains(t, logins[1].RiskReasons, "recent_failures")
+	require.Equal(t, loginFailed, logins[2].Outcome)
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SAML 2.0 names used by the web browser SSO profile
+const (
+	samlProtocolNS        = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS       = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS        = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlHTTPPostBinding   = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearerMethod      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlEmailNameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+)
+
+const (
+	// samlRequestTTL bounds the time a user may spend at the identity provider
+	samlRequestTTL = 10 * time.Minute
+	// samlClockSkew is the leeway given to the identity provider's clock
+	samlClockSkew = 2 * time.Minute
+	// samlRequestCookie holds the AuthnRequest ID, so a response is only accepted by the
+	// browser that started the login
+	samlRequestCookie = "nile_saml_request"
+	// samlResponseMaxBytes bounds the posted SAMLResponse form
+	samlResponseMaxBytes = 1 << 20
+)
+
+// samlConnectionAvailable reports whether a connection signs users in to an application
+func samlConnectionAvailable(c *SAMLConnection, app *Application) bool {
+	return c.Active && c.ApplicationID == app.ID
+}
+
+// samlServiceProvider holds the endpoints of a connection as the identity provider sees them
+type samlServiceProvider struct {
+	EntityID string // also the metadata URL
+	ACSURL   string
+}
+
+func (a *App) samlServiceProvider(r *http.Request, c *SAMLConnection) samlServiceProvider {
+	base := a.publicURL(r) + "/hosted/saml/" + url.PathEscape(c.Name)
+	return samlServiceProvider{EntityID: base + "/metadata", ACSURL: base + "/acs"}
+}
+
+// generateSAMLKeyPair creates the key and self-signed certificate a connection signs its
+// AuthnRequests with
+func generateSAMLKeyPair(name string) (keyPEM, certPEM string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "nileAuth SAML " + name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return keyPEM, certPEM, nil
+}
+
+// xmlEscape escapes text for an XML attribute or element
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// samlMetadata describes the service provider of a connection
+func samlMetadata(c *SAMLConnection, sp samlServiceProvider) (string, error) {
+	block, _ := pem.Decode([]byte(c.SPCertificate))
+	if block == nil {
+		return "", errors.New("connection has no service provider certificate")
+	}
+	return `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<md:EntityDescriptor xmlns:md="` + samlMetadataNS + `" entityID="` + xmlEscape(sp.EntityID) + `">` +
+		`<md:SPSSODescriptor AuthnRequestsSigned="true" WantAssertionsSigned="true" protocolSupportEnumeration="` + samlProtocolNS + `">` +
+		`<md:KeyDescriptor use="signing"><ds:KeyInfo xmlns:ds="` + xmldsigNS + `"><ds:X509Data><ds:X509Certificate>` +
+		base64.StdEncoding.EncodeToString(block.Bytes) +
+		`</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>` +
+		`<md:NameIDFormat>` + samlEmailNameIDFormat + `</md:NameIDFormat>` +
+		`<md:AssertionConsumerService Binding="` + samlHTTPPostBinding + `" Location="` + xmlEscape(sp.ACSURL) + `" index="0" isDefault="true"/>` +
+		`</md:SPSSODescriptor></md:EntityDescriptor>` + "\n", nil
+}
+
+// authnRequestURL sends an AuthnRequest with the HTTP-Redirect binding, signed with the
+// connection's key
+func authnRequestURL(c *SAMLConnection, sp samlServiceProvider, id string, now time.Time) (string, error) {
+	policy := `<samlp:NameIDPolicy AllowCreate="true"/>`
+	if c.EmailAttribute == "" {
+		policy = `<samlp:NameIDPolicy Format="` + samlEmailNameIDFormat + `" AllowCreate="true"/>`
+	}
+	request := `<samlp:AuthnRequest xmlns:samlp="` + samlProtocolNS + `" xmlns:saml="` + samlAssertionNS + `"` +
+		` ID="` + id + `" Version="2.0" IssueInstant="` + now.UTC().Format(time.RFC3339) + `"` +
+		` Destination="` + xmlEscape(c.IdPSSOURL) + `" AssertionConsumerServiceURL="` + xmlEscape(sp.ACSURL) + `"` +
+		` ProtocolBinding="` + samlHTTPPostBinding + `">` +
+		`<saml:Issuer>` + xmlEscape(sp.EntityID) + `</saml:Issuer>` + policy + `</samlp:AuthnRequest>`
+
+	var deflated bytes.Buffer
+	fw, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	fw.Write([]byte(request))
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode([]byte(c.SPPrivateKey))
+	if block == nil {
+		return "", errors.New("connection has no service provider key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	// The signature covers the query exactly as it is sent
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes())) +
+		"&SigAlg=" + url.QueryEscape(rsaSHA256SignatureMethod)
+	sum := sha256.Sum256([]byte(query))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+	sep := "?"
+	if strings.Contains(c.IdPSSOURL, "?") {
+		sep = "&"
+	}
+	return c.IdPSSOURL + sep + query, nil
+}
+
+// samlAssertion is what a verified response says about the user
+type samlAssertion struct {
+	ID           string
+	InResponseTo string
+	NameID       string
+	Attributes   map[string][]string
+	// ExpiresAt is when the assertion stops being acceptable, so its ID can be forgotten
+	ExpiresAt time.Time
+}
+
+func parseSAMLTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseSAMLResponse verifies a response posted to a connection's ACS: the signature of the
+// response or its assertion, the issuer, the bearer confirmation, the time conditions and
+// the audience. Unsolicited responses are refused.
+func parseSAMLResponse(c *SAMLConnection, sp samlServiceProvider, data []byte, now time.Time) (*samlAssertion, error) {
+	root, err := parseXMLTree(data)
+	if err != nil {
+		return nil, err
+	}
+	if !root.is(samlProtocolNS, "Response") || root.attr("Version") != "2.0" {
+		return nil, errors.New("not a SAML 2.0 response")
+	}
+	if dest := root.attr("Destination"); dest != "" && dest != sp.ACSURL {
+		return nil, fmt.Errorf("response is destined for %s", dest)
+	}
+	if issuer := root.element(samlAssertionNS, "Issuer"); issuer != nil && issuer.text() != c.IdPEntityID {
+		return nil, fmt.Errorf("response issued by %s", issuer.text())
+	}
+	if status := root.element(samlProtocolNS, "Status").element(samlProtocolNS, "StatusCode").attr("Value"); status != samlStatusSuccess {
+		return nil, fmt.Errorf("identity provider answered %s", status)
+	}
+	inResponseTo := root.attr("InResponseTo")
+	if inResponseTo == "" {
+		return nil, errors.New("unsolicited responses are not accepted")
+	}
+	if len(root.elements(samlAssertionNS, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	assertions := root.elements(samlAssertionNS, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("response must hold exactly one assertion")
+	}
+	as := assertions[0]
+
+	// Either signature will do, but every signature present must verify
+	certs, err := parseCertificates(c.IdPCertificate)
+	if err != nil {
+		return nil, err
+	}
+	signed := false
+	for _, n := range []*xmlNode{root, as} {
+		switch err := verifyXMLSignature(n, certs); err {
+		case nil:
+			signed = true
+		case errUnsigned:
+		default:
+			return nil, err
+		}
+	}
+	if !signed {
+		return nil, errors.New("neither the response nor the assertion is signed")
+	}
+
+	if as.attr("ID") == "" {
+		return nil, errors.New("assertion has no ID")
+	}
+	if issuer := as.element(samlAssertionNS, "Issuer").text(); issuer != c.IdPEntityID {
+		return nil, fmt.Errorf("assertion issued by %s", issuer)
+	}
+	subject := as.element(samlAssertionNS, "Subject")
+	nameID := subject.element(samlAssertionNS, "NameID").text()
+	if nameID == "" {
+		return nil, errors.New("assertion has no subject")
+	}
+	var expiresAt time.Time
+	for _, sc := range subject.elements(samlAssertionNS, "SubjectConfirmation") {
+		data := sc.element(samlAssertionNS, "SubjectConfirmationData")
+		if sc.attr("Method") != samlBearerMethod || data.attr("Recipient") != sp.ACSURL {
+			continue
+		}
+		if irt := data.attr("InResponseTo"); irt != "" && irt != inResponseTo {
+			continue
+		}
+		notOnOrAfter, err := parseSAMLTime(data.attr("NotOnOrAfter"))
+		if err != nil || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			continue
+		}
+		expiresAt = notOnOrAfter
+		break
+	}
+	if expiresAt.IsZero() {
+		return nil, errors.New("assertion has no valid bearer confirmation")
+	}
+
+	conditions := as.element(samlAssertionNS, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("assertion has no conditions")
+	}
+	if nb := conditions.attr("NotBefore"); nb != "" {
+		notBefore, err := parseSAMLTime(nb)
+		if err != nil || now.Add(samlClockSkew).Before(notBefore) {
+			return nil, errors.New("assertion is not valid yet")
+		}
+	}
+	if na := conditions.attr("NotOnOrAfter"); na != "" {
+		notOnOrAfter, err := parseSAMLTime(na)
+		if err != nil || !now.Before(notOnOrAfter.Add(samlClockSkew)) {
+			return nil, errors.New("assertion expired")
+		}
+		if notOnOrAfter.After(expiresAt) {
+			expiresAt = notOnOrAfter
+		}
+	}
+	// Every audience restriction must name this service provider
+	restrictions := conditions.elements(samlAssertionNS, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, errors.New("assertion has no audience restriction")
+	}
+	for _, restriction := range restrictions {
+		found := false
+		for _, audience := range restriction.elements(samlAssertionNS, "Audience") {
+			found = found || audience.text() == sp.EntityID
+		}
+		if !found {
+			return nil, errors.New("assertion is meant for another audience")
+		}
+	}
+
+	attributes := map[string][]string{}
+	for _, statement := range as.elements(samlAssertionNS, "AttributeStatement") {
+		for _, attribute := range statement.elements(samlAssertionNS, "Attribute") {
+			for _, value := range attribute.elements(samlAssertionNS, "AttributeValue") {
+				attributes[attribute.attr("Name")] = append(attributes[attribute.attr("Name")], value.text())
+			}
+		}
+	}
+	return &samlAssertion{
+		ID:           as.attr("ID"),
+		InResponseTo: inResponseTo,
+		NameID:       nameID,
+		Attributes:   attributes,
+		ExpiresAt:    expiresAt.Add(samlClockSkew),
+	}, nil
+}
+
+// samlEmail reads the user's email from an assertion, refusing domains the connection
+// does not own
+func samlEmail(c *SAMLConnection, as *samlAssertion) (string, error) {
+	email := as.NameID
+	if c.EmailAttribute != "" {
+		values := as.Attributes[c.EmailAttribute]
+		if len(values) == 0 {
+			return "", fmt.Errorf("assertion has no %s attribute", c.EmailAttribute)
+		}
+		email = values[0]
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return "", errors.New("assertion has no email")
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, d := range c.Domains {
+		if d == domain {
+			return email, nil
+		}
+	}
+	return "", fmt.Errorf("email domain %s is not allowed", domain)
+}
+
+// errSAMLAccountExists is an assertion naming a global user the connection did not provision
+var errSAMLAccountExists = errors.New("email belongs to a global user the connection does not sign in")
+
+// samlUser finds or provisions the user an assertion names and adds them to the
+// connection's organization. A connection's email domains are not verified, so it only
+// signs in the users it provisioned and, in an application's own namespace, adopts the
+// existing ones; accounts in the global pool are never taken over.
+func (a *App) samlUser(r *http.Request, c *SAMLConnection, app *Application, email string) (*User, error) {
+	user, err := a.DB.GetUserByEmail(userNamespace(app), email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		if user, err = a.provisionUser(r, app, email, map[string]interface{}{"saml_connection": c.Name}); err != nil {
+			return nil, err
+		}
+	} else {
+		bound, err := a.DB.SAMLUserBound(c.ID, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !bound && userNamespace(app) == globalNamespace {
+			return nil, errSAMLAccountExists
+		}
+	}
+	if err := a.DB.BindSAMLUser(c.ID, user.ID); err != nil {
+		return nil, err
+	}
+	if c.OrganizationID != nil {
+		member, err := a.DB.GetOrganizationMember(*c.OrganizationID, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if member == nil {
+			if err := a.DB.UpsertOrganizationMember(*c.OrganizationID, user.ID, orgRoleMember); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return user, nil
+}
+
+// HandleSAMLMetadata publishes the service provider metadata of a connection
+// GET /hosted/saml/{name}/metadata
+func (a *App) HandleSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	c, err := a.DB.GetSAMLConnectionByName(mux.Vars(r)["name"])
+	if err != nil || c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	metadata, err := samlMetadata(c, a.samlServiceProvider(r, c))
+	if err != nil {
+		log.Printf("saml connection %s: %v", c.Name, err)
+		http.Error(w, "metadata unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write([]byte(metadata))
+}
+
+// HandleHostedSAML sends the browser to a connection's identity provider with a signed
+// AuthnRequest
+// GET /hosted/saml/{name}
+func (a *App) HandleHostedSAML(w http.ResponseWriter, r *http.Request) {
+	r, auth, ok := a.beginHosted(w, r)
+	if !ok {
+		return
+	}
+	c, err := a.DB.GetSAMLConnectionByName(mux.Vars(r)["name"])
+	if err != nil || c == nil || !samlConnectionAvailable(c, auth.App) {
+		a.renderError(w, r, http.StatusNotFound, auth, defaultCopy["idp.unavailable"])
+		return
+	}
+	// IDs must not start with a digit
+	token, err := genToken(20)
+	if err != nil {
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	now := time.Now()
+	pending := &SAMLRequest{
+		ID:           "_" + token,
+		ConnectionID: c.ID,
+		Request:      auth.values().Encode(),
+		ExpiresAt:    now.Add(samlRequestTTL).Unix(),
+	}
+	target, err := authnRequestURL(c, a.samlServiceProvider(r, c), pending.ID, now)
+	if err == nil {
+		err = a.DB.CreateSAMLRequest(pending)
+	}
+	if err != nil {
+		log.Printf("saml connection %s: %v", c.Name, err)
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	// The identity provider posts back cross-site, so the cookie must allow it
+	http.SetCookie(w, &http.Cookie{Name: samlRequestCookie, Value: pending.ID, Path: "/hosted/saml", MaxAge: int(samlRequestTTL.Seconds()), HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode})
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// HandleSAMLACS consumes the identity provider's response, provisions the user on first
+// sign-in and continues the hosted login
+// POST /hosted/saml/{name}/acs
+func (a *App) HandleSAMLACS(w http.ResponseWriter, r *http.Request) {
+	c, err := a.DB.GetSAMLConnectionByName(mux.Vars(r)["name"])
+	if err != nil || c == nil || !c.Active {
+		a.renderError(w, r, http.StatusNotFound, nil, defaultCopy["idp.unavailable"])
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, samlResponseMaxBytes)
+	if err := r.ParseForm(); err != nil {
+		a.renderError(w, r, http.StatusBadRequest, nil, "Invalid request")
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(stripXMLSpace(r.PostFormValue("SAMLResponse")))
+	if err != nil {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["saml.failed"])
+		return
+	}
+	now := time.Now()
+	assertion, err := parseSAMLResponse(c, a.samlServiceProvider(r, c), raw, now)
+	if err != nil {
+		log.Printf("saml connection %s: %v", c.Name, err)
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["saml.failed"])
+		return
+	}
+
+	// The response must answer a request this browser started
+	cookie, cerr := r.Cookie(samlRequestCookie)
+	if cerr != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(assertion.InResponseTo)) != 1 {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: samlRequestCookie, Value: "", Path: "/hosted/saml", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode})
+	pending, err := a.DB.ConsumeSAMLRequest(assertion.InResponseTo)
+	if err != nil || pending == nil || pending.ConnectionID != c.ID || pending.ExpiresAt < now.Unix() {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return
+	}
+	form, qerr := url.ParseQuery(pending.Request)
+	auth, err := a.validateAuthorizeRequest(form)
+	if qerr != nil || err != nil || !samlConnectionAvailable(c, auth.App) {
+		a.renderError(w, r, http.StatusBadRequest, nil, defaultCopy["error.expired"])
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "application", auth.App))
+
+	fresh, err := a.DB.RecordSAMLAssertion(c.ID, assertion.ID, assertion.ExpiresAt.Unix())
+	if err != nil || !fresh {
+		log.Printf("saml connection %s: assertion %s replayed", c.Name, assertion.ID)
+		a.renderError(w, r, http.StatusBadRequest, auth, defaultCopy["saml.failed"])
+		return
+	}
+	email, err := samlEmail(c, assertion)
+	if err != nil {
+		log.Printf("saml connection %s: %v", c.Name, err)
+		a.renderError(w, r, http.StatusForbidden, auth, defaultCopy["saml.failed"])
+		return
+	}
+	user, err := a.samlUser(r, c, auth.App, email)
+	if err == errSAMLAccountExists {
+		log.Printf("saml connection %s: %v", c.Name, err)
+		a.renderError(w, r, http.StatusConflict, auth, defaultCopy["saml.exists"])
+		return
+	}
+	if err != nil {
+		log.Printf("saml connection %s: %v", c.Name, err)
+		a.renderError(w, r, http.StatusInternalServerError, auth, defaultCopy["error.title"])
+		return
+	}
+	a.authenticatedHosted(w, r, auth, a.newHostedPage(w, r, auth), user, amrFederated)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExclusiveCanonicalization(t *testing.T) {
+	// The example of section 2.2 of the Exclusive XML Canonicalization recommendation
+	root, err := parseXMLTree([]byte(`<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org"><n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+     <n3:stuff xmlns:n3="ftp://example.org"/>
+  </n1:elem2></n0:local>`))
+	require.NoError(t, err)
+	require.Equal(t, `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+     <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+  </n1:elem2>`, string(canonicalXML(root.Children[0].Node, nil, nil)))
+
+	// Unused namespaces are dropped, attributes sorted by namespace and the default
+	// namespace undeclared where an output ancestor declared it
+	root, err = parseXMLTree([]byte(`<root xmlns="http://a" xmlns:b="http://b" xmlns:unused="http://u"><b:child z="1" b:y="2" a="&quot;3&quot;&#9;"><inner xmlns="">x &amp; &lt;y&gt; &#13;</inner></b:child></root>`))
+	require.NoError(t, err)
+	child := `<b:child xmlns:b="http://b" a="&quot;3&quot;&#x9;" z="1" b:y="2"><inner>x &amp; &lt;y&gt; &#xD;</inner></b:child>`
+	require.Equal(t, child, string(canonicalXML(root.Children[0].Node, nil, nil)))
+	require.Equal(t, `<root xmlns="http://a">`+strings.Replace(child, "<inner>", `<inner xmlns="">`, 1)+`</root>`, string(canonicalXML(root, nil, nil)))
+
+	_, err = parseXMLTree([]byte(`<!DOCTYPE x [<!ENTITY e "boom">]><x>&e;</x>`))
+	require.Error(t, err)
+}
+
+// testIdP signs SAML responses the way an identity provider would
+type testIdP struct {
+	t    *testing.T
+	key  *rsa.PrivateKey
+	cert string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	keyPEM, certPEM, err := generateSAMLKeyPair("test idp")
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(keyPEM))
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	require.NoError(t, err)
+	return &testIdP{t: t, key: key, cert: certPEM}
+}
+
+// sign replaces the <!--sign--> marker inside the element with the given ID by an
+// enveloped signature of that element
+func (p *testIdP) sign(doc, id string) string {
+	root, err := parseXMLTree([]byte(doc))
+	require.NoError(p.t, err)
+	var find func(n *xmlNode) *xmlNode
+	find = func(n *xmlNode) *xmlNode {
+		if n.attr("ID") == id {
+			return n
+		}
+		for _, c := range n.Children {
+			if c.Node != nil {
+				if found := find(c.Node); found != nil {
+					return found
+				}
+			}
+		}
+		return nil
+	}
+	target := find(root)
+	require.NotNil(p.t, target)
+	digest := sha256.Sum256(canonicalXML(target, nil, nil))
+	signedInfo := `<ds:SignedInfo><ds:CanonicalizationMethod Algorithm="` + excC14NAlgorithm + `"/>` +
+		`<ds:SignatureMethod Algorithm="` + rsaSHA256SignatureMethod + `"/><ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="` + envelopedSignatureAlgorithm + `"/><ds:Transform Algorithm="` + excC14NAlgorithm + `"/>` +
+		`</ds:Transforms><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>`
+	sigRoot, err := parseXMLTree([]byte(`<ds:Signature xmlns:ds="` + xmldsigNS + `">` + signedInfo + `</ds:Signature>`))
+	require.NoError(p.t, err)
+	sum := sha256.Sum256(canonicalXML(sigRoot.Children[0].Node, nil, nil))
+	value, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	require.NoError(p.t, err)
+	signature := `<ds:Signature xmlns:ds="` + xmldsigNS + `">` + signedInfo +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(value) + `</ds:SignatureValue></ds:Signature>`
+	return strings.Replace(doc, "<!--sign-->", signature, 1)
+}
+
+// samlResponseOptions describe the response to a pending AuthnRequest
+type samlResponseOptions struct {
+	InResponseTo string
+	AssertionID  string
+	Email        string
+	Audience     string
+	Recipient    string
+	NotOnOrAfter time.Time
+}
+
+// response builds a response whose assertion carries the marker for sign
+func (p *testIdP) response(o samlResponseOptions) string {
+	now := time.Now().UTC()
+	return fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" xmlns:saml="%s" ID="_r%s" Version="2.0" IssueInstant="%s" Destination="%s" InResponseTo="%s">`+
+		`<saml:Issuer>https://idp.example.com</saml:Issuer><samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status>`+
+		`<saml:Assertion ID="%s" Version="2.0" IssueInstant="%s"><saml:Issuer>https://idp.example.com</saml:Issuer><!--sign-->`+
+		`<saml:Subject><saml:NameID Format="%s">%s</saml:NameID><saml:SubjectConfirmation Method="%s">`+
+		`<saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s"/></saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`<saml:AttributeStatement><saml:Attribute Name="department"><saml:AttributeValue>R&amp;D</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>`+
+		`</saml:Assertion></samlp:Response>`,
+		samlProtocolNS, samlAssertionNS, o.AssertionID, now.Format(time.RFC3339), o.Recipient, o.InResponseTo, samlStatusSuccess,
+		o.AssertionID, now.Format(time.RFC3339), samlEmailNameIDFormat, o.Email, samlBearerMethod,
+		o.InResponseTo, o.NotOnOrAfter.Format(time.RFC3339), o.Recipient,
+		now.Add(-time.Minute).Format(time.RFC3339), o.NotOnOrAfter.Format(time.RFC3339), o.Audience)
+}
+
+func TestSAMLServiceProvider(t *testing.T) {
+	idp := newTestIdP(t)
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	app.RedirectURIs = []string{"https://bench.example.com/callback"}
+	require.NoError(t, a.DB.UpdateApplication(app))
+	org, err := a.DB.CreateOrganization("Acme", &app.ID)
+	require.NoError(t, err)
+	conn := &SAMLConnection{
+		ApplicationID:  app.ID,
+		OrganizationID: &org.ID,
+		Name:           "Acme",
+		IdPEntityID:    "https://idp.example.com",
+		IdPSSOURL:      "https://idp.example.com/sso?tenant=1",
+		IdPCertificate: idp.cert,
+		Domains:        []string{"ACME.com", "acme.com"},
+		Active:         true,
+	}
+	require.NoError(t, normalizeSAMLConnection(conn))
+	require.Equal(t, []string{"acme.com"}, conn.Domains)
+	conn.SPPrivateKey, conn.SPCertificate, err = generateSAMLKeyPair(conn.Name)
+	require.NoError(t, err)
+	require.NoError(t, a.DB.CreateSAMLConnection(conn))
+
+	const entityID = "http://example.com/hosted/saml/acme/metadata"
+	const acsURL = "http://example.com/hosted/saml/acme/acs"
+	vars := map[string]string{"name": "acme"}
+	rec := httptest.NewRecorder()
+	a.HandleSAMLMetadata(rec, mux.SetURLVars(httptest.NewRequest("GET", "/hosted/saml/acme/metadata", nil), vars))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `entityID="`+entityID+`"`)
+	require.Contains(t, rec.Body.String(), `Location="`+acsURL+`"`)
+
+	authorize := url.Values{
+		"client_id":    {strconv.FormatInt(app.ID, 10)},
+		"redirect_uri": {"https://bench.example.com/callback"},
+		"state":        {"xyz"},
+	}
+	// start sends a new browser to the identity provider and returns the AuthnRequest ID
+	start := func() (*hostedBrowser, string) {
+		browser := &hostedBrowser{t: t}
+		rec := browser.do(func(w http.ResponseWriter, r *http.Request) {
+			a.HandleHostedSAML(w, mux.SetURLVars(r, vars))
+		}, "GET", "/hosted/saml/acme", authorize)
+		require.Equal(t, http.StatusSeeOther, rec.Code)
+		u, err := url.Parse(rec.Header().Get("Location"))
+		require.NoError(t, err)
+		require.Equal(t, "https://idp.example.com/sso", u.Scheme+"://"+u.Host+u.Path)
+		q := u.Query()
+		require.Equal(t, "1", q.Get("tenant"))
+
+		// The redirect binding signs the query as sent
+		signed := u.RawQuery[strings.Index(u.RawQuery, "SAMLRequest="):strings.Index(u.RawQuery, "&Signature=")]
+		sig, err := base64.StdEncoding.DecodeString(q.Get("Signature"))
+		require.NoError(t, err)
+		certs, err := parseCertificates(conn.SPCertificate)
+		require.NoError(t, err)
+		sum := sha256.Sum256([]byte(signed))
+		require.NoError(t, rsa.VerifyPKCS1v15(certs[0].PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], sig))
+
+		deflated, err := base64.StdEncoding.DecodeString(q.Get("SAMLRequest"))
+		require.NoError(t, err)
+		raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+		require.NoError(t, err)
+		request, err := parseXMLTree(raw)
+		require.NoError(t, err)
+		require.True(t, request.is(samlProtocolNS, "AuthnRequest"))
+		require.Equal(t, acsURL, request.attr("AssertionConsumerServiceURL"))
+		require.Equal(t, entityID, request.element(samlAssertionNS, "Issuer").text())
+		return browser, request.attr("ID")
+	}
+	post := func(browser *hostedBrowser, response string) *httptest.ResponseRecorder {
+		form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(response))}}
+		return browser.do(func(w http.ResponseWriter, r *http.Request) {
+			a.HandleSAMLACS(w, mux.SetURLVars(r, vars))
+		}, "POST", "/hosted/saml/acme/acs", form)
+	}
+	valid := func(requestID, assertionID string) samlResponseOptions {
+		return samlResponseOptions{
+			InResponseTo: requestID,
+			AssertionID:  assertionID,
+			Email:        "jane@acme.com",
+			Audience:     entityID,
+			Recipient:    acsURL,
+			NotOnOrAfter: time.Now().Add(5 * time.Minute),
+		}
+	}
+
+	// a signed assertion provisions the user, adds them to the organization and ends in
+	// an authorization code
+	browser, requestID := start()
+	response := idp.sign(idp.response(valid(requestID, "_a1")), "_a1")
+	rec = post(browser, response)
+	require.Equal(t, http.StatusSeeOther, rec.Code, rec.Body.String())
+	require.Contains(t, rec.Header().Get("Location"), "code=")
+	require.Contains(t, rec.Header().Get("Location"), "state=xyz")
+	user, err := a.DB.GetUserByEmail(userNamespace(app), "jane@acme.com")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	member, err := a.DB.GetOrganizationMember(org.ID, user.ID)
+	require.NoError(t, err)
+	require.NotNil(t, member)
+
+	// the same response, or the same assertion for a new request, is refused
+	rec = post(browser, response)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	browser, requestID = start()
+	rec = post(browser, idp.sign(idp.response(valid(requestID, "_a1")), "_a1"))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// the next login of the user is accepted
+	browser, requestID = start()
+	rec = post(browser, idp.sign(idp.response(valid(requestID, "_a2")), "_a2"))
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	bound, err := a.DB.SAMLUserBound(conn.ID, user.ID)
+	require.NoError(t, err)
+	require.True(t, bound)
+
+	// a global account the connection did not provision is not taken over by it
+	existing, err := a.DB.CreateUser("boss@acme.com", "x", &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	browser, requestID = start()
+	o := valid(requestID, "_a3")
+	o.Email = existing.Email
+	rec = post(browser, idp.sign(idp.response(o), o.AssertionID))
+	require.Equal(t, http.StatusConflict, rec.Code)
+	bound, err = a.DB.SAMLUserBound(conn.ID, existing.ID)
+	require.NoError(t, err)
+	require.False(t, bound)
+
+	refused := map[string]func(o *samlResponseOptions){
+		"audience":  func(o *samlResponseOptions) { o.Audience = "https://other.example.com" },
+		"recipient": func(o *samlResponseOptions) { o.Recipient = "https://other.example.com/acs" },
+		"expired":   func(o *samlResponseOptions) { o.NotOnOrAfter = time.Now().Add(-5 * time.Minute) },
+		"domain":    func(o *samlResponseOptions) { o.Email = "jane@evil.com" },
+		"request":   func(o *samlResponseOptions) { o.InResponseTo = "_unknown" },
+	}
+	for name, change := range refused {
+		browser, requestID = start()
+		o := valid(requestID, "_"+name)
+		change(&o)
+		rec = post(browser, idp.sign(idp.response(o), o.AssertionID))
+		require.NotEqual(t, http.StatusSeeOther, rec.Code, name)
+	}
+
+	// tampered, unsigned and foreign-signed assertions are refused
+	browser, requestID = start()
+	rec = post(browser, strings.Replace(idp.sign(idp.response(valid(requestID, "_t")), "_t"), "jane@acme.com", "boss@acme.com", 1))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	browser, requestID = start()
+	rec = post(browser, idp.response(valid(requestID, "_u")))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	browser, requestID = start()
+	rec = post(browser, newTestIdP(t).sign(idp.response(valid(requestID, "_f")), "_f"))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// a response only counts in the browser that started the login
+	_, requestID = start()
+	rec = post(&hostedBrowser{t: t}, idp.sign(idp.response(valid(requestID, "_b")), "_b"))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// inactive connections take no logins
+	conn.Active = false
+	require.NoError(t, a.DB.UpdateSAMLConnection(conn))
+	rec = (&hostedBrowser{t: t}).do(func(w http.ResponseWriter, r *http.Request) {
+		a.HandleHostedSAML(w, mux.SetURLVars(r, vars))
+	}, "GET", "/hosted/saml/acme", authorize)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,1532 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) lets an application's identity management system
+// provision its users and groups. Users are nileAuth users in the application's namespace
+// and groups are organizations owned by the application. Only resources created or
+// adopted through SCIM are visible to the SCIM client.
+const (
+	scimTypeUser  = "User"
+	scimTypeGroup = "Group"
+
+	scimUserSchema         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListResponseSchema = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchOpSchema      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema       = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimContentType        = "application/scim+json"
+
+	scimDefaultCount = 100
+	scimMaxCount     = 1000
+	// scimMaxFilterDepth bounds the nesting of filter expressions
+	scimMaxFilterDepth = 32
+)
+
+// scimUserAttributes are the User attributes kept in a resource's Attributes; userName,
+// active and password map onto the user itself and everything else is ignored
+var scimUserAttributes = []string{
+	"name", "displayName", "nickName", "title", "userType", "preferredLanguage", "locale", "timezone", "emails", "phoneNumbers",
+}
+
+// scimError is a request the SCIM protocol answers with an error response
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (e *scimError) Error() string { return e.detail }
+
+func scimBadRequest(scimType, detail string) error {
+	return &scimError{status: http.StatusBadRequest, scimType: scimType, detail: detail}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// writeSCIMError writes an error in the SCIM Error schema; scimType may be empty
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimErrorSchema},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(w, status, body)
+}
+
+// writeSCIMErr writes err as a SCIM error, hiding unexpected errors behind a 500
+func writeSCIMErr(w http.ResponseWriter, err error) {
+	var se *scimError
+	if errors.As(err, &se) {
+		writeSCIMError(w, se.status, se.scimType, se.detail)
+		return
+	}
+	writeSCIMError(w, http.StatusInternalServerError, "", "Internal error")
+}
+
+// scimLookup returns a member of a resource by case-insensitive attribute name
+func scimLookup(m map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// scimKeyOf returns the key m already uses for name, or name itself
+func scimKeyOf(m map[string]interface{}, name string) string {
+	if _, ok := m[name]; ok {
+		return name
+	}
+	for k := range m {
+		if strings.EqualFold(k, name) {
+			return k
+		}
+	}
+	return name
+}
+
+// scimNormalize turns a resource into its JSON form so filters and patches only see
+// strings, float64s, bools, slices and maps
+func scimNormalize(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	return out, json.Unmarshal(b, &out)
+}
+
+// stripSCIMSchema removes a schema URN prefix from an attribute path, such as
+// "urn:ietf:params:scim:schemas:core:2.0:User:userName"
+func stripSCIMSchema(path string) string {
+	if !strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return path
+	}
+	// The URN itself contains colons; the attribute follows the last one outside brackets
+	end := strings.IndexByte(path, '[')
+	if end < 0 {
+		end = len(path)
+	}
+	if i := strings.LastIndexByte(path[:end], ':'); i >= 0 {
+		return path[i+1:]
+	}
+	return path
+}
+
+// scimFilter is a parsed SCIM filter expression
+type scimFilter struct {
+	op       string // and, or, not, pr, a comparison operator, or "[]" for a value path
+	attr     string // attribute path for pr, comparisons and value paths
+	value    interface{}
+	children []*scimFilter
+}
+
+var scimComparisons = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+// scimTokens splits a filter into parentheses, brackets, quoted strings and words
+func scimTokens(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r()[]\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+	depth  int
+}
+
+// parseSCIMFilter parses the filter grammar of RFC 7644 section 3.4.2.2
+func parseSCIMFilter(s string) (*scimFilter, error) {
+	tokens, err := scimTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty filter")
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *scimFilterParser) expect(t string) error {
+	if got := p.next(); got != t {
+		if got == "" {
+			return fmt.Errorf("expected %q", t)
+		}
+		return fmt.Errorf("expected %q, got %q", t, got)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) or() (*scimFilter, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > scimMaxFilterDepth {
+		return nil, errors.New("filter is nested too deeply")
+	}
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{op: "or", children: []*scimFilter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) and() (*scimFilter, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &scimFilter{op: "and", children: []*scimFilter{left, right}}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) unary() (*scimFilter, error) {
+	tok := p.next()
+	switch {
+	case tok == "":
+		return nil, errors.New("unexpected end of filter")
+	case strings.EqualFold(tok, "not"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &scimFilter{op: "not", children: []*scimFilter{f}}, nil
+	case tok == "(":
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	}
+	attr := stripSCIMSchema(tok)
+	if !scimAttrPattern(attr) {
+		return nil, fmt.Errorf("invalid attribute %q", tok)
+	}
+	if p.peek() == "[" {
+		p.next()
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return &scimFilter{op: "[]", attr: attr, children: []*scimFilter{f}}, nil
+	}
+	op := strings.ToLower(p.next())
+	if op == "pr" {
+		return &scimFilter{op: op, attr: attr}, nil
+	}
+	if !scimComparisons[op] {
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+	raw := p.next()
+	var value interface{}
+	switch lower := strings.ToLower(raw); {
+	case raw == "":
+		return nil, errors.New("missing comparison value")
+	case strings.HasPrefix(raw, `"`):
+		var s string
+		if err := json.Unmarshal([]byte(raw), &s); err != nil {
+			return nil, fmt.Errorf("invalid string %s", raw)
+		}
+		value = s
+	case lower == "true" || lower == "false":
+		value = lower == "true"
+	case lower == "null":
+		value = nil
+	default:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", raw)
+		}
+		value = n
+	}
+	return &scimFilter{op: op, attr: attr, value: value}, nil
+}
+
+// scimAttrPattern reports whether s is an attribute name with an optional sub-attribute
+func scimAttrPattern(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) > 2 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || !unicode.IsLetter(rune(part[0])) && part[0] != '$' {
+			return false
+		}
+		for _, c := range part {
+			if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' && c != '-' && c != '$' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// scimValues returns the values an attribute path selects in a resource. A multi-valued
+// complex attribute without a sub-attribute selects the "value" of each element.
+func scimValues(doc map[string]interface{}, path string) []interface{} {
+	parts := strings.SplitN(path, ".", 2)
+	v, ok := scimLookup(doc, parts[0])
+	if !ok || v == nil {
+		return nil
+	}
+	items, multi := v.([]interface{})
+	if !multi {
+		items = []interface{}{v}
+	}
+	var out []interface{}
+	for _, item := range items {
+		m, complex := item.(map[string]interface{})
+		switch {
+		case len(parts) == 2 && complex:
+			if sub, ok := scimLookup(m, parts[1]); ok && sub != nil {
+				out = append(out, sub)
+			}
+		case len(parts) == 1 && complex && multi:
+			if sub, ok := scimLookup(m, "value"); ok && sub != nil {
+				out = append(out, sub)
+			}
+		case len(parts) == 1:
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// match reports whether a resource, or an element of a multi-valued attribute, matches
+func (f *scimFilter) match(doc map[string]interface{}) bool {
+	switch f.op {
+	case "and":
+		return f.children[0].match(doc) && f.children[1].match(doc)
+	case "or":
+		return f.children[0].match(doc) || f.children[1].match(doc)
+	case "not":
+		return !f.children[0].match(doc)
+	case "[]":
+		v, _ := scimLookup(doc, f.attr)
+		items, ok := v.([]interface{})
+		if !ok {
+			items = []interface{}{v}
+		}
+		for _, item := range items {
+			if m, ok := item.(map[string]interface{}); ok && f.children[0].match(m) {
+				return true
+			}
+		}
+		return false
+	case "pr":
+		for _, v := range scimValues(doc, f.attr) {
+			if s, ok := v.(string); !ok || s != "" {
+				return true
+			}
+		}
+		return false
+	}
+	values := scimValues(doc, f.attr)
+	if f.value == nil {
+		return (f.op == "eq") == (len(values) == 0)
+	}
+	for _, v := range values {
+		if scimCompare(v, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// scimCompare applies a comparison operator; strings compare case-insensitively
+func scimCompare(v interface{}, op string, want interface{}) bool {
+	switch want := want.(type) {
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		a, b := strings.ToLower(s), strings.ToLower(want)
+		switch op {
+		case "eq":
+			return a == b
+		case "ne":
+			return a != b
+		case "co":
+			return strings.Contains(a, b)
+		case "sw":
+			return strings.HasPrefix(a, b)
+		case "ew":
+			return strings.HasSuffix(a, b)
+		case "gt":
+			return a > b
+		case "ge":
+			return a >= b
+		case "lt":
+			return a < b
+		case "le":
+			return a <= b
+		}
+	case bool:
+		b, ok := v.(bool)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return b == want
+		case "ne":
+			return b != want
+		}
+	case float64:
+		n, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return n == want
+		case "ne":
+			return n != want
+		case "gt":
+			return n > want
+		case "ge":
+			return n >= want
+		case "lt":
+			return n < want
+		case "le":
+			return n <= want
+		}
+	}
+	return false
+}
+
+// scimPatchOp is one operation of a PatchOp request
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// applySCIMPatch applies PatchOp operations to a resource in its JSON form
+func applySCIMPatch(doc map[string]interface{}, ops []scimPatchOp) error {
+	if len(ops) == 0 {
+		return scimBadRequest("invalidValue", "Operations are required")
+	}
+	for _, op := range ops {
+		kind := strings.ToLower(op.Op)
+		if kind != "add" && kind != "replace" && kind != "remove" {
+			return scimBadRequest("invalidSyntax", "Unsupported operation "+op.Op)
+		}
+		if op.Path == "" {
+			value, ok := op.Value.(map[string]interface{})
+			if kind == "remove" {
+				return scimBadRequest("noTarget", "remove requires a path")
+			}
+			if !ok {
+				return scimBadRequest("invalidValue", "An operation without a path needs an object value")
+			}
+			for name, v := range value {
+				if err := applySCIMPatchPath(doc, kind, name, v); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := applySCIMPatchPath(doc, kind, op.Path, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applySCIMPatchPath applies one operation to attr, attr.sub, attr[filter] or
+// attr[filter].sub
+func applySCIMPatchPath(doc map[string]interface{}, kind, path string, value interface{}) error {
+	path = stripSCIMSchema(strings.TrimSpace(path))
+	attr, sub := path, ""
+	var filter *scimFilter
+	if i := strings.IndexByte(path, '['); i >= 0 {
+		j := strings.LastIndexByte(path, ']')
+		if j < i {
+			return scimBadRequest("invalidPath", "Invalid path "+path)
+		}
+		f, err := parseSCIMFilter(path[i+1 : j])
+		if err != nil {
+			return scimBadRequest("invalidPath", "Invalid path filter: "+err.Error())
+		}
+		attr, filter = path[:i], f
+		if rest := path[j+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ".") {
+				return scimBadRequest("invalidPath", "Invalid path "+path)
+			}
+			sub = rest[1:]
+		}
+	} else if i := strings.IndexByte(path, '.'); i >= 0 {
+		attr, sub = path[:i], path[i+1:]
+	}
+	if !scimAttrPattern(attr) || (sub != "" && !scimAttrPattern(sub)) {
+		return scimBadRequest("invalidPath", "Invalid path "+path)
+	}
+	key := scimKeyOf(doc, attr)
+	current := doc[key]
+
+	if filter != nil {
+		items, _ := current.([]interface{})
+		matched := false
+		kept := items[:0:0]
+		for _, item := range items {
+			m, ok := item.(map[string]interface{})
+			if !ok || !filter.match(m) {
+				kept = append(kept, item)
+				continue
+			}
+			matched = true
+			switch {
+			case kind == "remove" && sub == "":
+				continue
+			case kind == "remove":
+				delete(m, scimKeyOf(m, sub))
+			case sub != "":
+				m[scimKeyOf(m, sub)] = value
+			default:
+				if v, ok := value.(map[string]interface{}); ok {
+					for k, sv := range v {
+						m[scimKeyOf(m, k)] = sv
+					}
+				}
+			}
+			kept = append(kept, m)
+		}
+		if !matched && kind != "remove" {
+			// replace emails[type eq "work"].value adds the element when it is missing
+			if sub == "" || filter.op != "eq" || strings.Contains(filter.attr, ".") {
+				return scimBadRequest("noTarget", "No value matches "+path)
+			}
+			kept = append(kept, map[string]interface{}{filter.attr: filter.value, sub: value})
+		}
+		doc[key] = kept
+		return nil
+	}
+
+	if sub != "" {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			if current != nil {
+				return scimBadRequest("invalidPath", attr+" has no sub-attributes")
+			}
+			if kind == "remove" {
+				return nil
+			}
+			m = map[string]interface{}{}
+			doc[key] = m
+		}
+		if kind == "remove" {
+			delete(m, scimKeyOf(m, sub))
+		} else {
+			m[scimKeyOf(m, sub)] = value
+		}
+		return nil
+	}
+
+	items, multi := current.([]interface{})
+	switch kind {
+	case "remove":
+		// A value lists the elements to remove, as in removing members of a group
+		values, _ := value.([]interface{})
+		if !multi || len(values) == 0 {
+			delete(doc, key)
+			return nil
+		}
+		kept := items[:0:0]
+		for _, item := range items {
+			if !scimContainsValue(values, item) {
+				kept = append(kept, item)
+			}
+		}
+		doc[key] = kept
+	case "add":
+		if multi {
+			values, ok := value.([]interface{})
+			if !ok {
+				values = []interface{}{value}
+			}
+			for _, v := range values {
+				if !scimContainsValue(items, v) {
+					items = append(items, v)
+				}
+			}
+			doc[key] = items
+			return nil
+		}
+		if m, ok := current.(map[string]interface{}); ok {
+			if v, ok := value.(map[string]interface{}); ok {
+				for k, sv := range v {
+					m[scimKeyOf(m, k)] = sv
+				}
+				return nil
+			}
+		}
+		doc[key] = value
+	default:
+		doc[key] = value
+	}
+	return nil
+}
+
+// scimContainsValue reports whether values holds v, comparing complex values by their
+// "value" sub-attribute
+func scimContainsValue(values []interface{}, v interface{}) bool {
+	id := scimValueID(v)
+	for _, other := range values {
+		if scimValueID(other) == id {
+			return true
+		}
+	}
+	return false
+}
+
+func scimValueID(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		if id, ok := scimLookup(m, "value"); ok {
+			v = id
+		}
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// scimBool reads a boolean attribute, accepting the "True" and "False" strings some
+// clients send
+func scimBool(v interface{}) (bool, bool) {
+	switch v := v.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	}
+	return false, false
+}
+
+func scimString(doc map[string]interface{}, name string) (string, error) {
+	v, ok := scimLookup(doc, name)
+	if !ok || v == nil {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", scimBadRequest("invalidValue", name+" must be a string")
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// scimUserInput is the part of a User resource nileAuth stores
+type scimUserInput struct {
+	UserName   string
+	ExternalID string
+	Active     bool
+	Password   string
+	Attributes map[string]interface{}
+}
+
+func parseSCIMUser(doc map[string]interface{}) (*scimUserInput, error) {
+	in := &scimUserInput{Active: true, Attributes: map[string]interface{}{}}
+	var err error
+	if in.UserName, err = scimString(doc, "userName"); err != nil {
+		return nil, err
+	}
+	in.UserName = strings.ToLower(in.UserName)
+	if in.UserName == "" {
+		return nil, scimBadRequest("invalidValue", "userName is required")
+	}
+	if !strings.Contains(in.UserName, "@") {
+		return nil, scimBadRequest("invalidValue", "userName must be an email address")
+	}
+	if in.ExternalID, err = scimString(doc, "externalId"); err != nil {
+		return nil, err
+	}
+	if v, ok := scimLookup(doc, "active"); ok && v != nil {
+		if in.Active, ok = scimBool(v); !ok {
+			return nil, scimBadRequest("invalidValue", "active must be a boolean")
+		}
+	}
+	if v, ok := scimLookup(doc, "password"); ok && v != nil {
+		if in.Password, ok = v.(string); !ok {
+			return nil, scimBadRequest("invalidValue", "password must be a string")
+		}
+	}
+	for _, name := range scimUserAttributes {
+		if v, ok := scimLookup(doc, name); ok && v != nil {
+			in.Attributes[name] = v
+		}
+	}
+	return in, nil
+}
+
+// scimGroupInput is the part of a Group resource nileAuth stores
+type scimGroupInput struct {
+	DisplayName string
+	ExternalID  string
+	Members     []int64
+}
+
+func parseSCIMGroup(doc map[string]interface{}) (*scimGroupInput, error) {
+	in := &scimGroupInput{}
+	var err error
+	if in.DisplayName, err = scimString(doc, "displayName"); err != nil {
+		return nil, err
+	}
+	if in.DisplayName == "" {
+		return nil, scimBadRequest("invalidValue", "displayName is required")
+	}
+	if in.ExternalID, err = scimString(doc, "externalId"); err != nil {
+		return nil, err
+	}
+	v, _ := scimLookup(doc, "members")
+	if v == nil {
+		return in, nil
+	}
+	members, ok := v.([]interface{})
+	if !ok {
+		return nil, scimBadRequest("invalidValue", "members must be an array")
+	}
+	seen := map[int64]bool{}
+	for _, m := range members {
+		member, _ := m.(map[string]interface{})
+		raw, _ := scimLookup(member, "value")
+		s, _ := raw.(string)
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, scimBadRequest("invalidValue", "members must reference users by id")
+		}
+		if !seen[id] {
+			seen[id] = true
+			in.Members = append(in.Members, id)
+		}
+	}
+	return in, nil
+}
+
+// scimListParams reads the filter and the 1-based pagination of a list request
+func scimListParams(r *http.Request) (*scimFilter, int, int, error) {
+	q := r.URL.Query()
+	var filter *scimFilter
+	if s := strings.TrimSpace(q.Get("filter")); s != "" {
+		f, err := parseSCIMFilter(s)
+		if err != nil {
+			return nil, 0, 0, scimBadRequest("invalidFilter", "Invalid filter: "+err.Error())
+		}
+		filter = f
+	}
+	start, count := 1, scimDefaultCount
+	if s := q.Get("startIndex"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, 0, 0, scimBadRequest("invalidValue", "startIndex must be an integer")
+		}
+		if n > 1 {
+			start = n
+		}
+	}
+	if s := q.Get("count"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, 0, 0, scimBadRequest("invalidValue", "count must be an integer")
+		}
+		count = n
+		if count < 0 {
+			count = 0
+		}
+		if count > scimMaxCount {
+			count = scimMaxCount
+		}
+	}
+	return filter, start, count, nil
+}
+
+func writeSCIMList(w http.ResponseWriter, docs []map[string]interface{}, start, count int) {
+	total := len(docs)
+	from := start - 1
+	if from > total {
+		from = total
+	}
+	to := from + count
+	if to > total {
+		to = total
+	}
+	writeSCIMPage(w, docs[from:to], total, start)
+}
+
+// writeSCIMPage writes a list response for a page starting at the 1-based start of
+// total matching resources
+func writeSCIMPage(w http.ResponseWriter, page []map[string]interface{}, total, start int) {
+	if page == nil {
+		page = []map[string]interface{}{}
+	}
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimListResponseSchema},
+		"totalResults": total,
+		"startIndex":   start,
+		"itemsPerPage": len(page),
+		"Resources":    page,
+	})
+}
+
+// readSCIMBody decodes a request body into its JSON form
+func readSCIMBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20)).Decode(v); err != nil {
+		return scimBadRequest("invalidSyntax", "Invalid request body")
+	}
+	return nil
+}
+
+func (a *App) scimLocation(r *http.Request, endpoint string, id int64) string {
+	return a.publicURL(r) + "/scim/v2/" + endpoint + "/" + strconv.FormatInt(id, 10)
+}
+
+func scimMeta(resourceType, location string, res *SCIMResource) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceType": resourceType,
+		"created":      res.CreatedAt.UTC().Format(time.RFC3339),
+		"lastModified": res.UpdatedAt.UTC().Format(time.RFC3339),
+		"location":     location,
+	}
+}
+
+func (a *App) scimUserDoc(r *http.Request, res *SCIMResource, u *User) (map[string]interface{}, error) {
+	doc := map[string]interface{}{
+		"schemas":  []string{scimUserSchema},
+		"id":       strconv.FormatInt(u.ID, 10),
+		"userName": u.Email,
+		"active":   !u.Disabled,
+		"emails":   []interface{}{map[string]interface{}{"value": u.Email, "primary": true}},
+		"meta":     scimMeta(scimTypeUser, a.scimLocation(r, "Users", u.ID), res),
+	}
+	for name, v := range res.Attributes {
+		doc[name] = v
+	}
+	if res.ExternalID != "" {
+		doc["externalId"] = res.ExternalID
+	}
+	return scimNormalize(doc)
+}
+
+// scimGroupMembers returns the members of an organization that are SCIM users of the
+// application; other members are invisible to the SCIM client
+func (a *App) scimGroupMembers(app *Application, orgID int64) ([]*User, error) {
+	members, err := a.DB.ListOrganizationMembers(orgID)
+	if err != nil {
+		return nil, err
+	}
+	var users []*User
+	for _, m := range members {
+		res, err := a.DB.GetSCIMResource(app.ID, scimTypeUser, m.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			continue
+		}
+		u, err := a.DB.GetUserByID(m.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if u != nil {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (a *App) scimGroupDoc(r *http.Request, app *Application, res *SCIMResource, org *Organization) (map[string]interface{}, error) {
+	users, err := a.scimGroupMembers(app, org.ID)
+	if err != nil {
+		return nil, err
+	}
+	members := []interface{}{}
+	for _, u := range users {
+		members = append(members, map[string]interface{}{
+			"value":   strconv.FormatInt(u.ID, 10),
+			"display": u.Email,
+			"$ref":    a.scimLocation(r, "Users", u.ID),
+		})
+	}
+	doc := map[string]interface{}{
+		"schemas":     []string{scimGroupSchema},
+		"id":          strconv.FormatInt(org.ID, 10),
+		"displayName": org.Name,
+		"members":     members,
+		"meta":        scimMeta(scimTypeGroup, a.scimLocation(r, "Groups", org.ID), res),
+	}
+	if res.ExternalID != "" {
+		doc["externalId"] = res.ExternalID
+	}
+	return scimNormalize(doc)
+}
+
+// checkSCIMExternalID refuses an external ID another resource of the type already uses
+func (a *App) checkSCIMExternalID(app *Application, resourceType, externalID string, resourceID int64) error {
+	if externalID == "" {
+		return nil
+	}
+	res, err := a.DB.GetSCIMResourceByExternalID(app.ID, resourceType, externalID)
+	if err != nil {
+		return err
+	}
+	if res != nil && res.ResourceID != resourceID {
+		return &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "externalId is already taken"}
+	}
+	return nil
+}
+
+// saveSCIMUser applies a User resource to an existing user
+func (a *App) saveSCIMUser(r *http.Request, app *Application, user *User, res *SCIMResource, in *scimUserInput) error {
+	if err := a.checkSCIMExternalID(app, scimTypeUser, in.ExternalID, user.ID); err != nil {
+		return err
+	}
+	if in.UserName != user.Email {
+		if err := a.DB.UpdateUserEmail(user.ID, in.UserName); err != nil {
+			return &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "userName is already taken"}
+		}
+		user.Email = in.UserName
+	}
+	if in.Password != "" {
+		hashed, err := hashPassword(in.Password)
+		if err != nil {
+			return err
+		}
+		if err := a.DB.UpdateUserPassword(user.ID, hashed); err != nil {
+			return err
+		}
+	}
+	if err := a.setUserDisabled(r, user, !in.Active, map[string]interface{}{"scim": true}); err != nil {
+		return err
+	}
+	res.ExternalID = in.ExternalID
+	res.Attributes = in.Attributes
+	if err := a.DB.UpsertSCIMResource(res); err != nil {
+		return &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "externalId is already taken"}
+	}
+	return nil
+}
+
+// saveSCIMGroup applies a Group resource to an organization, adding and removing the
+// SCIM users among its members
+func (a *App) saveSCIMGroup(app *Application, org *Organization, res *SCIMResource, in *scimGroupInput) error {
+	if err := a.checkSCIMExternalID(app, scimTypeGroup, in.ExternalID, org.ID); err != nil {
+		return err
+	}
+	want := map[int64]bool{}
+	for _, id := range in.Members {
+		member, err := a.DB.GetSCIMResource(app.ID, scimTypeUser, id)
+		if err != nil {
+			return err
+		}
+		if member == nil {
+			return scimBadRequest("invalidValue", "Member "+strconv.FormatInt(id, 10)+" is not a user")
+		}
+		want[id] = true
+	}
+	if in.DisplayName != org.Name {
+		if err := a.DB.UpdateOrganization(org.ID, in.DisplayName); err != nil {
+			return err
+		}
+		org.Name = in.DisplayName
+	}
+	current, err := a.scimGroupMembers(app, org.ID)
+	if err != nil {
+		return err
+	}
+	for _, u := range current {
+		if want[u.ID] {
+			delete(want, u.ID)
+			continue
+		}
+		if err := a.DB.RemoveOrganizationMember(org.ID, u.ID); err != nil {
+			return err
+		}
+	}
+	for id := range want {
+		if err := a.DB.UpsertOrganizationMember(org.ID, id, orgRoleMember); err != nil {
+			return err
+		}
+	}
+	res.ExternalID = in.ExternalID
+	if err := a.DB.UpsertSCIMResource(res); err != nil {
+		return &scimError{status: http.StatusConflict, scimType: "uniqueness", detail: "externalId is already taken"}
+	}
+	return nil
+}
+
+var errSCIMNotFound = &scimError{status: http.StatusNotFound, detail: "Resource not found"}
+
+// loadSCIMUser returns the SCIM user named in the path
+func (a *App) loadSCIMUser(r *http.Request) (*SCIMResource, *User, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, nil, errSCIMNotFound
+	}
+	res, err := a.DB.GetSCIMResource(applicationFromRequest(r).ID, scimTypeUser, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res == nil {
+		return nil, nil, errSCIMNotFound
+	}
+	user, err := a.DB.GetUserByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user == nil {
+		return nil, nil, errSCIMNotFound
+	}
+	return res, user, nil
+}
+
+// loadSCIMGroup returns the SCIM group named in the path
+func (a *App) loadSCIMGroup(r *http.Request) (*SCIMResource, *Organization, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return nil, nil, errSCIMNotFound
+	}
+	res, err := a.DB.GetSCIMResource(applicationFromRequest(r).ID, scimTypeGroup, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res == nil {
+		return nil, nil, errSCIMNotFound
+	}
+	org, err := a.DB.GetOrganizationByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if org == nil {
+		return nil, nil, errSCIMNotFound
+	}
+	return res, org, nil
+}
+
+// HandleSCIMServiceProviderConfig describes the SCIM features nileAuth supports
+// GET /scim/v2/ServiceProviderConfig
+func (a *App) HandleSCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	supported := func(b bool) map[string]bool { return map[string]bool{"supported": b} }
+	writeSCIM(w, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": scimMaxCount},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "An API key of the application sent as a bearer token",
+			"primary":     true,
+		}},
+	})
+}
+
+// HandleSCIMListUsers lists the application's SCIM users matching the filter. Filters
+// on userName and externalId equality are answered by the database a page at a time;
+// other filters are matched against every user.
+// GET /scim/v2/Users
+func (a *App) HandleSCIMListUsers(w http.ResponseWriter, r *http.Request) {
+	app := applicationFromRequest(r)
+	filter, start, count, err := scimListParams(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	query := SCIMUserFilter{ApplicationID: app.ID}
+	paged := scimUserQuery(filter, &query)
+	if paged {
+		// A Limit of 0 would mean no limit, and count=0 only asks for the total
+		query.Offset, query.Limit = start-1, count
+		if count == 0 {
+			query.Limit = 1
+		}
+	}
+	users, total, err := a.DB.ListSCIMUsers(query)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	docs := []map[string]interface{}{}
+	for _, su := range users {
+		doc, err := a.scimUserDoc(r, su.Resource, su.User)
+		if err != nil {
+			writeSCIMErr(w, err)
+			return
+		}
+		if paged || filter.match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	if !paged {
+		writeSCIMList(w, docs, start, count)
+		return
+	}
+	if count == 0 {
+		docs = docs[:0]
+	}
+	writeSCIMPage(w, docs, total, start)
+}
+
+// scimUserQuery narrows a database query by a filter made of userName and externalId
+// equalities joined with and. It reports false for any other filter, which has to be
+// matched against the user documents instead.
+func scimUserQuery(f *scimFilter, q *SCIMUserFilter) bool {
+	if f == nil {
+		return true
+	}
+	if f.op == "and" {
+		return scimUserQuery(f.children[0], q) && scimUserQuery(f.children[1], q)
+	}
+	value, ok := f.value.(string)
+	if f.op != "eq" || !ok || value == "" {
+		return false
+	}
+	switch {
+	case strings.EqualFold(f.attr, "userName") && q.UserName == "":
+		q.UserName = value
+	case strings.EqualFold(f.attr, "externalId") && q.ExternalID == "":
+		q.ExternalID = value
+	default:
+		return false
+	}
+	return true
+}
+
+// HandleSCIMCreateUser provisions a user. A user who already exists in an isolated
+// namespace is adopted; global users are never taken over by one application.
+// POST /scim/v2/Users
+func (a *App) HandleSCIMCreateUser(w http.ResponseWriter, r *http.Request) {
+	app := applicationFromRequest(r)
+	var doc map[string]interface{}
+	if err := readSCIMBody(r, &doc); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	in, err := parseSCIMUser(doc)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if err := a.checkSCIMExternalID(app, scimTypeUser, in.ExternalID, 0); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	user, err := a.DB.GetUserByEmail(userNamespace(app), in.UserName)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if user != nil {
+		existing, err := a.DB.GetSCIMResource(app.ID, scimTypeUser, user.ID)
+		if err != nil {
+			writeSCIMErr(w, err)
+			return
+		}
+		if existing != nil || !app.IsolatedUsers {
+			writeSCIMError(w, http.StatusConflict, "uniqueness", "userName is already taken")
+			return
+		}
+	} else if user, err = a.provisionUser(r, app, in.UserName, map[string]interface{}{"scim": true}); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	res := &SCIMResource{ApplicationID: app.ID, Type: scimTypeUser, ResourceID: user.ID}
+	if err := a.saveSCIMUser(r, app, user, res, in); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	out, err := a.scimUserDoc(r, res, user)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	w.Header().Set("Location", a.scimLocation(r, "Users", user.ID))
+	writeSCIM(w, http.StatusCreated, out)
+}
+
+// HandleSCIMGetUser returns a SCIM user
+// GET /scim/v2/Users/{id}
+func (a *App) HandleSCIMGetUser(w http.ResponseWriter, r *http.Request) {
+	res, user, err := a.loadSCIMUser(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	doc, err := a.scimUserDoc(r, res, user)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, doc)
+}
+
+// HandleSCIMReplaceUser replaces a SCIM user
+// PUT /scim/v2/Users/{id}
+func (a *App) HandleSCIMReplaceUser(w http.ResponseWriter, r *http.Request) {
+	var doc map[string]interface{}
+	if err := readSCIMBody(r, &doc); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	a.updateSCIMUser(w, r, func(map[string]interface{}) (map[string]interface{}, error) { return doc, nil })
+}
+
+// HandleSCIMPatchUser applies PatchOp operations to a SCIM user; setting active to false
+// disables the user
+// PATCH /scim/v2/Users/{id}
+func (a *App) HandleSCIMPatchUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Operations []scimPatchOp `json:"Operations"`
+	}
+	if err := readSCIMBody(r, &req); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	a.updateSCIMUser(w, r, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return doc, applySCIMPatch(doc, req.Operations)
+	})
+}
+
+// updateSCIMUser stores the resource that change derives from the user's current one
+func (a *App) updateSCIMUser(w http.ResponseWriter, r *http.Request, change func(map[string]interface{}) (map[string]interface{}, error)) {
+	app := applicationFromRequest(r)
+	res, user, err := a.loadSCIMUser(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	doc, err := a.scimUserDoc(r, res, user)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if doc, err = change(doc); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	in, err := parseSCIMUser(doc)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if err := a.saveSCIMUser(r, app, user, res, in); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if doc, err = a.scimUserDoc(r, res, user); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, doc)
+}
+
+// HandleSCIMDeleteUser deprovisions a user. The account is disabled rather than deleted,
+// so its audit trail and organization memberships survive, and it leaves the SCIM client's
+// view.
+// DELETE /scim/v2/Users/{id}
+func (a *App) HandleSCIMDeleteUser(w http.ResponseWriter, r *http.Request) {
+	app := applicationFromRequest(r)
+	_, user, err := a.loadSCIMUser(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if err := a.setUserDisabled(r, user, true, map[string]interface{}{"scim": true}); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if err := a.DB.DeleteSCIMResource(app.ID, scimTypeUser, user.ID); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// scimExcludesMembers reports whether a group request asked to leave out members, which
+// clients do to avoid loading large groups
+func scimExcludesMembers(r *http.Request) bool {
+	for _, attr := range strings.Split(r.URL.Query().Get("excludedAttributes"), ",") {
+		if strings.EqualFold(strings.TrimSpace(attr), "members") {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleSCIMListGroups lists the application's SCIM groups matching the filter
+// GET /scim/v2/Groups
+func (a *App) HandleSCIMListGroups(w http.ResponseWriter, r *http.Request) {
+	app := applicationFromRequest(r)
+	filter, start, count, err := scimListParams(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	resources, err := a.DB.ListSCIMResources(app.ID, scimTypeGroup)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	docs := []map[string]interface{}{}
+	for _, res := range resources {
+		org, err := a.DB.GetOrganizationByID(res.ResourceID)
+		if err != nil {
+			writeSCIMErr(w, err)
+			return
+		}
+		if org == nil {
+			continue
+		}
+		doc, err := a.scimGroupDoc(r, app, res, org)
+		if err != nil {
+			writeSCIMErr(w, err)
+			return
+		}
+		if filter == nil || filter.match(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	if scimExcludesMembers(r) {
+		for _, doc := range docs {
+			delete(doc, "members")
+		}
+	}
+	writeSCIMList(w, docs, start, count)
+}
+
+// HandleSCIMCreateGroup creates an organization of the application as a SCIM group
+// POST /scim/v2/Groups
+func (a *App) HandleSCIMCreateGroup(w http.ResponseWriter, r *http.Request) {
+	app := applicationFromRequest(r)
+	var doc map[string]interface{}
+	if err := readSCIMBody(r, &doc); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	in, err := parseSCIMGroup(doc)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if err := a.checkSCIMExternalID(app, scimTypeGroup, in.ExternalID, 0); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	org, err := a.DB.CreateOrganization(in.DisplayName, &app.ID)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	res := &SCIMResource{ApplicationID: app.ID, Type: scimTypeGroup, ResourceID: org.ID}
+	if err := a.saveSCIMGroup(app, org, res, in); err != nil {
+		a.DB.DeleteOrganization(org.ID)
+		writeSCIMErr(w, err)
+		return
+	}
+	out, err := a.scimGroupDoc(r, app, res, org)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	w.Header().Set("Location", a.scimLocation(r, "Groups", org.ID))
+	writeSCIM(w, http.StatusCreated, out)
+}
+
+// HandleSCIMGetGroup returns a SCIM group
+// GET /scim/v2/Groups/{id}
+func (a *App) HandleSCIMGetGroup(w http.ResponseWriter, r *http.Request) {
+	res, org, err := a.loadSCIMGroup(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	doc, err := a.scimGroupDoc(r, applicationFromRequest(r), res, org)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if scimExcludesMembers(r) {
+		delete(doc, "members")
+	}
+	writeSCIM(w, http.StatusOK, doc)
+}
+
+// HandleSCIMReplaceGroup replaces a SCIM group and its membership
+// PUT /scim/v2/Groups/{id}
+func (a *App) HandleSCIMReplaceGroup(w http.ResponseWriter, r *http.Request) {
+	var doc map[string]interface{}
+	if err := readSCIMBody(r, &doc); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	a.updateSCIMGroup(w, r, func(map[string]interface{}) (map[string]interface{}, error) { return doc, nil })
+}
+
+// HandleSCIMPatchGroup applies PatchOp operations to a SCIM group, typically adding or
+// removing members
+// PATCH /scim/v2/Groups/{id}
+func (a *App) HandleSCIMPatchGroup(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Operations []scimPatchOp `json:"Operations"`
+	}
+	if err := readSCIMBody(r, &req); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	a.updateSCIMGroup(w, r, func(doc map[string]interface{}) (map[string]interface{}, error) {
+		return doc, applySCIMPatch(doc, req.Operations)
+	})
+}
+
+func (a *App) updateSCIMGroup(w http.ResponseWriter, r *http.Request, change func(map[string]interface{}) (map[string]interface{}, error)) {
+	app := applicationFromRequest(r)
+	res, org, err := a.loadSCIMGroup(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	doc, err := a.scimGroupDoc(r, app, res, org)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if doc, err = change(doc); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	in, err := parseSCIMGroup(doc)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if err := a.saveSCIMGroup(app, org, res, in); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if doc, err = a.scimGroupDoc(r, app, res, org); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if scimExcludesMembers(r) {
+		delete(doc, "members")
+	}
+	writeSCIM(w, http.StatusOK, doc)
+}
+
+// HandleSCIMDeleteGroup deletes the organization behind a SCIM group
+// DELETE /scim/v2/Groups/{id}
+func (a *App) HandleSCIMDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	_, org, err := a.loadSCIMGroup(r)
+	if err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	if err := a.DB.DeleteOrganization(org.ID); err != nil {
+		writeSCIMErr(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+// newSCIMTestServer routes the SCIM endpoints of a test app, returning the server and
+// the application's API key
+func newSCIMTestServer(t *testing.T) (*App, string, func(method, path, body string) (int, map[string]interface{})) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	r := mux.NewRouter()
+	scim := r.PathPrefix("/scim/v2").Subrouter()
+	scim.Use(a.APIKeyAuth)
+	scim.HandleFunc("/Users", a.HandleSCIMListUsers).Methods("GET")
+	scim.HandleFunc("/Users", a.HandleSCIMCreateUser).Methods("POST")
+	scim.HandleFunc("/Users/{id}", a.HandleSCIMGetUser).Methods("GET")
+	scim.HandleFunc("/Users/{id}", a.HandleSCIMReplaceUser).Methods("PUT")
+	scim.HandleFunc("/Users/{id}", a.HandleSCIMPatchUser).Methods("PATCH")
+	scim.HandleFunc("/Users/{id}", a.HandleSCIMDeleteUser).Methods("DELETE")
+	scim.HandleFunc("/Groups", a.HandleSCIMListGroups).Methods("GET")
+	scim.HandleFunc("/Groups", a.HandleSCIMCreateGroup).Methods("POST")
+	scim.HandleFunc("/Groups/{id}", a.HandleSCIMGetGroup).Methods("GET")
+	scim.HandleFunc("/Groups/{id}", a.HandleSCIMPatchGroup).Methods("PATCH")
+	scim.HandleFunc("/Groups/{id}", a.HandleSCIMDeleteGroup).Methods("DELETE")
+	call := func(method, path, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+plain)
+		req.Header.Set("Content-Type", scimContentType)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		var out map[string]interface{}
+		if rec.Body.Len() > 0 {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out), rec.Body.String())
+		}
+		return rec.Code, out
+	}
+	return a, plain, call
+}
+
+func TestSCIMFilterParsing(t *testing.T) {
+	doc := map[string]interface{}{
+		"userName": "Jane@Example.com",
+		"active":   true,
+		"name":     map[string]interface{}{"givenName": "Jane", "familyName": "Doe"},
+		"emails": []interface{}{
+			map[string]interface{}{"value": "jane@example.com", "type": "work"},
+			map[string]interface{}{"value": "jd@home.example", "type": "home"},
+		},
+		"meta": map[string]interface{}{"lastModified": "2026-10-01T00:00:00Z"},
+	}
+	matches := map[string]bool{
+		`userName eq "jane@example.com"`:                                  true,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "JANE"`:   true,
+		`userName ne "jane@example.com"`:                                  false,
+		`name.familyName co "oe" and active eq true`:                      true,
+		`not (active eq true) or name.givenName ew "x"`:                   false,
+		`emails[type eq "home" and value ew ".example"]`:                  true,
+		`emails[type eq "work" and value ew ".example"]`:                  false,
+		`emails co "home"`:                                                true,
+		`title pr or (meta.lastModified gt "2026-09-30T00:00:00Z")`:       true,
+		`meta.lastModified lt "2026-09-30T00:00:00Z" OR nickName eq "jd"`: false,
+		`title eq null`: true,
+		`(userName eq "a@b.c" or userName eq "jane@example.com") and active pr`: true,
+	}
+	for filter, want := range matches {
+		f, err := parseSCIMFilter(filter)
+		require.NoError(t, err, filter)
+		require.Equal(t, want, f.match(doc), filter)
+	}
+	for _, bad := range []string{"", "userName", `userName eq`, `userName xx "a"`, `(userName pr`, `emails[type eq "work"`, `userName eq "a" and`, `user name eq "a"`, `userName eq jane`, strings.Repeat("(", 40) + "active pr" + strings.Repeat(")", 40)} {
+		_, err := parseSCIMFilter(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestSCIMPatch(t *testing.T) {
+	doc := map[string]interface{}{
+		"userName": "jane@example.com",
+		"active":   true,
+		"emails":   []interface{}{map[string]interface{}{"value": "jane@example.com", "primary": true}},
+		"members":  []interface{}{map[string]interface{}{"value": "1"}, map[string]interface{}{"value": "2"}},
+	}
+	err := applySCIMPatch(doc, []scimPatchOp{
+		{Op: "Replace", Path: "active", Value: "False"},
+		{Op: "add", Path: "name.givenName", Value: "Jane"},
+		{Op: "replace", Value: map[string]interface{}{"displayName": "Jane D", "name.familyName": "Doe"}},
+		{Op: "replace", Path: `emails[type eq "work"].value`, Value: "jane@work.example"},
+		{Op: "add", Path: "members", Value: []interface{}{map[string]interface{}{"value": "2"}, map[string]interface{}{"value": "3"}}},
+		{Op: "remove", Path: "members", Value: []interface{}{map[string]interface{}{"value": "1"}}},
+		{Op: "remove", Path: `members[value eq "3"]`},
+	})
+	require.NoError(t, err)
+	active, _ := scimBool(doc["active"])
+	require.False(t, active)
+	require.Equal(t, map[string]interface{}{"givenName": "Jane", "familyName": "Doe"}, doc["name"])
+	require.Equal(t, "Jane D", doc["displayName"])
+	require.Len(t, doc["emails"], 2)
+	require.Equal(t, []interface{}{map[string]interface{}{"value": "2"}}, doc["members"])
+
+	for _, op := range []scimPatchOp{
+		{Op: "move", Path: "active", Value: true},
+		{Op: "remove"},
+		{Op: "replace", Value: "x"},
+		{Op: "replace", Path: "userName.first", Value: "x"},
+		{Op: "replace", Path: `emails[type eq "home"]`, Value: "x"},
+		{Op: "add", Path: "emails[type eq", Value: "x"},
+	} {
+		require.Error(t, applySCIMPatch(doc, []scimPatchOp{op}), op)
+	}
+}
+
+func TestSCIMUsers(t *testing.T) {
+	a, plain, call := newSCIMTestServer(t)
+	app, _ := a.validateAPIKey(plain)
+
+	status, jane := call("POST", "/scim/v2/Users", `{"schemas":["`+scimUserSchema+`"],"userName":"Jane@Example.com","externalId":"e-1","password":"initial-pw","name":{"givenName":"Jane","familyName":"Doe"}}`)
+	require.Equal(t, http.StatusCreated, status, jane)
+	require.Equal(t, "jane@example.com", jane["userName"])
+	require.Equal(t, true, jane["active"])
+	require.Equal(t, "e-1", jane["externalId"])
+	require.Equal(t, "Doe", jane["name"].(map[string]interface{})["familyName"])
+	id := jane["id"].(string)
+
+	for i, name := range []string{"ann", "bob", "cy"} {
+		status, body := call("POST", "/scim/v2/Users", `{"userName":"`+name+`@example.com","externalId":"e-`+string(rune('2'+i))+`"}`)
+		require.Equal(t, http.StatusCreated, status, body)
+	}
+	// userName and externalId are unique, and users outside SCIM are invisible
+	status, body := call("POST", "/scim/v2/Users", `{"userName":"jane@example.com"}`)
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, "uniqueness", body["scimType"])
+	status, _ = call("POST", "/scim/v2/Users", `{"userName":"dan@example.com","externalId":"e-1"}`)
+	require.Equal(t, http.StatusConflict, status)
+	hashed, err := hashPassword("pw")
+	require.NoError(t, err)
+	_, err = a.DB.CreateUser("self@example.com", hashed, &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	status, _ = call("POST", "/scim/v2/Users", `{"userName":"self@example.com"}`)
+	require.Equal(t, http.StatusConflict, status, "global users are not adopted")
+
+	status, list := call("GET", "/scim/v2/Users?startIndex=2&count=2", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(4), list["totalResults"])
+	require.Equal(t, float64(2), list["itemsPerPage"])
+	require.Equal(t, "ann@example.com", list["Resources"].([]interface{})[0].(map[string]interface{})["userName"])
+
+	status, list = call("GET", `/scim/v2/Users?filter=`+strings.ReplaceAll(`userName eq "JANE@example.com"`, " ", "%20"), "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(1), list["totalResults"])
+	status, list = call("GET", `/scim/v2/Users?count=0&filter=`+strings.ReplaceAll(`externalId eq "e-1" and userName eq "jane@example.com"`, " ", "%20"), "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(1), list["totalResults"])
+	require.Empty(t, list["Resources"])
+	status, list = call("GET", `/scim/v2/Users?filter=`+strings.ReplaceAll(`externalId eq "e-9"`, " ", "%20"), "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(0), list["totalResults"])
+	status, body = call("GET", `/scim/v2/Users?filter=userName%20zz%20"x"`, "")
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "invalidFilter", body["scimType"])
+
+	login := func(password string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"email":"jane@example.com","password":"`+password+`"}`))
+		req.Header.Set("X-API-Key", plain)
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(http.HandlerFunc(a.HandleLogin)).ServeHTTP(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return rec.Code, out
+	}
+	status, _ = login("initial-pw")
+	require.Equal(t, http.StatusOK, status)
+
+	// PATCH renames the user and, with Azure's string boolean, deactivates them
+	status, body = call("PATCH", "/scim/v2/Users/"+id, `{"schemas":["`+scimPatchOpSchema+`"],"Operations":[{"op":"Replace","path":"active","value":"False"},{"op":"replace","path":"userName","value":"jane.doe@example.com"}]}`)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, false, body["active"])
+	require.Equal(t, "jane.doe@example.com", body["userName"])
+	user, err := a.DB.GetUserByEmail(userNamespace(app), "jane.doe@example.com")
+	require.NoError(t, err)
+	require.True(t, user.Disabled)
+	status, body = call("GET", "/scim/v2/Users?filter=active%20eq%20false", "")
+	require.Equal(t, float64(1), body["totalResults"])
+
+	// disabled users cannot sign in, and can again once reactivated
+	req := httptest.NewRequest("POST", "/api/v1/auth/login", strings.NewReader(`{"email":"jane.doe@example.com","password":"initial-pw"}`))
+	req.Header.Set("X-API-Key", plain)
+	rec := httptest.NewRecorder()
+	a.APIKeyAuth(http.HandlerFunc(a.HandleLogin)).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Contains(t, rec.Body.String(), "USER_DISABLED")
+	status, body = call("PUT", "/scim/v2/Users/"+id, `{"userName":"jane@example.com","active":true,"externalId":"e-1"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Nil(t, body["name"], "PUT replaces the resource")
+	status, _ = login("initial-pw")
+	require.Equal(t, http.StatusOK, status)
+
+	// DELETE deactivates the user and hides them from the SCIM client
+	status, _ = call("DELETE", "/scim/v2/Users/"+id, "")
+	require.Equal(t, http.StatusNoContent, status)
+	status, body = call("GET", "/scim/v2/Users/"+id, "")
+	require.Equal(t, http.StatusNotFound, status)
+	require.Equal(t, "404", body["status"])
+	status, _ = login("initial-pw")
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestSCIMGroups(t *testing.T) {
+	a, _, call := newSCIMTestServer(t)
+	var ids []string
+	for _, name := range []string{"ann", "bob", "cy"} {
+		status, body := call("POST", "/scim/v2/Users", `{"userName":"`+name+`@example.com"}`)
+		require.Equal(t, http.StatusCreated, status, body)
+		ids = append(ids, body["id"].(string))
+	}
+
+	status, group := call("POST", "/scim/v2/Groups", `{"displayName":"Engineering","externalId":"g-1","members":[{"value":"`+ids[0]+`"},{"value":"`+ids[1]+`"}]}`)
+	require.Equal(t, http.StatusCreated, status, group)
+	require.Len(t, group["members"], 2)
+	gid := group["id"].(string)
+	status, _ = call("POST", "/scim/v2/Groups", `{"displayName":"Broken","members":[{"value":"999"}]}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, group = call("PATCH", "/scim/v2/Groups/"+gid, `{"Operations":[{"op":"add","path":"members","value":[{"value":"`+ids[2]+`"}]},{"op":"remove","path":"members[value eq \"`+ids[0]+`\"]"},{"op":"replace","path":"displayName","value":"Platform"}]}`)
+	require.Equal(t, http.StatusOK, status, group)
+	require.Equal(t, "Platform", group["displayName"])
+	var members []string
+	for _, m := range group["members"].([]interface{}) {
+		members = append(members, m.(map[string]interface{})["value"].(string))
+	}
+	require.ElementsMatch(t, []string{ids[1], ids[2]}, members)
+
+	status, list := call("GET", `/scim/v2/Groups?filter=displayName%20eq%20"platform"&excludedAttributes=members`, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(1), list["totalResults"])
+	require.NotContains(t, list["Resources"].([]interface{})[0], "members")
+
+	// a deprovisioned user leaves the group's view, and deleting the group deletes the organization
+	status, _ = call("DELETE", "/scim/v2/Users/"+ids[1], "")
+	require.Equal(t, http.StatusNoContent, status)
+	status, group = call("GET", "/scim/v2/Groups/"+gid, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, group["members"], 1)
+	status, _ = call("DELETE", "/scim/v2/Groups/"+gid, "")
+	require.Equal(t, http.StatusNoContent, status)
+	orgs, err := a.DB.ListOrganizations(nil)
+	require.NoError(t, err)
+	require.Empty(t, orgs)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Cookies and header of cookie sessions
+const (
+	refreshCookieName = "nile_refresh"
+	csrfCookieName    = "nile_csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// sessionCookieModes maps an application's session_cookie setting to the SameSite mode
+// of its session cookies
+var sessionCookieModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// normalizeSessionCookie validates a session_cookie setting; empty disables cookie sessions
+func normalizeSessionCookie(mode string) (string, error) {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if _, ok := sessionCookieModes[mode]; mode != "" && !ok {
+		return "", errors.New("session_cookie must be strict, lax, none or empty")
+	}
+	return mode, nil
+}
+
+// usesSessionCookie reports whether an application keeps refresh tokens in cookies
+func usesSessionCookie(app *Application) bool {
+	return app != nil && app.SessionCookie != ""
+}
+
+// csrfTokenFor derives the CSRF token of a cookie session from its refresh token, so a
+// value planted in the CSRF cookie by a sibling subdomain cannot be paired with it
+func csrfTokenFor(refresh string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("csrf:" + refresh))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authCookiePath scopes the refresh cookie to the auth routes the request came through
+// (such as /api/v1/auth), which hold the refresh and logout endpoints
+func authCookiePath(r *http.Request) string {
+	return path.Dir(r.URL.Path)
+}
+
+// setSessionCookies stores a refresh token in an HttpOnly cookie next to its CSRF cookie
+// and returns the CSRF token clients echo in X-CSRF-Token
+func setSessionCookies(w http.ResponseWriter, r *http.Request, app *Application, refresh string) string {
+	sameSite := sessionCookieModes[app.SessionCookie]
+	maxAge := int(refreshTokenTTL / time.Second)
+	csrf := csrfTokenFor(refresh)
+	http.SetCookie(w, &http.Cookie{Name: refreshCookieName, Value: refresh, Path: authCookiePath(r), MaxAge: maxAge, HttpOnly: true, Secure: true, SameSite: sameSite})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Value: csrf, Path: "/", MaxAge: maxAge, Secure: true, SameSite: sameSite})
+	return csrf
+}
+
+// clearSessionCookies expires both session cookies
+func clearSessionCookies(w http.ResponseWriter, r *http.Request, app *Application) {
+	sameSite := sessionCookieModes[app.SessionCookie]
+	http.SetCookie(w, &http.Cookie{Name: refreshCookieName, Path: authCookiePath(r), MaxAge: -1, HttpOnly: true, Secure: true, SameSite: sameSite})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookieName, Path: "/", MaxAge: -1, Secure: true, SameSite: sameSite})
+}
+
+// writeSession responds with a freshly issued session. Cookie session applications get
+// the refresh token as a cookie and the CSRF token in the body; others get the refresh
+// token in the body.
+func writeSession(w http.ResponseWriter, r *http.Request, status int, app *Application, body map[string]interface{}, refresh string) {
+	if usesSessionCookie(app) {
+		body["csrfToken"] = setSessionCookies(w, r, app, refresh)
+	} else {
+		body["refreshToken"] = refresh
+	}
+	writeJSON(w, status, body)
+}
+
+// sessionRefreshToken returns the refresh token a request presents: the one in its body,
+// or for cookie session applications the refresh cookie once the double-submitted CSRF
+// token checks out. It reports false after writing an error.
+func sessionRefreshToken(w http.ResponseWriter, r *http.Request, app *Application, bodyToken string) (token string, fromCookie, ok bool) {
+	if bodyToken != "" || !usesSessionCookie(app) {
+		return bodyToken, false, true
+	}
+	cookie, err := r.Cookie(refreshCookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false, true
+	}
+	header := r.Header.Get(csrfHeaderName)
+	csrfCookie, err := r.Cookie(csrfCookieName)
+	if header == "" || err != nil ||
+		!hmac.Equal([]byte(header), []byte(csrfCookie.Value)) ||
+		!hmac.Equal([]byte(header), []byte(csrfTokenFor(cookie.Value))) {
+		writeError(w, http.StatusForbidden, "INVALID_CSRF_TOKEN", "Missing or invalid CSRF token")
+		return "", false, false
+	}
+	return cookie.Value, true, true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieSessionRefreshAndLogout(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	require.NotNil(t, app)
+	app.SessionCookie = "strict"
+	require.NoError(t, a.DB.UpdateApplication(app))
+
+	call := func(handler http.HandlerFunc, path, body, csrf string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", plain)
+		if csrf != "" {
+			req.Header.Set(csrfHeaderName, csrf)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		a.APIKeyAuth(handler).ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) map[string]interface{} {
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		return out
+	}
+
+	rec := call(a.HandleRegister, "/api/v1/auth/register", `{"email":"c@example.com","password":"secret123"}`, "", nil)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	body := decode(rec)
+	require.NotContains(t, body, "refreshToken")
+	csrf, _ := body["csrfToken"].(string)
+	require.NotEmpty(t, csrf)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 2)
+	refresh := cookies[0]
+	require.Equal(t, refreshCookieName, refresh.Name)
+	require.True(t, refresh.HttpOnly)
+	require.True(t, refresh.Secure)
+	require.Equal(t, http.SameSiteStrictMode, refresh.SameSite)
+	require.Equal(t, "/api/v1/auth", refresh.Path)
+
+	// the cookie alone is not enough: the CSRF token must be echoed in the header
+	require.Equal(t, http.StatusForbidden, call(a.HandleRefresh, "/api/v1/auth/refresh", "", "", cookies).Code)
+	require.Equal(t, http.StatusForbidden, call(a.HandleRefresh, "/api/v1/auth/refresh", "", "forged", cookies).Code)
+
+	rec = call(a.HandleRefresh, "/api/v1/auth/refresh", "", csrf, cookies)
+	require.Equal(t, http.StatusOK, rec.Code)
+	body = decode(rec)
+	require.NotEmpty(t, body["accessToken"])
+	require.NotContains(t, body, "refreshToken")
+	rotated := rec.Result().Cookies()
+	require.NotEqual(t, refresh.Value, rotated[0].Value)
+
+	rec = call(a.HandleLogout, "/api/v1/auth/logout", "", body["csrfToken"].(string), rotated)
+	require.Equal(t, http.StatusOK, rec.Code)
+	for _, c := range rec.Result().Cookies() {
+		require.Equal(t, -1, c.MaxAge)
+	}
+	row, err := a.DB.GetRefreshToken(rotated[0].Value)
+	require.NoError(t, err)
+	require.True(t, row.Revoked)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	cfg "github.com/example/nileauth/internal/config"
+)
+
+// Import and export file formats
+const (
+	userFileJSONL = "jsonl"
+	userFileCSV   = "csv"
+)
+
+// Outcomes of importing a row
+const (
+	importCreated   = "created"
+	importUpdated   = "updated"
+	importUnchanged = "unchanged"
+	importFailed    = "failed"
+)
+
+const (
+	maxImportLineBytes = 1 << 20
+	maxImportBodyBytes = 64 << 20
+	exportPageSize     = 500
+)
+
+// userImportRow is one user of an import file. JSONL objects and CSV columns use the
+// same names; anything else, such as the extra fields of an export, is ignored.
+type userImportRow struct {
+	Email        string `json:"email"`
+	PasswordHash string `json:"password_hash"`
+	Disabled     *bool  `json:"disabled"`
+}
+
+type userImportResult struct {
+	Line   int    `json:"line"`
+	Email  string `json:"email,omitempty"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+type userImportSummary struct {
+	Created   int `json:"created"`
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+// userImporter upserts users into the namespace of an application, or the global pool
+// when app is nil. Existing users only have their disabled state updated: passwords
+// are set on creation, so running an import again never undoes a password that was
+// changed or upgraded since.
+type userImporter struct {
+	db     DB
+	app    *Application
+	dryRun bool
+
+	seen     map[string]int
+	unusable string
+}
+
+func newUserImporter(db DB, app *Application, dryRun bool) *userImporter {
+	return &userImporter{db: db, app: app, dryRun: dryRun, seen: map[string]int{}}
+}
+
+// userFileFormat picks the format of a file from its name, defaulting to JSONL
+func userFileFormat(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".csv") {
+		return userFileCSV
+	}
+	return userFileJSONL
+}
+
+// run imports every row of src, reporting each outcome as it goes. Rows fail on their
+// own; an error is returned only when the file cannot be read any further.
+func (im *userImporter) run(src io.Reader, format string, report func(userImportResult)) (userImportSummary, error) {
+	var sum userImportSummary
+	emit := func(res userImportResult) {
+		switch res.Action {
+		case importCreated:
+			sum.Created++
+		case importUpdated:
+			sum.Updated++
+		case importUnchanged:
+			sum.Unchanged++
+		default:
+			sum.Failed++
+		}
+		if report != nil {
+			report(res)
+		}
+	}
+	var err error
+	switch format {
+	case userFileJSONL:
+		err = im.readJSONL(src, emit)
+	case userFileCSV:
+		err = im.readCSV(src, emit)
+	default:
+		err = fmt.Errorf("unsupported format %q (supported: jsonl, csv)", format)
+	}
+	return sum, err
+}
+
+func (im *userImporter) readJSONL(src io.Reader, emit func(userImportResult)) error {
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineBytes)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var row userImportRow
+		if err := json.Unmarshal(text, &row); err != nil {
+			emit(userImportResult{Line: line, Action: importFailed, Error: "invalid JSON"})
+			continue
+		}
+		emit(im.importRow(line, row))
+	}
+	return scanner.Err()
+}
+
+func (im *userImporter) readCSV(src io.Reader, emit func(userImportResult)) error {
+	cr := csv.NewReader(src)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		// Spreadsheets like to start CSV files with a byte order mark
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return errors.New("the CSV header has no email column")
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(record) != len(header) {
+			emit(userImportResult{Line: line, Action: importFailed, Error: fmt.Sprintf("expected %d fields, got %d", len(header), len(record))})
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := userImportRow{Email: field("email"), PasswordHash: field("password_hash")}
+		if raw := field("disabled"); raw != "" {
+			disabled, err := strconv.ParseBool(raw)
+			if err != nil {
+				emit(userImportResult{Line: line, Email: row.Email, Action: importFailed, Error: "invalid disabled value"})
+				continue
+			}
+			row.Disabled = &disabled
+		}
+		emit(im.importRow(line, row))
+	}
+}
+
+func (im *userImporter) importRow(line int, row userImportRow) userImportResult {
+	email := strings.TrimSpace(row.Email)
+	res := userImportResult{Line: line, Email: email}
+	fail := func(msg string) userImportResult {
+		res.Action, res.Error = importFailed, msg
+		return res
+	}
+	if email == "" || !strings.Contains(email, "@") {
+		return fail("a valid email is required")
+	}
+	if first, ok := im.seen[email]; ok {
+		return fail(fmt.Sprintf("duplicate of line %d", first))
+	}
+	im.seen[email] = line
+	if row.PasswordHash != "" {
+		if err := checkPasswordHash(row.PasswordHash); err != nil {
+			return fail(err.Error())
+		}
+	}
+
+	namespace := userNamespace(im.app)
+	user, err := im.db.GetUserByEmail(namespace, email)
+	if err != nil {
+		return fail("failed to look up user")
+	}
+	disable := row.Disabled != nil && *row.Disabled
+	if user == nil {
+		res.Action = importCreated
+		if im.dryRun {
+			return res
+		}
+		password := row.PasswordHash
+		if password == "" {
+			if password, err = im.unusablePassword(); err != nil {
+				return fail("failed to hash password")
+			}
+		}
+		var appID *int64
+		if im.app != nil {
+			appID = &im.app.ID
+		}
+		if user, err = im.db.CreateUser(email, password, appID, namespace); err != nil {
+			return fail("failed to create user")
+		}
+		if disable {
+			if err := im.db.SetUserDisabled(user.ID, true); err != nil {
+				return fail("user created but could not be disabled")
+			}
+		}
+		return res
+	}
+
+	if row.Disabled == nil || disable == user.Disabled {
+		res.Action = importUnchanged
+		return res
+	}
+	res.Action = importUpdated
+	if im.dryRun {
+		return res
+	}
+	if err := im.db.SetUserDisabled(user.ID, disable); err != nil {
+		return fail("failed to update user")
+	}
+	if disable {
+		if err := im.db.RevokeAllRefreshTokensForUser(user.ID); err != nil {
+			return fail("user disabled but sessions could not be revoked")
+		}
+	}
+	return res
+}
+
+// unusablePassword returns the hash of a discarded random password, given to users
+// imported without one so they have to reset it. Bcrypt is slow on purpose, so one
+// hash is shared by the whole import.
+func (im *userImporter) unusablePassword() (string, error) {
+	if im.unusable != "" {
+		return im.unusable, nil
+	}
+	random, err := genToken(32)
+	if err != nil {
+		return "", err
+	}
+	im.unusable, err = hashPassword(random)
+	return im.unusable, err
+}
+
+// exportUsers writes the users matching filter to w a page at a time, leaving out their
+// password hashes unless withHashes is set. It returns how many users were written.
+func exportUsers(db DB, w io.Writer, format string, filter UserFilter, withHashes bool) (int, error) {
+	var writeUser func(u *User) error
+	var flush func() error
+	switch format {
+	case userFileJSONL:
+		enc := json.NewEncoder(w)
+		writeUser = func(u *User) error {
+			out := adminUserJSON(u)
+			if withHashes {
+				out["password_hash"] = u.Password
+			}
+			return enc.Encode(out)
+		}
+		flush = func() error { return nil }
+	case userFileCSV:
+		cw := csv.NewWriter(w)
+		header := []string{"id", "email", "application_id", "namespace_id", "mfa_enabled", "disabled", "created_at"}
+		if withHashes {
+			header = append(header, "password_hash")
+		}
+		if err := cw.Write(header); err != nil {
+			return 0, err
+		}
+		writeUser = func(u *User) error {
+			appID := ""
+			if u.ApplicationID != nil {
+				appID = strconv.FormatInt(*u.ApplicationID, 10)
+			}
+			record := []string{
+				strconv.FormatInt(u.ID, 10),
+				u.Email,
+				appID,
+				strconv.FormatInt(u.NamespaceID, 10),
+				strconv.FormatBool(u.TOTPSecret != ""),
+				strconv.FormatBool(u.Disabled),
+				u.CreatedAt.UTC().Format(time.RFC3339),
+			}
+			if withHashes {
+				record = append(record, u.Password)
+			}
+			return cw.Write(record)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return 0, fmt.Errorf("unsupported format %q (supported: jsonl, csv)", format)
+	}
+
+	filter.Limit, filter.Offset = exportPageSize, 0
+	count := 0
+	for {
+		users, _, err := db.ListUsers(filter)
+		if err != nil {
+			return count, err
+		}
+		for _, u := range users {
+			if err := writeUser(u); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err := flush(); err != nil {
+			return count, err
+		}
+		if f, ok := w.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+		if len(users) < exportPageSize {
+			return count, nil
+		}
+		filter.Offset += exportPageSize
+	}
+}
+
+// runImportUsers implements the import-users command: it upserts the users of a JSONL
+// or CSV file, printing failed rows to stderr and a summary to stdout
+func runImportUsers(c *cfg.Config, args []string) error {
+	fs := flag.NewFlagSet("import-users", flag.ContinueOnError)
+	file := fs.String("file", "-", "File to import, - for stdin")
+	format := fs.String("format", "", "File format, jsonl or csv (default: from the file name, else jsonl)")
+	appID := fs.Int64("application-id", 0, "Application whose user pool receives the users (default: the global pool)")
+	dryRun := fs.Bool("dry-run", false, "Check and report rows without writing anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = userFileFormat(*file)
+	}
+	src := io.Reader(os.Stdin)
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	if closer, ok := db.(interface{ close() error }); ok {
+		defer closer.close()
+	}
+	var app *Application
+	if *appID != 0 {
+		if app, err = db.GetApplicationByID(*appID); err != nil {
+			return fmt.Errorf("loading application: %w", err)
+		}
+		if app == nil {
+			return fmt.Errorf("application %d not found", *appID)
+		}
+	}
+
+	summary, err := newUserImporter(db, app, *dryRun).run(src, *format, func(res userImportResult) {
+		if res.Action == importFailed {
+			fmt.Fprintf(os.Stderr, "line %d %s: %s\n", res.Line, res.Email, res.Error)
+		}
+	})
+	prefix := ""
+	if *dryRun {
+		prefix = "Dry run: "
+	}
+	fmt.Printf("%s%d created, %d updated, %d unchanged, %d failed\n", prefix, summary.Created, summary.Updated, summary.Unchanged, summary.Failed)
+	if err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d rows failed", summary.Failed)
+	}
+	return nil
+}
+
+// runExportUsers implements the export-users command
+func runExportUsers(c *cfg.Config, args []string) error {
+	fs := flag.NewFlagSet("export-users", flag.ContinueOnError)
+	file := fs.String("file", "-", "File to write, - for stdout")
+	format := fs.String("format", "", "File format, jsonl or csv (default: from the file name, else jsonl)")
+	appID := fs.Int64("application-id", 0, "Only export users of this application")
+	withHashes := fs.Bool("include-password-hashes", false, "Include password hashes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = userFileFormat(*file)
+	}
+	var filter UserFilter
+	if *appID != 0 {
+		filter.ApplicationID = appID
+	}
+
+	db, err := openDB(c)
+	if err != nil {
+		return err
+	}
+	if closer, ok := db.(interface{ close() error }); ok {
+		defer closer.close()
+	}
+	out := bufio.NewWriter(os.Stdout)
+	if *file != "-" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = bufio.NewWriter(f)
+	}
+	count, err := exportUsers(db, out, *format, filter, *withHashes)
+	if err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d users\n", count)
+	return nil
+}
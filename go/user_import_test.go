@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestImportedPasswordHashes(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("hunter2"), salt, 1, 64, 1, 32)
+	argon := fmt.Sprintf("$argon2id$v=19$m=64,t=1,p=1$%s$%s", base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	digest := sha256.Sum256(append([]byte("hunter2"), salt...))
+	ssha := "{SSHA256}" + base64.StdEncoding.EncodeToString(append(digest[:], salt...))
+	bcryptHash, err := hashPassword("hunter2")
+	require.NoError(t, err)
+
+	for _, h := range []string{argon, ssha, bcryptHash} {
+		require.NoError(t, checkPasswordHash(h), h)
+		require.True(t, comparePassword(h, "hunter2"), h)
+		require.False(t, comparePassword(h, "hunter3"), h)
+	}
+	for _, h := range []string{
+		"5f4dcc3b5aa765d61d8327deb882cf99",
+		"$2a$10$tooshort",
+		"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$a2V5a2V5",
+		"$argon2id$v=19$m=524288,t=1,p=1$c2FsdA$a2V5a2V5",
+		"$argon2d$v=19$m=64,t=1,p=1$c2FsdA$a2V5a2V5",
+		"{SSHA256}c2hvcnQ=",
+		"{MD5}X03MO1qnZdYdgyfeuILPmQ==",
+	} {
+		require.Error(t, checkPasswordHash(h), h)
+		require.False(t, comparePassword(h, "password"), h)
+	}
+}
+
+func TestUserImportAndExport(t *testing.T) {
+	plain, err := generateAPIKey()
+	require.NoError(t, err)
+	a := newAPIKeyTestApp(t, true, plain)
+	app, _ := a.validateAPIKey(plain)
+	appID := fmt.Sprint(app.ID)
+
+	salt := []byte("pepper-and-salt!")
+	digest := sha256.Sum256(append([]byte("legacy-pw"), salt...))
+	ssha := "{SSHA256}" + base64.StdEncoding.EncodeToString(append(digest[:], salt...))
+	existing, err := a.DB.CreateUser("old@example.com", "$2a$10$abcdefghijklmnopqrstuu5Nw8ZJxR8J5J0P0j0yj0n5h0Gc6M5a", &app.ID, userNamespace(app))
+	require.NoError(t, err)
+	jsonl := strings.Join([]string{
+		`{"email":"legacy@example.com","password_hash":"` + ssha + `"}`,
+		`{"email":"nopw@example.com","disabled":true}`,
+		`{"email":"old@example.com","password_hash":"` + ssha + `","disabled":true}`,
+		`{"email":"legacy@example.com"}`,
+		`{"email":"bad@example.com","password_hash":"md5:abc"}`,
+		`not json`,
+		``,
+		`{"email":"no-at-sign"}`,
+	}, "\n")
+	importUsers := func(query, contentType, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "/api/v1/admin/users/import?"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		a.HandleImportUsers(rec, req)
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &out))
+		data, _ := out["data"].(map[string]interface{})
+		return rec.Code, data
+	}
+
+	// a dry run reports every row without writing
+	status, data := importUsers("dry_run=true&application_id="+appID, "application/x-ndjson", jsonl)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(2), data["created"])
+	require.Equal(t, float64(1), data["updated"])
+	require.Equal(t, float64(4), data["failed"])
+	lines := []float64{}
+	for _, e := range data["errors"].([]interface{}) {
+		lines = append(lines, e.(map[string]interface{})["line"].(float64))
+	}
+	require.Equal(t, []float64{4, 5, 6, 8}, lines)
+	users, total, err := a.DB.ListUsers(UserFilter{})
+	require.NoError(t, err)
+	require.Equal(t, 1, total, users)
+
+	// the real import upserts, and running it again changes nothing
+	_, data = importUsers("application_id="+appID, "", jsonl)
+	require.Equal(t, float64(2), data["created"])
+	require.Equal(t, float64(1), data["updated"])
+	old, err := a.DB.GetUserByID(existing.ID)
+	require.NoError(t, err)
+	require.True(t, old.Disabled)
+	require.NotEqual(t, ssha, old.Password)
+	_, data = importUsers("application_id="+appID, "", jsonl)
+	require.Equal(t, float64(0), data["created"])
+	require.Equal(t, float64(0), data["updated"])
+	require.Equal(t, float64(3), data["unchanged"])
+
+	// the imported hash works at login and is then upgraded to bcrypt
+	user, err := a.verifyCredentials(httptest.NewRequest("POST", "/", nil), app, "legacy@example.com", "legacy-pw")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	stored, err := a.DB.GetUserByEmail(userNamespace(app), "legacy@example.com")
+	require.NoError(t, err)
+	require.True(t, isBcryptHash(stored.Password))
+	require.True(t, comparePassword(stored.Password, "legacy-pw"))
+
+	// CSV rows are matched by column name
+	csvBody := "\ufeffDisabled,email,password_hash\nfalse,csv@example.com," + ssha + "\nmaybe,csv2@example.com,\n\"x\",\"a\",\"b\",\"c\"\n"
+	status, data = importUsers("application_id="+appID, "text/csv", csvBody)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, float64(1), data["created"])
+	require.Equal(t, float64(2), data["failed"])
+	status, _ = importUsers("format=csv", "", "mail,password_hash\nx@example.com,\n")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// exports leave hashes out unless asked for
+	export := func(query string) string {
+		rec := httptest.NewRecorder()
+		a.HandleExportUsers(rec, httptest.NewRequest("GET", "/api/v1/admin/users/export?"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	out := export("application_id=" + appID)
+	require.Equal(t, 4, strings.Count(out, "\n"))
+	require.NotContains(t, out, "password_hash")
+	out = export("format=csv&email=csv&include_password_hashes=true")
+	rows := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, rows, 2)
+	require.True(t, strings.HasSuffix(rows[0], ",password_hash"))
+	require.True(t, strings.HasSuffix(rows[1], ","+ssha))
+
+	// an export can be imported again as is
+	var buf bytes.Buffer
+	_, err = exportUsers(a.DB, &buf, userFileJSONL, UserFilter{}, true)
+	require.NoError(t, err)
+	summary, err := newUserImporter(a.DB, app, true).run(&buf, userFileJSONL, nil)
+	require.NoError(t, err)
+	require.Equal(t, userImportSummary{Unchanged: 4}, summary)
+
+	// rows before a malformed record stay imported, and are reported and audited
+	status, data = importUsers("format=csv", "", "email\npartial@example.com\nbad\"quote@example.com\n")
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, float64(1), data["created"])
+	events, _, err := a.DB.ListAuditEvents(AuditEventFilter{Action: auditUsersImported, Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, events[0].Details["created"])
+	require.Equal(t, false, events[0].Details["complete"])
+}
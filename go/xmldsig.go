@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Namespaces and algorithms of XML signatures
+const (
+	xmldsigNS                   = "http://www.w3.org/2000/09/xmldsig#"
+	xmlNamespaceURI             = "http://www.w3.org/XML/1998/namespace"
+	excC14NAlgorithm            = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	rsaSHA256SignatureMethod    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+)
+
+// xmlDigestMethods and xmlSignatureMethods are the algorithms accepted in signatures;
+// SHA-1 is deliberately missing
+var (
+	xmlDigestMethods = map[string]crypto.Hash{
+		"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+		"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+	}
+	xmlSignatureMethods = map[string]crypto.Hash{
+		rsaSHA256SignatureMethod:                            crypto.SHA256,
+		"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+	}
+)
+
+// errUnsigned reports an element without an enveloped signature
+var errUnsigned = errors.New("xmldsig: element is not signed")
+
+// xmlNode is an element of a parsed document. Names keep their prefixes, and namespace
+// declarations stay among the attributes, so elements can be canonicalized exactly as
+// they were signed.
+type xmlNode struct {
+	Prefix   string
+	Local    string
+	Attrs    []xml.Attr // Name.Space holds the prefix
+	Children []xmlContent
+	Parent   *xmlNode
+}
+
+// xmlContent is a child element or a run of text
+type xmlContent struct {
+	Node *xmlNode
+	Text string
+}
+
+// parseXMLTree parses a document into a tree. Documents with a DTD are rejected;
+// comments and processing instructions are dropped.
+func parseXMLTree(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *xmlNode
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{Prefix: t.Name.Space, Local: t.Name.Local, Attrs: t.Attr, Parent: cur}
+			if cur != nil {
+				cur.Children = append(cur.Children, xmlContent{Node: n})
+			} else if root == nil {
+				root = n
+			} else {
+				return nil, errors.New("xml: more than one root element")
+			}
+			cur = n
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.Prefix || t.Name.Local != cur.Local {
+				return nil, errors.New("xml: mismatched end element")
+			}
+			cur = cur.Parent
+		case xml.CharData:
+			if cur != nil {
+				cur.Children = append(cur.Children, xmlContent{Text: string(t)})
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("xml: text outside the root element")
+			}
+		case xml.Directive:
+			return nil, errors.New("xml: DTDs are not allowed")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("xml: incomplete document")
+	}
+	return root, nil
+}
+
+// lookupNS resolves a prefix ("" for the default namespace) in the element's scope
+func (n *xmlNode) lookupNS(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespaceURI, true
+	}
+	for e := n; e != nil; e = e.Parent {
+		for _, a := range e.Attrs {
+			if (prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns") || (prefix != "" && a.Name.Space == "xmlns" && a.Name.Local == prefix) {
+				return a.Value, true
+			}
+		}
+	}
+	return "", prefix == ""
+}
+
+func (n *xmlNode) is(space, local string) bool {
+	if n == nil || n.Local != local {
+		return false
+	}
+	uri, _ := n.lookupNS(n.Prefix)
+	return uri == space
+}
+
+// elements returns the child elements with a name
+func (n *xmlNode) elements(space, local string) []*xmlNode {
+	var out []*xmlNode
+	if n == nil {
+		return out
+	}
+	for _, c := range n.Children {
+		if c.Node.is(space, local) {
+			out = append(out, c.Node)
+		}
+	}
+	return out
+}
+
+// element returns the first child element with a name, or nil
+func (n *xmlNode) element(space, local string) *xmlNode {
+	if found := n.elements(space, local); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// attr returns an unqualified attribute; missing attributes and elements read as ""
+func (n *xmlNode) attr(local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attrs {
+		if a.Name.Space == "" && a.Name.Local == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// text returns the element's own text, trimmed
+func (n *xmlNode) text() string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, c := range n.Children {
+		if c.Node == nil {
+			b.WriteString(c.Text)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// canonicalXML serializes an element with Exclusive XML Canonicalization 1.0 without
+// comments, leaving out skip (an enveloped signature). inclusive is the PrefixList of an
+// InclusiveNamespaces element.
+func canonicalXML(n, skip *xmlNode, inclusive []string) []byte {
+	var b bytes.Buffer
+	writeCanonicalXML(&b, n, skip, inclusive, map[string]string{"": ""})
+	return b.Bytes()
+}
+
+// writeCanonicalXML writes one element; rendered holds the namespace declarations in
+// effect from output ancestors
+func writeCanonicalXML(b *bytes.Buffer, n, skip *xmlNode, inclusive []string, rendered map[string]string) {
+	// Only namespaces the element or its attributes use are declared, plus the inclusive ones
+	used := map[string]bool{n.Prefix: true}
+	for _, a := range n.Attrs {
+		if a.Name.Space != "" && a.Name.Space != "xmlns" {
+			used[a.Name.Space] = true
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		used[p] = true
+	}
+	scope := make(map[string]string, len(rendered))
+	for p, uri := range rendered {
+		scope[p] = uri
+	}
+	var prefixes []string
+	for p := range used {
+		uri, ok := n.lookupNS(p)
+		if !ok || p == "xml" {
+			continue
+		}
+		if prev, seen := rendered[p]; seen && prev == uri {
+			continue
+		}
+		scope[p] = uri
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	type attr struct{ space, name, value string }
+	var attrs []attr
+	for _, a := range n.Attrs {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		space := ""
+		name := a.Name.Local
+		if a.Name.Space != "" {
+			space, _ = n.lookupNS(a.Name.Space)
+			name = a.Name.Space + ":" + a.Name.Local
+		}
+		attrs = append(attrs, attr{space, name, a.Value})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return localName(attrs[i].name) < localName(attrs[j].name)
+	})
+
+	qname := n.Local
+	if n.Prefix != "" {
+		qname = n.Prefix + ":" + n.Local
+	}
+	b.WriteString("<" + qname)
+	for _, p := range prefixes {
+		if p == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:` + p + `="`)
+		}
+		b.WriteString(escapeCanonicalAttr(scope[p]) + `"`)
+	}
+	for _, a := range attrs {
+		b.WriteString(" " + a.name + `="` + escapeCanonicalAttr(a.value) + `"`)
+	}
+	b.WriteString(">")
+	for _, c := range n.Children {
+		switch {
+		case c.Node == nil:
+			b.WriteString(escapeCanonicalText(c.Text))
+		case c.Node != skip:
+			writeCanonicalXML(b, c.Node, skip, inclusive, scope)
+		}
+	}
+	b.WriteString("</" + qname + ">")
+}
+
+func localName(qname string) string {
+	if i := strings.IndexByte(qname, ':'); i >= 0 {
+		return qname[i+1:]
+	}
+	return qname
+}
+
+var (
+	canonicalTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	canonicalAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeCanonicalText(s string) string { return canonicalTextEscaper.Replace(s) }
+func escapeCanonicalAttr(s string) string { return canonicalAttrEscaper.Replace(s) }
+
+// inclusivePrefixes reads the InclusiveNamespaces PrefixList of a canonicalization method
+// or transform
+func inclusivePrefixes(method *xmlNode) []string {
+	return strings.Fields(method.element(excC14NAlgorithm, "InclusiveNamespaces").attr("PrefixList"))
+}
+
+// verifyXMLSignature checks the enveloped signature of an element against trusted
+// certificates. The signature's single reference must point at the element itself, so
+// signed content elsewhere in the document cannot stand in for it.
+func verifyXMLSignature(n *xmlNode, certs []*x509.Certificate) error {
+	sigs := n.elements(xmldsigNS, "Signature")
+	if len(sigs) == 0 {
+		return errUnsigned
+	}
+	if len(sigs) > 1 {
+		return errors.New("xmldsig: more than one signature")
+	}
+	sig := sigs[0]
+	signedInfo := sig.element(xmldsigNS, "SignedInfo")
+	c14n := signedInfo.element(xmldsigNS, "CanonicalizationMethod")
+	if c14n.attr("Algorithm") != excC14NAlgorithm {
+		return errors.New("xmldsig: canonicalization must be exclusive C14N")
+	}
+	sigHash, ok := xmlSignatureMethods[signedInfo.element(xmldsigNS, "SignatureMethod").attr("Algorithm")]
+	if !ok {
+		return errors.New("xmldsig: unsupported signature method")
+	}
+	refs := signedInfo.elements(xmldsigNS, "Reference")
+	if len(refs) != 1 {
+		return errors.New("xmldsig: exactly one reference is required")
+	}
+	ref := refs[0]
+	if id := n.attr("ID"); id == "" || ref.attr("URI") != "#"+id {
+		return errors.New("xmldsig: reference does not point at the signed element")
+	}
+	enveloped := false
+	var inclusive []string
+	for _, t := range ref.element(xmldsigNS, "Transforms").elements(xmldsigNS, "Transform") {
+		switch t.attr("Algorithm") {
+		case envelopedSignatureAlgorithm:
+			enveloped = true
+		case excC14NAlgorithm:
+			inclusive = inclusivePrefixes(t)
+		default:
+			return errors.New("xmldsig: unsupported transform")
+		}
+	}
+	if !enveloped {
+		return errors.New("xmldsig: signature must be enveloped")
+	}
+	digestHash, ok := xmlDigestMethods[ref.element(xmldsigNS, "DigestMethod").attr("Algorithm")]
+	if !ok {
+		return errors.New("xmldsig: unsupported digest method")
+	}
+	want, err := base64.StdEncoding.DecodeString(stripXMLSpace(ref.element(xmldsigNS, "DigestValue").text()))
+	if err != nil {
+		return errors.New("xmldsig: malformed digest")
+	}
+	h := digestHash.New()
+	h.Write(canonicalXML(n, sig, inclusive))
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return errors.New("xmldsig: digest mismatch")
+	}
+
+	value, err := base64.StdEncoding.DecodeString(stripXMLSpace(sig.element(xmldsigNS, "SignatureValue").text()))
+	if err != nil {
+		return errors.New("xmldsig: malformed signature value")
+	}
+	h = sigHash.New()
+	h.Write(canonicalXML(signedInfo, nil, inclusivePrefixes(c14n)))
+	hashed := h.Sum(nil)
+	for _, cert := range certs {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, sigHash, hashed, value) == nil {
+			return nil
+		}
+	}
+	return errors.New("xmldsig: signature does not verify with a trusted certificate")
+}
+
+// stripXMLSpace removes the line breaks base64 values are often wrapped with
+func stripXMLSpace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// parseCertificates reads PEM certificates, or a single base64 DER certificate as found in
+// SAML metadata
+func parseCertificates(data string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		der, err := base64.StdEncoding.DecodeString(stripXMLSpace(data))
+		if err != nil {
+			return nil, errors.New("no certificate found")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}